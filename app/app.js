@@ -28,15 +28,16 @@ document
 async function createVideoDraft() {
   const title = document.getElementById("video-title").value;
   const description = document.getElementById("video-description").value;
+  const visibility = document.getElementById("video-visibility").value;
 
   try {
-    const res = await fetch("/api/videos", {
+    const res = await authFetch("/api/videos", {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
         Authorization: `Bearer ${localStorage.getItem("token")}`,
       },
-      body: JSON.stringify({ title, description }),
+      body: JSON.stringify({ title, description, visibility }),
     });
     const data = await res.json();
     if (!res.ok) {
@@ -72,6 +73,7 @@ async function login() {
 
     if (data.token) {
       localStorage.setItem("token", data.token);
+      localStorage.setItem("refreshToken", data.refresh_token);
       document.getElementById("auth-section").style.display = "none";
       document.getElementById("video-section").style.display = "block";
       await getVideos();
@@ -83,6 +85,53 @@ async function login() {
   }
 }
 
+// Access tokens expire after an hour. authFetch refreshes the session and
+// retries once when a request is rejected with 401.
+async function authFetch(url, options = {}) {
+  const res = await fetch(url, options);
+  if (res.status !== 401 || !(await refreshSession())) {
+    return res;
+  }
+  return fetch(url, {
+    ...options,
+    headers: {
+      ...options.headers,
+      Authorization: `Bearer ${localStorage.getItem("token")}`,
+    },
+  });
+}
+
+// Refresh tokens are single-use, so concurrent requests share one refresh.
+let refreshing = null;
+
+function refreshSession() {
+  if (!refreshing) {
+    refreshing = doRefresh().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+}
+
+async function doRefresh() {
+  const refreshToken = localStorage.getItem("refreshToken");
+  if (!refreshToken) {
+    return false;
+  }
+  const res = await fetch("/api/refresh", {
+    method: "POST",
+    headers: { Authorization: `Bearer ${refreshToken}` },
+  });
+  if (!res.ok) {
+    logout();
+    return false;
+  }
+  const data = await res.json();
+  localStorage.setItem("token", data.token);
+  localStorage.setItem("refreshToken", data.refresh_token);
+  return true;
+}
+
 async function signup() {
   const email = document.getElementById("email").value;
   const password = document.getElementById("password").value;
@@ -107,7 +156,15 @@ async function signup() {
 }
 
 function logout() {
+  const refreshToken = localStorage.getItem("refreshToken");
+  if (refreshToken) {
+    fetch("/api/revoke", {
+      method: "POST",
+      headers: { Authorization: `Bearer ${refreshToken}` },
+    });
+  }
   localStorage.removeItem("token");
+  localStorage.removeItem("refreshToken");
   document.getElementById("auth-section").style.display = "block";
   document.getElementById("video-section").style.display = "none";
 }
@@ -120,7 +177,7 @@ async function uploadThumbnail(videoID) {
   formData.append("thumbnail", thumbnailFile);
 
   try {
-    const res = await fetch(`/api/thumbnail_upload/${videoID}`, {
+    const res = await authFetch(`/api/thumbnail_upload/${videoID}`, {
       method: "POST",
       headers: {
         Authorization: `Bearer ${localStorage.getItem("token")}`,
@@ -147,14 +204,17 @@ async function uploadVideoFile(videoID) {
   const formData = new FormData();
   formData.append("video", videoFile);
 
+  const watching = new AbortController();
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    const upload = authFetch(`/api/video_upload/${videoID}`, {
       method: "POST",
       headers: {
         Authorization: `Bearer ${localStorage.getItem("token")}`,
       },
       body: formData,
     });
+    watchUploadProgress(videoID, watching.signal);
+    const res = await upload;
     if (!res.ok) {
       const data = await res.json();
       throw new Error(`Failed to upload video file. Error: ${data.error}`);
@@ -164,12 +224,63 @@ async function uploadVideoFile(videoID) {
     await getVideo(videoID);
   } catch (error) {
     alert(`Error: ${error.message}`);
+  } finally {
+    watching.abort();
+    showUploadProgress(null);
+  }
+}
+
+// watchUploadProgress renders the progress stream of a video's upload
+// until signal is aborted. EventSource can't send the Authorization
+// header, so the stream is read with fetch. A stream that ends, such as
+// one that only reported the previous upload's outcome, is reopened.
+async function watchUploadProgress(videoID, signal) {
+  while (!signal.aborted) {
+    try {
+      const res = await fetch(`/api/videos/${videoID}/progress`, {
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem("token")}`,
+        },
+        signal,
+      });
+      if (!res.ok) return;
+      const reader = res.body.pipeThrough(new TextDecoderStream()).getReader();
+      let buffer = "";
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) break;
+        buffer += value;
+        const events = buffer.split("\n\n");
+        buffer = events.pop();
+        for (const event of events) {
+          const data = event.split("\n").find((line) => line.startsWith("data: "));
+          if (data) showUploadProgress(JSON.parse(data.slice(6)));
+        }
+      }
+    } catch {
+      return;
+    }
+    await new Promise((resolve) => setTimeout(resolve, 500));
+  }
+}
+
+function showUploadProgress(progress) {
+  const bar = document.getElementById("video-upload-progress");
+  const stage = document.getElementById("video-upload-stage");
+  bar.hidden = !progress;
+  stage.textContent = progress ? progress.stage : "";
+  if (!progress) return;
+  if (progress.total > 0) {
+    bar.max = progress.total;
+    bar.value = progress.bytes;
+  } else {
+    bar.removeAttribute("value");
   }
 }
 
 async function getVideos() {
   try {
-    const res = await fetch("/api/videos", {
+    const res = await authFetch("/api/videos", {
       method: "GET",
       headers: {
         Authorization: `Bearer ${localStorage.getItem("token")}`,
@@ -185,8 +296,14 @@ async function getVideos() {
     videoList.innerHTML = "";
     for (const video of videos) {
       const listItem = document.createElement("li");
-      listItem.textContent = video.title;
+      listItem.textContent = video.duration
+        ? `${video.title} (${formatDuration(video.duration)})`
+        : video.title;
       listItem.onclick = () => getVideo(video.id);
+      if (video.preview_url) {
+        listItem.onmouseenter = () => showHoverPreview(listItem, video.preview_url);
+        listItem.onmouseleave = () => listItem.querySelector(".hover-preview")?.remove();
+      }
       videoList.appendChild(listItem);
     }
   } catch (error) {
@@ -194,9 +311,28 @@ async function getVideos() {
   }
 }
 
+// showHoverPreview plays a video's preview inside its list item. Previews
+// are animated images unless the server renders them as MP4 clips.
+function showHoverPreview(listItem, previewURL) {
+  if (listItem.querySelector(".hover-preview")) {
+    return;
+  }
+  const isClip = new URL(previewURL, window.location.href).pathname.endsWith(".mp4");
+  const preview = document.createElement(isClip ? "video" : "img");
+  preview.className = "hover-preview";
+  preview.src = previewURL;
+  if (isClip) {
+    preview.muted = true;
+    preview.loop = true;
+    preview.autoplay = true;
+    preview.playsInline = true;
+  }
+  listItem.appendChild(preview);
+}
+
 async function getVideo(videoID) {
   try {
-    const res = await fetch(`/api/videos/${videoID}`, {
+    const res = await authFetch(`/api/videos/${videoID}`, {
       method: "GET",
       headers: {
         Authorization: `Bearer ${localStorage.getItem("token")}`,
@@ -215,12 +351,44 @@ async function getVideo(videoID) {
 
 let currentVideo = null;
 
+function formatDuration(seconds) {
+  const total = Math.round(seconds);
+  const h = Math.floor(total / 3600);
+  const m = Math.floor((total % 3600) / 60);
+  const s = String(total % 60).padStart(2, "0");
+  return h > 0 ? `${h}:${String(m).padStart(2, "0")}:${s}` : `${m}:${s}`;
+}
+
+// technicalSummary describes a video's streams, like
+// "1920×1080 · h264/aac · 29.97 fps · 4.2 Mbps".
+function technicalSummary(video) {
+  const parts = [];
+  if (video.width && video.height) {
+    parts.push(`${video.width}×${video.height}`);
+  }
+  if (video.codec) {
+    parts.push(video.audio_codec ? `${video.codec}/${video.audio_codec}` : video.codec);
+  }
+  if (video.frame_rate) {
+    parts.push(`${video.frame_rate} fps`);
+  }
+  if (video.bitrate) {
+    parts.push(`${(video.bitrate / 1e6).toFixed(1)} Mbps`);
+  }
+  if (video.duration) {
+    parts.push(formatDuration(video.duration));
+  }
+  return parts.join(" · ");
+}
+
 function viewVideo(video) {
   currentVideo = video;
   document.getElementById("video-display").style.display = "block";
   document.getElementById("video-title-display").textContent = video.title;
   document.getElementById("video-description-display").textContent =
     video.description;
+  document.getElementById("video-technical-display").textContent =
+    technicalSummary(video);
 
   const thumbnailImg = document.getElementById("thumbnail-image");
   if (!video.thumbnail_url) {
@@ -251,10 +419,97 @@ function viewVideo(video) {
       videoPlayer.style.display = "none";
     } else {
       videoPlayer.style.display = "block";
-      videoPlayer.src = video.video_url;
+      videoPlayer.src = video.stream_url || video.video_url;
       videoPlayer.load();
     }
   }
+  loadStoryboard(video);
+}
+
+// parseStoryboard reads a sprite sheet's WebVTT index into cues of
+// {start, end, url, x, y, w, h}, resolving image references against the
+// index's own URL.
+function parseStoryboard(vtt, vttURL) {
+  const toSeconds = (ts) =>
+    ts.split(":").reduce((total, part) => total * 60 + parseFloat(part), 0);
+  const lines = vtt.split(/\r?\n/);
+  const cues = [];
+  for (let i = 0; i < lines.length - 1; i++) {
+    const times = lines[i].match(/^([\d:.]+) --> ([\d:.]+)/);
+    const image = lines[i + 1].match(/^(.*)#xywh=(\d+),(\d+),(\d+),(\d+)$/);
+    if (!times || !image) {
+      continue;
+    }
+    const [x, y, w, h] = image.slice(2).map(Number);
+    cues.push({
+      start: toSeconds(times[1]),
+      end: toSeconds(times[2]),
+      url: new URL(image[1], new URL(vttURL, window.location.href)).href,
+      x, y, w, h,
+    });
+  }
+  return cues;
+}
+
+// loadStoryboard sets up the scrubber under the player, which shows the
+// sprite sheet tile for the time under the pointer and seeks on release.
+async function loadStoryboard(video) {
+  const storyboard = document.getElementById("storyboard");
+  const videoPlayer = document.getElementById("video-player");
+  storyboard.hidden = true;
+  if (!video.sprite_vtt_url || !video.duration || !videoPlayer) {
+    return;
+  }
+
+  let cues;
+  try {
+    const res = await authFetch(video.sprite_vtt_url, {
+      headers: { Authorization: `Bearer ${localStorage.getItem("token")}` },
+    });
+    if (!res.ok) {
+      return;
+    }
+    cues = parseStoryboard(await res.text(), video.sprite_vtt_url);
+  } catch {
+    return;
+  }
+  if (cues.length === 0 || currentVideo?.id !== video.id) {
+    return;
+  }
+
+  const scrubber = document.getElementById("storyboard-scrubber");
+  const tile = document.getElementById("storyboard-tile");
+  scrubber.max = video.duration;
+  scrubber.value = 0;
+  storyboard.hidden = false;
+
+  const showTile = (time, offsetX) => {
+    const cue = cues.find((c) => time >= c.start && time < c.end) ?? cues[cues.length - 1];
+    tile.style.width = `${cue.w}px`;
+    tile.style.height = `${cue.h}px`;
+    tile.style.backgroundImage = `url("${cue.url}")`;
+    tile.style.backgroundPosition = `-${cue.x}px -${cue.y}px`;
+    tile.style.left = `${Math.max(0, offsetX - cue.w / 2)}px`;
+    tile.style.display = "block";
+  };
+  scrubber.onmousemove = (event) => {
+    const fraction = event.offsetX / scrubber.clientWidth;
+    showTile(fraction * video.duration, event.offsetX);
+  };
+  scrubber.onmouseleave = () => {
+    tile.style.display = "none";
+  };
+  scrubber.oninput = () => {
+    const fraction = scrubber.value / video.duration;
+    showTile(Number(scrubber.value), fraction * scrubber.clientWidth);
+  };
+  scrubber.onchange = () => {
+    videoPlayer.currentTime = Number(scrubber.value);
+    tile.style.display = "none";
+  };
+  videoPlayer.ontimeupdate = () => {
+    scrubber.value = videoPlayer.currentTime;
+  };
 }
 
 async function deleteVideo() {
@@ -264,7 +519,7 @@ async function deleteVideo() {
   }
 
   try {
-    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+    const res = await authFetch(`/api/videos/${currentVideo.id}`, {
       method: "DELETE",
       headers: {
         Authorization: `Bearer ${localStorage.getItem("token")}`,
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +16,91 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// parsePublicBaseURL validates PUBLIC_BASE_URL and strips any trailing
+// slash so paths can be appended directly.
+func parsePublicBaseURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("missing host")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("must not contain a query or fragment")
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// publicURL returns the absolute URL clients should use for path, which
+// must start with a slash. Without a public base URL configured it uses
+// the one a trusted proxy forwarded the request in ctx for, and falls back
+// to localhost.
+func (cfg *apiConfig) publicURL(ctx context.Context, path string) string {
+	base := cfg.publicBaseURL
+	if base == "" {
+		base, _ = ctx.Value(forwardedBaseURLKey{}).(string)
+	}
+	if base == "" {
+		base = "http://localhost:" + cfg.port
+	}
+	return base + path
+}
+
+// assetURL is the URL of a file in the assets directory, under ASSETS_URL
+// when the directory is served from somewhere other than this server.
+func (cfg *apiConfig) assetURL(ctx context.Context, fileName string) string {
+	if cfg.assetsBaseURL != "" {
+		return cfg.assetsBaseURL + "/" + fileName
+	}
+	return cfg.publicURL(ctx, "/assets/"+fileName)
+}
+
+type forwardedBaseURLKey struct{}
+
+// forwardedBaseURLMiddleware lets URLs made while handling a request use
+// the scheme, host and path prefix the client reached a trusted proxy at,
+// from X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix. A
+// configured PUBLIC_BASE_URL takes precedence, and the headers of anyone
+// else are ignored since they'd end up in stored URLs.
+func (cfg *apiConfig) forwardedBaseURLMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if base, ok := cfg.forwardedBaseURL(r); ok && cfg.publicBaseURL == "" {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedBaseURLKey{}, base))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (cfg *apiConfig) forwardedBaseURL(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !ipInNets(peer, cfg.trustedProxies) {
+		return "", false
+	}
+
+	// Each proxy appends what it saw, so the first value is what the
+	// client used
+	first := func(name string) string {
+		value, _, _ := strings.Cut(r.Header.Get(name), ",")
+		return strings.TrimSpace(value)
+	}
+	forwardedHost := first("X-Forwarded-Host")
+	if forwardedHost == "" {
+		return "", false
+	}
+	proto := first("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+	}
+	prefix := strings.Trim(first("X-Forwarded-Prefix"), "/")
+	base, err := parsePublicBaseURL(proto + "://" + forwardedHost + "/" + prefix)
+	return base, err == nil
+}
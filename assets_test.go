@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestPublicURL(t *testing.T) {
+	tests := []struct {
+		base string
+		want string
+	}{
+		{"", "http://localhost:8091/assets/a.jpg"},
+		{"https://example.com", "https://example.com/assets/a.jpg"},
+		{"https://example.com/", "https://example.com/assets/a.jpg"},
+		{"https://example.com/tubely/", "https://example.com/tubely/assets/a.jpg"},
+	}
+	for _, tt := range tests {
+		cfg := &apiConfig{port: "8091"}
+		if tt.base != "" {
+			base, err := parsePublicBaseURL(tt.base)
+			if err != nil {
+				t.Fatalf("parsePublicBaseURL(%q): %v", tt.base, err)
+			}
+			cfg.publicBaseURL = base
+		}
+		if got := cfg.publicURL(context.Background(), "/assets/a.jpg"); got != tt.want {
+			t.Errorf("base %q: publicURL = %q, want %q", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestParsePublicBaseURLRejectsInvalid(t *testing.T) {
+	for _, raw := range []string{"example.com", "ftp://example.com", "https://", "https://example.com/?x=1"} {
+		if _, err := parsePublicBaseURL(raw); err == nil {
+			t.Errorf("parsePublicBaseURL(%q) succeeded, want error", raw)
+		}
+	}
+}
+
+func TestForwardedBaseURL(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.publicBaseURL = ""
+	token, video := h.createUserAndVideo("forwarded@example.com")
+	videoURL := h.cfg.s3CfDistribution + "/landscape/a.mp4"
+	video.VideoURL = &videoURL
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	streamURL := func() string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/api/videos/"+video.ID.String(), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Forwarded-Host", "videos.example.com, internal:8080")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Prefix", "/tubely")
+		var got videoResponse
+		decodeJSON(t, h.send(req), &got)
+		if got.StreamURL == nil {
+			t.Fatal("no stream_url")
+		}
+		return *got.StreamURL
+	}
+	path := "/api/videos/" + video.ID.String() + "/stream"
+
+	// Anyone could send the headers, so they only count from a proxy
+	if got := streamURL(); got != h.cfg.publicURL(context.Background(), path) {
+		t.Errorf("untrusted peer: stream_url = %s", got)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	h.cfg.trustedProxies = []*net.IPNet{loopback}
+	if got, want := streamURL(), "https://videos.example.com/tubely"+path; got != want {
+		t.Errorf("trusted proxy: stream_url = %s, want %s", got, want)
+	}
+	// A configured base URL wins
+	h.cfg.publicBaseURL = "https://tubely.example.com"
+	if got, want := streamURL(), "https://tubely.example.com"+path; got != want {
+		t.Errorf("with PUBLIC_BASE_URL: stream_url = %s, want %s", got, want)
+	}
+}
+
+func TestAssetURL(t *testing.T) {
+	cfg := &apiConfig{port: "8091", assetsRoot: "/srv/assets"}
+	if got := cfg.assetURL(context.Background(), "a.jpg"); got != "http://localhost:8091/assets/a.jpg" {
+		t.Errorf("assetURL = %s", got)
+	}
+	cfg.assetsBaseURL = "https://assets.example.com/tubely"
+	got := cfg.assetURL(context.Background(), "a.jpg")
+	if got != "https://assets.example.com/tubely/a.jpg" {
+		t.Errorf("with ASSETS_URL: assetURL = %s", got)
+	}
+	if path, ok := cfg.localThumbnailPath(got); !ok || path != "/srv/assets/a.jpg" {
+		t.Errorf("localThumbnailPath(%s) = %s, %v", got, path, ok)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// Ways of running Whisper, set with WHISPER_MODE.
+const (
+	whisperOff   = "off"
+	whisperLocal = "local"
+	whisperAPI   = "api"
+)
+
+const (
+	defaultWhisperAPIURL = "https://api.openai.com/v1/audio/transcriptions"
+
+	// whisperAPITimeout bounds a request to the transcription API, which
+	// answers only once the whole file is transcribed.
+	whisperAPITimeout = 15 * time.Minute
+)
+
+// errNoSpeech is returned when Whisper hears nothing to caption.
+var errNoSpeech = errors.New("no speech found")
+
+// whisperTranscript is the JSON both the whisper command and the API's
+// verbose_json format produce. The command reports the language as a code
+// and the API as an English name.
+type whisperTranscript struct {
+	Language string           `json:"language"`
+	Segments []whisperSegment `json:"segments"`
+}
+
+type whisperSegment struct {
+	Start float64 `json:"start"` // seconds
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// transcriber turns the speech in an audio file into a transcript.
+// language is a hint, empty to have it detected.
+type transcriber interface {
+	transcribe(ctx context.Context, audioPath, language string) (whisperTranscript, error)
+}
+
+// whisperCommand runs openai-whisper's command line tool. It takes one of
+// the media tool slots, since it's as hungry for CPU as ffmpeg.
+type whisperCommand struct {
+	binary string
+	model  string
+}
+
+func (c whisperCommand) transcribe(ctx context.Context, audioPath, language string) (whisperTranscript, error) {
+	outputDir, err := os.MkdirTemp("", "tubely-whisper-")
+	if err != nil {
+		return whisperTranscript{}, err
+	}
+	defer os.RemoveAll(outputDir)
+
+	args := []string{audioPath,
+		"--model", c.model,
+		"--output_format", "json",
+		"--output_dir", outputDir,
+		"--verbose", "False",
+	}
+	if language != "" {
+		args = append(args, "--language", language)
+	}
+	if _, err := runMediaTool(ctx, c.binary, args...); err != nil {
+		return whisperTranscript{}, err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(audioPath), filepath.Ext(audioPath)) + ".json"
+	data, err := os.ReadFile(filepath.Join(outputDir, name))
+	if err != nil {
+		return whisperTranscript{}, fmt.Errorf("couldn't read whisper output: %w", err)
+	}
+	var transcript whisperTranscript
+	if err := json.Unmarshal(data, &transcript); err != nil {
+		return whisperTranscript{}, fmt.Errorf("couldn't parse whisper output: %w", err)
+	}
+	return transcript, nil
+}
+
+// whisperAPIClient sends audio to OpenAI's transcription endpoint, or any
+// server that speaks its API.
+type whisperAPIClient struct {
+	client *http.Client
+	url    string
+	apiKey string
+	model  string
+}
+
+func (c whisperAPIClient) transcribe(ctx context.Context, audioPath, language string) (whisperTranscript, error) {
+	audio, err := os.Open(audioPath)
+	if err != nil {
+		return whisperTranscript{}, err
+	}
+	defer audio.Close()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filepath.Base(audioPath))
+	if err != nil {
+		return whisperTranscript{}, err
+	}
+	if _, err := io.Copy(part, audio); err != nil {
+		return whisperTranscript{}, err
+	}
+	fields := [][2]string{
+		{"model", c.model},
+		{"response_format", "verbose_json"},
+		{"timestamp_granularities[]", "segment"},
+	}
+	if language != "" {
+		fields = append(fields, [2]string{"language", language})
+	}
+	for _, field := range fields {
+		if err := form.WriteField(field[0], field[1]); err != nil {
+			return whisperTranscript{}, err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return whisperTranscript{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, &body)
+	if err != nil {
+		return whisperTranscript{}, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return whisperTranscript{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return whisperTranscript{}, fmt.Errorf("transcription API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var transcript whisperTranscript
+	if err := json.NewDecoder(resp.Body).Decode(&transcript); err != nil {
+		return whisperTranscript{}, fmt.Errorf("couldn't parse transcription: %w", err)
+	}
+	return transcript, nil
+}
+
+// extractSpeechAudio writes a video's audio as 16 kHz mono MP3 and returns
+// its path. That's all Whisper listens to, and it keeps an hour of speech
+// well under the API's 25 MB upload limit.
+func extractSpeechAudio(ctx context.Context, inputPath string) (string, error) {
+	outputPath := inputPath + ".speech.mp3"
+	_, err := runMediaTool(ctx, "ffmpeg",
+		"-i", inputPath,
+		"-vn",
+		"-ac", "1",
+		"-ar", "16000",
+		"-c:a", "libmp3lame",
+		"-b:a", "32k",
+		"-f", "mp3",
+		outputPath,
+	)
+	if err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// transcriptCaptions turns a transcript's segments into WebVTT cues, one
+// line each.
+func transcriptCaptions(transcript whisperTranscript) ([]byte, error) {
+	var cues []captionCue
+	for _, segment := range transcript.Segments {
+		text := strings.Join(strings.Fields(segment.Text), " ")
+		if text == "" {
+			continue
+		}
+		start := time.Duration(max(segment.Start, 0) * float64(time.Second))
+		end := time.Duration(segment.End * float64(time.Second))
+		if end <= start {
+			end = start + time.Second
+		}
+		cues = append(cues, captionCue{start: start, end: end, text: []string{text}})
+	}
+	if len(cues) == 0 {
+		return nil, errNoSpeech
+	}
+	return parseCaptions([]byte(formatWebVTT(cues)))
+}
+
+// whisperLanguages are the codes Whisper can transcribe, for matching the
+// English names the API reports them by.
+var whisperLanguages = strings.Fields(`en zh de es ru ko fr ja pt tr pl ca nl ar sv it id hi fi vi
+	he uk el ms cs ro da hu ta no th ur hr bg lt la mi ml cy sk te fa lv bn sr az sl kn et mk br
+	eu is hy ne mn bs kk sq sw gl mr pa si km sn yo so af oc ka be tg sd gu am yi lo uz fo ht ps
+	tk nn mt sa lb my bo tl mg as tt haw ln ha ba jw su yue`)
+
+// transcriptLanguage is the language code to file a transcript under: the
+// one Whisper was told to use, else the one it detected, else "und".
+func transcriptLanguage(reported, hint string) string {
+	if hint != "" {
+		return hint
+	}
+	if tag, err := language.Parse(reported); err == nil {
+		return tag.String()
+	}
+	names := display.English.Tags()
+	for _, code := range whisperLanguages {
+		tag, err := language.Parse(code)
+		if err == nil && strings.EqualFold(names.Name(tag), reported) {
+			return tag.String()
+		}
+	}
+	return language.Und.String()
+}
+
+// generatedCaptionLabel names a transcribed track in a player's menu.
+func generatedCaptionLabel(lang string) string {
+	tag, err := language.Parse(lang)
+	if err != nil || tag == language.Und {
+		return "Auto-generated"
+	}
+	return display.English.Tags().Name(tag) + " (auto-generated)"
+}
+
+// shouldAutoCaption decides whether an upload's audio gets transcribed. The
+// form field "auto_captions" overrides the configured default when present.
+func (cfg *apiConfig) shouldAutoCaption(formValue string) bool {
+	if cfg.transcriber == nil || !cfg.mediaToolsAvailable {
+		return false
+	}
+	if apply, err := strconv.ParseBool(formValue); err == nil {
+		return apply
+	}
+	return cfg.autoCaptionsByDefault
+}
+
+// generateCaptions transcribes a freshly uploaded video and attaches the
+// result as a caption track. It runs in the background after the upload
+// was answered; how it went is kept in the video's caption status.
+func (cfg *apiConfig) generateCaptions(store ObjectStore, videoID uuid.UUID, videoURL, videoKey string) {
+	ctx := context.Background()
+	cfg.setCaptionStatus(videoID, videoURL, videoProcessing, "")
+	err := cfg.storeGeneratedCaptions(ctx, store, videoID, videoURL, videoKey)
+	if err != nil {
+		slog.Error("couldn't generate captions", "video_id", videoID, "err", err)
+		msg := "Couldn't transcribe the video's audio"
+		if errors.Is(err, errNoSpeech) {
+			msg = "No speech was found in the video"
+		}
+		cfg.setCaptionStatus(videoID, videoURL, videoFailed, msg)
+	}
+}
+
+func (cfg *apiConfig) storeGeneratedCaptions(ctx context.Context, store ObjectStore, videoID uuid.UUID, videoURL, videoKey string) error {
+	sourcePath, err := downloadToTemp(ctx, store, videoKey)
+	if err != nil {
+		return fmt.Errorf("couldn't download video: %w", err)
+	}
+	defer os.Remove(sourcePath)
+
+	audioPath, err := extractSpeechAudio(ctx, sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't extract audio: %w", err)
+	}
+	defer os.Remove(audioPath)
+
+	transcript, err := cfg.transcriber.transcribe(ctx, audioPath, cfg.whisperLanguage)
+	if err != nil {
+		return fmt.Errorf("couldn't transcribe audio: %w", err)
+	}
+	return cfg.attachTranscript(ctx, videoID, videoURL, transcript)
+}
+
+// attachTranscript stores a transcript as the video's track for its
+// language, replacing an earlier transcript but never captions someone
+// uploaded. Nothing is attached if the video's file changed meanwhile.
+func (cfg *apiConfig) attachTranscript(ctx context.Context, videoID uuid.UUID, videoURL string, transcript whisperTranscript) error {
+	vtt, err := transcriptCaptions(transcript)
+	if err != nil {
+		return err
+	}
+	lang := transcriptLanguage(transcript.Language, cfg.whisperLanguage)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return err
+	}
+	if video.VideoURL == nil || *video.VideoURL != videoURL {
+		return nil
+	}
+	for _, existing := range video.Captions {
+		if existing.Language == lang && !existing.Generated {
+			cfg.setCaptionStatus(videoID, videoURL, videoReady, "")
+			return nil
+		}
+	}
+
+	track, err := cfg.storeCaptionFile(ctx, vtt)
+	if err != nil {
+		return fmt.Errorf("couldn't save caption file: %w", err)
+	}
+	track.Language = lang
+	track.Label = generatedCaptionLabel(lang)
+	track.Generated = true
+	old, replaced := removeCaptionTrack(&video, lang)
+	video.Captions = append(video.Captions, track)
+	ready := videoReady
+	video.CaptionStatus = &ready
+	video.CaptionError = nil
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		cfg.removeCaptionFile(ctx, track)
+		return err
+	}
+	if replaced {
+		if err := cfg.removeCaptionFile(ctx, old); err != nil {
+			slog.Warn("couldn't delete replaced caption file", "video_id", video.ID, "err", err)
+		}
+	}
+	if err := cfg.syncHLSCaptions(ctx, video); err != nil {
+		slog.Warn("couldn't add captions to HLS playlist", "video_id", video.ID, "err", err)
+	}
+	return nil
+}
+
+// setCaptionStatus records how generating captions is going. Like the
+// processing status it's informational, so failures are only logged.
+func (cfg *apiConfig) setCaptionStatus(videoID uuid.UUID, videoURL, status, errMsg string) {
+	_, err := cfg.db.SetCaptionStatus(videoID, videoURL, status, errMsg)
+	if err != nil {
+		slog.Warn("couldn't record caption status", "video_id", videoID, "status", status, "err", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestWhisperAPIClient(t *testing.T) {
+	var gotAuth string
+	var gotFields map[string]string
+	var gotAudio string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parsing form: %v", err)
+		}
+		gotFields = map[string]string{}
+		for name, values := range r.MultipartForm.Value {
+			gotFields[name] = values[0]
+		}
+		file, _, err := r.FormFile("file")
+		if err == nil {
+			buf := make([]byte, 16)
+			n, _ := file.Read(buf)
+			gotAudio = string(buf[:n])
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"language": "portuguese",
+			"segments": []map[string]any{{"start": 0.5, "end": 2, "text": " Olá, mundo."}},
+		})
+	}))
+	defer server.Close()
+
+	audioPath := filepath.Join(t.TempDir(), "speech.mp3")
+	if err := os.WriteFile(audioPath, []byte("mp3 bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := whisperAPIClient{client: server.Client(), url: server.URL, apiKey: "sk-test", model: "whisper-1"}
+	transcript, err := client.transcribe(context.Background(), audioPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotAuth != "Bearer sk-test" {
+		t.Errorf("expected the API key as a bearer token, got %q", gotAuth)
+	}
+	if gotFields["model"] != "whisper-1" || gotFields["response_format"] != "verbose_json" {
+		t.Errorf("unexpected form fields %v", gotFields)
+	}
+	if _, ok := gotFields["language"]; ok {
+		t.Error("expected no language hint when none is configured")
+	}
+	if gotAudio != "mp3 bytes" {
+		t.Errorf("expected the audio file to be sent, got %q", gotAudio)
+	}
+	if transcriptLanguage(transcript.Language, "") != "pt" {
+		t.Errorf("expected portuguese to be filed as pt, got %q", transcriptLanguage(transcript.Language, ""))
+	}
+	vtt, err := transcriptCaptions(transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "WEBVTT\n\n00:00:00.500 --> 00:00:02.000\nOlá, mundo.\n"; string(vtt) != want {
+		t.Errorf("got captions %q, want %q", vtt, want)
+	}
+}
+
+func TestWhisperAPIClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"message":"Invalid API key"}}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	audioPath := filepath.Join(t.TempDir(), "speech.mp3")
+	os.WriteFile(audioPath, []byte("mp3"), 0644)
+	client := whisperAPIClient{client: server.Client(), url: server.URL, model: "whisper-1"}
+	_, err := client.transcribe(context.Background(), audioPath, "en")
+	if err == nil || !strings.Contains(err.Error(), "Invalid API key") {
+		t.Errorf("expected the API's error, got %v", err)
+	}
+}
+
+func TestTranscriptLanguage(t *testing.T) {
+	cases := []struct{ reported, hint, want string }{
+		{"en", "", "en"},
+		{"english", "", "en"},
+		{"Japanese", "", "ja"},
+		{"klingon", "", "und"},
+		{"", "", "und"},
+		{"french", "de", "de"},
+	}
+	for _, c := range cases {
+		if got := transcriptLanguage(c.reported, c.hint); got != c.want {
+			t.Errorf("transcriptLanguage(%q, %q) = %q, want %q", c.reported, c.hint, got, c.want)
+		}
+	}
+	if got := generatedCaptionLabel("en"); got != "English (auto-generated)" {
+		t.Errorf("unexpected label %q", got)
+	}
+}
+
+func TestTranscriptCaptionsWithoutSpeech(t *testing.T) {
+	_, err := transcriptCaptions(whisperTranscript{Segments: []whisperSegment{{Start: 0, End: 1, Text: "  "}}})
+	if err != errNoSpeech {
+		t.Errorf("expected errNoSpeech, got %v", err)
+	}
+}
+
+func TestAttachTranscript(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("auto-captions@example.com")
+	videoURL := h.cfg.s3CfDistribution + "/landscape/abc.mp4"
+	video.VideoURL = &videoURL
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	transcript := func(text string) whisperTranscript {
+		return whisperTranscript{Language: "en", Segments: []whisperSegment{{Start: 1, End: 2, Text: text}}}
+	}
+
+	if err := h.cfg.attachTranscript(context.Background(), video.ID, videoURL, transcript("first")); err != nil {
+		t.Fatal(err)
+	}
+	// A later transcript replaces the earlier one
+	if err := h.cfg.attachTranscript(context.Background(), video.ID, videoURL, transcript("second")); err != nil {
+		t.Fatal(err)
+	}
+	got := h.getVideo(video.ID)
+	if len(got.Captions) != 1 || !got.Captions[0].Generated || got.Captions[0].Language != "en" {
+		t.Fatalf("expected one generated en track, got %+v", got.Captions)
+	}
+	if got.CaptionStatus == nil || *got.CaptionStatus != videoReady {
+		t.Errorf("expected caption status ready, got %v", got.CaptionStatus)
+	}
+	if n := len(h.s3.keys()); n != 1 {
+		t.Errorf("expected the replaced transcript to be deleted, have %d objects", n)
+	}
+	vtt, err := h.cfg.readCaptionFile(context.Background(), got.Captions[0])
+	if err != nil || !strings.Contains(string(vtt), "second") {
+		t.Errorf("expected the latest transcript, got %q (%v)", vtt, err)
+	}
+
+	resp := h.do(http.MethodGet, "/api/videos/"+video.ID.String(), token, nil)
+	var body videoResponse
+	decodeJSON(t, resp, &body)
+	if len(body.Captions) != 1 || !body.Captions[0].Generated || body.Captions[0].Label != "English (auto-generated)" {
+		t.Errorf("unexpected captions in response: %+v", body.Captions)
+	}
+
+	// Captions someone uploaded are never overwritten
+	manual := database.CaptionTrack{Language: "en", URL: "https://cdn.example.com/captions/manual.vtt", Key: "captions/manual.vtt"}
+	got.Captions = database.CaptionTracks{manual}
+	if err := h.cfg.db.UpdateVideo(got); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.cfg.attachTranscript(context.Background(), video.ID, videoURL, transcript("third")); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.getVideo(video.ID); len(got.Captions) != 1 || got.Captions[0].Generated {
+		t.Errorf("expected the uploaded track to be kept, got %+v", got.Captions)
+	}
+
+	// Nor is anything attached once the video's file has changed
+	if err := h.cfg.attachTranscript(context.Background(), video.ID, videoURL+"?old", transcript("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.getVideo(video.ID); len(got.Captions) != 1 || got.Captions[0].Generated {
+		t.Errorf("expected a stale transcript to be dropped, got %+v", got.Captions)
+	}
+}
+
+func TestCaptionStatus(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("caption-status@example.com")
+	videoURL := h.cfg.s3CfDistribution + "/landscape/abc.mp4"
+	video.VideoURL = &videoURL
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	h.cfg.setCaptionStatus(video.ID, videoURL, videoFailed, "No speech was found in the video")
+	resp := h.do(http.MethodGet, "/api/videos/"+video.ID.String()+"/status", token, nil)
+	var body struct {
+		CaptionStatus string    `json:"caption_status"`
+		CaptionError  string    `json:"caption_error"`
+		UpdatedAt     time.Time `json:"updated_at"`
+	}
+	decodeJSON(t, resp, &body)
+	if body.CaptionStatus != videoFailed || body.CaptionError != "No speech was found in the video" {
+		t.Errorf("unexpected caption status %+v", body)
+	}
+}
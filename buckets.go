@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// BucketResolver picks the bucket a user's new uploads are stored in, e.g.
+// to keep EU users' videos in an EU bucket. An empty result means the
+// default bucket.
+type BucketResolver func(userID uuid.UUID) string
+
+// resolveBucket returns the bucket new uploads for userID should go to.
+func (cfg *apiConfig) resolveBucket(userID uuid.UUID) string {
+	if cfg.bucketResolver != nil {
+		if bucket := cfg.bucketResolver(userID); bucket != "" {
+			return bucket
+		}
+	}
+	return cfg.s3Bucket
+}
+
+// storeForBucket returns an object store for bucket, reusing the default
+// store when it's the default bucket.
+func (cfg *apiConfig) storeForBucket(bucket string) ObjectStore {
+	if bucket == "" || bucket == cfg.s3Bucket || cfg.s3Client == nil {
+		return cfg.store
+	}
+	return newS3ObjectStore(cfg.s3Client, cfg.presigner, bucket, cfg.s3MaxAttempts, cfg.s3PartSize)
+}
+
+// videoStore returns the store holding a video's objects. Videos uploaded
+// before buckets were recorded live in the default bucket.
+func (cfg *apiConfig) videoStore(video database.Video) ObjectStore {
+	if video.VideoBucket == nil {
+		return cfg.store
+	}
+	return cfg.storeForBucket(*video.VideoBucket)
+}
+
+// parseUserBuckets parses "user-id=bucket" pairs.
+func parseUserBuckets(values []string) (map[uuid.UUID]string, error) {
+	buckets := make(map[uuid.UUID]string, len(values))
+	for _, value := range values {
+		rawID, bucket, ok := strings.Cut(value, "=")
+		if !ok || strings.TrimSpace(bucket) == "" {
+			return nil, fmt.Errorf("%q isn't of the form user-id=bucket", value)
+		}
+		userID, err := uuid.Parse(strings.TrimSpace(rawID))
+		if err != nil {
+			return nil, fmt.Errorf("%q: invalid user ID: %w", value, err)
+		}
+		buckets[userID] = strings.TrimSpace(bucket)
+	}
+	return buckets, nil
+}
+
+// userBucketResolver routes the listed users to their bucket and everyone
+// else to the default.
+func userBucketResolver(buckets map[uuid.UUID]string) BucketResolver {
+	return func(userID uuid.UUID) string {
+		return buckets[userID]
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestUploadVideoUsesResolvedBucket(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("eu@example.com")
+	h.cfg.bucketResolver = userBucketResolver(map[uuid.UUID]string{video.UserID: "tubely-eu"})
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	keys := h.s3.keys()
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 object, got %v", keys)
+	}
+	if bucket := h.s3.buckets[keys[0]]; bucket != "tubely-eu" {
+		t.Fatalf("expected upload in tubely-eu, got %q", bucket)
+	}
+	stored := h.getVideo(video.ID)
+	if stored.VideoBucket == nil || *stored.VideoBucket != "tubely-eu" {
+		t.Fatalf("expected bucket to be recorded, got %v", stored.VideoBucket)
+	}
+}
+
+func TestUploadVideoDefaultBucket(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.bucketResolver = userBucketResolver(map[uuid.UUID]string{uuid.New(): "tubely-eu"})
+	token, video := h.createUserAndVideo("us@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	keys := h.s3.keys()
+	if len(keys) != 1 || h.s3.buckets[keys[0]] != h.cfg.s3Bucket {
+		t.Fatalf("expected one object in the default bucket, got %v", h.s3.buckets)
+	}
+}
+
+func TestParseUserBuckets(t *testing.T) {
+	id := uuid.New()
+	buckets, err := parseUserBuckets([]string{id.String() + "= tubely-eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buckets[id] != "tubely-eu" {
+		t.Fatalf("unexpected mapping %v", buckets)
+	}
+
+	for _, bad := range []string{"tubely-eu", "not-a-uuid=tubely-eu", id.String() + "="} {
+		if _, err := parseUserBuckets([]string{bad}); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
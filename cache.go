@@ -1,6 +1,13 @@
 package main
 
-import "net/http"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
 
 func noCacheMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -8,3 +15,46 @@ func noCacheMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// respondWithCachedJSON is respondWithJSON for read endpoints that clients
+// poll. The ETag is a hash of the encoded body, so it changes whenever any
+// field does, and a matching If-None-Match gets a 304 instead of the body.
+// If-Modified-Since is only consulted when the client sent no ETag, since
+// lastModified has one second resolution. A zero lastModified is omitted.
+func respondWithCachedJSON(w http.ResponseWriter, r *http.Request, payload any, lastModified time.Time) {
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("error marshalling JSON", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	sum := sha256.Sum256(dat)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "no-cache")
+	if !lastModified.IsZero() {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(dat)
+}
+
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListContains(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVideoGetConditionalRequests(t *testing.T) {
+	h := newTestHarness(t)
+	_, video := h.createUserAndVideo("cache@example.com")
+	path := "/api/videos/" + video.ID.String()
+
+	get := func(header, value string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, h.srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	first := get("", "")
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != http.StatusOK || etag == "" || first.Header.Get("Last-Modified") == "" {
+		t.Fatalf("expected 200 with validators, got %d etag=%q last-modified=%q",
+			first.StatusCode, etag, first.Header.Get("Last-Modified"))
+	}
+
+	if resp := get("If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("matching If-None-Match: expected 304, got %d", resp.StatusCode)
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if resp := get("If-Modified-Since", future); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since in the future: expected 304, got %d", resp.StatusCode)
+	}
+
+	video.Description = "changed"
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	resp := get("If-None-Match", etag)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("after update: expected 200, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("ETag") == etag {
+		t.Fatal("expected ETag to change after update")
+	}
+}
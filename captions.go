@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	// Browsers only load <track> files served as text/vtt
+	mime.AddExtensionType(".vtt", "text/vtt; charset=utf-8")
+}
+
+const maxCaptionBytes = 2 << 20 // 2 MB
+
+// captionCue is one timed piece of caption text.
+type captionCue struct {
+	start, end time.Duration
+	text       []string
+}
+
+// captionError points at the part of a caption file that couldn't be
+// parsed. Cue is 1-based and zero for problems outside any cue.
+type captionError struct {
+	cue  int
+	line int
+	msg  string
+}
+
+func (e *captionError) Error() string {
+	if e.cue == 0 {
+		return fmt.Sprintf("line %d: %s", e.line, e.msg)
+	}
+	return fmt.Sprintf("cue %d (line %d): %s", e.cue, e.line, e.msg)
+}
+
+var (
+	vttTimestampPattern = regexp.MustCompile(`^(?:(\d{2,}):)?([0-5]\d):([0-5]\d)\.(\d{3})$`)
+	srtTimestampPattern = regexp.MustCompile(`^(\d{2,}):([0-5]\d):([0-5]\d),(\d{3})$`)
+)
+
+// parseCaptions validates a WebVTT or SRT file and returns its cues as
+// WebVTT, the only format browsers play. WebVTT input is kept as is, so
+// styling and positioning survive.
+func parseCaptions(data []byte) ([]byte, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("caption file is empty")
+	}
+
+	if firstLine, _, _ := strings.Cut(text, "\n"); isWebVTTHeader(firstLine) {
+		if _, err := parseWebVTT(text); err != nil {
+			return nil, err
+		}
+		return []byte(text), nil
+	}
+
+	cues, err := parseSRT(text)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(formatWebVTT(cues)), nil
+}
+
+func isWebVTTHeader(line string) bool {
+	rest, ok := strings.CutPrefix(line, "WEBVTT")
+	return ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t')
+}
+
+// captionBlock is a run of non-blank lines and the line number it starts on.
+type captionBlock struct {
+	line  int
+	lines []string
+}
+
+func splitCaptionBlocks(text string) []captionBlock {
+	var blocks []captionBlock
+	var current *captionBlock
+	for i, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			current = nil
+			continue
+		}
+		if current == nil {
+			blocks = append(blocks, captionBlock{line: i + 1})
+			current = &blocks[len(blocks)-1]
+		}
+		current.lines = append(current.lines, line)
+	}
+	return blocks
+}
+
+func parseWebVTT(text string) ([]captionCue, error) {
+	blocks := splitCaptionBlocks(text)
+	var cues []captionCue
+	// The first block is the header
+	for _, block := range blocks[1:] {
+		first := block.lines[0]
+		if strings.HasPrefix(first, "NOTE") || strings.HasPrefix(first, "STYLE") || strings.HasPrefix(first, "REGION") {
+			continue
+		}
+
+		n := len(cues) + 1
+		timing, timingLine := first, block.line
+		rest := block.lines[1:]
+		if !strings.Contains(first, "-->") {
+			// An optional cue identifier comes before the timing line
+			if len(rest) == 0 {
+				return nil, &captionError{cue: n, line: block.line, msg: "missing timing line"}
+			}
+			timing, timingLine = rest[0], block.line+1
+			rest = rest[1:]
+		}
+
+		cue, err := parseCueTiming(timing, vttTimestampPattern)
+		if err != nil {
+			return nil, &captionError{cue: n, line: timingLine, msg: err.Error()}
+		}
+		if err := checkCueOrder(cue, cues); err != nil {
+			return nil, &captionError{cue: n, line: timingLine, msg: err.Error()}
+		}
+		cue.text = rest
+		cues = append(cues, cue)
+	}
+	if len(cues) == 0 {
+		return nil, errors.New("caption file has no cues")
+	}
+	return cues, nil
+}
+
+func parseSRT(text string) ([]captionCue, error) {
+	var cues []captionCue
+	for _, block := range splitCaptionBlocks(text) {
+		n := len(cues) + 1
+		if _, err := strconv.Atoi(strings.TrimSpace(block.lines[0])); err != nil {
+			if len(cues) == 0 {
+				return nil, &captionError{line: block.line, msg: "not a WebVTT or SRT file"}
+			}
+			return nil, &captionError{cue: n, line: block.line, msg: fmt.Sprintf("expected a cue number, got %q", block.lines[0])}
+		}
+		if len(block.lines) < 2 {
+			return nil, &captionError{cue: n, line: block.line, msg: "missing timing line"}
+		}
+
+		cue, err := parseCueTiming(block.lines[1], srtTimestampPattern)
+		if err != nil {
+			return nil, &captionError{cue: n, line: block.line + 1, msg: err.Error()}
+		}
+		if err := checkCueOrder(cue, cues); err != nil {
+			return nil, &captionError{cue: n, line: block.line + 1, msg: err.Error()}
+		}
+		cue.text = block.lines[2:]
+		cues = append(cues, cue)
+	}
+	if len(cues) == 0 {
+		return nil, errors.New("caption file has no cues")
+	}
+	return cues, nil
+}
+
+// parseCueTiming parses a "start --> end" line, ignoring any WebVTT cue
+// settings after the end time.
+func parseCueTiming(line string, pattern *regexp.Regexp) (captionCue, error) {
+	startText, rest, ok := strings.Cut(line, "-->")
+	if !ok {
+		return captionCue{}, fmt.Errorf("expected \"start --> end\", got %q", line)
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return captionCue{}, errors.New("missing end time")
+	}
+
+	start, err := parseCaptionTimestamp(strings.TrimSpace(startText), pattern)
+	if err != nil {
+		return captionCue{}, err
+	}
+	end, err := parseCaptionTimestamp(fields[0], pattern)
+	if err != nil {
+		return captionCue{}, err
+	}
+	if end <= start {
+		return captionCue{}, fmt.Errorf("end time %s isn't after start time %s", fields[0], strings.TrimSpace(startText))
+	}
+	return captionCue{start: start, end: end}, nil
+}
+
+func parseCaptionTimestamp(s string, pattern *regexp.Regexp) (time.Duration, error) {
+	m := pattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	hours, _ := strconv.Atoi(m[1]) // empty when a WebVTT timestamp leaves out the hours
+	minutes, _ := strconv.Atoi(m[2])
+	seconds, _ := strconv.Atoi(m[3])
+	millis, _ := strconv.Atoi(m[4])
+	return time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second +
+		time.Duration(millis)*time.Millisecond, nil
+}
+
+// checkCueOrder rejects a cue that starts before the one before it.
+func checkCueOrder(cue captionCue, previous []captionCue) error {
+	if len(previous) == 0 {
+		return nil
+	}
+	if last := previous[len(previous)-1]; cue.start < last.start {
+		return fmt.Errorf("starts at %s, before the previous cue", vttTimestamp(cue.start.Seconds()))
+	}
+	return nil
+}
+
+func formatWebVTT(cues []captionCue) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "\n%s --> %s\n", vttTimestamp(cue.start.Seconds()), vttTimestamp(cue.end.Seconds()))
+		for _, line := range cue.text {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseCaptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "webvtt kept as is",
+			in:   "WEBVTT\n\nNOTE a comment\n\nintro\n00:01.000 --> 00:02.500 align:start\nHello\n\n00:00:03.000 --> 00:00:04.000\n<b>World</b>\n",
+			want: "WEBVTT\n\nNOTE a comment\n\nintro\n00:01.000 --> 00:02.500 align:start\nHello\n\n00:00:03.000 --> 00:00:04.000\n<b>World</b>\n",
+		},
+		{
+			name: "srt converted",
+			in:   "\xef\xbb\xbf1\r\n00:00:01,000 --> 00:00:02,500\r\nHello\r\nthere\r\n\r\n2\r\n00:00:03,000 --> 00:00:04,000\r\nWorld\r\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\nthere\n\n00:00:03.000 --> 00:00:04.000\nWorld\n",
+		},
+		{
+			name:    "end before start",
+			in:      "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nok\n\n00:00:05.000 --> 00:00:04.000\nbad\n",
+			wantErr: "cue 2 (line 6): end time 00:00:04.000 isn't after start time 00:00:05.000",
+		},
+		{
+			name:    "out of order",
+			in:      "1\n00:00:05,000 --> 00:00:06,000\nlater\n\n2\n00:00:01,000 --> 00:00:02,000\nearlier\n",
+			wantErr: "cue 2 (line 6): starts at 00:00:01.000, before the previous cue",
+		},
+		{
+			name:    "bad timestamp",
+			in:      "WEBVTT\n\n00:00:01 --> 00:00:02.000\nno millis\n",
+			wantErr: `cue 1 (line 3): invalid timestamp "00:00:01"`,
+		},
+		{
+			name:    "srt with vtt timestamps",
+			in:      "1\n00:00:01.000 --> 00:00:02.000\nwrong separator\n",
+			wantErr: `cue 1 (line 2): invalid timestamp "00:00:01.000"`,
+		},
+		{
+			name:    "not captions",
+			in:      "just some text\n",
+			wantErr: "line 1: not a WebVTT or SRT file",
+		},
+		{
+			name:    "no cues",
+			in:      "WEBVTT\n",
+			wantErr: "caption file has no cues",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCaptions([]byte(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func captionForm(lang, body string) func(mw *multipart.Writer) {
+	return func(mw *multipart.Writer) {
+		part, _ := mw.CreateFormFile("captions", "subs.srt")
+		part.Write([]byte(body))
+		mw.WriteField("language", lang)
+	}
+}
+
+func TestUploadCaptions(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("captions@example.com")
+	path := fmt.Sprintf("/api/videos/%s/captions", video.ID)
+	srt := "1\n00:00:01,000 --> 00:00:02,000\nHello\n"
+
+	resp := h.sendForm(path, token, captionForm("en", srt))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp = h.sendForm(path, token, captionForm("pt-br", srt))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	stored := h.getVideo(video.ID)
+	if len(stored.Captions) != 2 || stored.Captions[0].Language != "en" || stored.Captions[1].Language != "pt-BR" {
+		t.Fatalf("expected en and pt-BR tracks, got %+v", stored.Captions)
+	}
+	englishKey := stored.Captions[0].Key
+
+	// The track is stored in the bucket as WebVTT
+	if !strings.HasPrefix(englishKey, captionKeyPrefix) || stored.Captions[0].URL != h.cfg.s3CfDistribution+"/"+englishKey {
+		t.Fatalf("unexpected track location %+v", stored.Captions[0])
+	}
+	if ct := h.s3.ctypes[englishKey]; ct != "text/vtt" {
+		t.Errorf("expected text/vtt, got %q", ct)
+	}
+	if body := h.s3.objects[englishKey]; !strings.HasPrefix(string(body), "WEBVTT") {
+		t.Errorf("expected the SRT to be converted, got %q", body)
+	}
+
+	// Uploading English again replaces the track and its file
+	resp = h.sendForm(path, token, captionForm("en", srt))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if _, ok := h.s3.objects[englishKey]; ok {
+		t.Error("expected the replaced caption file to be deleted")
+	}
+	if stored = h.getVideo(video.ID); len(stored.Captions) != 2 {
+		t.Fatalf("expected two tracks after replacing one, got %+v", stored.Captions)
+	}
+
+	resp = h.do(http.MethodDelete, path+"/pt-BR", token, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if stored = h.getVideo(video.ID); len(stored.Captions) != 1 || stored.Captions[0].Language != "en" {
+		t.Fatalf("expected only the English track, got %+v", stored.Captions)
+	}
+}
+
+func TestUploadCaptionsRejectsBadInput(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("captions@example.com")
+	path := fmt.Sprintf("/api/videos/%s/captions", video.ID)
+
+	resp := h.sendForm(path, token, captionForm("en", "1\n00:00:02,000 --> 00:00:01,000\nbackwards\n"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	decodeJSON(t, resp, &body)
+	if body.Code != errCodeInvalidCaptions || !strings.Contains(body.Error, "cue 1 (line 2)") {
+		t.Errorf("expected the bad cue to be reported, got %+v", body)
+	}
+
+	resp = h.sendForm(path, token, captionForm("not a language", "WEBVTT\n\n00:01.000 --> 00:02.000\nhi\n"))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a bad language, got %d", resp.StatusCode)
+	}
+	if stored := h.getVideo(video.ID); len(stored.Captions) != 0 {
+		t.Errorf("expected no tracks, got %+v", stored.Captions)
+	}
+}
+
+func TestCaptionsInHLSPlaylist(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.hlsCaptions = true
+	token, video := h.createUserAndVideo("hls-captions@example.com")
+	path := fmt.Sprintf("/api/videos/%s/captions", video.ID)
+
+	const master = "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=3124000,RESOLUTION=1280x720\n720p.m3u8\n"
+	masterKey := "landscape/abc/hls/master.m3u8"
+	h.s3.objects[masterKey] = []byte(master)
+	hlsURL := h.cfg.s3CfDistribution + "/" + masterKey
+	duration := 12.5
+	video.HLSURL = &hlsURL
+	video.Duration = &duration
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	vtt := "WEBVTT\n\n00:01.000 --> 00:02.000\nhi\n"
+	for _, lang := range []string{"en", "pt-BR"} {
+		if resp := h.sendForm(path, token, captionForm(lang, vtt)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("uploading %s: got status %d", lang, resp.StatusCode)
+		}
+	}
+	got := string(h.s3.objects[masterKey])
+	for _, want := range []string{
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="en",LANGUAGE="en",AUTOSELECT=YES,URI="subtitles_en.m3u8"`,
+		`LANGUAGE="pt-BR"`,
+		`RESOLUTION=1280x720,SUBTITLES="subs"` + "\n720p.m3u8\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("master playlist missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Count(got, `SUBTITLES="subs"`) != 1 {
+		t.Errorf("expected the stream to reference the subtitles once:\n%s", got)
+	}
+	playlist := string(h.s3.objects["landscape/abc/hls/subtitles_en.m3u8"])
+	if !strings.Contains(playlist, "#EXTINF:12.500,\nsubtitles_en.vtt\n") {
+		t.Errorf("unexpected subtitle playlist:\n%s", playlist)
+	}
+	if string(h.s3.objects["landscape/abc/hls/subtitles_en.vtt"]) != vtt {
+		t.Error("expected the track to be copied next to the renditions")
+	}
+
+	// Removing every track takes the subtitles back out
+	for _, lang := range []string{"en", "pt-BR"} {
+		if resp := h.do(http.MethodDelete, path+"/"+lang, token, nil); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("deleting %s: got status %d", lang, resp.StatusCode)
+		}
+	}
+	if got := string(h.s3.objects[masterKey]); got != master {
+		t.Errorf("expected the original master playlist back, got:\n%s", got)
+	}
+	for _, key := range h.s3.keys() {
+		if strings.Contains(key, "subtitles_") {
+			t.Errorf("expected %s to be deleted", key)
+		}
+	}
+}
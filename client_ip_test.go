@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{
+			name:       "direct connection",
+			remoteAddr: "203.0.113.7:5000",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "spoofed forwarded header from untrusted peer",
+			remoteAddr: "203.0.113.7:5000",
+			forwarded:  []string{"1.2.3.4"},
+			realIP:     "5.6.7.8",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "behind trusted proxy",
+			remoteAddr: "10.1.2.3:5000",
+			forwarded:  []string{"198.51.100.20"},
+			want:       "198.51.100.20",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.1.2.3:5000",
+			forwarded:  []string{"198.51.100.20, 192.168.1.1, 10.9.9.9"},
+			want:       "198.51.100.20",
+		},
+		{
+			name:       "client-supplied entry left of the real client is ignored",
+			remoteAddr: "10.1.2.3:5000",
+			forwarded:  []string{"1.2.3.4, 198.51.100.20"},
+			want:       "198.51.100.20",
+		},
+		{
+			name:       "multiple forwarded headers",
+			remoteAddr: "10.1.2.3:5000",
+			forwarded:  []string{"1.2.3.4", "198.51.100.20"},
+			want:       "198.51.100.20",
+		},
+		{
+			name:       "garbled entry stops the walk",
+			remoteAddr: "10.1.2.3:5000",
+			forwarded:  []string{"1.2.3.4, not-an-ip, 10.0.0.2"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "X-Real-IP from trusted proxy",
+			remoteAddr: "192.168.1.1:5000",
+			realIP:     "198.51.100.20",
+			want:       "198.51.100.20",
+		},
+		{
+			name:       "trusted proxy without headers",
+			remoteAddr: "10.1.2.3:5000",
+			want:       "10.1.2.3",
+		},
+		{
+			name:       "IPv6 peer",
+			remoteAddr: "[2001:db8::1]:5000",
+			forwarded:  []string{"198.51.100.20"},
+			want:       "2001:db8::1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, f := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCIDRsRejectsInvalid(t *testing.T) {
+	for _, value := range []string{"nope", "10.0.0.0/33"} {
+		if _, err := parseCIDRs([]string{value}); err == nil {
+			t.Errorf("parseCIDRs(%q) succeeded, want error", value)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const clipTitleSuffix = " (clip)"
+
+// keyframeTolerance is how close to a keyframe, in seconds, a clip has to
+// start for the cut to be stream-copied.
+const keyframeTolerance = 0.01
+
+// clipTime is a time in a video, in seconds. In JSON it's a number of
+// seconds or a string like "75.5", "1:15.5" or "0:01:15.5".
+type clipTime float64
+
+func (t *clipTime) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*t = clipTime(seconds)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("time must be a number of seconds or a timestamp")
+	}
+	seconds, err := parseClipTime(s)
+	if err != nil {
+		return err
+	}
+	*t = clipTime(seconds)
+	return nil
+}
+
+// parseClipTime reads seconds, MM:SS or HH:MM:SS, each with optional
+// fractional seconds.
+func parseClipTime(s string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var seconds float64
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || value < 0 || math.IsInf(value, 0) {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		last := i == len(parts)-1
+		if (i > 0 && value >= 60) || (!last && value != math.Trunc(value)) {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		seconds = seconds*60 + value
+	}
+	return seconds, nil
+}
+
+// clipTitle names a clip after the video it was cut from, shortening the
+// source's title if the suffix would make it too long.
+func clipTitle(title string, maxLength int) string {
+	return suffixedTitle(title, clipTitleSuffix, maxLength)
+}
+
+// startsOnKeyframe reports whether the first video stream has a keyframe
+// at the given second, so a cut from there can copy the stream as is.
+func startsOnKeyframe(ctx context.Context, inputPath string, at float64) (bool, error) {
+	if at == 0 {
+		return true, nil
+	}
+	interval := fmt.Sprintf("%s%%+2", strconv.FormatFloat(max(at-1, 0), 'f', 3, 64))
+	output, err := runMediaTool(ctx, "ffprobe", "-v", "error",
+		"-select_streams", "v:0",
+		"-read_intervals", interval,
+		"-show_entries", "packet=pts_time,flags",
+		"-of", "csv=p=0",
+		inputPath)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		pts, flags, ok := strings.Cut(strings.TrimSpace(line), ",")
+		if !ok || !strings.Contains(flags, "K") {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(pts, 64)
+		if err == nil && math.Abs(seconds-at) <= keyframeTolerance {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// clipArgs are the ffmpeg arguments that cut start to end seconds out of
+// input into an MP4. Copying keeps the streams as they are, which is only
+// exact when start is on a keyframe; otherwise the clip is re-encoded.
+func clipArgs(input, output string, start, end float64, streamCopy bool) []string {
+	args := []string{
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+		"-i", input,
+		"-t", strconv.FormatFloat(end-start, 'f', 3, 64),
+		"-map", "0:v:0", "-map", "0:a:0?",
+	}
+	if streamCopy {
+		args = append(args, "-c", "copy", "-avoid_negative_ts", "make_zero")
+	} else {
+		args = append(args,
+			"-c:v", "libx264", "-crf", "20", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+			"-c:a", "aac", "-b:a", "128k")
+	}
+	return append(args, "-f", "mp4", "-y", output)
+}
+
+// cutClip writes start to end seconds of a video to a new MP4 and returns
+// its path. The streams are copied when the cut starts on a keyframe and
+// re-encoded otherwise, or if copying them into MP4 fails.
+func cutClip(ctx context.Context, inputPath string, start, end float64) (string, error) {
+	outputPath := inputPath + ".clip.mp4"
+	onKeyframe, err := startsOnKeyframe(ctx, inputPath, start)
+	if err != nil {
+		return "", err
+	}
+	if onKeyframe {
+		_, err := runMediaTool(ctx, "ffmpeg", clipArgs(inputPath, outputPath, start, end, true)...)
+		if err == nil {
+			return outputPath, nil
+		}
+		slog.Warn("couldn't copy clip streams, re-encoding", "err", err)
+	}
+	_, err = runMediaTool(ctx, "ffmpeg", clipArgs(inputPath, outputPath, start, end, false)...)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// fileSHA256 returns the hex SHA-256 digest of a file's contents.
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
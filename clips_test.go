@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseClipTime(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "75.5", want: 75.5},
+		{in: "1:15.5", want: 75.5},
+		{in: "0:01:15.5", want: 75.5},
+		{in: "1:00:00", want: 3600},
+		{in: "1:60", wantErr: true},
+		{in: "1.5:10", wantErr: true},
+		{in: "-3", wantErr: true},
+		{in: "1:2:3:4", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseClipTime(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseClipTime(%q): expected an error, got %v", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseClipTime(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestClipTimeJSON(t *testing.T) {
+	var params struct {
+		Start clipTime `json:"start"`
+		End   clipTime `json:"end"`
+	}
+	if err := json.Unmarshal([]byte(`{"start": 2.5, "end": "0:10"}`), &params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Start != 2.5 || params.End != 10 {
+		t.Errorf("unexpected times %+v", params)
+	}
+	if err := json.Unmarshal([]byte(`{"start": true}`), &params); err == nil {
+		t.Error("expected an error for a boolean time")
+	}
+}
+
+func TestClipArgs(t *testing.T) {
+	copied := clipArgs("in.mp4", "out.mp4", 1.5, 4, true)
+	if !slices.Contains(copied, "copy") || slices.Contains(copied, "libx264") {
+		t.Errorf("expected a stream copy, got %v", copied)
+	}
+	want := "-ss 1.500 -i in.mp4 -t 2.500"
+	if got := strings.Join(copied, " "); !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want prefix %q", got, want)
+	}
+
+	encoded := clipArgs("in.mp4", "out.mp4", 1.5, 4, false)
+	if slices.Contains(encoded, "copy") || !slices.Contains(encoded, "libx264") {
+		t.Errorf("expected a re-encode, got %v", encoded)
+	}
+	if encoded[len(encoded)-1] != "out.mp4" {
+		t.Errorf("expected the output last, got %v", encoded)
+	}
+}
+
+func TestClipTitle(t *testing.T) {
+	if got := clipTitle("Trip", 200); got != "Trip (clip)" {
+		t.Errorf("got %q", got)
+	}
+	if got := clipTitle("abcdefghij", 12); got != "abcde (clip)" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCreateClipValidatesTimes(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("clips@example.com")
+
+	for _, body := range []string{
+		`{"start": 5}`,
+		`{"start": 5, "end": 5}`,
+		`{"start": "1:75", "end": 90}`,
+	} {
+		resp := h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/clips", video.ID), token, strings.NewReader(body))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, resp.StatusCode)
+		}
+		if code := errorCode(t, resp); code != errCodeInvalidParams {
+			t.Errorf("%s: unexpected code %q", body, code)
+		}
+	}
+}
+
+func TestCreateClipRequiresUploadedVideo(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("clips@example.com")
+
+	resp := h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/clips", video.ID), token, strings.NewReader(`{"start": 0, "end": 1}`))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", resp.StatusCode)
+	}
+	if code := errorCode(t, resp); code != errCodeVideoNotReady {
+		t.Errorf("unexpected code %q", code)
+	}
+}
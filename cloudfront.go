@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// cloudFrontSigner signs URLs and cookies for a CloudFront distribution
+// whose behaviors require signed requests, so the bucket behind it can
+// stay private. keyPairID names the public key registered with the
+// distribution's key group.
+type cloudFrontSigner struct {
+	keyPairID string
+	key       *rsa.PrivateKey
+}
+
+// parseCloudFrontKey reads an RSA private key in PKCS #1 or PKCS #8 PEM
+// form, as CloudFront key pairs are generated.
+func parseCloudFrontKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key isn't an RSA key")
+	}
+	return key, nil
+}
+
+// cloudFrontPolicy is the policy statement CloudFront checks a signature
+// against. Its JSON has to be exactly what was signed, so it's built from
+// structs rather than a map to keep the field order fixed, and without
+// HTML escaping, which would mangle any & in the resource.
+type cloudFrontPolicy struct {
+	Statement []cloudFrontStatement `json:"Statement"`
+}
+
+type cloudFrontStatement struct {
+	Resource  string `json:"Resource"`
+	Condition struct {
+		DateLessThan struct {
+			EpochTime int64 `json:"AWS:EpochTime"`
+		} `json:"DateLessThan"`
+	} `json:"Condition"`
+}
+
+func newCloudFrontPolicy(resource string, expires time.Time) ([]byte, error) {
+	statement := cloudFrontStatement{Resource: resource}
+	statement.Condition.DateLessThan.EpochTime = expires.Unix()
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(cloudFrontPolicy{Statement: []cloudFrontStatement{statement}})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (s *cloudFrontSigner) sign(policy []byte) (string, error) {
+	hash := sha1.Sum(policy)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return cloudFrontBase64(signature), nil
+}
+
+// SignURL signs rawURL with a canned policy, which only needs the expiry
+// added to the URL alongside the signature.
+func (s *cloudFrontSigner) SignURL(rawURL string, expires time.Time) (string, error) {
+	policy, err := newCloudFrontPolicy(rawURL, expires)
+	if err != nil {
+		return "", err
+	}
+	signature, err := s.sign(policy)
+	if err != nil {
+		return "", err
+	}
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return rawURL + separator + "Expires=" + strconv.FormatInt(expires.Unix(), 10) +
+		"&Signature=" + signature + "&Key-Pair-Id=" + s.keyPairID, nil
+}
+
+// SignedCookies returns the cookies granting access to every URL matching
+// resource, which may end in a * wildcard, until expires. Custom policies
+// are the only kind that can hold a wildcard, so the policy travels in a
+// cookie too.
+func (s *cloudFrontSigner) SignedCookies(resource string, expires time.Time) (map[string]string, error) {
+	policy, err := newCloudFrontPolicy(resource, expires)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := s.sign(policy)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"CloudFront-Policy":      cloudFrontBase64(policy),
+		"CloudFront-Signature":   signature,
+		"CloudFront-Key-Pair-Id": s.keyPairID,
+	}, nil
+}
+
+// cloudFrontBase64 is base64 with the characters that are invalid in URL
+// query strings and cookies swapped for ones CloudFront expects.
+func cloudFrontBase64(data []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(data))
+}
+
+// handlerPlaybackCookies sets CloudFront signed cookies for everything
+// stored under a video's key: the video itself and its HLS renditions,
+// whose segments can't each be given a signed URL. The CDN only receives
+// them if it's on a domain the cookies are scoped to.
+func (cfg *apiConfig) handlerPlaybackCookies(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Resource  string    `json:"resource"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	if cfg.cloudFront == nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Signed cookies aren't enabled", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.DeletedAt != nil || !cfg.canViewVideo(r, video) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Couldn't get video", nil)
+		return
+	}
+	key, ok := cfg.videoKey(video)
+	if !ok {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoNotReady, "Video hasn't been uploaded yet", nil)
+		return
+	}
+
+	// The video and its HLS directory share the key without its extension
+	resource := cfg.s3CfDistribution + "/" + strings.TrimSuffix(hlsPrefix(key), "/hls/") + "*"
+	expires := time.Now().Add(cfg.videoURLExpiry)
+	cookies, err := cfg.cloudFront.SignedCookies(resource, expires)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign cookies", err)
+		return
+	}
+	for name, value := range cookies {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Domain:   cfg.cloudFrontCookieDomain,
+			Path:     "/",
+			Expires:  expires,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteNoneMode,
+		})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, response{Resource: resource, ExpiresAt: expires.UTC()})
+}
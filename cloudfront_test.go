@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCloudFrontSigner(t *testing.T) *cloudFrontSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys come from disk as PEM, so go through the parser too
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseCloudFrontKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cloudFrontSigner{keyPairID: "KTEST", key: parsed}
+}
+
+// verifyCloudFrontSignature checks signature the way CloudFront does.
+func verifyCloudFrontSignature(t *testing.T, signer *cloudFrontSigner, policy, signature string) {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha1.Sum([]byte(policy))
+	if err := rsa.VerifyPKCS1v15(&signer.key.PublicKey, crypto.SHA1, hash[:], raw); err != nil {
+		t.Errorf("signature doesn't verify against %s: %v", policy, err)
+	}
+}
+
+func TestCloudFrontSignURL(t *testing.T) {
+	signer := newTestCloudFrontSigner(t)
+	expires := time.Unix(1700000000, 0)
+
+	signed, err := signer.SignURL("https://cdn.example.com/landscape/a.mp4?v=1&x=2", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("Expires") != "1700000000" || query.Get("Key-Pair-Id") != "KTEST" || query.Get("v") != "1" {
+		t.Errorf("unexpected query %v", query)
+	}
+	policy := `{"Statement":[{"Resource":"https://cdn.example.com/landscape/a.mp4?v=1&x=2","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`
+	verifyCloudFrontSignature(t, signer, policy, query.Get("Signature"))
+
+	if _, err := parseCloudFrontKey([]byte("not a key")); err == nil {
+		t.Error("expected an error for data that isn't PEM")
+	}
+}
+
+func TestPlaybackCookies(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("cookies@example.com")
+	cookiesPath := fmt.Sprintf("/api/videos/%s/playback_cookies", video.ID)
+
+	if resp := h.do(http.MethodPost, cookiesPath, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("without CloudFront: expected 404, got %d", resp.StatusCode)
+	}
+
+	h.cfg.cloudFront = newTestCloudFrontSigner(t)
+	h.cfg.videoDelivery = videoDeliveryCloudFront
+	if resp := h.do(http.MethodPost, cookiesPath, "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("before upload: expected 409, got %d", resp.StatusCode)
+	}
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: expected 200, got %d", resp.StatusCode)
+	}
+	var uploaded videoResponse
+	decodeJSON(t, resp, &uploaded)
+	stored := h.getVideo(video.ID)
+	if uploaded.VideoURL == nil || !strings.HasPrefix(*uploaded.VideoURL, h.cfg.s3CfDistribution+"/"+*stored.VideoKey+"?Expires=") {
+		t.Errorf("expected a signed distribution URL, got %v", uploaded.VideoURL)
+	}
+
+	resp = h.do(http.MethodPost, cookiesPath, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	cookies := map[string]string{}
+	for _, c := range resp.Cookies() {
+		cookies[c.Name] = c.Value
+	}
+	if cookies["CloudFront-Key-Pair-Id"] != "KTEST" {
+		t.Errorf("unexpected cookies %v", cookies)
+	}
+	policy, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(cookies["CloudFront-Policy"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resource := h.cfg.s3CfDistribution + "/" + strings.TrimSuffix(*stored.VideoKey, ".mp4") + "*"
+	if !strings.Contains(string(policy), `"Resource":"`+resource+`"`) {
+		t.Errorf("policy %s doesn't cover %s", policy, resource)
+	}
+	verifyCloudFrontSignature(t, h.cfg.cloudFront, string(policy), cookies["CloudFront-Signature"])
+}
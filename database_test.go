@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestDatabaseConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tubely.db")
+	db, err := database.NewClient(path, database.DefaultOptions())
+	if err != nil {
+		t.Fatalf("couldn't create database: %v", err)
+	}
+	user, err := db.CreateUser(database.CreateUserParams{Email: "writer@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("couldn't create user: %v", err)
+	}
+
+	const writers, updates = 16, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			video, err := db.CreateVideo(database.CreateVideoParams{Title: fmt.Sprint("video ", i), UserID: user.ID})
+			if err != nil {
+				errs <- fmt.Errorf("create: %w", err)
+				return
+			}
+			for j := range updates {
+				video.Title = fmt.Sprintf("video %d rev %d", i, j)
+				if err := db.UpdateVideo(video); err != nil {
+					errs <- fmt.Errorf("update: %w", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	videos, err := db.GetVideos(user.ID)
+	if err != nil {
+		t.Fatalf("couldn't list videos: %v", err)
+	}
+	if len(videos) != writers {
+		t.Errorf("expected %d videos, got %d", writers, len(videos))
+	}
+	if _, err := os.Stat(path + "-wal"); err != nil {
+		t.Errorf("expected the database to be in WAL mode: %v", err)
+	}
+}
+
+func TestDatabaseForeignKeys(t *testing.T) {
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"), database.DefaultOptions())
+	if err != nil {
+		t.Fatalf("couldn't create database: %v", err)
+	}
+
+	_, err = db.CreateVideo(database.CreateVideoParams{Title: "orphan", UserID: uuid.New()})
+	if err == nil {
+		t.Fatal("expected a video for a missing user to be rejected")
+	}
+	if errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected a constraint error, got %v", err)
+	}
+}
+
+func TestDatabaseMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tubely.db")
+
+	// A database from before migrations, with only the original columns
+	legacy, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := uuid.New()
+	for _, stmt := range []string{
+		`CREATE TABLE users (id TEXT PRIMARY KEY, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, password TEXT NOT NULL, email TEXT UNIQUE NOT NULL)`,
+		`CREATE TABLE videos (id TEXT PRIMARY KEY, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, title TEXT NOT NULL, description TEXT, thumbnail_url TEXT, video_url TEXT, user_id TEXT)`,
+		`INSERT INTO users (id, password, email) VALUES ('` + userID.String() + `', 'hash', 'legacy@example.com')`,
+		`INSERT INTO videos (id, title, description, video_url, user_id) VALUES ('` + uuid.NewString() + `', 'old', '', 'https://cdn.example.com/portrait/abc.mp4', '` + userID.String() + `')`,
+	} {
+		if _, err := legacy.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy.Close()
+
+	for i := range 2 {
+		db, err := database.NewClient(path, database.DefaultOptions())
+		if err != nil {
+			t.Fatalf("couldn't migrate: %v", err)
+		}
+		videos, err := db.GetVideos(userID)
+		if err != nil || len(videos) != 1 {
+			t.Fatalf("videos after migrating: %d, %v", len(videos), err)
+		}
+		if video := videos[0]; video.Orientation == nil || *video.Orientation != "portrait" || video.Visibility != database.VisibilityUnlisted {
+			t.Errorf("migrated video = %+v", video)
+		}
+		if _, err := db.CreateAPIKey(database.CreateAPIKeyParams{UserID: userID, Name: "k", Prefix: "p", KeyHash: fmt.Sprint("hash ", i)}); err != nil {
+			t.Errorf("tables added by the migration: %v", err)
+		}
+	}
+
+	migrated, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.Close()
+	var applied int
+	if err := migrated.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = 1").Scan(&applied); err != nil || applied != 1 {
+		t.Errorf("first migration recorded %d times, %v", applied, err)
+	}
+}
+
+func TestDatabaseQueries(t *testing.T) {
+	testDatabaseQueries(t, filepath.Join(t.TempDir(), "tubely.db"))
+}
+
+// TestPostgresQueries runs the same queries against a real Postgres server.
+// Point TUBELY_TEST_POSTGRES_DSN at a scratch database to run it; its
+// tables are emptied.
+func TestPostgresQueries(t *testing.T) {
+	dsn := os.Getenv("TUBELY_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TUBELY_TEST_POSTGRES_DSN isn't set")
+	}
+	testDatabaseQueries(t, dsn)
+}
+
+// testDatabaseQueries covers the queries written differently for each
+// database.
+func testDatabaseQueries(t *testing.T, dsn string) {
+	db, err := database.NewClient(dsn, database.DefaultOptions())
+	if err != nil {
+		t.Fatalf("couldn't connect: %v", err)
+	}
+	// Migrating an existing schema again is a no-op
+	if db, err = database.NewClient(dsn, database.DefaultOptions()); err != nil {
+		t.Fatalf("couldn't reconnect: %v", err)
+	}
+	if err := db.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.CreateUser(database.CreateUserParams{Email: "pg@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uuid.UUID
+	for _, title := range []string{"one", "two", "three"} {
+		video, err := db.CreateVideo(database.CreateVideoParams{Title: title, UserID: user.ID, Visibility: database.VisibilityPublic})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, video.ID)
+	}
+	video, err := db.GetVideo(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	orientation, size, duration := "landscape", int64(1000), 12.5
+	video.Orientation, video.VideoSize, video.Duration = &orientation, &size, &duration
+	if err := db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := db.ListVideos(database.ListVideosParams{UserID: user.ID, SortBy: "title", Limit: 2})
+	if err != nil || len(page) != 2 {
+		t.Fatalf("first page: %d videos, %v", len(page), err)
+	}
+	rest, err := db.ListVideos(database.ListVideosParams{UserID: user.ID, SortBy: "title", Limit: 2, After: page[1].ID})
+	if err != nil || len(rest) != 1 || rest[0].Title != "two" {
+		t.Fatalf("second page: %+v, %v", rest, err)
+	}
+
+	summary, err := db.GetLibrarySummary(user.ID)
+	if err != nil || summary.TotalVideos != 3 || summary.TotalBytes != 1000 || summary.ByOrientation["landscape"] != 1 || summary.MissingThumbnails != 3 {
+		t.Fatalf("summary = %+v, %v", summary, err)
+	}
+	if modified, err := db.GetVideosLastModified(user.ID); err != nil || modified.IsZero() {
+		t.Fatalf("last modified = %v, %v", modified, err)
+	}
+
+	if err := db.SoftDeleteVideo(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if trashed, err := db.GetVideosDeletedBefore(time.Now().Add(time.Minute)); err != nil || len(trashed) != 1 {
+		t.Fatalf("deleted before: %d videos, %v", len(trashed), err)
+	}
+
+	if _, claimed, err := db.ClaimIdempotencyKey(user.ID, "k", "req", time.Now().Add(-time.Hour)); err != nil || !claimed {
+		t.Fatalf("first claim: %v, %v", claimed, err)
+	}
+	if _, claimed, err := db.ClaimIdempotencyKey(user.ID, "k", "req", time.Now().Add(-time.Hour)); err != nil || claimed {
+		t.Fatalf("second claim: %v, %v", claimed, err)
+	}
+
+	job, err := db.CreateVideoJob(database.VideoJob{VideoID: ids[0], UserID: user.ID, SourcePath: "/tmp/x", MediaType: "video/mp4", SourceSHA256: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ClaimVideoJob(ids[0]); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("claiming a skipped video's job: %v", err)
+	}
+	if claimed, err := db.ClaimVideoJob(); err != nil || claimed.ID != job.ID || claimed.Status != database.JobRunning {
+		t.Fatalf("claimed %+v, %v", claimed, err)
+	}
+	if _, err := db.ClaimVideoJob(); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("claiming again: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// dbRetryAfter is the Retry-After, in seconds, sent when the database is
+// briefly unavailable.
+const dbRetryAfter = 2
+
+// respondWithDBError reports a failed database call. Transient failures
+// like a locked SQLite file are a 503 the client can retry; anything else
+// is a 500 with msg.
+func respondWithDBError(w http.ResponseWriter, msg string, err error) {
+	if database.IsUnavailable(err) {
+		w.Header().Set("Retry-After", strconv.Itoa(dbRetryAfter))
+		respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeUnavailable, "Database is temporarily unavailable, try again shortly", err)
+		return
+	}
+	respondWithErrorCode(w, http.StatusInternalServerError, errCodeDatabase, msg, err)
+}
+
+// respondWithVideoLookupError reports a failed GetVideo, only claiming the
+// video doesn't exist when the database actually said so.
+func respondWithVideoLookupError(w http.ResponseWriter, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	respondWithDBError(w, "Couldn't get video", err)
+}
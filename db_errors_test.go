@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestRespondWithVideoLookupError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"not found", database.ErrNotFound, http.StatusNotFound, errCodeVideoNotFound},
+		{"locked", fmt.Errorf("get video: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), http.StatusServiceUnavailable, errCodeUnavailable},
+		{"other", sqlite3.Error{Code: sqlite3.ErrCorrupt}, http.StatusInternalServerError, errCodeDatabase},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			respondWithVideoLookupError(rec, tt.err)
+			resp := rec.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if code := errorCode(t, resp); code != tt.wantCode {
+				t.Errorf("expected %s, got %s", tt.wantCode, code)
+			}
+			if retry := resp.Header.Get("Retry-After"); (retry != "") != (tt.wantStatus == http.StatusServiceUnavailable) {
+				t.Errorf("unexpected Retry-After %q", retry)
+			}
+		})
+	}
+}
+
+func TestGetMissingVideo(t *testing.T) {
+	h := newTestHarness(t)
+
+	resp := h.do(http.MethodGet, "/api/videos/"+uuid.NewString(), "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Ways VIDEO_DELIVERY hands stored objects to clients. Public links to them
+// through the distribution and needs objects anyone can read; signed
+// presigns a GET for each response so the bucket can stay private, and
+// cloudfront signs distribution URLs so it can stay private behind the CDN.
+const (
+	videoDeliveryPublic     = "public"
+	videoDeliverySigned     = "signed"
+	videoDeliveryCloudFront = "cloudfront"
+)
+
+// parseVideoDelivery validates VIDEO_DELIVERY, defaulting to public.
+func parseVideoDelivery(value string) (string, error) {
+	switch value {
+	case "":
+		return videoDeliveryPublic, nil
+	case videoDeliveryPublic, videoDeliverySigned, videoDeliveryCloudFront:
+		return value, nil
+	default:
+		return "", fmt.Errorf("must be %s, %s or %s", videoDeliveryPublic, videoDeliverySigned, videoDeliveryCloudFront)
+	}
+}
+
+// signsURLs reports whether links to a video's files are signed. Private
+// videos always are, so their owner is only ever handed URLs that expire.
+func (cfg *apiConfig) signsURLs(video database.Video) bool {
+	return cfg.videoDelivery != videoDeliveryPublic || video.Visibility == database.VisibilityPrivate
+}
+
+// videoKey is the object key of an uploaded video's file. Rows from before
+// keys were stored have it recovered from the video URL.
+func (cfg *apiConfig) videoKey(video database.Video) (string, bool) {
+	if video.VideoURL == nil {
+		return "", false
+	}
+	if video.VideoKey != nil && *video.VideoKey != "" {
+		return *video.VideoKey, true
+	}
+	return cfg.videoKeyFromURL(*video.VideoURL)
+}
+
+// playableVideoURL is a URL a browser can load the video from, whatever
+// format the row stored it in. The distribution only fronts the default
+// bucket, so publicly delivered videos kept elsewhere go through the
+// download endpoint.
+func (cfg *apiConfig) playableVideoURL(ctx context.Context, video database.Video) *string {
+	key, ok := cfg.videoKey(video)
+	if !ok {
+		return nil
+	}
+	if cfg.signsURLs(video) {
+		return cfg.signedURL(video, key)
+	}
+	url := cfg.s3CfDistribution + "/" + key
+	if video.VideoBucket != nil && *video.VideoBucket != cfg.s3Bucket {
+		url = cfg.publicURL(ctx, "/api/videos/"+video.ID.String()+"/download")
+	}
+	return &url
+}
+
+// deliveryURL is how clients get a file derived from the video, such as
+// its preview clip, which is stored next to it.
+func (cfg *apiConfig) deliveryURL(video database.Video, storedURL *string) *string {
+	if storedURL == nil || !cfg.signsURLs(video) {
+		return storedURL
+	}
+	key, ok := cfg.videoKeyFromURL(*storedURL)
+	if !ok {
+		return storedURL
+	}
+	return cfg.signedURL(video, key)
+}
+
+// signedURL signs a GET of key: through CloudFront when it's configured and
+// fronts the video's bucket, otherwise presigned by the video's store.
+// Signing only fails on misconfiguration, and an unsigned URL wouldn't load
+// from a private bucket anyway, so the URL is left out.
+func (cfg *apiConfig) signedURL(video database.Video, key string) *string {
+	var url string
+	var err error
+	if cfg.cloudFront != nil && (video.VideoBucket == nil || *video.VideoBucket == cfg.s3Bucket) {
+		url, err = cfg.cloudFront.SignURL(cfg.s3CfDistribution+"/"+key, time.Now().Add(cfg.videoURLExpiry))
+	} else {
+		url, err = cfg.videoStore(video).SignedURL(context.Background(), key, cfg.videoURLExpiry)
+	}
+	if err != nil {
+		slog.Error("couldn't sign object URL", "video_id", video.ID, "key", key, "err", err)
+		return nil
+	}
+	return &url
+}
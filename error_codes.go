@@ -0,0 +1,74 @@
+package main
+
+import "net/http"
+
+// Error codes are returned alongside the human-readable message in error
+// responses so clients can branch on them and localize their own messages.
+// They're part of the API: add new ones freely, but don't rename them.
+const (
+	errCodeBadRequest          = "BAD_REQUEST"
+	errCodeUnauthorized        = "UNAUTHORIZED"
+	errCodeForbidden           = "FORBIDDEN"
+	errCodeNotFound            = "NOT_FOUND"
+	errCodeConflict            = "CONFLICT"
+	errCodeTooLarge            = "FILE_TOO_LARGE"
+	errCodeInternal            = "INTERNAL_ERROR"
+	errCodeUnavailable         = "SERVICE_UNAVAILABLE"
+	errCodeInvalidID           = "INVALID_ID"
+	errCodeMissingToken        = "MISSING_TOKEN"
+	errCodeInvalidToken        = "INVALID_TOKEN"
+	errCodeTokenExpired        = "TOKEN_EXPIRED"
+	errCodeVideoNotFound       = "VIDEO_NOT_FOUND"
+	errCodeNotVideoOwner       = "NOT_VIDEO_OWNER"
+	errCodeVideoInTrash        = "VIDEO_IN_TRASH"
+	errCodeVideoNotReady       = "VIDEO_NOT_UPLOADED"
+	errCodeUploadInProgress    = "UPLOAD_IN_PROGRESS"
+	errCodeIdempotencyInUse    = "IDEMPOTENCY_KEY_IN_USE"
+	errCodeIdempotencyMismatch = "IDEMPOTENCY_KEY_MISMATCH"
+	errCodeRateLimited         = "RATE_LIMITED"
+	errCodeInvalidForm         = "INVALID_FORM"
+	errCodeInvalidFields       = "INVALID_FORM_FIELDS"
+	errCodeMissingFile         = "MISSING_FILE"
+	errCodeInvalidVideo        = "INVALID_VIDEO_TYPE"
+	errCodeInvalidDimension    = "INVALID_VIDEO_DIMENSIONS"
+	errCodeVideoTooLong        = "VIDEO_TOO_LONG"
+	errCodeInvalidImage        = "INVALID_IMAGE_TYPE"
+	errCodeInvalidCaptions     = "INVALID_CAPTIONS"
+	errCodeInvalidParams       = "INVALID_PARAMETERS"
+	errCodeFetchFailed         = "FETCH_FAILED"
+	errCodeFFmpegFailed        = "FFMPEG_FAILED"
+	errCodeFFmpegMissing       = "FFMPEG_UNAVAILABLE"
+	errCodeFFmpegBusy          = "FFMPEG_BUSY"
+	errCodeFFmpegTimeout       = "FFMPEG_TIMEOUT"
+	errCodeStorageFailed       = "STORAGE_FAILED"
+	errCodeObjectMissing       = "VIDEO_OBJECT_MISSING"
+	errCodeIntegrityFailed     = "INTEGRITY_CHECK_FAILED"
+	errCodeDatabase            = "DATABASE_ERROR"
+)
+
+// defaultErrorCode is the code for errors that don't have a more specific
+// one.
+func defaultErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return errCodeBadRequest
+	case http.StatusUnauthorized:
+		return errCodeUnauthorized
+	case http.StatusForbidden:
+		return errCodeForbidden
+	case http.StatusNotFound:
+		return errCodeNotFound
+	case http.StatusConflict:
+		return errCodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return errCodeTooLarge
+	case http.StatusTooManyRequests:
+		return errCodeRateLimited
+	case http.StatusServiceUnavailable:
+		return errCodeUnavailable
+	}
+	if status >= 500 {
+		return errCodeInternal
+	}
+	return errCodeBadRequest
+}
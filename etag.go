@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// computeETag returns the ETag S3 would assign to the contents of r when
+// uploaded in parts of partSize bytes. A partSize of zero, or content that
+// fits in one part, gives the plain MD5 a single PutObject produces;
+// otherwise it's the MD5 of the concatenated part MD5s suffixed with the
+// part count.
+func computeETag(r io.Reader, partSize int64) (string, error) {
+	h := newETagHasher(partSize)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return h.etag(), nil
+}
+
+// etagHasher works out computeETag's result from content written to it,
+// for content that streams past rather than being read from a file.
+type etagHasher struct {
+	partSize int64
+	part     hash.Hash
+	partLen  int64
+	partSums []byte
+	parts    int
+}
+
+func newETagHasher(partSize int64) *etagHasher {
+	return &etagHasher{partSize: partSize, part: md5.New()}
+}
+
+func (h *etagHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if h.partSize > 0 {
+			chunk = p[:min(int64(len(p)), h.partSize-h.partLen)]
+		}
+		h.part.Write(chunk)
+		h.partLen += int64(len(chunk))
+		p = p[len(chunk):]
+		if h.partSize > 0 && h.partLen == h.partSize {
+			h.endPart()
+		}
+	}
+	return n, nil
+}
+
+// endPart adds the part being hashed to the finished ones.
+func (h *etagHasher) endPart() {
+	h.partSums = h.part.Sum(h.partSums)
+	h.parts++
+	h.part.Reset()
+	h.partLen = 0
+}
+
+func (h *etagHasher) etag() string {
+	partSums, parts := h.partSums, h.parts
+	if h.partLen > 0 || parts == 0 {
+		partSums = h.part.Sum(partSums)
+		parts++
+	}
+	if parts == 1 {
+		return hex.EncodeToString(partSums)
+	}
+	sum := md5.Sum(partSums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts)
+}
+
+// etagsMatch compares two ETags, ignoring the quotes S3 wraps them in.
+func etagsMatch(a, b string) bool {
+	return strings.Trim(a, `"`) == strings.Trim(b, `"`)
+}
+
+// etagListContains reports whether an If-None-Match style header lists the
+// given entity tag. Weak validators are compared by their opaque value, and
+// "*" matches anything.
+func etagListContains(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if candidate != "" && etagsMatch(candidate, etag) {
+			return true
+		}
+	}
+	return false
+}
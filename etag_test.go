@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestComputeETagSinglePart(t *testing.T) {
+	data := []byte("hello tubely")
+	sum := md5.Sum(data)
+	want := hex.EncodeToString(sum[:])
+
+	for _, partSize := range []int64{0, 1024} {
+		got, err := computeETag(bytes.NewReader(data), partSize)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("partSize %d: expected %s, got %s", partSize, want, got)
+		}
+	}
+}
+
+func TestComputeETagMultipart(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefghij"), 25) // 250 bytes
+	const partSize = 100
+
+	var sums []byte
+	for i := 0; i < len(data); i += partSize {
+		end := min(i+partSize, len(data))
+		sum := md5.Sum(data[i:end])
+		sums = append(sums, sum[:]...)
+	}
+	final := md5.Sum(sums)
+	want := fmt.Sprintf("%s-3", hex.EncodeToString(final[:]))
+
+	got, err := computeETag(bytes.NewReader(data), partSize)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestETagsMatchIgnoresQuotes(t *testing.T) {
+	if !etagsMatch(`"abc"`, "abc") {
+		t.Fatal("expected quoted and unquoted ETags to match")
+	}
+	if etagsMatch("abc", "abd") {
+		t.Fatal("expected different ETags not to match")
+	}
+}
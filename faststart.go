@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// isFastStart reports whether an MP4's moov atom comes before its media
+// data, so players can start before the whole file has downloaded. It walks
+// the top-level boxes and returns an error whenever it can't tell, in which
+// case callers should process the file anyway.
+func isFastStart(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	return moovBeforeMdat(f, stat.Size())
+}
+
+func moovBeforeMdat(r io.ReadSeeker, size int64) (bool, error) {
+	var offset int64
+	header := make([]byte, 16)
+	for offset < size {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return false, err
+		}
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return false, err
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		switch boxSize {
+		case 0:
+			// The box runs to the end of the file
+			boxSize = size - offset
+		case 1:
+			// A 64-bit size follows the type
+			if _, err := io.ReadFull(r, header[8:16]); err != nil {
+				return false, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+
+		switch boxType {
+		case "moov":
+			return true, nil
+		case "mdat", "moof":
+			return false, nil
+		}
+
+		if boxSize < 8 {
+			return false, errors.New("invalid MP4 box size")
+		}
+		offset += boxSize
+	}
+	return false, errors.New("no moov or mdat box found")
+}
+
+// moovScanner answers moovBeforeMdat for an MP4 written to it, for uploads
+// that stream past instead of sitting in a seekable file. Box bodies are
+// skipped as they go by, so only the current box header is ever buffered.
+type moovScanner struct {
+	header  []byte
+	skip    int64
+	decided bool
+	fast    bool
+	err     error
+}
+
+func (s *moovScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && !s.decided && s.err == nil {
+		if s.skip > 0 {
+			step := min(s.skip, int64(len(p)))
+			s.skip -= step
+			p = p[step:]
+			continue
+		}
+
+		want := 8
+		if len(s.header) >= 8 && binary.BigEndian.Uint32(s.header[:4]) == 1 {
+			want = 16
+		}
+		take := min(want-len(s.header), len(p))
+		s.header = append(s.header, p[:take]...)
+		p = p[take:]
+		if len(s.header) < want {
+			continue
+		}
+		if want == 8 && binary.BigEndian.Uint32(s.header[:4]) == 1 {
+			// A 64-bit size follows the type
+			continue
+		}
+		s.box()
+	}
+	return n, nil
+}
+
+// box handles a complete box header.
+func (s *moovScanner) box() {
+	boxSize := int64(binary.BigEndian.Uint32(s.header[:4]))
+	switch string(s.header[4:8]) {
+	case "moov":
+		s.decided, s.fast = true, true
+		return
+	case "mdat", "moof":
+		s.decided = true
+		return
+	}
+	switch boxSize {
+	case 0:
+		// The box runs to the end of the file, so nothing comes after it
+		s.err = errors.New("no moov or mdat box found")
+		return
+	case 1:
+		boxSize = int64(binary.BigEndian.Uint64(s.header[8:16]))
+	}
+	if boxSize < int64(len(s.header)) {
+		s.err = errors.New("invalid MP4 box size")
+		return
+	}
+	s.skip = boxSize - int64(len(s.header))
+	s.header = s.header[:0]
+}
+
+// result is moovBeforeMdat's answer for everything written so far.
+func (s *moovScanner) result() (bool, error) {
+	if s.err != nil {
+		return false, s.err
+	}
+	if !s.decided {
+		return false, errors.New("no moov or mdat box found")
+	}
+	return s.fast, nil
+}
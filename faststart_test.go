@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func mp4Box(boxType string, payload int) []byte {
+	b := make([]byte, 8+payload)
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	copy(b[4:], boxType)
+	return b
+}
+
+func TestMoovBeforeMdat(t *testing.T) {
+	largeMdat := make([]byte, 16)
+	binary.BigEndian.PutUint32(largeMdat, 1)
+	copy(largeMdat[4:], "mdat")
+	binary.BigEndian.PutUint64(largeMdat[8:], 16)
+
+	tests := []struct {
+		name    string
+		boxes   [][]byte
+		want    bool
+		wantErr bool
+	}{
+		{"faststart", [][]byte{mp4Box("ftyp", 12), mp4Box("moov", 40), mp4Box("mdat", 100)}, true, false},
+		{"moov at end", [][]byte{mp4Box("ftyp", 12), mp4Box("mdat", 100), mp4Box("moov", 40)}, false, false},
+		{"skips free boxes", [][]byte{mp4Box("ftyp", 12), mp4Box("free", 8), mp4Box("moov", 40)}, true, false},
+		{"64-bit mdat first", [][]byte{mp4Box("ftyp", 12), largeMdat, mp4Box("moov", 40)}, false, false},
+		{"no moov or mdat", [][]byte{mp4Box("ftyp", 12)}, false, true},
+		{"truncated", [][]byte{mp4Box("ftyp", 12)[:6]}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Join(tt.boxes, nil)
+			got, err := moovBeforeMdat(bytes.NewReader(data), int64(len(data)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+
+			// Streamed a few bytes at a time, the scanner agrees
+			var s moovScanner
+			for chunk := range slices.Chunk(data, 3) {
+				s.Write(chunk)
+			}
+			got, err = s.result()
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("scanner: got %v, %v; want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	// A zero-size box can't loop forever
+	zero := make([]byte, 8)
+	copy(zero[4:], "free")
+	data := append(mp4Box("ftyp", 12), zero...)
+	if _, err := moovBeforeMdat(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Error("expected error for box running to end of file without moov")
+	}
+}
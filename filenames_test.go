@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain", "holiday.mp4", "holiday.mp4"},
+		{"unix path", "../../etc/passwd", "passwd"},
+		{"windows path", `C:\Users\me\clip.mov`, "clip.mov"},
+		{"control characters", "bad\x00name\r\n.mp4", "badname.mp4"},
+		{"surrounding whitespace", "  clip.mp4  ", "clip.mp4"},
+		{"unicode", "vidéo d'été.mp4", "vidéo d'été.mp4"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := sanitizeFilename(tc.input)
+			if got == nil {
+				t.Fatalf("expected %q, got nil", tc.want)
+			}
+			if *got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, *got)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameEmpty(t *testing.T) {
+	for _, input := range []string{"", "   ", "dir/", "..", "\x00\x01"} {
+		if got := sanitizeFilename(input); got != nil {
+			t.Errorf("expected nil for %q, got %q", input, *got)
+		}
+	}
+}
+
+func TestSanitizeFilenameTruncatesKeepingExtension(t *testing.T) {
+	got := sanitizeFilename(strings.Repeat("a", 400) + ".mp4")
+	if got == nil {
+		t.Fatal("expected a filename")
+	}
+	if len(*got) != maxFilenameLength {
+		t.Fatalf("expected length %d, got %d", maxFilenameLength, len(*got))
+	}
+	if !strings.HasSuffix(*got, ".mp4") {
+		t.Fatalf("expected extension to be kept, got %q", *got)
+	}
+}
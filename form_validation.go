@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// formFieldError is one problem with a submitted multipart form.
+type formFieldError struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+// validateUploadForm checks a parsed upload form: exactly one non-empty file
+// under fileField, no other file parts, and no value fields outside
+// allowedValues. It returns every problem it finds rather than stopping at
+// the first, so clients can fix the whole form in one go.
+func validateUploadForm(form *multipart.Form, fileField string, allowedValues ...string) []formFieldError {
+	var problems []formFieldError
+	if form == nil {
+		return []formFieldError{{Field: fileField, Problem: "missing file part"}}
+	}
+
+	files := form.File[fileField]
+	switch {
+	case len(files) == 0:
+		problem := "missing file part"
+		if others := slices.Sorted(maps.Keys(form.File)); len(others) > 0 {
+			problem = fmt.Sprintf("missing file part; got a file under %s instead", strings.Join(others, ", "))
+		}
+		problems = append(problems, formFieldError{Field: fileField, Problem: problem})
+	case len(files) > 1:
+		problems = append(problems, formFieldError{Field: fileField, Problem: fmt.Sprintf("expected one file, got %d", len(files))})
+	case files[0].Size == 0:
+		problems = append(problems, formFieldError{Field: fileField, Problem: "file is empty"})
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(form.File)) {
+		if name != fileField {
+			problems = append(problems, formFieldError{Field: name, Problem: "unexpected file part"})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(form.Value)) {
+		if !slices.Contains(allowedValues, name) {
+			problems = append(problems, formFieldError{Field: name, Problem: "unexpected field"})
+		}
+	}
+	return problems
+}
+
+// maxUploadFormValueBytes caps the text fields sent alongside an upload's
+// file part, all of them together.
+const maxUploadFormValueBytes = 1 << 20
+
+// readUploadForm reads a multipart upload form a part at a time, handing
+// the first part under fileField to receive as it comes off the wire
+// instead of buffering it first. Whatever receive leaves unread, and every
+// other file part, is read and discarded, so each file's size is still
+// known. The returned form records the files' names and sizes but not
+// their contents, for validateUploadForm; it's also set on r, with the
+// values in r.Form and r.PostForm, so FormValue works as usual.
+func readUploadForm(r *http.Request, fileField string, receive func(io.Reader) error) (*multipart.Form, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &multipart.Form{Value: map[string][]string{}, File: map[string][]*multipart.FileHeader{}}
+	var valueBytes int64
+	received := false
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadFormValueBytes-valueBytes+1))
+			if err != nil {
+				return nil, err
+			}
+			valueBytes += int64(len(value))
+			if valueBytes > maxUploadFormValueBytes {
+				return nil, multipart.ErrMessageTooLarge
+			}
+			form.Value[name] = append(form.Value[name], string(value))
+			continue
+		}
+
+		counted := &progressReader{r: part, report: func(int64) {}}
+		if name == fileField && !received {
+			received = true
+			if err := receive(counted); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := io.Copy(io.Discard, counted); err != nil {
+			return nil, err
+		}
+		form.File[name] = append(form.File[name], &multipart.FileHeader{
+			Filename: part.FileName(),
+			Header:   part.Header,
+			Size:     counted.n,
+		})
+	}
+
+	r.MultipartForm = form
+	r.PostForm = form.Value
+	r.Form = url.Values{}
+	for name, values := range form.Value {
+		r.Form[name] = append(r.Form[name], values...)
+	}
+	for name, values := range r.URL.Query() {
+		r.Form[name] = append(r.Form[name], values...)
+	}
+	return form, nil
+}
+
+// multipartParseProblem turns a ParseMultipartForm or MultipartReader error
+// caused by the request not being a multipart form into a field problem.
+// Other errors (truncated bodies, I/O failures) return ok=false.
+func multipartParseProblem(err error) (formFieldError, bool) {
+	if errors.Is(err, http.ErrNotMultipart) {
+		return formFieldError{Field: "Content-Type", Problem: "request must be multipart/form-data"}, true
+	}
+	if errors.Is(err, http.ErrMissingBoundary) {
+		return formFieldError{Field: "Content-Type", Problem: "multipart boundary is missing"}, true
+	}
+	return formFieldError{}, false
+}
+
+// respondWithFormErrors sends a 422 listing every problem with the form.
+func respondWithFormErrors(w http.ResponseWriter, problems []formFieldError) {
+	type formErrorResponse struct {
+		Error  string           `json:"error"`
+		Code   string           `json:"code"`
+		Fields []formFieldError `json:"fields"`
+	}
+	respondWithJSON(w, http.StatusUnprocessableEntity, formErrorResponse{
+		Error:  "Invalid form data",
+		Code:   errCodeInvalidFields,
+		Fields: problems,
+	})
+}
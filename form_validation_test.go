@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// sendForm posts a multipart form built by build to path.
+func (h *testHarness) sendForm(path, token string, build func(mw *multipart.Writer)) *http.Response {
+	h.t.Helper()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	build(mw)
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, h.srv.URL+path, body)
+	if err != nil {
+		h.t.Fatalf("couldn't create request: %v", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatalf("request failed: %v", err)
+	}
+	h.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+type formErrorBody struct {
+	Code   string           `json:"code"`
+	Fields []formFieldError `json:"fields"`
+}
+
+func TestUploadFormValidation(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("forms@example.com")
+	videoPath := "/api/video_upload/" + video.ID.String()
+	thumbPath := "/api/thumbnail_upload/" + video.ID.String()
+
+	tests := []struct {
+		name  string
+		path  string
+		build func(mw *multipart.Writer)
+		want  []formFieldError
+	}{
+		{
+			name: "wrong field name",
+			path: videoPath,
+			build: func(mw *multipart.Writer) {
+				part, _ := mw.CreateFormFile("file", "clip.mp4")
+				part.Write([]byte("data"))
+			},
+			want: []formFieldError{
+				{Field: "video", Problem: "missing file part; got a file under file instead"},
+				{Field: "file", Problem: "unexpected file part"},
+			},
+		},
+		{
+			name: "empty file and unknown field",
+			path: videoPath,
+			build: func(mw *multipart.Writer) {
+				mw.CreateFormFile("video", "clip.mp4")
+				mw.WriteField("title", "nope")
+				mw.WriteField("watermark", "true")
+			},
+			want: []formFieldError{
+				{Field: "video", Problem: "file is empty"},
+				{Field: "title", Problem: "unexpected field"},
+			},
+		},
+		{
+			name: "two thumbnails",
+			path: thumbPath,
+			build: func(mw *multipart.Writer) {
+				for range 2 {
+					part, _ := mw.CreateFormFile("thumbnail", "thumb.png")
+					part.Write([]byte("data"))
+				}
+			},
+			want: []formFieldError{
+				{Field: "thumbnail", Problem: "expected one file, got 2"},
+			},
+		},
+		{
+			name:  "missing thumbnail",
+			path:  thumbPath,
+			build: func(mw *multipart.Writer) {},
+			want: []formFieldError{
+				{Field: "thumbnail", Problem: "missing file part"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := h.sendForm(tt.path, token, tt.build)
+			if resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("expected 422, got %d", resp.StatusCode)
+			}
+			var body formErrorBody
+			decodeJSON(t, resp, &body)
+			if body.Code != errCodeInvalidFields {
+				t.Errorf("expected code %s, got %s", errCodeInvalidFields, body.Code)
+			}
+			if len(body.Fields) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, body.Fields)
+			}
+			for i := range tt.want {
+				if body.Fields[i] != tt.want[i] {
+					t.Errorf("problem %d: expected %v, got %v", i, tt.want[i], body.Fields[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUploadRejectsNonMultipartBody(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("notmultipart@example.com")
+
+	resp := h.do(http.MethodPost, "/api/video_upload/"+video.ID.String(), token, bytes.NewReader([]byte("raw")))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+	var body formErrorBody
+	decodeJSON(t, resp, &body)
+	if len(body.Fields) != 1 || body.Fields[0].Field != "Content-Type" {
+		t.Errorf("expected a Content-Type problem, got %v", body.Fields)
+	}
+}
+
+func TestReadUploadForm(t *testing.T) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("watermark", "true")
+	part, _ := mw.CreateFormFile("video", "first.mp4")
+	part.Write([]byte("first file"))
+	part, _ = mw.CreateFormFile("video", "second.mp4")
+	part.Write([]byte("second"))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload?dryRun=true", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	// Only the first file is handed over, and what it leaves is still
+	// counted
+	var received []string
+	form, err := readUploadForm(req, "video", func(r io.Reader) error {
+		head := make([]byte, 5)
+		_, err := io.ReadFull(r, head)
+		received = append(received, string(head))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0] != "first" {
+		t.Errorf("expected only the start of the first file, got %q", received)
+	}
+	files := form.File["video"]
+	if len(files) != 2 || files[0].Filename != "first.mp4" || files[0].Size != 10 || files[1].Size != 6 {
+		t.Fatalf("unexpected files %+v", files)
+	}
+	if req.FormValue("watermark") != "true" || req.FormValue("dryRun") != "true" {
+		t.Errorf("expected form and query values, got %v", req.Form)
+	}
+	if req.MultipartForm != form {
+		t.Error("expected the form to be set on the request")
+	}
+}
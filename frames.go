@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errFrameOutOfRange = errors.New("requested time is past the end of the video")
+
+// autoThumbnailAt is where in an upload the automatic thumbnail is taken.
+const autoThumbnailAt = "10%"
+
+// maxFrameWidth is the widest a frame is extracted at. Wider frames are
+// scaled down, keeping their aspect ratio.
+const maxFrameWidth = 1280
+
+// frameTimestamp resolves a requested poster frame time against a video's
+// duration. value is either seconds ("12.5") or a percentage of the
+// duration ("25%"). Empty picks 1 second in, or 10% of the way through
+// videos shorter than 10 seconds.
+func frameTimestamp(value string, duration float64) (float64, error) {
+	if value == "" {
+		return min(1, duration/10), nil
+	}
+
+	var at float64
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			return 0, fmt.Errorf("invalid percentage %q", value)
+		}
+		at = duration * p / 100
+	} else {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		at = seconds
+	}
+
+	// The last frame starts slightly before the end, so 100% is only
+	// reachable by backing off a little
+	if at >= duration {
+		if at > duration || duration == 0 {
+			return 0, errFrameOutOfRange
+		}
+		at = max(duration-0.1, 0)
+	}
+	return at, nil
+}
+
+// extractFrame grabs the frame at the given time in seconds and returns it
+// as a JPEG no wider than maxFrameWidth.
+func extractFrame(ctx context.Context, videoPath string, at float64) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "tubely-frame")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// Seeking before -i is fast and, with re-encoding, still frame accurate
+	outputPath := filepath.Join(dir, "frame.jpg")
+	_, err = runMediaTool(ctx, "ffmpeg", "-v", "error",
+		"-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", videoPath,
+		"-frames:v", "1", "-vf", fmt.Sprintf("scale=w='min(iw,%d)':h=-2", maxFrameWidth),
+		"-q:v", "2", "-f", "image2", outputPath)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(outputPath)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFrameTimestamp(t *testing.T) {
+	tests := []struct {
+		value    string
+		duration float64
+		want     float64
+		wantErr  error
+	}{
+		{"", 60, 1, nil},
+		{"", 5, 0.5, nil},
+		{"12.5", 60, 12.5, nil},
+		{"0", 60, 0, nil},
+		{"25%", 60, 15, nil},
+		{"100%", 60, 59.9, nil},
+		{"60", 60, 59.9, nil},
+		{"61", 60, 0, errFrameOutOfRange},
+	}
+	for _, tt := range tests {
+		got, err := frameTimestamp(tt.value, tt.duration)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("frameTimestamp(%q, %v) error = %v, want %v", tt.value, tt.duration, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("frameTimestamp(%q, %v) = %v, want %v", tt.value, tt.duration, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"abc", "-1", "150%", "-5%"} {
+		if _, err := frameTimestamp(value, 60); err == nil {
+			t.Errorf("frameTimestamp(%q) succeeded, want error", value)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// maxAPIKeyNameLength caps the label users give their API keys.
+const maxAPIKeyNameLength = 100
+
+// handlerAPIKeysCreate issues an API key that scripts can use in place of
+// a login to create and upload videos. The key is only ever shown in this
+// response. Managing keys needs a JWT, so a leaked key can't be used to
+// mint more.
+func (cfg *apiConfig) handlerAPIKeysCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+	}
+	type response struct {
+		database.APIKey
+		Key string `json:"key"`
+	}
+
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var params parameters
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || utf8.RuneCountInString(params.Name) > maxAPIKeyNameLength {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Name must be between 1 and 100 characters", nil)
+		return
+	}
+
+	key, err := auth.MakeAPIKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key", err)
+		return
+	}
+	stored, err := cfg.db.CreateAPIKey(database.CreateAPIKeyParams{
+		UserID:  userID,
+		Name:    params.Name,
+		Prefix:  key[:len(auth.APIKeyPrefix)+6],
+		KeyHash: auth.HashAPIKey(key),
+	})
+	if err != nil {
+		respondWithDBError(w, "Couldn't save API key", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusCreated, response{APIKey: stored, Key: key})
+}
+
+func (cfg *apiConfig) handlerAPIKeysList(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	keys, err := cfg.db.GetAPIKeys(userID)
+	if err != nil {
+		respondWithDBError(w, "Couldn't get API keys", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+// handlerAPIKeyDelete revokes an API key. Requests already authenticated
+// with it carry on; later ones are refused.
+func (cfg *apiConfig) handlerAPIKeyDelete(w http.ResponseWriter, r *http.Request) {
+	keyID, err := uuid.Parse(r.PathValue("keyID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid API key ID", err)
+		return
+	}
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	err = cfg.db.DeleteAPIKey(keyID, userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Couldn't find API key", err)
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, "Couldn't revoke API key", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateUploader is authenticate for the endpoints scripts use to
+// push videos, which also accept an "ApiKey <key>" Authorization header.
+func (cfg *apiConfig) authenticateUploader(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	if !hasAPIKey(r) {
+		return cfg.authenticate(w, r)
+	}
+	key, err := cfg.requestAPIKey(r)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Invalid API key", nil)
+		return uuid.Nil, false
+	}
+	if err != nil {
+		respondWithDBError(w, "Couldn't check API key", err)
+		return uuid.Nil, false
+	}
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > time.Minute {
+		err = cfg.db.TouchAPIKey(key.ID)
+		if err != nil {
+			slog.Warn("couldn't record API key use", "key_id", key.ID, "err", err)
+		}
+	}
+	return key.UserID, true
+}
+
+func hasAPIKey(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "ApiKey ")
+}
+
+// requestAPIKey looks up the API key a request carries, returning
+// ErrNotFound if it isn't one.
+func (cfg *apiConfig) requestAPIKey(r *http.Request) (database.APIKey, error) {
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil || !strings.HasPrefix(key, auth.APIKeyPrefix) {
+		return database.APIKey{}, database.ErrNotFound
+	}
+	return cfg.db.GetAPIKeyByHash(auth.HashAPIKey(key))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestAPIKeys(t *testing.T) {
+	h := newTestHarness(t)
+	token, _ := h.createUserAndVideo("ci@example.com")
+
+	resp := h.do(http.MethodPost, "/api/api_keys", token, strings.NewReader(`{"name":"ci"}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", resp.StatusCode)
+	}
+	var created struct {
+		database.APIKey
+		Key string `json:"key"`
+	}
+	decodeJSON(t, resp, &created)
+	if !strings.HasPrefix(created.Key, created.Prefix) || created.Name != "ci" {
+		t.Fatalf("created = %+v", created)
+	}
+
+	withAPIKey := func(req *http.Request, key string) *http.Request {
+		req.Header.Set("Authorization", "ApiKey "+key)
+		return req
+	}
+
+	// The key can create a video and upload to it
+	req, err := http.NewRequest(http.MethodPost, h.srv.URL+"/api/videos", strings.NewReader(`{"title":"from ci"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = h.send(withAPIKey(req, created.Key))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create video with API key: expected 201, got %d", resp.StatusCode)
+	}
+	var video database.Video
+	decodeJSON(t, resp, &video)
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 16, 9))); err != nil {
+		t.Fatal(err)
+	}
+	req = h.uploadRequest("/api/thumbnail_upload/"+video.ID.String(), "", "thumbnail", "thumb.png", buf.Bytes())
+	if resp := h.send(withAPIKey(req, created.Key)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("thumbnail upload with API key: expected 200, got %d", resp.StatusCode)
+	}
+
+	resp = h.do(http.MethodGet, "/api/api_keys", token, nil)
+	var keys []map[string]any
+	decodeJSON(t, resp, &keys)
+	if len(keys) != 1 || keys[0]["last_used_at"] == nil {
+		t.Fatalf("keys = %v", keys)
+	}
+	if _, ok := keys[0]["key"]; ok {
+		t.Error("listing exposes the key")
+	}
+	if _, ok := keys[0]["key_hash"]; ok {
+		t.Error("listing exposes the key hash")
+	}
+
+	// Keys can't manage keys, or do anything besides uploading
+	req, _ = http.NewRequest(http.MethodGet, h.srv.URL+"/api/api_keys", nil)
+	if resp := h.send(withAPIKey(req, created.Key)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("listing keys with a key: expected 401, got %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodGet, h.srv.URL+"/api/videos", nil)
+	if resp := h.send(withAPIKey(req, created.Key)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("listing videos with a key: expected 401, got %d", resp.StatusCode)
+	}
+
+	otherToken, _ := h.createUserAndVideo("other@example.com")
+	if resp := h.do(http.MethodDelete, "/api/api_keys/"+created.ID.String(), otherToken, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting another user's key: expected 404, got %d", resp.StatusCode)
+	}
+	if resp := h.do(http.MethodDelete, "/api/api_keys/"+created.ID.String(), token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodPost, h.srv.URL+"/api/videos", strings.NewReader(`{"title":"revoked"}`))
+	resp = h.send(withAPIKey(req, created.Key))
+	if resp.StatusCode != http.StatusUnauthorized || errorCode(t, resp) != errCodeInvalidToken {
+		t.Errorf("revoked key: expected 401, got %d", resp.StatusCode)
+	}
+
+	if resp := h.do(http.MethodPost, "/api/api_keys", token, strings.NewReader(`{"name":"  "}`)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("blank name: expected 400, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// handlerBackfillVideoInfo probes a page of videos uploaded before stream
+// details were recorded and stores their dimensions, duration, codecs,
+// frame rate, bitrate and orientation.
+// Each object is downloaded to a temp file since ffprobe needs to read it,
+// so pages are small; pass the returned next_cursor as ?cursor= for the
+// next one. Videos that couldn't be probed are reported and stay behind
+// the cursor, so a later run from the start retries them.
+func (cfg *apiConfig) handlerBackfillVideoInfo(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Processed  int      `json:"processed"`
+		Updated    int      `json:"updated"`
+		NextCursor *string  `json:"next_cursor"`
+		Errors     []string `json:"errors,omitempty"`
+	}
+
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+	if !cfg.mediaToolsAvailable {
+		respondWithError(w, http.StatusServiceUnavailable, "ffprobe isn't installed", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	var afterCreated time.Time
+	var afterID uuid.UUID
+	if cursor := query.Get("cursor"); cursor != "" {
+		afterCreated, afterID, err = parseBackfillCursor(cursor)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid cursor", err)
+			return
+		}
+	}
+	limit := 10
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 100 {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "limit must be between 1 and 100", err)
+			return
+		}
+	}
+
+	videos, err := cfg.db.GetVideosMissingProbeInfo(afterCreated, afterID, limit)
+	if err != nil {
+		respondWithDBError(w, "Couldn't retrieve videos", err)
+		return
+	}
+
+	resp := response{}
+	for _, video := range videos {
+		resp.Processed++
+		key, ok := cfg.videoKey(video)
+		if !ok {
+			resp.Errors = append(resp.Errors, video.ID.String()+": invalid video URL format")
+			continue
+		}
+
+		probe, err := probeStoredObject(r, cfg.videoStore(video), key)
+		if err != nil {
+			resp.Errors = append(resp.Errors, video.ID.String()+": "+err.Error())
+			continue
+		}
+
+		orientation := probe.orientation()
+		video.Orientation = &orientation
+		probe.applyTo(&video)
+		err = cfg.db.UpdateVideo(video)
+		if err != nil {
+			resp.Errors = append(resp.Errors, video.ID.String()+": "+err.Error())
+			continue
+		}
+		resp.Updated++
+	}
+
+	if len(videos) == limit {
+		last := videos[len(videos)-1]
+		next := fmt.Sprintf("%d_%s", last.CreatedAt.Unix(), last.ID)
+		resp.NextCursor = &next
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// parseBackfillCursor reads the position a next_cursor holds: the last
+// video's creation time, in Unix seconds, and its ID. Carrying both means
+// the next page can be found even if that video has since been deleted.
+func parseBackfillCursor(cursor string) (time.Time, uuid.UUID, error) {
+	seconds, id, ok := strings.Cut(cursor, "_")
+	if !ok {
+		return time.Time{}, uuid.Nil, errors.New("cursor has no video ID")
+	}
+	unix, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+	videoID, err := uuid.Parse(id)
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+	return time.Unix(unix, 0), videoID, nil
+}
+
+// probeStoredObject downloads an object to a temp file and probes it.
+func probeStoredObject(r *http.Request, store ObjectStore, key string) (videoProbe, error) {
+	tmpPath, err := downloadToTemp(r.Context(), store, key)
+	if err != nil {
+		return videoProbe{}, err
+	}
+	defer os.Remove(tmpPath)
+
+	return probeVideo(r.Context(), tmpPath)
+}
+
+// downloadToTemp copies an object from store into a new temp file and
+// returns its path. The caller removes the file.
+func downloadToTemp(ctx context.Context, store ObjectStore, key string) (string, error) {
+	body, _, err := store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	tmpFile, err := os.CreateTemp("", "tubely-download-*"+filepath.Ext(key))
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	_, err = io.Copy(tmpFile, body)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// backfillResponse is the body of POST /admin/backfill_video_info.
+type backfillResponse struct {
+	Processed  int      `json:"processed"`
+	Updated    int      `json:"updated"`
+	NextCursor *string  `json:"next_cursor"`
+	Errors     []string `json:"errors"`
+}
+
+// backfillAll runs the backfill a page of one video at a time until the
+// cursor runs out, and returns the totals and the number of pages.
+func (h *testHarness) backfillAll() (backfillResponse, int) {
+	h.t.Helper()
+	total, pages := backfillResponse{}, 0
+	query := "?limit=1"
+	for {
+		req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/backfill_video_info"+query, nil)
+		req.Header.Set("Authorization", "ApiKey admin-key")
+		resp := h.send(req)
+		if resp.StatusCode != http.StatusOK {
+			h.t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		var page backfillResponse
+		decodeJSON(h.t, resp, &page)
+		total.Processed += page.Processed
+		total.Updated += page.Updated
+		total.Errors = append(total.Errors, page.Errors...)
+		pages++
+		if page.NextCursor == nil {
+			return total, pages
+		}
+		query = "?limit=1&cursor=" + *page.NextCursor
+	}
+}
+
+// storeWithoutProbeInfo records a video as stored under key the way
+// uploads did before stream details were recorded.
+func (h *testHarness) storeWithoutProbeInfo(video database.Video, key string) {
+	h.t.Helper()
+	url := h.cfg.s3CfDistribution + "/" + key
+	video.VideoURL = &url
+	video.VideoKey = &key
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func TestBackfillVideoInfoReportsFailures(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.adminAPIKey = "admin-key"
+	// Nothing gets as far as ffprobe
+	h.cfg.mediaToolsAvailable = true
+	_, first := h.createUserAndVideo("backfill-gone@example.com")
+	_, second := h.createUserAndVideo("backfill-gone-too@example.com")
+	h.storeWithoutProbeInfo(first, "landscape/gone.mp4")
+	h.storeWithoutProbeInfo(second, "landscape/gone-too.mp4")
+
+	total, pages := h.backfillAll()
+	if total.Processed != 2 || total.Updated != 0 || pages != 3 {
+		t.Fatalf("processed %d, updated %d over %d pages", total.Processed, total.Updated, pages)
+	}
+	reported := strings.Join(total.Errors, "\n")
+	if len(total.Errors) != 2 || !strings.Contains(reported, first.ID.String()) || !strings.Contains(reported, second.ID.String()) {
+		t.Errorf("expected both videos to be reported, got %v", total.Errors)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/backfill_video_info?limit=1000", nil)
+	req.Header.Set("Authorization", "ApiKey admin-key")
+	if resp := h.send(req); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("oversized page: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestBackfillVideoInfoCursorOutlivesItsVideo(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.adminAPIKey = "admin-key"
+	h.cfg.mediaToolsAvailable = true
+	var videos []database.Video
+	for i, email := range []string{"cursor-a@example.com", "cursor-b@example.com", "cursor-c@example.com"} {
+		_, video := h.createUserAndVideo(email)
+		h.storeWithoutProbeInfo(video, fmt.Sprintf("landscape/cursor-%d.mp4", i))
+		videos = append(videos, video)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/backfill_video_info?limit=1", nil)
+	req.Header.Set("Authorization", "ApiKey admin-key")
+	var page backfillResponse
+	decodeJSON(t, h.send(req), &page)
+	if page.NextCursor == nil {
+		t.Fatal("expected a next cursor")
+	}
+	// The video the cursor ends on goes away before the next page
+	seen := strings.Join(page.Errors, "\n")
+	for _, video := range videos {
+		if strings.Contains(seen, video.ID.String()) {
+			if err := h.cfg.db.DeleteVideo(video.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, h.srv.URL+"/admin/backfill_video_info?limit=5&cursor="+*page.NextCursor, nil)
+	req.Header.Set("Authorization", "ApiKey admin-key")
+	decodeJSON(t, h.send(req), &page)
+	if page.Processed != 2 {
+		t.Errorf("expected the other two videos after the cursor, got %d", page.Processed)
+	}
+
+	for _, cursor := range []string{"nope", "12_nope", "x_" + videos[0].ID.String(), videos[0].ID.String()} {
+		req, _ = http.NewRequest(http.MethodPost, h.srv.URL+"/admin/backfill_video_info?cursor="+cursor, nil)
+		req.Header.Set("Authorization", "ApiKey admin-key")
+		if resp := h.send(req); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("cursor %q: expected 400, got %d", cursor, resp.StatusCode)
+		}
+	}
+}
+
+func TestBackfillVideoInfo(t *testing.T) {
+	h := newTestHarness(t)
+	requireFFmpeg(t)
+	h.cfg.adminAPIKey = "admin-key"
+	_, probed := h.createUserAndVideo("backfill@example.com")
+	_, missing := h.createUserAndVideo("backfill-missing@example.com")
+	h.storeWithoutProbeInfo(probed, "portrait/probed.mp4")
+	h.storeWithoutProbeInfo(missing, "portrait/missing.mp4")
+	h.s3.objects["portrait/probed.mp4"] = makeTestMP4(t, 90, 160)
+
+	total, _ := h.backfillAll()
+	if total.Processed != 2 || total.Updated != 1 {
+		t.Fatalf("processed %d, updated %d", total.Processed, total.Updated)
+	}
+	if len(total.Errors) != 1 || !strings.HasPrefix(total.Errors[0], missing.ID.String()) {
+		t.Errorf("expected the missing object to be reported, got %v", total.Errors)
+	}
+
+	got := h.getVideo(probed.ID)
+	if got.Width == nil || *got.Width != 90 || got.Height == nil || *got.Height != 160 {
+		t.Errorf("expected 90x160, got %v x %v", got.Width, got.Height)
+	}
+	if got.Orientation == nil || *got.Orientation != "portrait" {
+		t.Errorf("expected portrait, got %v", got.Orientation)
+	}
+	if got.Duration == nil || got.Codec == nil || got.Bitrate == nil {
+		t.Errorf("expected duration, codec and bitrate, got %v, %v, %v", got.Duration, got.Codec, got.Bitrate)
+	}
+
+	// Probed videos drop out, so a rerun only retries the failure
+	if total, _ := h.backfillAll(); total.Processed != 1 || total.Updated != 0 {
+		t.Errorf("rerun: processed %d, updated %d", total.Processed, total.Updated)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"golang.org/x/text/language"
+)
+
+const maxCaptionLabelLength = 100
+
+// handlerUploadCaptions attaches a WebVTT or SRT caption track to a video.
+// Tracks are keyed by language, so uploading one for a language that
+// already has a track replaces it. SRT files are converted to WebVTT.
+func (cfg *apiConfig) handlerUploadCaptions(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptionBytes+(64<<10))
+
+	video, ok := cfg.ownedVideoForCaptions(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseMultipartForm(maxCaptionBytes)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Caption file is larger than the 2 MB limit", err)
+			return
+		}
+		if problem, ok := multipartParseProblem(err); ok {
+			respondWithFormErrors(w, []formFieldError{problem})
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Error parsing form data", err)
+		return
+	}
+	problems := validateUploadForm(r.MultipartForm, "captions", "language", "label")
+	lang, err := language.Parse(r.FormValue("language"))
+	if err != nil {
+		problems = append(problems, formFieldError{Field: "language", Problem: "must be a language code like en or pt-BR"})
+	}
+	label := r.FormValue("label")
+	if utf8.RuneCountInString(label) > maxCaptionLabelLength {
+		problems = append(problems, formFieldError{Field: "label", Problem: "must be at most 100 characters"})
+	}
+	if len(problems) > 0 {
+		respondWithFormErrors(w, problems)
+		return
+	}
+
+	file, _, err := r.FormFile("captions")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "Error getting file from form data", err)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error reading caption file", err)
+		return
+	}
+	if !utf8.Valid(data) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidCaptions, "Caption file must be UTF-8 text", nil)
+		return
+	}
+	vtt, err := parseCaptions(data)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidCaptions, "Invalid caption file: "+err.Error(), err)
+		return
+	}
+
+	track, err := cfg.storeCaptionFile(r.Context(), vtt)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Error saving caption file", err)
+		return
+	}
+	track.Language = lang.String()
+	track.Label = label
+	old, replaced := removeCaptionTrack(&video, track.Language)
+	video.Captions = append(video.Captions, track)
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		cfg.removeCaptionFile(context.WithoutCancel(r.Context()), track)
+		respondWithDBError(w, "Error updating video in database", err)
+		return
+	}
+	if replaced {
+		if err := cfg.removeCaptionFile(r.Context(), old); err != nil {
+			slog.Warn("couldn't delete replaced caption file", "video_id", video.ID, "err", err)
+		}
+	}
+	if err := cfg.syncHLSCaptions(r.Context(), video); err != nil {
+		slog.Warn("couldn't add captions to HLS playlist", "video_id", video.ID, "err", err)
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.videoResponse(r.Context(), video))
+}
+
+// handlerDeleteCaptions removes a video's caption track for a language.
+func (cfg *apiConfig) handlerDeleteCaptions(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoForCaptions(w, r)
+	if !ok {
+		return
+	}
+
+	lang, err := language.Parse(r.PathValue("language"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid language code", err)
+		return
+	}
+	old, removed := removeCaptionTrack(&video, lang.String())
+	if !removed {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "No captions for that language", nil)
+		return
+	}
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithDBError(w, "Error updating video in database", err)
+		return
+	}
+	if err := cfg.removeCaptionFile(r.Context(), old); err != nil {
+		slog.Warn("couldn't delete caption file", "video_id", video.ID, "err", err)
+	}
+	if err := cfg.syncHLSCaptions(r.Context(), video); err != nil {
+		slog.Warn("couldn't remove captions from HLS playlist", "video_id", video.ID, "err", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownedVideoForCaptions loads the video a captions request targets, writing
+// the error response if the caller can't change it.
+func (cfg *apiConfig) ownedVideoForCaptions(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, jwtErrorCode(err), jwtErrorMessage(err), err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return database.Video{}, false
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeNotVideoOwner, "You can't change this video's captions", nil)
+		return database.Video{}, false
+	}
+	if video.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash first", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+// removeCaptionTrack drops the video's track for lang, if it has one, and
+// returns it.
+func removeCaptionTrack(video *database.Video, lang string) (database.CaptionTrack, bool) {
+	for i, track := range video.Captions {
+		if track.Language == lang {
+			video.Captions = append(video.Captions[:i:i], video.Captions[i+1:]...)
+			return track, true
+		}
+	}
+	return database.CaptionTrack{}, false
+}
+
+// captionKeyPrefix is where caption tracks are stored in the default
+// bucket. Like thumbnails they stay there whichever bucket the video is in.
+const captionKeyPrefix = "captions/"
+
+// storeCaptionFile uploads a WebVTT file under a new random key and returns
+// a track pointing at it.
+func (cfg *apiConfig) storeCaptionFile(ctx context.Context, vtt []byte) (database.CaptionTrack, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return database.CaptionTrack{}, err
+	}
+	key := captionKeyPrefix + base64.RawURLEncoding.EncodeToString(randomBytes) + ".vtt"
+	_, err := cfg.store.Put(ctx, key, bytes.NewReader(vtt), "text/vtt", cfg.storageClass)
+	if err != nil {
+		return database.CaptionTrack{}, err
+	}
+	return database.CaptionTrack{Key: key, URL: cfg.s3CfDistribution + "/" + key}, nil
+}
+
+// readCaptionFile returns a caption track's WebVTT file.
+func (cfg *apiConfig) readCaptionFile(ctx context.Context, track database.CaptionTrack) ([]byte, error) {
+	if track.Key == "" {
+		return os.ReadFile(filepath.Join(cfg.assetsRoot, filepath.Base(track.URL)))
+	}
+	body, _, err := cfg.store.Get(ctx, track.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// removeCaptionFile deletes a caption track's file. A file that's already
+// gone is fine.
+func (cfg *apiConfig) removeCaptionFile(ctx context.Context, track database.CaptionTrack) error {
+	if track.Key != "" {
+		err := cfg.store.Delete(ctx, track.Key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+		return nil
+	}
+	err := os.Remove(filepath.Join(cfg.assetsRoot, filepath.Base(track.URL)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerCreateClip cuts the part of a video between start and end into a
+// new video in the caller's library that links back to its source. Anyone
+// who can watch a video can clip it. The cut is processed like an upload,
+// so the response is the same as an upload's.
+func (cfg *apiConfig) handlerCreateClip(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Start      *clipTime `json:"start"`
+		End        *clipTime `json:"end"`
+		Title      string    `json:"title"`
+		Visibility string    `json:"visibility"`
+	}
+
+	sourceID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	userID, ok := cfg.authenticateUploader(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Couldn't decode parameters: "+err.Error(), err)
+		return
+	}
+	if params.Start == nil || params.End == nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Both start and end are required", nil)
+		return
+	}
+	start, end := float64(*params.Start), float64(*params.End)
+	if start < 0 || end <= start {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "end must be after start", nil)
+		return
+	}
+	if params.Visibility != "" {
+		params.Visibility, err = parseVisibility(params.Visibility)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, err.Error(), err)
+			return
+		}
+	}
+
+	source, err := cfg.db.GetVideo(sourceID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if !cfg.canViewVideo(r, source) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if source.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash before clipping it", nil)
+		return
+	}
+	if source.VideoURL == nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoNotReady, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	key, ok := cfg.videoKey(source)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Invalid video URL format", nil)
+		return
+	}
+
+	title := params.Title
+	if strings.TrimSpace(title) == "" {
+		title = clipTitle(source.Title, cfg.maxTitleLength)
+	}
+	title, description, err := validateVideoMetadata(title, source.Description, cfg.maxTitleLength, cfg.maxDescriptionLength)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, err.Error(), err)
+		return
+	}
+
+	if !cfg.mediaToolsAvailable {
+		respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeFFmpegMissing, "ffmpeg isn't installed", nil)
+		return
+	}
+
+	// Hold the source still only while it's downloaded, so an upload
+	// doesn't replace it halfway through
+	if !cfg.uploadLocks.tryLock(sourceID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is in progress", nil)
+		return
+	}
+	sourcePath, err := downloadToTemp(r.Context(), cfg.videoStore(source), key)
+	cfg.uploadLocks.unlock(sourceID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't download video", err)
+		return
+	}
+	defer os.Remove(sourcePath)
+
+	// Videos uploaded before durations were stored need probing first
+	if source.Duration == nil {
+		probe, err := probeVideo(r.Context(), sourcePath)
+		if err != nil {
+			respondWithMediaToolError(w, "Couldn't probe video", err)
+			return
+		}
+		source.Duration = &probe.Duration
+	}
+	if end > *source.Duration {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "end is past the end of the video", nil)
+		return
+	}
+
+	clipPath, err := cutClip(r.Context(), sourcePath, start, end)
+	if err != nil {
+		respondWithMediaToolError(w, "Couldn't cut clip", err)
+		return
+	}
+	defer os.Remove(clipPath)
+	sourceSHA256, err := fileSHA256(clipPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read clip", err)
+		return
+	}
+
+	clip, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       title,
+		Description: description,
+		Visibility:  params.Visibility,
+		UserID:      userID,
+	})
+	if err != nil {
+		respondWithDBError(w, "Couldn't create video", err)
+		return
+	}
+	clip.ClipOf = &source.ID
+	clip.ClipStart = &start
+	clip.ClipEnd = &end
+	err = cfg.db.UpdateVideo(clip)
+	if err != nil {
+		cfg.deleteUnstoredClip(clip.ID)
+		respondWithDBError(w, "Couldn't save clip", err)
+		return
+	}
+
+	fileName := "clip.mp4"
+	if source.VideoFilename != nil {
+		fileName = strings.TrimSuffix(*source.VideoFilename, path.Ext(*source.VideoFilename)) + "-clip.mp4"
+	}
+	stored := cfg.processAndStoreVideo(w, r, clip, userID, videoUpload{
+		path:         clipPath,
+		mediaType:    "video/mp4",
+		fileName:     fileName,
+		sourceSHA256: sourceSHA256,
+		storageClass: cfg.storageClass,
+
+		sourceWatermarked: source.Watermarked,
+	})
+	if !stored {
+		cfg.deleteUnstoredClip(clip.ID)
+		return
+	}
+	// Nothing holds the clip's lock, so a queued job can start right away
+	cfg.wakeVideoJobWorker()
+}
+
+// deleteUnstoredClip removes a clip's row when its file never made it into
+// storage, so a failed cut doesn't leave an empty video behind.
+func (cfg *apiConfig) deleteUnstoredClip(videoID uuid.UUID) {
+	if err := cfg.db.DeleteVideo(videoID); err != nil {
+		slog.Warn("couldn't delete unstored clip", "video_id", videoID, "err", err)
+	}
+}
+
+// clipResponse is where in its source video a clip was cut from.
+type clipResponse struct {
+	SourceVideoID uuid.UUID `json:"source_video_id"`
+	Start         float64   `json:"start"`
+	End           float64   `json:"end"`
+}
+
+func clipInfo(video database.Video) *clipResponse {
+	if video.ClipOf == nil || video.ClipStart == nil || video.ClipEnd == nil {
+		return nil
+	}
+	return &clipResponse{SourceVideoID: *video.ClipOf, Start: *video.ClipStart, End: *video.ClipEnd}
+}
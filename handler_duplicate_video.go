@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const copyTitleSuffix = " (copy)"
+
+// handlerDuplicateVideo adds a copy of one of the caller's videos to their
+// library, so its metadata can be edited separately. The stored video is
+// copied inside S3 rather than downloaded and uploaded again, and the
+// thumbnail and caption files are copied too. Preview clips, sprite sheets
+// and HLS renditions aren't; they're regenerated on the copy's next upload.
+func (cfg *apiConfig) handlerDuplicateVideo(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, jwtErrorCode(err), jwtErrorMessage(err), err)
+		return
+	}
+
+	source, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if source.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeNotVideoOwner, "You can't copy this video", nil)
+		return
+	}
+	if source.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash before copying it", nil)
+		return
+	}
+
+	// Hold the source still so an upload doesn't replace its object mid-copy
+	if !cfg.uploadLocks.tryLock(videoID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is in progress", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(videoID)
+
+	duplicate := database.Video{
+		CreateVideoParams: database.CreateVideoParams{
+			Title:       copyTitle(source.Title, cfg.maxTitleLength),
+			Description: source.Description,
+			Visibility:  source.Visibility,
+			UserID:      userID,
+		},
+		VideoFilename:     source.VideoFilename,
+		VideoSize:         source.VideoSize,
+		Orientation:       source.Orientation,
+		Width:             source.Width,
+		Height:            source.Height,
+		Duration:          source.Duration,
+		Codec:             source.Codec,
+		AudioCodec:        source.AudioCodec,
+		FrameRate:         source.FrameRate,
+		Bitrate:           source.Bitrate,
+		SourceSHA256:      source.SourceSHA256,
+		ThumbnailFilename: source.ThumbnailFilename,
+		ClipOf:            source.ClipOf,
+		ClipStart:         source.ClipStart,
+		ClipEnd:           source.ClipEnd,
+		Watermarked:       source.Watermarked,
+		Attribution:       source.Attribution,
+	}
+
+	// Undo the copies made so far if a later step fails
+	var cleanups []func()
+	cleanUp := func() {
+		for _, f := range cleanups {
+			f()
+		}
+	}
+
+	if source.VideoURL != nil {
+		srcKey, ok := cfg.videoKey(source)
+		if !ok {
+			respondWithError(w, http.StatusInternalServerError, "Invalid video URL format", nil)
+			return
+		}
+		store := cfg.videoStore(source)
+		info, err := store.Head(r.Context(), srcKey)
+		if errors.Is(err, ErrObjectNotFound) {
+			respondWithErrorCode(w, http.StatusNotFound, errCodeObjectMissing, "Video file is missing from storage", err)
+			return
+		}
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't check video file", err)
+			return
+		}
+
+		randomBytes := make([]byte, 32)
+		if _, err := rand.Read(randomBytes); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error generating random bytes", err)
+			return
+		}
+		dstKey := path.Join(path.Dir(srcKey), hex.EncodeToString(randomBytes)+path.Ext(srcKey))
+		copied, err := store.Copy(r.Context(), srcKey, dstKey, info.StorageClass)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't copy video file", err)
+			return
+		}
+		cleanups = append(cleanups, func() {
+			if err := store.Delete(context.WithoutCancel(r.Context()), dstKey); err != nil {
+				slog.Warn("couldn't delete copied video object", "key", dstKey, "err", err)
+			}
+		})
+
+		videoURL := cfg.s3CfDistribution + "/" + dstKey
+		duplicate.VideoURL = &videoURL
+		duplicate.VideoKey = &dstKey
+		duplicate.VideoBucket = source.VideoBucket
+		duplicate.VideoETag = source.VideoETag
+		if etag := strings.Trim(copied.ETag, `"`); etag != "" {
+			duplicate.VideoETag = &etag
+		}
+	}
+
+	if source.ThumbnailURL != nil {
+		duplicate.ThumbnailURL = source.ThumbnailURL
+		duplicate.ThumbnailColor = source.ThumbnailColor
+		_, isLocal := cfg.localThumbnailPath(*source.ThumbnailURL)
+		if _, inBucket := cfg.thumbnailKey(*source.ThumbnailURL); isLocal || inBucket {
+			f, err := cfg.openThumbnail(r.Context(), *source.ThumbnailURL)
+			if err != nil {
+				cleanUp()
+				respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail", err)
+				return
+			}
+			duplicate.ThumbnailURL = nil
+			err = cfg.replaceThumbnail(r.Context(), &duplicate, f, path.Ext(*source.ThumbnailURL))
+			f.Close()
+			if err != nil {
+				cleanUp()
+				respondWithError(w, http.StatusInternalServerError, "Couldn't copy thumbnail", err)
+				return
+			}
+			copiedThumbnail := *duplicate.ThumbnailURL
+			cleanups = append(cleanups, func() {
+				cfg.deleteThumbnail(context.WithoutCancel(r.Context()), copiedThumbnail)
+			})
+		}
+	}
+
+	for _, track := range source.Captions {
+		data, err := cfg.readCaptionFile(r.Context(), track)
+		if err != nil {
+			cleanUp()
+			respondWithError(w, http.StatusInternalServerError, "Couldn't read caption file", err)
+			return
+		}
+		copied, err := cfg.storeCaptionFile(r.Context(), data)
+		if err != nil {
+			cleanUp()
+			respondWithError(w, http.StatusInternalServerError, "Couldn't copy caption file", err)
+			return
+		}
+		cleanups = append(cleanups, func() {
+			cfg.removeCaptionFile(context.WithoutCancel(r.Context()), copied)
+		})
+		copied.Language = track.Language
+		copied.Label = track.Label
+		copied.Generated = track.Generated
+		duplicate.Captions = append(duplicate.Captions, copied)
+	}
+
+	created, err := cfg.db.CreateVideo(duplicate.CreateVideoParams)
+	if err != nil {
+		cleanUp()
+		respondWithDBError(w, "Couldn't create video", err)
+		return
+	}
+	duplicate.ID = created.ID
+	duplicate.CreatedAt = created.CreatedAt
+	duplicate.UpdatedAt = created.UpdatedAt
+	err = cfg.db.UpdateVideo(duplicate)
+	if err != nil {
+		cleanUp()
+		if err := cfg.db.DeleteVideo(created.ID); err != nil {
+			slog.Warn("couldn't delete partly copied video", "video_id", created.ID, "err", err)
+		}
+		respondWithDBError(w, "Couldn't save copied video", err)
+		return
+	}
+
+	duplicate, err = cfg.db.GetVideo(created.ID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, cfg.videoResponse(r.Context(), duplicate))
+}
+
+// copyTitle appends the copy suffix to a title, shortening the title if
+// that would make it too long.
+func copyTitle(title string, maxLength int) string {
+	return suffixedTitle(title, copyTitleSuffix, maxLength)
+}
+
+// suffixedTitle appends suffix to a title, shortening the title if that
+// would make it longer than maxLength.
+func suffixedTitle(title, suffix string, maxLength int) string {
+	runes := []rune(title)
+	suffixRunes := []rune(suffix)
+	if len(runes)+len(suffixRunes) > maxLength && maxLength >= len(suffixRunes) {
+		runes = []rune(strings.TrimSpace(string(runes[:maxLength-len(suffixRunes)])))
+	}
+	return string(runes) + suffix
+}
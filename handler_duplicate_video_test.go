@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDuplicateVideo(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("copy@example.com")
+
+	key := "landscape/original.mp4"
+	h.s3.objects[key] = []byte("video bytes")
+	h.s3.classes[key] = "STANDARD_IA"
+	videoURL := h.cfg.s3CfDistribution + "/" + key
+	thumbnailURL := h.cfg.publicURL(context.Background(), "/assets/thumb.png")
+	video.VideoURL = &videoURL
+	video.ThumbnailURL = &thumbnailURL
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(h.cfg.assetsRoot, "thumb.png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/duplicate", video.ID), token, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var copied videoResponse
+	decodeJSON(t, resp, &copied)
+	if copied.ID == video.ID || copied.Title != video.Title+" (copy)" || copied.UserID != video.UserID {
+		t.Fatalf("unexpected copy %+v", copied)
+	}
+
+	if len(h.s3.copies) != 1 || len(h.s3.puts) != 0 {
+		t.Fatalf("expected one server-side copy and no uploads, got copies %v, puts %v", h.s3.copies, h.s3.puts)
+	}
+	newKey := h.s3.copies[0]
+	if newKey == key || !strings.HasPrefix(newKey, "landscape/") || string(h.s3.objects[newKey]) != "video bytes" {
+		t.Errorf("unexpected copied object %q", newKey)
+	}
+	if h.s3.classes[newKey] != "STANDARD_IA" {
+		t.Errorf("expected the storage class to be kept, got %q", h.s3.classes[newKey])
+	}
+
+	stored := h.getVideo(copied.ID)
+	if stored.VideoURL == nil || *stored.VideoURL != h.cfg.s3CfDistribution+"/"+newKey {
+		t.Errorf("unexpected video URL %v", stored.VideoURL)
+	}
+	if stored.ThumbnailURL == nil || *stored.ThumbnailURL == thumbnailURL {
+		t.Fatalf("expected a separate thumbnail file, got %v", stored.ThumbnailURL)
+	}
+	if data, err := os.ReadFile(filepath.Join(h.cfg.assetsRoot, filepath.Base(*stored.ThumbnailURL))); err != nil || string(data) != "png" {
+		t.Errorf("thumbnail copy: %q, %v", data, err)
+	}
+}
+
+func TestDuplicateVideoRequiresOwner(t *testing.T) {
+	h := newTestHarness(t)
+	_, video := h.createUserAndVideo("owner@example.com")
+	otherToken, _ := h.createUserAndVideo("other@example.com")
+
+	resp := h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/duplicate", video.ID), otherToken, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", resp.StatusCode)
+	}
+}
+
+func TestCopyTitle(t *testing.T) {
+	if got := copyTitle("Trip", 200); got != "Trip (copy)" {
+		t.Errorf("got %q", got)
+	}
+	if got := copyTitle("abcdefghij", 12); got != "abcde (copy)" {
+		t.Errorf("got %q", got)
+	}
+}
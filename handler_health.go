@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds each dependency check in /readyz, so a hung
+// database or S3 endpoint fails the probe instead of stalling it.
+const readinessTimeout = 2 * time.Second
+
+// dependencyStatus is how one dependency fared in a readiness check.
+// Status is "ok", "error", or "disabled" for ffmpeg when the server was
+// started without it on purpose.
+type dependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handlerHealthz answers as long as the process is serving requests. It
+// checks nothing else, so orchestrators don't restart a server just
+// because something it depends on is down.
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handlerReadyz checks the database, the object store and the media tools
+// and reports each one. It responds 503 if any of them is failing, so the
+// server is taken out of rotation until they recover.
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(ctx context.Context) error{
+		"database": cfg.db.Ping,
+		"storage":  cfg.store.Check,
+	}
+	if cfg.mediaToolsAvailable {
+		checks["ffmpeg"] = func(context.Context) error { return checkMediaTools() }
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		statuses = map[string]dependencyStatus{"ffmpeg": {Status: "disabled"}}
+		ready    = true
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+			defer cancel()
+			status := dependencyStatus{Status: "ok"}
+			if err := check(ctx); err != nil {
+				status = dependencyStatus{Status: "error", Error: err.Error()}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			statuses[name] = status
+			if status.Status != "ok" {
+				ready = false
+			}
+		}()
+	}
+	wg.Wait()
+
+	code, overall := http.StatusOK, "ok"
+	if !ready {
+		code, overall = http.StatusServiceUnavailable, "unavailable"
+	}
+	respondWithJSON(w, code, struct {
+		Status string                      `json:"status"`
+		Checks map[string]dependencyStatus `json:"checks"`
+	}{overall, statuses})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	h := newTestHarness(t)
+
+	type readiness struct {
+		Status string                      `json:"status"`
+		Checks map[string]dependencyStatus `json:"checks"`
+	}
+
+	resp := h.do("GET", "/healthz", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("healthz: got status %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	resp = h.do("GET", "/readyz", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("readyz: got status %d, want 200", resp.StatusCode)
+	}
+	var got readiness
+	decodeJSON(t, resp, &got)
+	if got.Status != "ok" || got.Checks["database"].Status != "ok" || got.Checks["storage"].Status != "ok" {
+		t.Errorf("readyz: got %+v", got)
+	}
+	if got.Checks["ffmpeg"].Status != "disabled" {
+		t.Errorf("ffmpeg check = %+v, want disabled without media tools", got.Checks["ffmpeg"])
+	}
+
+	h.s3.headBucketErr = errors.New("access denied")
+	resp = h.do("GET", "/readyz", "", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("readyz with S3 down: got status %d, want 503", resp.StatusCode)
+	}
+	got = readiness{}
+	decodeJSON(t, resp, &got)
+	if got.Status != "unavailable" || got.Checks["storage"].Status != "error" || got.Checks["storage"].Error == "" {
+		t.Errorf("readyz with S3 down: got %+v", got)
+	}
+	if got.Checks["database"].Status != "ok" {
+		t.Errorf("database check = %+v, want ok", got.Checks["database"])
+	}
+}
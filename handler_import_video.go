@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// handlerImportVideo queues a video to be downloaded from a URL the client
+// gives and then processed like an upload. The download happens on a job
+// worker, so the response is always 202 with the job, whose status and
+// progress clients poll. It takes the same options as a direct upload's
+// finalize request, and "importer": "yt-dlp" fetches the video from its
+// page on a platform instead, along with the platform's credits.
+func (cfg *apiConfig) handlerImportVideo(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL            string `json:"url"`
+		FileName       string `json:"file_name"`
+		NormalizeAudio string `json:"normalize_audio"`
+		Watermark      string `json:"watermark"`
+		AutoCaptions   string `json:"auto_captions"`
+		StorageClass   string `json:"storage_class"`
+		Importer       string `json:"importer"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	userID, ok := cfg.authenticateUploader(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Couldn't decode parameters", err)
+		return
+	}
+	if params.URL == "" {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "url is required", nil)
+		return
+	}
+	if _, err := parseRemoteURL(params.URL); err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "url must be an absolute http or https URL", err)
+		return
+	}
+	storageClass, err := cfg.uploadStorageClass(params.StorageClass)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid storage class", err)
+		return
+	}
+	importer := params.Importer
+	switch importer {
+	case "", importerDirect:
+		importer = ""
+	case importerYTDLP:
+		if cfg.platformDownloader == nil {
+			respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeUnavailable, "Importing with yt-dlp needs YTDLP_BINARY set", nil)
+			return
+		}
+	default:
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "importer must be direct or yt-dlp", nil)
+		return
+	}
+	// Nothing would pick the job up
+	if cfg.jobWorkers == 0 {
+		respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeUnavailable, "Importing videos needs VIDEO_JOB_WORKERS above 0", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotVideoOwner, "You must be the video owner", nil)
+		return
+	}
+	if video.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash before uploading", nil)
+		return
+	}
+
+	if !cfg.uploadLocks.tryLock(video.ID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is already in progress", nil)
+		return
+	}
+	defer cfg.releaseUploadLock(video.ID)
+
+	// Platform imports are named after the video's title once it's known
+	fileName := params.FileName
+	if fileName == "" && importer == "" {
+		fileName = importFileName(params.URL)
+	}
+	queued := cfg.queueVideoJob(w, r, video, userID, videoUpload{
+		fileName:       fileName,
+		normalizeAudio: params.NormalizeAudio,
+		watermark:      params.Watermark,
+		autoCaptions:   params.AutoCaptions,
+		storageClass:   storageClass,
+		sourceURL:      params.URL,
+		importer:       importer,
+	})
+	if queued {
+		cfg.progress.set(video.ID, uploadProgress{Stage: stageQueued})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestImportVideo(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 1
+	// The test server is on loopback, which the default client refuses
+	h.cfg.importClient = &http.Client{}
+	token, video := h.createUserAndVideo("import@example.com")
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(minimalMP4)
+	}))
+	defer remote.Close()
+
+	path := fmt.Sprintf("/api/videos/%s/import", video.ID)
+	body := fmt.Sprintf(`{"url": %q}`, remote.URL+"/media/remote.mp4")
+	resp := h.do(http.MethodPost, path, token, strings.NewReader(body))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Location") == "" {
+		t.Error("expected a Location header for the job")
+	}
+	var queued struct {
+		Job videoJobResponse `json:"job"`
+	}
+	decodeJSON(t, resp, &queued)
+	if queued.Job.Status != database.JobQueued {
+		t.Fatalf("unexpected job %+v", queued.Job)
+	}
+
+	h.cfg.runQueuedVideoJobs(context.Background())
+
+	stored := h.getVideo(video.ID)
+	if stored.VideoURL == nil || stored.VideoFilename == nil || *stored.VideoFilename != "remote.mp4" {
+		t.Fatalf("expected the imported video to be stored, got %v, %v", stored.VideoURL, stored.VideoFilename)
+	}
+	job, err := h.cfg.db.GetVideoJob(queued.Job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != database.JobDone {
+		t.Errorf("expected the job to be done, got %q %q", job.Status, job.Error)
+	}
+	if entries, _ := os.ReadDir(h.cfg.jobDir); len(entries) != 0 {
+		t.Errorf("expected the downloaded file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestImportVideoRefusesPrivateAddresses(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 1
+	token, video := h.createUserAndVideo("import-private@example.com")
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the import shouldn't reach a loopback server")
+	}))
+	defer remote.Close()
+
+	path := fmt.Sprintf("/api/videos/%s/import", video.ID)
+	resp := h.do(http.MethodPost, path, token, strings.NewReader(fmt.Sprintf(`{"url": %q}`, remote.URL)))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	var queued struct {
+		Job videoJobResponse `json:"job"`
+	}
+	decodeJSON(t, resp, &queued)
+
+	h.cfg.runQueuedVideoJobs(context.Background())
+
+	resp = h.do(http.MethodGet, "/api/jobs/"+queued.Job.ID.String(), token, nil)
+	var job videoJobResponse
+	decodeJSON(t, resp, &job)
+	if job.Status != database.JobFailed || job.Error == "" {
+		t.Errorf("expected the job to fail with a reason, got %+v", job)
+	}
+	if len(h.s3.keys()) != 0 {
+		t.Errorf("nothing should be stored, got %v", h.s3.keys())
+	}
+}
+
+func TestImportVideoValidation(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.jobWorkers = 1
+	token, video := h.createUserAndVideo("import-invalid@example.com")
+	path := fmt.Sprintf("/api/videos/%s/import", video.ID)
+
+	for _, body := range []string{`{}`, `{"url": "ftp://example.com/a.mp4"}`, `{"url": "/a.mp4"}`} {
+		resp := h.do(http.MethodPost, path, token, strings.NewReader(body))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, resp.StatusCode)
+		}
+	}
+
+	h.cfg.jobWorkers = 0
+	resp := h.do(http.MethodPost, path, token, strings.NewReader(`{"url": "https://example.com/a.mp4"}`))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("without workers: expected 503, got %d", resp.StatusCode)
+	}
+}
+
+// fakePlatformDownloader leaves the files yt-dlp would, without going
+// anywhere.
+type fakePlatformDownloader struct {
+	info      string
+	thumbnail []byte
+}
+
+func (d fakePlatformDownloader) download(ctx context.Context, pageURL, dir string) error {
+	files := map[string][]byte{
+		"video.mp4":   minimalMP4,
+		ytDLPInfoFile: []byte(d.info),
+	}
+	if d.thumbnail != nil {
+		files["thumbnail.png"] = d.thumbnail
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestImportVideoWithYTDLP(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 1
+	token, video := h.createUserAndVideo("import-ytdlp@example.com")
+	// The platform's description is only used when the video has none
+	video.Description = ""
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/videos/%s/import", video.ID)
+	body := `{"url": "https://videos.example.com/watch?v=abc", "importer": "yt-dlp"}`
+
+	if resp := h.do(http.MethodPost, path, token, strings.NewReader(body)); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("without yt-dlp: expected 503, got %d", resp.StatusCode)
+	}
+
+	var thumbnail bytes.Buffer
+	if err := png.Encode(&thumbnail, image.NewRGBA(image.Rect(0, 0, 16, 9))); err != nil {
+		t.Fatal(err)
+	}
+	h.cfg.platformDownloader = fakePlatformDownloader{
+		info: `{
+			"id": "abc",
+			"title": "Bears/Wolves",
+			"description": "A documentary",
+			"ext": "mp4",
+			"webpage_url": "https://videos.example.com/watch?v=abc",
+			"extractor_key": "Example",
+			"uploader": "Nature Films",
+			"channel_url": "https://videos.example.com/@nature",
+			"license": "CC BY 4.0",
+			"upload_date": "20240131"
+		}`,
+		thumbnail: thumbnail.Bytes(),
+	}
+	resp := h.do(http.MethodPost, path, token, strings.NewReader(body))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	var queued struct {
+		Job videoJobResponse `json:"job"`
+	}
+	decodeJSON(t, resp, &queued)
+
+	h.cfg.runQueuedVideoJobs(context.Background())
+
+	job, err := h.cfg.db.GetVideoJob(queued.Job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != database.JobDone {
+		t.Fatalf("expected the job to be done, got %q %q", job.Status, job.Error)
+	}
+	stored := h.getVideo(video.ID)
+	if stored.VideoURL == nil || stored.VideoFilename == nil || *stored.VideoFilename != "Bears-Wolves.mp4" {
+		t.Errorf("expected the video to be stored under its title, got %v, %v", stored.VideoURL, stored.VideoFilename)
+	}
+	if stored.Description != "A documentary" {
+		t.Errorf("expected the platform's description, got %q", stored.Description)
+	}
+	if stored.ThumbnailURL == nil {
+		t.Error("expected the platform's thumbnail")
+	}
+	want := database.Attribution{
+		SourceURL:   "https://videos.example.com/watch?v=abc",
+		Platform:    "Example",
+		SourceID:    "abc",
+		Title:       "Bears/Wolves",
+		Uploader:    "Nature Films",
+		UploaderURL: "https://videos.example.com/@nature",
+		License:     "CC BY 4.0",
+		UploadDate:  "2024-01-31",
+	}
+	if stored.Attribution != want {
+		t.Errorf("unexpected attribution %+v", stored.Attribution)
+	}
+	if entries, _ := os.ReadDir(h.cfg.jobDir); len(entries) != 0 {
+		t.Errorf("expected the downloaded files to be removed, found %d", len(entries))
+	}
+}
+
+func TestImportVideoWithYTDLPCleansMetadata(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 1
+	h.cfg.maxTitleLength = 10
+	h.cfg.maxDescriptionLength = 20
+	token, video := h.createUserAndVideo("import-ytdlp-clean@example.com")
+	video.Description = ""
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	h.cfg.platformDownloader = fakePlatformDownloader{info: `{
+		"id": "abc",
+		"title": "Bears\u0000 & Wolves in winter",
+		"description": "  Cafe\u0301\u0007 documentary\nabout\u001b[31m bears and wolves",
+		"uploader": "Nature\u0008 Films",
+		"license": "` + strings.Repeat("CC BY 4.0 ", 50) + `"
+	}`}
+
+	path := fmt.Sprintf("/api/videos/%s/import", video.ID)
+	body := `{"url": "https://videos.example.com/watch?v=abc", "importer": "yt-dlp"}`
+	resp := h.do(http.MethodPost, path, token, strings.NewReader(body))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	h.cfg.runQueuedVideoJobs(context.Background())
+
+	stored := h.getVideo(video.ID)
+	if want := "Café documentary\nabo"; stored.Description != want {
+		t.Errorf("expected description %q, got %q", want, stored.Description)
+	}
+	if want := "Bears & Wo"; stored.Attribution.Title != want {
+		t.Errorf("expected title %q, got %q", want, stored.Attribution.Title)
+	}
+	if want := "Nature Films"; stored.Attribution.Uploader != want {
+		t.Errorf("expected uploader %q, got %q", want, stored.Attribution.Uploader)
+	}
+	if n := len(stored.Attribution.License); n == 0 || n > maxAttributionFieldLength {
+		t.Errorf("expected the license to be cut to %d characters, got %d", maxAttributionFieldLength, n)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// handlerLibrarySummary returns aggregate stats over the caller's videos.
+func (cfg *apiConfig) handlerLibrarySummary(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, jwtErrorMessage(err), err)
+		return
+	}
+
+	summary, err := cfg.db.GetLibrarySummary(userID)
+	if err != nil {
+		respondWithDBError(w, "Couldn't summarize videos", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, summary)
+}
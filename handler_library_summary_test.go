@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestLibrarySummary(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("summary@example.com")
+
+	size, duration, orientation, thumb := int64(1000), 12.5, "portrait", "http://localhost/assets/a.jpg"
+	video.VideoSize = &size
+	video.Duration = &duration
+	video.Orientation = &orientation
+	video.ThumbnailURL = &thumb
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	// A second, not yet uploaded video
+	if _, err := h.cfg.db.CreateVideo(database.CreateVideoParams{Title: "draft", UserID: video.UserID}); err != nil {
+		t.Fatal(err)
+	}
+	// Another user's video shouldn't be counted
+	h.createUserAndVideo("other@example.com")
+
+	resp := h.do(http.MethodGet, "/api/videos/summary", token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var got database.LibrarySummary
+	decodeJSON(t, resp, &got)
+	if got.TotalVideos != 2 || got.TotalBytes != 1000 || got.TotalDuration != 12.5 || got.MissingThumbnails != 1 {
+		t.Errorf("summary = %+v", got)
+	}
+	if got.ByOrientation["portrait"] != 1 || got.ByOrientation["landscape"] != 0 {
+		t.Errorf("by orientation = %v", got.ByOrientation)
+	}
+}
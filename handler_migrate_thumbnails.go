@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerMigrateThumbnails moves the thumbnails of a page of videos from
+// the assets directory into the bucket, for switching THUMBNAIL_STORAGE to
+// s3. Thumbnails that are already in the bucket are left alone, so a run
+// can be repeated safely; resume an interrupted run by passing the returned
+// next_cursor as ?cursor=. Videos whose thumbnail file is missing are
+// skipped and left to the thumbnail checker.
+func (cfg *apiConfig) handlerMigrateThumbnails(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Processed  int      `json:"processed"`
+		Migrated   int      `json:"migrated"`
+		Missing    int      `json:"missing"`
+		NextCursor *string  `json:"next_cursor"`
+		Errors     []string `json:"errors,omitempty"`
+	}
+
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+	if cfg.thumbnailStorage != thumbnailStorageS3 {
+		respondWithErrorCode(w, http.StatusConflict, errCodeConflict, "Set THUMBNAIL_STORAGE=s3 before migrating thumbnails", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	offset := 0
+	if cursor := query.Get("cursor"); cursor != "" {
+		offset, err = strconv.Atoi(cursor)
+		if err != nil || offset < 0 {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid cursor", err)
+			return
+		}
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 1000 {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "limit must be between 1 and 1000", err)
+			return
+		}
+	}
+
+	videos, err := cfg.db.GetVideosPage(offset, limit)
+	if err != nil {
+		respondWithDBError(w, "Couldn't retrieve videos", err)
+		return
+	}
+
+	resp := response{}
+	for _, video := range videos {
+		resp.Processed++
+		if video.ThumbnailURL == nil {
+			continue
+		}
+		if _, ok := cfg.localThumbnailPath(*video.ThumbnailURL); !ok {
+			continue
+		}
+		if !cfg.uploadLocks.tryLock(video.ID) {
+			resp.Errors = append(resp.Errors, video.ID.String()+": video is being updated, run again to retry")
+			continue
+		}
+		err := cfg.migrateThumbnail(r.Context(), video)
+		cfg.uploadLocks.unlock(video.ID)
+		if errors.Is(err, os.ErrNotExist) {
+			resp.Missing++
+			continue
+		}
+		if err != nil {
+			resp.Errors = append(resp.Errors, video.ID.String()+": "+err.Error())
+			continue
+		}
+		resp.Migrated++
+	}
+
+	if len(videos) == limit {
+		next := strconv.Itoa(offset + len(videos))
+		resp.NextCursor = &next
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// migrateThumbnail uploads a video's thumbnail file and its resized
+// variants to the bucket under the same names, points the video at them and
+// only then removes the files. A variant whose file is missing is dropped.
+func (cfg *apiConfig) migrateThumbnail(ctx context.Context, video database.Video) error {
+	// Re-read the video now that it's locked, in case its thumbnail changed
+	video, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		return err
+	}
+	if video.ThumbnailURL == nil {
+		return nil
+	}
+	path, ok := cfg.localThumbnailPath(*video.ThumbnailURL)
+	if !ok {
+		return nil
+	}
+
+	var uploaded []string
+	removeUploaded := func() {
+		for _, key := range uploaded {
+			if err := cfg.store.Delete(context.WithoutCancel(ctx), key); err != nil {
+				slog.Warn("couldn't delete migrated thumbnail", "key", key, "err", err)
+			}
+		}
+	}
+
+	thumbnailURL, err := cfg.uploadThumbnailFile(ctx, path)
+	if err != nil {
+		return err
+	}
+	uploaded = append(uploaded, thumbnailKeyPrefix+filepath.Base(path))
+	localPaths := []string{path}
+
+	var variants database.ThumbnailVariants
+	for _, variant := range video.ThumbnailVariants {
+		variantPath, ok := cfg.localThumbnailPath(variant.URL)
+		if !ok {
+			variants = append(variants, variant)
+			continue
+		}
+		variant.URL, err = cfg.uploadThumbnailFile(ctx, variantPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			removeUploaded()
+			return err
+		}
+		uploaded = append(uploaded, thumbnailKeyPrefix+filepath.Base(variantPath))
+		localPaths = append(localPaths, variantPath)
+		variants = append(variants, variant)
+	}
+
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailVariants = variants
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		removeUploaded()
+		return fmt.Errorf("couldn't update video: %w", err)
+	}
+
+	for _, localPath := range localPaths {
+		err = os.Remove(localPath)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Warn("couldn't remove migrated thumbnail file", "path", localPath, "err", err)
+		}
+	}
+	return nil
+}
+
+// uploadThumbnailFile copies a thumbnail file from the assets directory
+// into the bucket under the same name and returns its URL.
+func (cfg *apiConfig) uploadThumbnailFile(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	key := thumbnailKeyPrefix + filepath.Base(path)
+	_, err = cfg.store.Put(ctx, key, f, mime.TypeByExtension(filepath.Ext(path)), "")
+	if err != nil {
+		return "", fmt.Errorf("couldn't upload thumbnail: %w", err)
+	}
+	return cfg.s3CfDistribution + "/" + key, nil
+}
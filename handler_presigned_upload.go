@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// presignedUploadExpiry is how long a direct upload URL stays valid.
+const presignedUploadExpiry = 15 * time.Minute
+
+// S3Presigner signs upload and download URLs. *s3.PresignClient satisfies
+// it; tests swap in a fake.
+type S3Presigner interface {
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+	PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+	PresignPostObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignPostOptions)) (*s3.PresignedPostRequest, error)
+}
+
+// handlerCreatePresignedUpload returns a URL the client can upload a video
+// to directly, so large files don't pass through this server. By default
+// that's a presigned PUT; with "method": "POST" it's a POST policy for an
+// HTML form, whose fields the browser sends ahead of the file. Either way
+// the signature pins the content type and exact size the client declared.
+// Once the upload succeeds the client calls handlerFinalizeUpload.
+func (cfg *apiConfig) handlerCreatePresignedUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+		Method      string `json:"method"`
+	}
+	type response struct {
+		UploadURL string            `json:"upload_url"`
+		Method    string            `json:"method"`
+		Headers   map[string]string `json:"headers"`
+		Fields    map[string]string `json:"fields,omitempty"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	if cfg.presigner == nil {
+		respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeUnavailable, "Direct uploads need an S3 storage backend", nil)
+		return
+	}
+	video, userID, ok := cfg.directUploadVideo(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.videoTypeAllowed(params.ContentType) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidVideo, "Invalid video type", nil)
+		return
+	}
+	if params.Size <= 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "size must be a positive number of bytes", nil)
+		return
+	}
+	if params.Size > maxVideoUploadBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Video is larger than the 1 GB limit", nil)
+		return
+	}
+	if params.Method == "" {
+		params.Method = http.MethodPut
+	}
+	if params.Method != http.MethodPut && params.Method != http.MethodPost {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "method must be PUT or POST", nil)
+		return
+	}
+
+	randomBytes := make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating random bytes", err)
+		return
+	}
+	key := "uploads/" + hex.EncodeToString(randomBytes)
+	bucket := cfg.resolveBucket(userID)
+
+	resp := response{
+		Method:    params.Method,
+		Headers:   map[string]string{},
+		ExpiresAt: time.Now().Add(presignedUploadExpiry).UTC(),
+	}
+	if params.Method == http.MethodPost {
+		presigned, err := cfg.presigner.PresignPostObject(r.Context(), &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}, func(o *s3.PresignPostOptions) {
+			o.Expires = presignedUploadExpiry
+			o.Conditions = []interface{}{
+				[]interface{}{"content-length-range", params.Size, params.Size},
+				map[string]string{"Content-Type": params.ContentType},
+			}
+		})
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't create upload URL", err)
+			return
+		}
+		resp.UploadURL = presigned.URL
+		resp.Fields = presigned.Values
+		resp.Fields["Content-Type"] = params.ContentType
+	} else {
+		presigned, err := cfg.presigner.PresignPutObject(r.Context(), &s3.PutObjectInput{
+			Bucket:        aws.String(bucket),
+			Key:           aws.String(key),
+			ContentType:   aws.String(params.ContentType),
+			ContentLength: aws.Int64(params.Size),
+		}, s3.WithPresignExpires(presignedUploadExpiry))
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't create upload URL", err)
+			return
+		}
+		resp.UploadURL = presigned.URL
+		for name, values := range presigned.SignedHeader {
+			if len(values) > 0 && http.CanonicalHeaderKey(name) != "Host" {
+				resp.Headers[http.CanonicalHeaderKey(name)] = values[0]
+			}
+		}
+	}
+
+	// Only the latest URL can be finalized, so an earlier upload that was
+	// never finalized is dropped
+	if video.PendingUploadKey != nil {
+		err := cfg.storeForBucket(bucket).Delete(r.Context(), *video.PendingUploadKey)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			slog.Warn("couldn't delete abandoned direct upload", "video_id", video.ID, "key", *video.PendingUploadKey, "err", err)
+		}
+	}
+	video.PendingUploadKey = &key
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithDBError(w, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerFinalizeUpload processes a video the client uploaded directly to
+// S3 the same way a regular upload is processed, then removes the staged
+// original.
+func (cfg *apiConfig) handlerFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		FileName       string `json:"file_name"`
+		NormalizeAudio string `json:"normalize_audio"`
+		Watermark      string `json:"watermark"`
+		AutoCaptions   string `json:"auto_captions"`
+		StorageClass   string `json:"storage_class"`
+	}
+
+	video, userID, ok := cfg.directUploadVideo(w, r)
+	if !ok {
+		return
+	}
+
+	// The body is optional
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Couldn't decode parameters", err)
+		return
+	}
+	storageClass, err := cfg.uploadStorageClass(params.StorageClass)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid storage class", err)
+		return
+	}
+
+	if video.PendingUploadKey == nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoNotReady, "No direct upload is pending for this video", nil)
+		return
+	}
+	stagedKey := *video.PendingUploadKey
+
+	if !cfg.uploadLocks.tryLock(video.ID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is already in progress", nil)
+		return
+	}
+	defer cfg.releaseUploadLock(video.ID)
+
+	store := cfg.storeForBucket(cfg.resolveBucket(userID))
+	info, err := store.Head(r.Context(), stagedKey)
+	if errors.Is(err, ErrObjectNotFound) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoNotReady, "The upload hasn't been received yet", err)
+		return
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't check uploaded video", err)
+		return
+	}
+
+	// discardStaged forgets the staged original once it's no longer needed
+	discardStaged := func() bool {
+		err := store.Delete(context.WithoutCancel(r.Context()), stagedKey)
+		if err != nil {
+			slog.Warn("couldn't delete staged upload", "video_id", video.ID, "key", stagedKey, "err", err)
+		}
+		video.PendingUploadKey = nil
+		err = cfg.db.UpdateVideo(video)
+		if err != nil {
+			respondWithDBError(w, "Couldn't update video", err)
+			return false
+		}
+		return true
+	}
+
+	// The presigned URL pins the size, but don't rely on it alone
+	if info.Size > maxVideoUploadBytes {
+		if discardStaged() {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Video is larger than the 1 GB limit", nil)
+		}
+		return
+	}
+
+	sourcePath, err := downloadToTemp(r.Context(), store, stagedKey)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't download uploaded video", err)
+		return
+	}
+	defer os.Remove(sourcePath)
+
+	mediaType, sourceSHA256, err := inspectUploadedFile(sourcePath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read uploaded video", err)
+		return
+	}
+	mediaType, err = cfg.confirmVideoType(r.Context(), sourcePath, mediaType)
+	if err != nil {
+		respondWithMediaToolError(w, "Error checking video type", err)
+		return
+	}
+	if !cfg.videoTypeAllowed(mediaType) {
+		if discardStaged() {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidVideo, "Invalid video type", nil)
+		}
+		return
+	}
+	if video.SourceSHA256 != nil && *video.SourceSHA256 == sourceSHA256 {
+		if discardStaged() {
+			cfg.progress.set(video.ID, uploadProgress{Stage: stageDone})
+			respondWithJSON(w, http.StatusOK, unchangedVideoResponse{videoResponse: cfg.videoResponse(r.Context(), video), Unchanged: true})
+		}
+		return
+	}
+
+	fileName := params.FileName
+	if fileName == "" {
+		fileName = "video.mp4"
+	}
+	video.PendingUploadKey = nil
+	stored := cfg.processAndStoreVideo(w, r, video, userID, videoUpload{
+		path:           sourcePath,
+		mediaType:      mediaType,
+		fileName:       fileName,
+		sourceSHA256:   sourceSHA256,
+		normalizeAudio: params.NormalizeAudio,
+		watermark:      params.Watermark,
+		autoCaptions:   params.AutoCaptions,
+		storageClass:   storageClass,
+	})
+	if stored {
+		err := store.Delete(context.WithoutCancel(r.Context()), stagedKey)
+		if err != nil {
+			slog.Warn("couldn't delete staged upload", "video_id", video.ID, "key", stagedKey, "err", err)
+		}
+	}
+}
+
+// directUploadVideo authenticates a direct upload request and loads the
+// video it targets, writing the error response if it can't be used.
+func (cfg *apiConfig) directUploadVideo(w http.ResponseWriter, r *http.Request) (database.Video, uuid.UUID, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return database.Video{}, uuid.Nil, false
+	}
+
+	userID, ok := cfg.authenticateUploader(w, r)
+	if !ok {
+		return database.Video{}, uuid.Nil, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return database.Video{}, uuid.Nil, false
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotVideoOwner, "You must be the video owner", nil)
+		return database.Video{}, uuid.Nil, false
+	}
+	if video.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash before uploading", nil)
+		return database.Video{}, uuid.Nil, false
+	}
+	return video, userID, true
+}
+
+// inspectUploadedFile sniffs a file's container type and hashes it.
+func inspectUploadedFile(path string) (mediaType, sha string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", "", fmt.Errorf("couldn't read header: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", "", err
+	}
+	return detectVideoType(header[:n]), hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakePresigner records what it was asked to sign.
+type fakePresigner struct {
+	inputs     []*s3.PutObjectInput
+	conditions []interface{}
+}
+
+func (p *fakePresigner) PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	p.inputs = append(p.inputs, params)
+	return &v4.PresignedHTTPRequest{
+		URL:    fmt.Sprintf("https://%s.s3.example.com/%s?X-Amz-Signature=abc", aws.ToString(params.Bucket), aws.ToString(params.Key)),
+		Method: http.MethodPut,
+		SignedHeader: http.Header{
+			"Content-Type":   []string{aws.ToString(params.ContentType)},
+			"Content-Length": []string{fmt.Sprint(aws.ToInt64(params.ContentLength))},
+			"Host":           []string{aws.ToString(params.Bucket) + ".s3.example.com"},
+		},
+	}, nil
+}
+
+func (p *fakePresigner) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	var options s3.PresignOptions
+	for _, fn := range optFns {
+		fn(&options)
+	}
+	return &v4.PresignedHTTPRequest{
+		URL:    fmt.Sprintf("https://%s.s3.example.com/%s?X-Amz-Expires=%d", aws.ToString(params.Bucket), aws.ToString(params.Key), int(options.Expires.Seconds())),
+		Method: http.MethodGet,
+	}, nil
+}
+
+func (p *fakePresigner) PresignPostObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignPostOptions)) (*s3.PresignedPostRequest, error) {
+	p.inputs = append(p.inputs, params)
+	var options s3.PresignPostOptions
+	for _, fn := range optFns {
+		fn(&options)
+	}
+	p.conditions = options.Conditions
+	return &s3.PresignedPostRequest{
+		URL:    fmt.Sprintf("https://%s.s3.example.com", aws.ToString(params.Bucket)),
+		Values: map[string]string{"key": aws.ToString(params.Key), "policy": "e30=", "X-Amz-Signature": "abc"},
+	}, nil
+}
+
+type presignedUploadResponse struct {
+	UploadURL string            `json:"upload_url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	Fields    map[string]string `json:"fields"`
+}
+
+func TestPresignedUploadRoundTrip(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	presigner := &fakePresigner{}
+	h.cfg.presigner = presigner
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	body := fmt.Sprintf(`{"content_type":"video/mp4","size":%d}`, len(minimalMP4))
+	resp := h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/upload_url", video.ID), token, strings.NewReader(body))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var presigned presignedUploadResponse
+	decodeJSON(t, resp, &presigned)
+	if presigned.Method != http.MethodPut || presigned.UploadURL == "" {
+		t.Fatalf("unexpected response %+v", presigned)
+	}
+	if presigned.Headers["Content-Type"] != "video/mp4" {
+		t.Errorf("expected the content type to be signed, got %v", presigned.Headers)
+	}
+	if _, ok := presigned.Headers["Host"]; ok {
+		t.Error("Host shouldn't be returned as a header to send")
+	}
+
+	input := presigner.inputs[0]
+	if aws.ToInt64(input.ContentLength) != int64(len(minimalMP4)) {
+		t.Errorf("expected the size to be signed, got %d", aws.ToInt64(input.ContentLength))
+	}
+	stagedKey := aws.ToString(input.Key)
+	if !strings.HasPrefix(stagedKey, "uploads/") {
+		t.Fatalf("expected a staging key, got %s", stagedKey)
+	}
+
+	// Finalizing before the object arrives is a conflict
+	resp = h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/finalize_upload", video.ID), token, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 before the upload, got %d", resp.StatusCode)
+	}
+
+	// Simulate the client's PUT
+	h.s3.objects[stagedKey] = minimalMP4
+
+	resp = h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/finalize_upload", video.ID), token, strings.NewReader(`{"file_name":"clip.mp4"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	keys := h.s3.keys()
+	if len(keys) != 1 || !strings.HasPrefix(keys[0], "other/") {
+		t.Fatalf("expected only the processed video to remain, got %v", keys)
+	}
+	stored := h.getVideo(video.ID)
+	if stored.VideoURL == nil || stored.PendingUploadKey != nil {
+		t.Fatalf("expected video stored and nothing pending, got %v %v", stored.VideoURL, stored.PendingUploadKey)
+	}
+	if stored.VideoFilename == nil || *stored.VideoFilename != "clip.mp4" {
+		t.Errorf("expected file name clip.mp4, got %v", stored.VideoFilename)
+	}
+
+	// Nothing is pending any more
+	resp = h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/finalize_upload", video.ID), token, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 with nothing pending, got %d", resp.StatusCode)
+	}
+}
+
+func TestPresignedUploadPostPolicy(t *testing.T) {
+	h := newTestHarness(t)
+	presigner := &fakePresigner{}
+	h.cfg.presigner = presigner
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	resp := h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/upload_url", video.ID), token,
+		strings.NewReader(`{"content_type":"video/mp4","size":1234,"method":"POST"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var presigned presignedUploadResponse
+	decodeJSON(t, resp, &presigned)
+	if presigned.Method != http.MethodPost || presigned.UploadURL == "" {
+		t.Fatalf("unexpected response %+v", presigned)
+	}
+	if presigned.Fields["Content-Type"] != "video/mp4" || !strings.HasPrefix(presigned.Fields["key"], "uploads/") {
+		t.Errorf("expected the form fields to carry the type and key, got %v", presigned.Fields)
+	}
+
+	wantConditions := []interface{}{
+		[]interface{}{"content-length-range", int64(1234), int64(1234)},
+		map[string]string{"Content-Type": "video/mp4"},
+	}
+	if !reflect.DeepEqual(presigner.conditions, wantConditions) {
+		t.Errorf("expected the policy to pin the size and type, got %v", presigner.conditions)
+	}
+	if stored := h.getVideo(video.ID); stored.PendingUploadKey == nil || *stored.PendingUploadKey != presigned.Fields["key"] {
+		t.Errorf("expected the signed key to be pending, got %v", stored.PendingUploadKey)
+	}
+}
+
+func TestPresignedUploadRejectsBadRequests(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.presigner = &fakePresigner{}
+	token, video := h.createUserAndVideo("owner@example.com")
+	otherToken, _ := h.createUserAndVideo("other@example.com")
+	path := fmt.Sprintf("/api/videos/%s/upload_url", video.ID)
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+		code   string
+	}{
+		{"wrong type", token, `{"content_type":"video/x-matroska","size":10}`, http.StatusBadRequest, errCodeInvalidVideo},
+		{"no size", token, `{"content_type":"video/mp4"}`, http.StatusBadRequest, errCodeInvalidParams},
+		{"too large", token, fmt.Sprintf(`{"content_type":"video/mp4","size":%d}`, int64(maxVideoUploadBytes)+1), http.StatusRequestEntityTooLarge, errCodeTooLarge},
+		{"bad method", token, `{"content_type":"video/mp4","size":10,"method":"PATCH"}`, http.StatusBadRequest, errCodeInvalidParams},
+		{"not owner", otherToken, `{"content_type":"video/mp4","size":10}`, http.StatusUnauthorized, errCodeNotVideoOwner},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := h.do(http.MethodPost, path, tc.token, strings.NewReader(tc.body))
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected %d, got %d", tc.status, resp.StatusCode)
+			}
+			if code := errorCode(t, resp); code != tc.code {
+				t.Errorf("expected %s, got %s", tc.code, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// defaultPublicPageSize is how many public videos a page holds when the
+// client doesn't ask for a limit.
+const defaultPublicPageSize = 20
+
+// handlerPublicVideosRetrieve lists everyone's public videos that are ready
+// to play, newest first. It needs no login and is always paged, with the
+// X-Next-Cursor and Link headers pointing at the next page like the
+// caller's own listing.
+func (cfg *apiConfig) handlerPublicVideosRetrieve(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	params := database.ListVideosParams{
+		Visibility: database.VisibilityPublic,
+		Status:     videoReady,
+		SortBy:     "created_at",
+		Descending: true,
+		Limit:      defaultPublicPageSize,
+	}
+
+	var err error
+	if value := query.Get("limit"); value != "" {
+		params.Limit, err = strconv.Atoi(value)
+		if err != nil || params.Limit < 1 || params.Limit > maxVideoPageSize {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, fmt.Sprintf("limit must be between 1 and %d", maxVideoPageSize), err)
+			return
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		params.After, err = uuid.Parse(cursor)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid cursor", err)
+			return
+		}
+		after, err := cfg.db.GetVideo(params.After)
+		if err != nil || after.Visibility != database.VisibilityPublic || after.DeletedAt != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Cursor is no longer valid, start from the first page", err)
+			return
+		}
+	}
+
+	// One extra video says whether there's another page
+	params.Limit++
+	videos, err := cfg.db.ListVideos(params)
+	if err != nil {
+		respondWithDBError(w, "Couldn't retrieve videos", err)
+		return
+	}
+	if len(videos) == params.Limit {
+		videos = videos[:len(videos)-1]
+		next := videos[len(videos)-1].ID.String()
+		nextQuery := r.URL.Query()
+		nextQuery.Set("cursor", next)
+		w.Header().Set("X-Next-Cursor", next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, cfg.publicURL(r.Context(), "/api/videos/public?"+nextQuery.Encode())))
+	}
+
+	respondWithCachedJSON(w, r, cfg.videoResponses(r.Context(), videos), time.Time{})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// handlerReconcileStorage runs the orphan collector on demand. It only
+// reports the objects no video references unless called with
+// ?confirm=true, in which case they're deleted. ?min_age overrides how old
+// an object must be to count, e.g. "0s" to include uploads that may still
+// be in progress.
+func (cfg *apiConfig) handlerReconcileStorage(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("confirm") != "true"
+	minAge := cfg.orphanMinAge
+	if value := r.URL.Query().Get("min_age"); value != "" {
+		minAge, err = time.ParseDuration(value)
+		if err != nil || minAge < 0 {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "min_age must be a non-negative duration", err)
+			return
+		}
+	}
+
+	report, err := cfg.collectOrphans(r.Context(), dryRun, minAge)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reconcile storage", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
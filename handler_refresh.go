@@ -1,44 +1,99 @@
 package main
 
 import (
+	"errors"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
+// Access tokens are short-lived and can't be revoked, so sessions are kept
+// alive with refresh tokens, which can.
+const (
+	accessTokenTTL  = time.Hour
+	refreshTokenTTL = 60 * 24 * time.Hour
+)
+
+// handlerRefresh trades a refresh token for a new access token and a new
+// refresh token. Each refresh token works once: it's revoked as it's
+// rotated, and if a revoked one is presented again it must have been
+// copied, so every session of its user is revoked.
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't find token", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingToken, "Couldn't find token", err)
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	stored, err := cfg.db.GetRefreshToken(refreshToken)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithDBError(w, "Couldn't get refresh token", err)
+		return
+	}
+	switch {
+	case stored.Token == "":
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Invalid refresh token", nil)
+		return
+	case stored.RevokedAt != nil:
+		slog.Warn("revoked refresh token reused, ending all sessions", "user_id", stored.UserID)
+		err = cfg.db.RevokeUserRefreshTokens(stored.UserID)
+		if err != nil {
+			respondWithDBError(w, "Couldn't revoke sessions", err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Refresh token has been revoked", nil)
+		return
+	case time.Now().After(stored.ExpiresAt):
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeTokenExpired, "Refresh token expired", nil)
 		return
 	}
 
-	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour,
-	)
+	next, err := auth.MakeRefreshToken()
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		return
+	}
+	err = cfg.db.RotateRefreshToken(refreshToken, database.CreateRefreshTokenParams{
+		Token:     next,
+		UserID:    stored.UserID,
+		ExpiresAt: time.Now().UTC().Add(refreshTokenTTL),
+	})
+	if errors.Is(err, database.ErrNotFound) {
+		// Another request rotated it first
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Refresh token has been revoked", nil)
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, "Couldn't rotate refresh token", err)
 		return
 	}
 
+	accessToken, err := cfg.makeAccessToken(stored.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: next,
 	})
 }
 
+func (cfg *apiConfig) makeAccessToken(userID uuid.UUID) (string, error) {
+	return auth.MakeJWT(userID, cfg.jwtSecret, accessTokenTTL, cfg.jwtScope)
+}
+
 func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
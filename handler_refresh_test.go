@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	h := newTestHarness(t)
+	credentials := `{"email":"rotate@example.com","password":"hunter22"}`
+	if resp := h.do(http.MethodPost, "/api/users", "", strings.NewReader(credentials)); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("signup: expected 201, got %d", resp.StatusCode)
+	}
+	resp := h.do(http.MethodPost, "/api/login", "", strings.NewReader(credentials))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: expected 200, got %d", resp.StatusCode)
+	}
+	type tokens struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	var login tokens
+	decodeJSON(t, resp, &login)
+
+	refresh := func(token string, want int) tokens {
+		t.Helper()
+		resp := h.do(http.MethodPost, "/api/refresh", token, nil)
+		if resp.StatusCode != want {
+			t.Fatalf("refresh: expected %d, got %d", want, resp.StatusCode)
+		}
+		var got tokens
+		if want == http.StatusOK {
+			decodeJSON(t, resp, &got)
+		}
+		return got
+	}
+
+	rotated := refresh(login.RefreshToken, http.StatusOK)
+	if rotated.Token == "" || rotated.RefreshToken == "" || rotated.RefreshToken == login.RefreshToken {
+		t.Fatalf("refresh didn't rotate: %+v", rotated)
+	}
+	if resp := h.do(http.MethodGet, "/api/videos", rotated.Token, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("new access token rejected: %d", resp.StatusCode)
+	}
+	rotated = refresh(rotated.RefreshToken, http.StatusOK)
+
+	// Reusing a rotated token ends the session it was rotated into too
+	refresh(login.RefreshToken, http.StatusUnauthorized)
+	refresh(rotated.RefreshToken, http.StatusUnauthorized)
+
+	refresh("not-a-token", http.StatusUnauthorized)
+	refresh("", http.StatusBadRequest)
+
+	resp = h.do(http.MethodPost, "/api/login", "", strings.NewReader(credentials))
+	decodeJSON(t, resp, &login)
+	if resp := h.do(http.MethodPost, "/api/revoke", login.RefreshToken, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: expected 204, got %d", resp.StatusCode)
+	}
+	refresh(login.RefreshToken, http.StatusUnauthorized)
+
+	user, err := h.cfg.db.GetUserByEmail("rotate@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
+		Token:     "expired",
+		UserID:    user.ID,
+		ExpiresAt: time.Now().UTC().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = h.do(http.MethodPost, "/api/refresh", "expired", nil)
+	if resp.StatusCode != http.StatusUnauthorized || errorCode(t, resp) != errCodeTokenExpired {
+		t.Errorf("expired token: got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerResignVideos rewrites the stored video, preview and thumbnail URLs
+// of a page of videos into the current format, e.g. after S3_CF_DISTRO or
+// PUBLIC_BASE_URL changes, and records video keys older rows lack. URLs
+// under a retired distribution are recognized when it's passed as ?from=.
+// Rows that are already current are left alone, so a run can be repeated
+// safely; resume an interrupted run by passing the returned next_cursor as
+// ?cursor=.
+func (cfg *apiConfig) handlerResignVideos(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Processed  int      `json:"processed"`
+		Updated    int      `json:"updated"`
+		NextCursor *string  `json:"next_cursor"`
+		Errors     []string `json:"errors,omitempty"`
+	}
+
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	query := r.URL.Query()
+	offset := 0
+	if cursor := query.Get("cursor"); cursor != "" {
+		offset, err = strconv.Atoi(cursor)
+		if err != nil || offset < 0 {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid cursor", err)
+			return
+		}
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 1000 {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "limit must be between 1 and 1000", err)
+			return
+		}
+	}
+	oldPrefixes := []string{}
+	for _, from := range query["from"] {
+		oldPrefixes = append(oldPrefixes, strings.TrimSuffix(from, "/")+"/")
+	}
+
+	videos, err := cfg.db.GetVideosPage(offset, limit)
+	if err != nil {
+		respondWithDBError(w, "Couldn't retrieve videos", err)
+		return
+	}
+
+	resp := response{}
+	for _, video := range videos {
+		resp.Processed++
+		changed, err := cfg.rewriteStoredURLs(&video, oldPrefixes)
+		if err != nil {
+			resp.Errors = append(resp.Errors, video.ID.String()+": "+err.Error())
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := cfg.db.UpdateVideo(video); err != nil {
+			resp.Errors = append(resp.Errors, video.ID.String()+": "+err.Error())
+			continue
+		}
+		resp.Updated++
+	}
+
+	if len(videos) == limit {
+		next := strconv.Itoa(offset + len(videos))
+		resp.NextCursor = &next
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// rewriteStoredURLs points a video's URLs at the current distribution and
+// base URL, and reports whether anything changed.
+func (cfg *apiConfig) rewriteStoredURLs(video *database.Video, oldPrefixes []string) (bool, error) {
+	changed := false
+	// Rows from before video keys were stored get theirs filled in
+	if video.VideoURL != nil && video.VideoKey == nil {
+		key, ok := cfg.videoKeyFromURL(*video.VideoURL)
+		if !ok {
+			key, ok = keyUnderPrefixes(*video.VideoURL, oldPrefixes)
+		}
+		if ok {
+			video.VideoKey = &key
+			changed = true
+		}
+	}
+	for _, stored := range []*string{video.VideoURL, video.PreviewURL, video.SpriteURL, video.SpriteVTTURL, video.HLSURL} {
+		if stored == nil {
+			continue
+		}
+		key, ok := cfg.videoKeyFromURL(*stored)
+		if !ok {
+			key, ok = keyUnderPrefixes(*stored, oldPrefixes)
+		}
+		if !ok {
+			return false, fmt.Errorf("unrecognized URL %s", *stored)
+		}
+		current := cfg.s3CfDistribution + "/" + key
+		if *stored != current {
+			*stored = current
+			changed = true
+		}
+	}
+
+	if video.ThumbnailURL != nil {
+		current := cfg.assetURL(context.Background(), filepath.Base(*video.ThumbnailURL))
+		// Thumbnails in the bucket move with the distribution instead
+		key, ok := cfg.thumbnailKey(*video.ThumbnailURL)
+		if !ok {
+			key, ok = keyUnderPrefixes(*video.ThumbnailURL, oldPrefixes)
+			ok = ok && strings.HasPrefix(key, thumbnailKeyPrefix)
+		}
+		if ok {
+			current = cfg.s3CfDistribution + "/" + key
+		}
+		if *video.ThumbnailURL != current {
+			*video.ThumbnailURL = current
+			changed = true
+		}
+	}
+	for i, track := range video.Captions {
+		current := cfg.assetURL(context.Background(), filepath.Base(track.URL))
+		if track.Key != "" {
+			current = cfg.s3CfDistribution + "/" + track.Key
+		}
+		if track.URL != current {
+			video.Captions[i].URL = current
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// keyUnderPrefixes strips the first matching prefix from a stored URL.
+func keyUnderPrefixes(storedURL string, prefixes []string) (string, bool) {
+	for _, prefix := range prefixes {
+		if key, ok := strings.CutPrefix(storedURL, prefix); ok && key != "" {
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResignVideosRewritesOldDistribution(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.adminAPIKey = "admin-key"
+	_, video := h.createUserAndVideo("owner@example.com")
+	_, current := h.createUserAndVideo("other@example.com")
+
+	oldURL := "https://old-cdn.example.com/landscape/abc.mp4"
+	video.VideoURL = &oldURL
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	currentURL := h.cfg.s3CfDistribution + "/portrait/def.mp4"
+	current.VideoURL = &currentURL
+	currentKey := "portrait/def.mp4"
+	current.VideoKey = &currentKey
+	if err := h.cfg.db.UpdateVideo(current); err != nil {
+		t.Fatal(err)
+	}
+
+	resign := func(query string) (processed, updated int, next *string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/resign_videos"+query, nil)
+		req.Header.Set("Authorization", "ApiKey admin-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		var body struct {
+			Processed  int      `json:"processed"`
+			Updated    int      `json:"updated"`
+			NextCursor *string  `json:"next_cursor"`
+			Errors     []string `json:"errors"`
+		}
+		decodeJSON(t, resp, &body)
+		return body.Processed, body.Updated, body.NextCursor
+	}
+
+	// One per page, so the cursor has to be followed
+	totalProcessed, totalUpdated, pages := 0, 0, 0
+	query := "?limit=1&from=https://old-cdn.example.com"
+	for {
+		processed, updated, next := resign(query)
+		totalProcessed += processed
+		totalUpdated += updated
+		pages++
+		if next == nil {
+			break
+		}
+		query = "?limit=1&from=https://old-cdn.example.com&cursor=" + *next
+	}
+	if totalProcessed != 2 || totalUpdated != 1 || pages != 3 {
+		t.Fatalf("processed %d, updated %d over %d pages", totalProcessed, totalUpdated, pages)
+	}
+
+	want := h.cfg.s3CfDistribution + "/landscape/abc.mp4"
+	got := h.getVideo(video.ID)
+	if got.VideoURL == nil || *got.VideoURL != want {
+		t.Fatalf("expected %s, got %v", want, got.VideoURL)
+	}
+	if got.VideoKey == nil || *got.VideoKey != "landscape/abc.mp4" {
+		t.Errorf("expected the video key to be recorded, got %v", got.VideoKey)
+	}
+
+	// A second run has nothing left to do
+	if _, updated, _ := resign("?from=https://old-cdn.example.com"); updated != 0 {
+		t.Fatalf("expected a rerun to change nothing, updated %d", updated)
+	}
+}
+
+func TestResignVideosRequiresAdmin(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.adminAPIKey = "admin-key"
+	resp := h.do(http.MethodPost, "/admin/resign_videos", "", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", resp.StatusCode)
+	}
+}
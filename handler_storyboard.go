@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/google/uuid"
+)
+
+// maxStoryboardSize bounds how much of a stored sprite index is read. A
+// full sheet's index is a few kilobytes.
+const maxStoryboardSize = 1 << 20
+
+// handlerStoryboardVTT serves a video's sprite sheet index with its cues
+// pointing at the sheet's delivery URL, signed if the video's are.
+func (cfg *apiConfig) handlerStoryboardVTT(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.DeletedAt != nil || !cfg.canViewVideo(r, video) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if video.SpriteURL == nil || video.SpriteVTTURL == nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Video has no storyboard", nil)
+		return
+	}
+
+	spriteKey, ok := cfg.videoKeyFromURL(*video.SpriteURL)
+	vttKey, vttOK := cfg.videoKeyFromURL(*video.SpriteVTTURL)
+	if !ok || !vttOK {
+		respondWithError(w, http.StatusInternalServerError, "Invalid storyboard URL format", nil)
+		return
+	}
+	imageURL := cfg.deliveryURL(video, video.SpriteURL)
+	if imageURL == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign sprite sheet URL", nil)
+		return
+	}
+
+	body, _, err := cfg.videoStore(video).Get(r.Context(), vttKey)
+	if errors.Is(err, ErrObjectNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Storyboard is missing", err)
+		return
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't get storyboard", err)
+		return
+	}
+	defer body.Close()
+	vtt, err := io.ReadAll(io.LimitReader(body, maxStoryboardSize))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't read storyboard", err)
+		return
+	}
+
+	// The signed URL inside expires, so it mustn't be cached past that
+	w.Header().Set("Content-Type", "text/vtt")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, rewriteSpriteVTT(string(vtt), path.Base(spriteKey), *imageURL))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+)
+
+// How GET /api/videos/{videoID}/stream serves a video, set with
+// VIDEO_STREAM_MODE: by proxying the bytes from the store, or by
+// redirecting to a short-lived signed URL.
+const (
+	streamModeProxy    = "proxy"
+	streamModeRedirect = "redirect"
+)
+
+// handlerStreamVideo serves a video, or with ?quality= one of its
+// renditions, for playback in a <video> tag. Range, If-Range and the other
+// conditional headers are honored, so players can seek. The store is read
+// in chunks, so a short range fetches little more than its own bytes.
+func (cfg *apiConfig) handlerStreamVideo(w http.ResponseWriter, r *http.Request) {
+	video, key, ok := cfg.requestedVideoFile(w, r)
+	if !ok {
+		return
+	}
+
+	if cfg.streamMode == streamModeRedirect {
+		signed := cfg.signedURL(video, key)
+		if signed == nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", nil)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, *signed, http.StatusFound)
+		return
+	}
+
+	store := cfg.videoStore(video)
+	info, err := store.Head(r.Context(), key)
+	if errors.Is(err, ErrObjectNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeObjectMissing, "Video file is missing", err)
+		return
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadGateway, errCodeStorageFailed, "Couldn't get video file", err)
+		return
+	}
+
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "video/mp4"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	content := &objectReadSeeker{ctx: r.Context(), store: store, key: key, size: info.Size}
+	defer content.Close()
+	http.ServeContent(w, r, path.Base(key), info.LastModified, content)
+}
+
+// Bounds on how much of an object objectReadSeeker fetches at once. A
+// read after a seek starts with the smallest chunk, since http.ServeContent
+// doesn't say how much of a range it's going to copy, and each chunk after
+// that is twice as big, so long reads still take few requests.
+const (
+	minStreamChunk = 1 << 20  // 1 MB
+	maxStreamChunk = 64 << 20 // 64 MB
+)
+
+// objectReadSeeker reads a stored object as an io.ReadSeeker for
+// http.ServeContent, fetching it a chunk at a time from the current offset
+// on the first read after each seek.
+type objectReadSeeker struct {
+	ctx   context.Context
+	store ObjectStore
+	key   string
+	size  int64
+
+	offset int64
+	body   io.ReadCloser
+	// bodyEnd is where the chunk being read ends, and chunk is the size
+	// of the next one, or zero to start over from minStreamChunk.
+	bodyEnd int64
+	chunk   int64
+}
+
+func (o *objectReadSeeker) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		o.chunk = max(o.chunk, minStreamChunk)
+		length := min(o.chunk, o.size-o.offset)
+		body, err := o.store.GetRange(o.ctx, o.key, o.offset, length)
+		if err != nil {
+			return 0, err
+		}
+		o.body, o.bodyEnd = body, o.offset+length
+		o.chunk = min(o.chunk*2, maxStreamChunk)
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if o.offset >= o.bodyEnd {
+		// The next read fetches the chunk after this one
+		o.Close()
+		if err == io.EOF && o.offset < o.size {
+			err = nil
+		}
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *objectReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %d", offset)
+	}
+	if offset != o.offset {
+		o.Close()
+		o.offset = offset
+		o.chunk = 0
+	}
+	return offset, nil
+}
+
+func (o *objectReadSeeker) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
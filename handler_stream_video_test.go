@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestStreamVideo(t *testing.T) {
+	h := newTestHarness(t)
+	_, video := h.createUserAndVideo("stream@example.com")
+
+	videoKey := "landscape/stream.mp4"
+	videoURL := h.cfg.s3CfDistribution + "/" + videoKey
+	video.VideoURL = &videoURL
+	video.VideoKey = &videoKey
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	h.s3.objects[videoKey] = data
+	h.s3.ctypes[videoKey] = "video/mp4"
+	etag, err := h.cfg.store.Head(context.Background(), videoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/api/videos/" + video.ID.String() + "/stream"
+	get := func(headers map[string]string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, h.srv.URL+path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := h.send(req)
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get(nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("full stream: %d, %d bytes", resp.StatusCode, len(body))
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" || resp.Header.Get("Content-Type") != "video/mp4" {
+		t.Errorf("headers = %v", resp.Header)
+	}
+
+	resp, body = get(map[string]string{"Range": "bytes=100-199"})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[100:200]) {
+		t.Fatalf("range: %d, %d bytes", resp.StatusCode, len(body))
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "bytes 100-199/1000" {
+		t.Errorf("Content-Range = %q", cr)
+	}
+
+	resp, body = get(map[string]string{"Range": "bytes=900-"})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[900:]) {
+		t.Fatalf("open-ended range: %d, %d bytes", resp.StatusCode, len(body))
+	}
+
+	// A stale If-Range gets the whole current file instead of a piece
+	resp, _ = get(map[string]string{"Range": "bytes=0-9", "If-Range": etag.ETag})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("matching If-Range: expected 206, got %d", resp.StatusCode)
+	}
+	resp, body = get(map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`})
+	if resp.StatusCode != http.StatusOK || len(body) != len(data) {
+		t.Errorf("stale If-Range: %d, %d bytes", resp.StatusCode, len(body))
+	}
+
+	resp, _ = get(map[string]string{"Range": "bytes=5000-"})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */1000" {
+		t.Errorf("unsatisfiable range: %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+
+	var got videoResponse
+	decodeJSON(t, h.do(http.MethodGet, "/api/videos/"+video.ID.String(), "", nil), &got)
+	if got.StreamURL == nil || *got.StreamURL != h.cfg.publicURL(context.Background(), path) {
+		t.Errorf("stream_url = %v", got.StreamURL)
+	}
+
+	// Redirect mode hands players a signed URL instead
+	h.cfg.presigner = &fakePresigner{}
+	h.cfg.store = newS3ObjectStore(h.s3, h.cfg.presigner, h.cfg.s3Bucket, 1, 0)
+	h.cfg.streamMode = streamModeRedirect
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.Get(h.srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	want := fmt.Sprintf("https://tubely-test.s3.example.com/%s?X-Amz-Expires=3600", videoKey)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != want {
+		t.Errorf("redirect: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+// rangeRecordingStore notes the length of every range read from it.
+type rangeRecordingStore struct {
+	ObjectStore
+	lengths []int64
+}
+
+func (s *rangeRecordingStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	s.lengths = append(s.lengths, length)
+	return s.ObjectStore.GetRange(ctx, key, offset, length)
+}
+
+func TestObjectReadSeekerFetchesChunks(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789"), (3*minStreamChunk+500)/10)
+	store := &rangeRecordingStore{ObjectStore: newLocalObjectStore(t.TempDir(), "http://localhost/media", []byte("secret"))}
+	if _, err := store.Put(ctx, "landscape/big.mp4", bytes.NewReader(data), "video/mp4", ""); err != nil {
+		t.Fatal(err)
+	}
+	content := &objectReadSeeker{ctx: ctx, store: store, key: "landscape/big.mp4", size: int64(len(data))}
+	defer content.Close()
+
+	// A short range near the start only fetches the first chunk
+	content.Seek(100, io.SeekStart)
+	got := make([]byte, 100)
+	if _, err := io.ReadFull(content, got); err != nil || !bytes.Equal(got, data[100:200]) {
+		t.Fatalf("short range: %v", err)
+	}
+	if fmt.Sprint(store.lengths) != fmt.Sprint([]int64{minStreamChunk}) {
+		t.Errorf("short range fetched %v", store.lengths)
+	}
+
+	// Reading it all grows the chunks
+	store.lengths = nil
+	content.Seek(0, io.SeekStart)
+	all, err := io.ReadAll(content)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Fatalf("full read: %d bytes, %v", len(all), err)
+	}
+	want := []int64{minStreamChunk, 2 * minStreamChunk, int64(len(data)) - 3*minStreamChunk}
+	if fmt.Sprint(store.lengths) != fmt.Sprint(want) {
+		t.Errorf("full read fetched %v, want %v", store.lengths, want)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerThumbnailFromFrame sets a video's thumbnail to a frame of the
+// uploaded video. The "at" query parameter picks the frame, in seconds or
+// as a percentage of the duration.
+func (cfg *apiConfig) handlerThumbnailFromFrame(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, jwtErrorCode(err), jwtErrorMessage(err), err)
+		return
+	}
+
+	if !cfg.mediaToolsAvailable {
+		respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeFFmpegMissing, "ffmpeg isn't installed", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotVideoOwner, "You can't upload a thumbnail for this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoNotReady, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	key, ok := cfg.videoKey(video)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Invalid video URL format", nil)
+		return
+	}
+
+	if !cfg.uploadLocks.tryLock(videoID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is already in progress", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(videoID)
+
+	videoPath, err := downloadToTemp(r.Context(), cfg.videoStore(video), key)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't download video", err)
+		return
+	}
+	defer os.Remove(videoPath)
+
+	// Videos uploaded before durations were stored need probing first
+	if video.Duration == nil {
+		probe, err := probeVideo(r.Context(), videoPath)
+		if err != nil {
+			respondWithMediaToolError(w, "Couldn't probe video", err)
+			return
+		}
+		video.Duration = &probe.Duration
+	}
+
+	at, err := frameTimestamp(r.URL.Query().Get("at"), *video.Duration)
+	if err != nil {
+		if errors.Is(err, errFrameOutOfRange) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Requested time is past the end of the video", err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Time must be in seconds or a percentage", err)
+		return
+	}
+
+	thumbnailData, fileExtension, err := cfg.frameThumbnail(r.Context(), videoPath, at)
+	if err != nil {
+		respondWithMediaToolError(w, "Couldn't extract frame", err)
+		return
+	}
+
+	err = cfg.replaceThumbnail(r.Context(), &video, thumbnailData, fileExtension)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error saving thumbnail", err)
+		return
+	}
+	video.ThumbnailFilename = nil
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithDBError(w, "Error updating video in database", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.videoResponse(r.Context(), video))
+}
+
+// setAutoThumbnail gives a freshly processed video without a thumbnail one
+// taken autoThumbnailAt of the way through videoPath. The caller saves the
+// video.
+func (cfg *apiConfig) setAutoThumbnail(ctx context.Context, video *database.Video, videoPath string, duration float64) error {
+	at, err := frameTimestamp(autoThumbnailAt, duration)
+	if err != nil {
+		return err
+	}
+	thumbnailData, fileExtension, err := cfg.frameThumbnail(ctx, videoPath, at)
+	if err != nil {
+		return err
+	}
+	err = cfg.replaceThumbnail(ctx, video, thumbnailData, fileExtension)
+	if err != nil {
+		return err
+	}
+	video.ThumbnailFilename = nil
+	return nil
+}
+
+// frameThumbnail grabs the frame at the given second of a local video file
+// as a thumbnail image, in the configured thumbnail format, and returns it
+// with its file extension.
+func (cfg *apiConfig) frameThumbnail(ctx context.Context, videoPath string, at float64) (io.Reader, string, error) {
+	frame, err := extractFrame(ctx, videoPath, at)
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.thumbnailFormat == "" {
+		return bytes.NewReader(frame), ".jpg", nil
+	}
+	normalized, ext, err := normalizeThumbnail(ctx, bytes.NewReader(frame), cfg.thumbnailFormat, cfg.thumbnailQuality)
+	if err != nil {
+		return nil, "", err
+	}
+	return normalized, ext, nil
+}
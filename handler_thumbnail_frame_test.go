@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestThumbnailFromFrame(t *testing.T) {
+	fixture := makeTestMP4(t, 320, 240)
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("frame@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", fixture)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: expected 200, got %d", resp.StatusCode)
+	}
+
+	post := func(at string) *http.Response {
+		return h.do(http.MethodPost, fmt.Sprintf("/api/videos/%s/thumbnail_frame?at=%s", video.ID, at), token, nil)
+	}
+
+	if resp := post("5"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("past the end: expected 400, got %d", resp.StatusCode)
+	}
+	if got := h.getVideo(video.ID); got.ThumbnailURL != nil {
+		t.Fatalf("thumbnail set after rejected request: %s", *got.ThumbnailURL)
+	}
+
+	if resp := post("50%25"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if got := h.getVideo(video.ID); got.ThumbnailURL == nil {
+		t.Fatal("expected thumbnail URL to be stored")
+	}
+}
+
+func TestAutoThumbnail(t *testing.T) {
+	fixture := makeTestMP4(t, 1920, 1080)
+	h := newTestHarness(t)
+	h.cfg.autoThumbnails = true
+	token, video := h.createUserAndVideo("autothumb@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", fixture)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: expected 200, got %d", resp.StatusCode)
+	}
+	got := h.getVideo(video.ID)
+	if got.ThumbnailURL == nil {
+		t.Fatal("expected a thumbnail to be generated")
+	}
+
+	f, err := os.Open(filepath.Join(h.cfg.assetsRoot, path.Base(*got.ThumbnailURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Width != maxFrameWidth || img.Height != 720 {
+		t.Errorf("expected a %dx720 thumbnail, got %dx%d", maxFrameWidth, img.Width, img.Height)
+	}
+
+	// A thumbnail that's already set is kept on re-upload
+	resp = h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "again.mp4", fixture)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("re-upload: expected 200, got %d", resp.StatusCode)
+	}
+	if again := h.getVideo(video.ID); again.ThumbnailURL == nil || *again.ThumbnailURL != *got.ThumbnailURL {
+		t.Errorf("expected the thumbnail to be kept, got %v", again.ThumbnailURL)
+	}
+}
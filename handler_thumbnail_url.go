@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerThumbnailFromURL replaces a video's thumbnail with an image the
+// server downloads from a client-supplied URL.
+func (cfg *apiConfig) handlerThumbnailFromURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ThumbnailURL string `json:"thumbnail_url"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, jwtErrorCode(err), jwtErrorMessage(err), err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Couldn't decode parameters", err)
+		return
+	}
+	if params.ThumbnailURL == "" {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "thumbnail_url is required", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotVideoOwner, "You can't upload a thumbnail for this video", nil)
+		return
+	}
+
+	if !cfg.uploadLocks.tryLock(videoID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is already in progress", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(videoID)
+
+	data, err := fetchRemoteFile(r.Context(), cfg.remoteClient, params.ThumbnailURL, maxThumbnailBytes)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeFetchFailed, "Couldn't fetch thumbnail", err)
+		return
+	}
+
+	// Trust the bytes rather than the remote server's Content-Type
+	_, fileExtension, err := verifyThumbnail(r.Context(), data, cfg.allowedThumbnailTypes)
+	if err != nil {
+		respondWithThumbnailError(w, err)
+		return
+	}
+
+	var thumbnailData io.Reader = bytes.NewReader(data)
+	if cfg.thumbnailFormat != "" {
+		normalized, normalizedExtension, err := normalizeThumbnail(r.Context(), thumbnailData, cfg.thumbnailFormat, cfg.thumbnailQuality)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Couldn't convert thumbnail image", err)
+			return
+		}
+		thumbnailData = normalized
+		fileExtension = normalizedExtension
+	}
+
+	err = cfg.replaceThumbnail(r.Context(), &video, thumbnailData, fileExtension)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error saving thumbnail", err)
+		return
+	}
+	if u, err := url.Parse(params.ThumbnailURL); err == nil {
+		video.ThumbnailFilename = sanitizeFilename(u.Path)
+	}
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithDBError(w, "Error updating video in database", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.videoResponse(r.Context(), video))
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestThumbnailFromURLRejectsPrivateAddress(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("thumb@example.com")
+
+	// The harness server itself listens on loopback, which the fetch client
+	// must refuse to connect to.
+	body := strings.NewReader(`{"thumbnail_url": "` + h.srv.URL + `/app/index.html"}`)
+	resp := h.do(http.MethodPatch, "/api/videos/"+video.ID.String()+"/thumbnail", token, body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if got := h.getVideo(video.ID); got.ThumbnailURL != nil {
+		t.Errorf("thumbnail URL was set to %q", *got.ThumbnailURL)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// tusVersion is the only version of the tus resumable upload protocol
+// (https://tus.io/protocols/resumable-upload) the server speaks.
+const tusVersion = "1.0.0"
+
+// tusUploadsPath is where tus clients create uploads. Each upload then
+// lives at its ID under it.
+const tusUploadsPath = "/api/tus"
+
+// statusChecksumMismatch is the status tus defines for a chunk whose
+// Upload-Checksum doesn't match the bytes received.
+const statusChecksumMismatch = 460
+
+// tusChecksumAlgorithms are the Upload-Checksum algorithms PATCH accepts.
+var tusChecksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// handlerTusOptions describes the server's tus support.
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination,checksum")
+	w.Header().Set("Tus-Checksum-Algorithm", "sha1,sha256,md5")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxVideoUploadBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerTusCreate starts a resumable upload for a video. The video ID and
+// processing options come in the Upload-Metadata header under video_id,
+// filename, normalize_audio, watermark, auto_captions and storage_class.
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	userID, ok := cfg.authenticateUploader(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Upload-Defer-Length isn't supported", nil)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Upload-Length must be a positive integer", err)
+		return
+	}
+	if length > maxVideoUploadBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Video is larger than the 1 GB limit", nil)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid Upload-Metadata", err)
+		return
+	}
+	storageClass, err := cfg.uploadStorageClass(metadata["storage_class"])
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid storage class", err)
+		return
+	}
+	videoID, err := uuid.Parse(metadata["video_id"])
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Upload-Metadata must include a valid video_id", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotVideoOwner, "You must be the video owner", nil)
+		return
+	}
+	if video.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash before uploading", nil)
+		return
+	}
+
+	cfg.purgeExpiredTusUploads()
+
+	upload := database.TusUpload{
+		ID:             uuid.New(),
+		CreatedAt:      time.Now(),
+		UserID:         userID,
+		VideoID:        videoID,
+		Length:         length,
+		FileName:       metadata["filename"],
+		NormalizeAudio: metadata["normalize_audio"],
+		Watermark:      metadata["watermark"],
+		AutoCaptions:   metadata["auto_captions"],
+		StorageClass:   storageClass,
+	}
+	err = os.MkdirAll(cfg.tusDir, 0755)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload directory", err)
+		return
+	}
+	f, err := os.OpenFile(cfg.tusFilePath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
+		return
+	}
+	f.Close()
+	err = cfg.db.CreateTusUpload(upload)
+	if err != nil {
+		os.Remove(cfg.tusFilePath(upload.ID))
+		respondWithDBError(w, "Couldn't create upload", err)
+		return
+	}
+
+	w.Header().Set("Location", cfg.publicURL(r.Context(), tusUploadsPath+"/"+upload.ID.String()))
+	w.Header().Set("Upload-Expires", upload.CreatedAt.Add(cfg.tusUploadExpiry).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handlerTusHead tells a client how much of an upload has arrived, so it
+// can resume from there.
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload, ok := cfg.ownedTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.CreatedAt.Add(cfg.tusUploadExpiry).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerTusPatch appends a chunk to an upload. Whatever part of the chunk
+// arrives before the connection drops is kept, unless the chunk came with
+// an Upload-Checksum; then only a complete, matching chunk is kept, so a
+// client on a flaky network never resumes from corrupted bytes. The chunk
+// that completes the upload also runs it through the same validation and
+// processing as a regular upload and responds with the video, like the
+// upload endpoint.
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, errCodeInvalidParams, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Upload-Offset must be a non-negative integer", err)
+		return
+	}
+	checksum, wantSum, err := parseTusChecksum(r.Header.Get("Upload-Checksum"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid Upload-Checksum", err)
+		return
+	}
+
+	upload, ok := cfg.ownedTusUpload(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.uploadLocks.tryLock(upload.ID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "Another request is writing to this upload", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(upload.ID)
+	// Reload now that no other request can move the offset
+	upload, err = cfg.db.GetTusUpload(upload.ID)
+	if err != nil {
+		respondWithTusLookupError(w, err)
+		return
+	}
+	if offset != upload.Offset {
+		respondWithErrorCode(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("Upload-Offset is %d, expected %d", offset, upload.Offset), nil)
+		return
+	}
+
+	path := cfg.tusFilePath(upload.ID)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload file", err)
+		return
+	}
+	defer f.Close()
+	// Drop anything written after the last recorded offset by a request
+	// that failed part way
+	err = f.Truncate(upload.Offset)
+	if err == nil {
+		_, err = f.Seek(upload.Offset, io.SeekStart)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload file", err)
+		return
+	}
+
+	// Progress covers the whole upload, not just this chunk
+	cfg.progress.set(upload.VideoID, uploadProgress{Stage: stageReceiving, Bytes: upload.Offset, Total: upload.Length})
+	var body io.Reader = &progressReader{
+		r:      http.MaxBytesReader(w, r.Body, upload.Length-upload.Offset),
+		n:      upload.Offset,
+		report: func(n int64) { cfg.progress.setBytes(upload.VideoID, n) },
+	}
+	if checksum != nil {
+		body = io.TeeReader(body, checksum)
+	}
+	written, copyErr := io.Copy(f, body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(copyErr, &maxBytesErr) {
+		f.Truncate(upload.Offset)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Chunk goes past Upload-Length", copyErr)
+		return
+	}
+	if checksum != nil {
+		if copyErr != nil {
+			// A partial chunk can't be checked, so none of it is kept
+			f.Truncate(upload.Offset)
+			respondWithError(w, http.StatusInternalServerError, "Error receiving upload", copyErr)
+			return
+		}
+		if !bytes.Equal(checksum.Sum(nil), wantSum) {
+			f.Truncate(upload.Offset)
+			respondWithErrorCode(w, statusChecksumMismatch, errCodeIntegrityFailed, "Chunk doesn't match Upload-Checksum", nil)
+			return
+		}
+	}
+	if written > 0 {
+		upload.Offset += written
+		err = cfg.db.SetTusUploadOffset(upload.ID, upload.Offset)
+		if err != nil {
+			respondWithDBError(w, "Couldn't record upload progress", err)
+			return
+		}
+	}
+	if copyErr != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error receiving upload", copyErr)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.Offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	f.Close()
+	cfg.completeTusUpload(w, r, upload)
+}
+
+// completeTusUpload processes a fully received upload. The upload is
+// removed afterwards whatever the outcome; a client that needs to retry
+// starts a new one.
+func (cfg *apiConfig) completeTusUpload(w http.ResponseWriter, r *http.Request, upload database.TusUpload) {
+	defer cfg.discardTusUpload(upload.ID)
+	path := cfg.tusFilePath(upload.ID)
+
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash before uploading", nil)
+		return
+	}
+	if !cfg.uploadLocks.tryLock(video.ID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is already in progress", nil)
+		return
+	}
+	defer cfg.releaseUploadLock(video.ID)
+	defer cfg.progress.finish(video.ID)
+
+	mediaType, sourceSHA256, err := inspectUploadedFile(path)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read uploaded video", err)
+		return
+	}
+	mediaType, err = cfg.confirmVideoType(r.Context(), path, mediaType)
+	if err != nil {
+		respondWithMediaToolError(w, "Error checking video type", err)
+		return
+	}
+	if !cfg.videoTypeAllowed(mediaType) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidVideo, "Invalid video type", nil)
+		return
+	}
+	if video.SourceSHA256 != nil && *video.SourceSHA256 == sourceSHA256 {
+		cfg.progress.set(video.ID, uploadProgress{Stage: stageDone})
+		respondWithJSON(w, http.StatusOK, unchangedVideoResponse{videoResponse: cfg.videoResponse(r.Context(), video), Unchanged: true})
+		return
+	}
+
+	fileName := upload.FileName
+	if fileName == "" {
+		fileName = "video.mp4"
+	}
+	cfg.processAndStoreVideo(w, r, video, upload.UserID, videoUpload{
+		path:           path,
+		mediaType:      mediaType,
+		fileName:       fileName,
+		sourceSHA256:   sourceSHA256,
+		normalizeAudio: upload.NormalizeAudio,
+		watermark:      upload.Watermark,
+		autoCaptions:   upload.AutoCaptions,
+		storageClass:   upload.StorageClass,
+	})
+}
+
+// handlerTusDelete abandons an upload.
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload, ok := cfg.ownedTusUpload(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.uploadLocks.tryLock(upload.ID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "Another request is writing to this upload", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(upload.ID)
+
+	cfg.discardTusUpload(upload.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTusResumable sets the Tus-Resumable response header and turns away
+// requests for a protocol version the server doesn't speak.
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithErrorCode(w, http.StatusPreconditionFailed, errCodeInvalidParams, "Tus-Resumable must be "+tusVersion, nil)
+		return false
+	}
+	return true
+}
+
+// authenticate returns the user a request's bearer token belongs to,
+// writing the error response if there isn't a valid one.
+func (cfg *apiConfig) authenticate(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, jwtErrorCode(err), jwtErrorMessage(err), err)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// ownedTusUpload loads the upload a request targets. Other users' uploads
+// are reported as missing.
+func (cfg *apiConfig) ownedTusUpload(w http.ResponseWriter, r *http.Request) (database.TusUpload, bool) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Upload not found", err)
+		return database.TusUpload{}, false
+	}
+	userID, ok := cfg.authenticateUploader(w, r)
+	if !ok {
+		return database.TusUpload{}, false
+	}
+
+	upload, err := cfg.db.GetTusUpload(uploadID)
+	if err != nil {
+		respondWithTusLookupError(w, err)
+		return database.TusUpload{}, false
+	}
+	if upload.UserID != userID {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Upload not found", nil)
+		return database.TusUpload{}, false
+	}
+	if time.Since(upload.CreatedAt) > cfg.tusUploadExpiry {
+		respondWithErrorCode(w, http.StatusGone, errCodeNotFound, "Upload has expired", nil)
+		return database.TusUpload{}, false
+	}
+	return upload, true
+}
+
+func respondWithTusLookupError(w http.ResponseWriter, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Upload not found", err)
+		return
+	}
+	respondWithDBError(w, "Couldn't get upload", err)
+}
+
+func (cfg *apiConfig) tusFilePath(id uuid.UUID) string {
+	return filepath.Join(cfg.tusDir, id.String())
+}
+
+// discardTusUpload forgets an upload and deletes what was received of it.
+func (cfg *apiConfig) discardTusUpload(id uuid.UUID) {
+	err := cfg.db.DeleteTusUpload(id)
+	if err != nil {
+		slog.Warn("couldn't delete tus upload", "upload_id", id, "err", err)
+		return
+	}
+	err = os.Remove(cfg.tusFilePath(id))
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("couldn't delete tus upload file", "upload_id", id, "err", err)
+	}
+}
+
+// purgeExpiredTusUploads discards uploads older than cfg.tusUploadExpiry
+// that no request is writing to.
+func (cfg *apiConfig) purgeExpiredTusUploads() {
+	ids, err := cfg.db.GetTusUploadsCreatedBefore(time.Now().Add(-cfg.tusUploadExpiry))
+	if err != nil {
+		slog.Warn("couldn't list expired tus uploads", "err", err)
+		return
+	}
+	for _, id := range ids {
+		if !cfg.uploadLocks.tryLock(id) {
+			continue
+		}
+		cfg.discardTusUpload(id)
+		cfg.uploadLocks.unlock(id)
+	}
+}
+
+// parseTusChecksum decodes an Upload-Checksum header, an algorithm name and
+// a base64 digest, into a hash to feed the chunk to and the digest it
+// should produce. An empty header returns a nil hash.
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+	if header == "" {
+		return nil, nil, nil
+	}
+	name, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return nil, nil, errors.New("expected an algorithm and a digest")
+	}
+	newHash, ok := tusChecksumAlgorithms[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported algorithm %q", name)
+	}
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, nil, fmt.Errorf("digest isn't base64: %w", err)
+	}
+	h := newHash()
+	if len(sum) != h.Size() {
+		return nil, nil, fmt.Errorf("%s digest must be %d bytes", name, h.Size())
+	}
+	return h, sum, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// pairs of a key and a base64 value, which may be left out.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid pair %q", strings.TrimSpace(pair))
+		}
+		if _, ok := metadata[fields[0]]; ok {
+			return nil, fmt.Errorf("duplicate key %q", fields[0])
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("value of %q isn't base64: %w", fields[0], err)
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, nil
+}
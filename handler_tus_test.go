@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func (h *testHarness) tusRequest(method, path, token string, body []byte) *http.Request {
+	h.t.Helper()
+	req, err := http.NewRequest(method, h.srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		h.t.Fatalf("couldn't create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	return req
+}
+
+// createTusUpload starts an upload for videoID and returns its path.
+func (h *testHarness) createTusUpload(token, videoID string, length int) string {
+	h.t.Helper()
+	req := h.tusRequest(http.MethodPost, tusUploadsPath, token, nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "video_id "+base64.StdEncoding.EncodeToString([]byte(videoID))+
+		",filename "+base64.StdEncoding.EncodeToString([]byte("clip.mp4")))
+	resp := h.send(req)
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		h.t.Fatalf("create: expected 201, got %d: %s", resp.StatusCode, body)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		h.t.Fatalf("bad Location %q: %v", resp.Header.Get("Location"), err)
+	}
+	return location.Path
+}
+
+func (h *testHarness) patchTusUpload(path, token string, offset int, chunk []byte) *http.Response {
+	h.t.Helper()
+	req := h.tusRequest(http.MethodPatch, path, token, chunk)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return h.send(req)
+}
+
+func TestTusUpload(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("tus@example.com")
+	path := h.createTusUpload(token, video.ID.String(), len(minimalMP4))
+
+	half := len(minimalMP4) / 2
+	resp := h.patchTusUpload(path, token, 0, minimalMP4[:half])
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first chunk: got %d with offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+
+	head := h.send(h.tusRequest(http.MethodHead, path, token, nil))
+	if head.StatusCode != http.StatusOK || head.Header.Get("Upload-Offset") != strconv.Itoa(half) ||
+		head.Header.Get("Upload-Length") != strconv.Itoa(len(minimalMP4)) {
+		t.Fatalf("head: got %d, offset %q, length %q", head.StatusCode, head.Header.Get("Upload-Offset"), head.Header.Get("Upload-Length"))
+	}
+
+	// Resending from the old offset is a conflict
+	if resp := h.patchTusUpload(path, token, 0, minimalMP4); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("stale offset: expected 409, got %d", resp.StatusCode)
+	}
+
+	resp = h.patchTusUpload(path, token, half, minimalMP4[half:])
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("last chunk: expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Upload-Offset") != strconv.Itoa(len(minimalMP4)) {
+		t.Errorf("last chunk: offset %q", resp.Header.Get("Upload-Offset"))
+	}
+
+	stored := h.getVideo(video.ID)
+	if stored.VideoURL == nil || stored.VideoFilename == nil || *stored.VideoFilename != "clip.mp4" {
+		t.Fatalf("expected the video to be stored, got %v, %v", stored.VideoURL, stored.VideoFilename)
+	}
+	if len(h.s3.keys()) != 1 {
+		t.Errorf("expected one stored object, got %v", h.s3.keys())
+	}
+
+	// The finished upload is cleaned up
+	if head := h.send(h.tusRequest(http.MethodHead, path, token, nil)); head.StatusCode != http.StatusNotFound {
+		t.Errorf("head after completion: expected 404, got %d", head.StatusCode)
+	}
+	entries, _ := os.ReadDir(h.cfg.tusDir)
+	if len(entries) != 0 {
+		t.Errorf("expected upload file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestTusUploadRejections(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("tus-reject@example.com")
+	otherToken, _ := h.createUserAndVideo("tus-other@example.com")
+
+	req := h.tusRequest(http.MethodPost, tusUploadsPath, token, nil)
+	req.Header.Del("Tus-Resumable")
+	if resp := h.send(req); resp.StatusCode != http.StatusPreconditionFailed || resp.Header.Get("Tus-Version") != tusVersion {
+		t.Errorf("missing Tus-Resumable: expected 412, got %d", resp.StatusCode)
+	}
+
+	req = h.tusRequest(http.MethodPost, tusUploadsPath, token, nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(maxVideoUploadBytes+1))
+	req.Header.Set("Upload-Metadata", "video_id "+base64.StdEncoding.EncodeToString([]byte(video.ID.String())))
+	if resp := h.send(req); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large: expected 413, got %d", resp.StatusCode)
+	}
+
+	path := h.createTusUpload(token, video.ID.String(), 10)
+	if resp := h.patchTusUpload(path, otherToken, 0, []byte("abc")); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("other user: expected 404, got %d", resp.StatusCode)
+	}
+	if resp := h.patchTusUpload(path, token, 0, make([]byte, 11)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("past Upload-Length: expected 413, got %d", resp.StatusCode)
+	}
+
+	if resp := h.send(h.tusRequest(http.MethodDelete, path, token, nil)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+	if resp := h.send(h.tusRequest(http.MethodHead, path, token, nil)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("head after delete: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("my clip.mp4"))
+	metadata, err := parseTusMetadata(fmt.Sprintf("filename %s, is_confidential", encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["filename"] != "my clip.mp4" {
+		t.Errorf("filename = %q", metadata["filename"])
+	}
+	if v, ok := metadata["is_confidential"]; !ok || v != "" {
+		t.Errorf("is_confidential = %q, %v", v, ok)
+	}
+
+	for _, header := range []string{"filename not-base64!", "a YQ==, a YQ==", "a b c"} {
+		if _, err := parseTusMetadata(header); err == nil {
+			t.Errorf("%q: expected an error", header)
+		}
+	}
+}
+
+func TestTusUploadChecksum(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("tus-checksum@example.com")
+	path := h.createTusUpload(token, video.ID.String(), 10)
+
+	patch := func(chunk []byte, checksum string) *http.Response {
+		req := h.tusRequest(http.MethodPatch, path, token, chunk)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		req.Header.Set("Upload-Checksum", checksum)
+		return h.send(req)
+	}
+	sum := sha1.Sum([]byte("hello"))
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	if resp := patch([]byte("hellp"), "sha1 "+digest); resp.StatusCode != statusChecksumMismatch {
+		t.Fatalf("mismatch: expected %d, got %d", statusChecksumMismatch, resp.StatusCode)
+	}
+	head := h.send(h.tusRequest(http.MethodHead, path, token, nil))
+	if head.Header.Get("Upload-Offset") != "0" {
+		t.Fatalf("mismatched chunk was kept, offset %q", head.Header.Get("Upload-Offset"))
+	}
+
+	if resp := patch([]byte("hello"), "crc32 "+digest); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown algorithm: expected 400, got %d", resp.StatusCode)
+	}
+	if resp := patch([]byte("hello"), "sha1 "+digest); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "5" {
+		t.Errorf("matching chunk: got %d with offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+}
@@ -1,15 +1,11 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
 )
 
@@ -17,19 +13,12 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	userID, ok := cfg.authenticateUploader(w, r)
+	if !ok {
 		return
 	}
 
@@ -39,109 +28,94 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	const maxMemory = 10 << 20 // 10 MB
 	err = r.ParseMultipartForm(maxMemory)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error parsing form data", err)
+		if problem, ok := multipartParseProblem(err); ok {
+			respondWithFormErrors(w, []formFieldError{problem})
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Error parsing form data", err)
+		return
+	}
+	if problems := validateUploadForm(r.MultipartForm, "thumbnail"); len(problems) > 0 {
+		respondWithFormErrors(w, problems)
 		return
 	}
 
 	// Get the file from the form data
-	file, _, err := r.FormFile("thumbnail")
+	file, fileHeader, err := r.FormFile("thumbnail")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error getting file from form data", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "Error getting file from form data", err)
 		return
 	}
 	defer file.Close()
 
-	// Get the Content-Type header from the file
-	header := make([]byte, 512)
-	_, err = file.Read(header)
+	data, err := io.ReadAll(io.LimitReader(file, maxThumbnailBytes+1))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error reading file header", err)
+		respondWithError(w, http.StatusInternalServerError, "Error reading thumbnail file", err)
 		return
 	}
-
-	// Reset the read position to the start of the file
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error resetting file read position", err)
+	if len(data) > maxThumbnailBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Thumbnail is larger than the 10 MB limit", nil)
 		return
 	}
 
-	mediaType := http.DetectContentType(header)
-
-	// Use the Content-Type header to determine the file extension
-	var fileExtension string
-	switch mediaType {
-	case "image/jpeg":
-		fileExtension = ".jpg"
-	case "image/png":
-		fileExtension = ".png"
-	default:
-		respondWithError(w, http.StatusBadRequest, "Unsupported media type", nil)
+	// Check the whole file is a real image of an allowed type, and use its
+	// type for the file extension
+	_, fileExtension, err := verifyThumbnail(r.Context(), data, cfg.allowedThumbnailTypes)
+	if err != nil {
+		respondWithThumbnailError(w, err)
 		return
 	}
 
 	// Get the video's metadata from the SQLite database
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithVideoLookupError(w, err)
 		return
 	}
 	// Check if the user is the owner of the video
 	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You can't upload a thumbnail for this video", nil)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotVideoOwner, "You can't upload a thumbnail for this video", nil)
 		return
 	}
-
-	// Fill a 32-byte slice with random bytes and convert it into a random base64 string
-	randomBytes := make([]byte, 32)
-	_, err = rand.Read(randomBytes)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error generating random bytes", err)
-		return
-	}
-	randomString := base64.RawURLEncoding.EncodeToString(randomBytes)
-
-	// Create the file name and file path
-	fileName := fmt.Sprintf("%s%s", randomString, fileExtension)
-	filePath := filepath.Join(cfg.assetsRoot, fileName)
-
-	// Create the new file
-	localFile, err := os.Create(filePath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating new file", err)
+	if video.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash before uploading", nil)
 		return
 	}
-	defer localFile.Close()
 
-	// Copy the image data to the new file
-	_, err = io.Copy(localFile, file)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error copying image data to new file", err)
+	// Only one upload per video at a time
+	if !cfg.uploadLocks.tryLock(videoID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is already in progress", nil)
 		return
 	}
-
-	// Delete the old thumbnail file if it exists
-	if video.ThumbnailURL != nil {
-		oldThumbnailPath := filepath.Join(cfg.assetsRoot, filepath.Base(*video.ThumbnailURL))
-		err = os.Remove(oldThumbnailPath)
-		if err != nil && !os.IsNotExist(err) {
-			respondWithError(w, http.StatusInternalServerError, "Error deleting old thumbnail file", err)
+	defer cfg.uploadLocks.unlock(videoID)
+
+	// Re-encode the thumbnail into the configured format, or keep it as uploaded
+	var thumbnailData io.Reader = bytes.NewReader(data)
+	if cfg.thumbnailFormat != "" {
+		normalized, normalizedExtension, err := normalizeThumbnail(r.Context(), thumbnailData, cfg.thumbnailFormat, cfg.thumbnailQuality)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Couldn't convert thumbnail image", err)
 			return
 		}
+		thumbnailData = normalized
+		fileExtension = normalizedExtension
 	}
 
-	// Update the video's new ThumbnailURL
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, fileName)
-	video.ThumbnailURL = &thumbnailURL
+	err = cfg.replaceThumbnail(r.Context(), &video, thumbnailData, fileExtension)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error saving thumbnail", err)
+		return
+	}
+	video.ThumbnailFilename = sanitizeFilename(fileHeader.Filename)
 
 	// Update the database with the new thumbnail URL
 	err = cfg.db.UpdateVideo(video)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error updating video in database", err)
+		respondWithDBError(w, "Error updating video in database", err)
 		return
 	}
 
 	// Respond with updated JSON of the video's metadata
-	respondWithJSON(w, http.StatusOK, video)
+	respondWithJSON(w, http.StatusOK, cfg.videoResponse(r.Context(), video))
 
 }
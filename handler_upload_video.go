@@ -1,208 +1,747 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+// maxVideoUploadBytes caps the size of an uploaded video.
+const maxVideoUploadBytes = 1 << 30 // 1 GB
+
+// handlerUploadVideo receives a video as a multipart form and stores it.
+// The file part is streamed into the store as it arrives, under an
+// "uploads/" staging key, with its hashes, ETag and moov position worked
+// out on the way; once the rest of the form checks out it's probed
+// through a signed URL and copied to its final key. Only uploads that need
+// local work (ffmpeg re-encoding, stripping metadata, leveling audio,
+// watermarking or moving the moov atom, a job worker, or
+// S3_PART_SIZE_MB=0) go through a temp file, either straight away or
+// fetched back from the staging key when the form asks for it.
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	// Set an upload limit
-	const maxUpload = 1 << 30 // 1 GB
-	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	// Turn away uploads that say up front they're too big, before reading
+	// any of the body
+	if r.ContentLength > maxVideoUploadBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Video is larger than the 1 GB limit",
+			fmt.Errorf("declared length %d exceeds the limit", r.ContentLength))
+		return
+	}
+	// Chunked requests don't declare a length, so also cap what's read
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadBytes)
 
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
 		return
 	}
 
 	// Authenticate the user
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	userID, ok := cfg.authenticateUploader(w, r)
+	if !ok {
 		return
 	}
 
 	// Get the video's metadata from the SQLite database
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithVideoLookupError(w, err)
 		return
 	}
 	// Check if the user is the owner of the video
 	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You must be the video owner", nil)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotVideoOwner, "You must be the video owner", nil)
 		return
 	}
-
-	// Parse the form data
-	const maxMemory = 1 << 30 // 1 GB
-	err = r.ParseMultipartForm(maxMemory)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error parsing form data", err)
+	if video.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash before uploading", nil)
 		return
 	}
 
-	// Get the file from the form data
-	videoFile, _, err := r.FormFile("video")
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error getting file from form data", err)
+	// A dry run only analyzes the file, so it doesn't need the lock
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	// Only one upload per video at a time
+	if !dryRun {
+		if !cfg.uploadLocks.tryLock(videoID) {
+			respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is already in progress", nil)
+			return
+		}
+		defer cfg.releaseUploadLock(videoID)
+
+		// Count the body as it arrives, before the form parsing reads it
+		cfg.progress.set(videoID, uploadProgress{Stage: stageReceiving, Total: max(r.ContentLength, 0)})
+		defer cfg.progress.finish(videoID)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{&progressReader{r: r.Body, report: func(n int64) { cfg.progress.setBytes(videoID, n) }}, r.Body}
+	}
+
+	// A client that sends the hash of the file it's about to upload as
+	// If-None-Match can skip the upload entirely when nothing has changed
+	if !dryRun && video.SourceSHA256 != nil && etagListContains(r.Header.Get("If-None-Match"), *video.SourceSHA256) {
+		cfg.progress.set(videoID, uploadProgress{Stage: stageDone})
+		respondWithJSON(w, http.StatusOK, unchangedVideoResponse{videoResponse: cfg.videoResponse(r.Context(), video), Unchanged: true})
 		return
 	}
-	defer videoFile.Close()
 
-	// Read the first 512 bytes to detect the content type
-	fileHeader := make([]byte, 512)
-	_, err = videoFile.Read(fileHeader)
+	// Unless something is already known to need a local copy, the file is
+	// streamed into the store as it arrives, under a staging key it's
+	// copied from once the rest of the form has been checked
+	store := cfg.storeForBucket(cfg.resolveBucket(userID))
+	stream := false
+	if !dryRun {
+		stream, err = cfg.streamsUploads(store, userID)
+		if err != nil {
+			respondWithDBError(w, "Couldn't load watermark", err)
+			return
+		}
+	}
+
+	var (
+		mediaType   string
+		confirmType bool
+		invalidType bool
+		tmpPath     string
+		stagedKey   string
+		stagedInfo  ObjectInfo
+		analysis    uploadAnalysis
+		analysisErr error
+		digest      = newUploadDigest(cfg.s3PartSize)
+	)
+	defer func() {
+		// clean up
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+		if stagedKey != "" {
+			store.Delete(context.WithoutCancel(r.Context()), stagedKey)
+		}
+	}()
+
+	// Read the form, taking in the file as it comes
+	_, err = readUploadForm(r, "video", func(part io.Reader) error {
+		// Peek at the first 512 bytes to detect the content type
+		buffered := bufio.NewReaderSize(part, 512)
+		fileHeader, err := buffered.Peek(512)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		mediaType = detectVideoType(fileHeader)
+		if dryRun {
+			analysis, analysisErr = cfg.analyzeUpload(r.Context(), buffered, mediaType, video)
+			return nil
+		}
+
+		// Validate the file against the allowed container types. A file
+		// that might be an MP4 the sniffer doesn't recognize is checked
+		// again with ffprobe once it's been received.
+		confirmType = cfg.mp4Candidate(mediaType, fileHeader)
+		if !confirmType && !cfg.videoTypeAllowed(mediaType) {
+			invalidType = true
+			return nil
+		}
+
+		// Hash the file as it goes by, for the checksum and for verifying
+		// what the store received
+		src := io.TeeReader(buffered, digest)
+		if stream {
+			key, err := randomObjectKey("uploads/", "")
+			if err != nil {
+				return processingFailure(http.StatusInternalServerError, errCodeInternal, "Error generating random bytes", err)
+			}
+			stagedInfo, err = store.Put(r.Context(), key, src, mediaType, "")
+			if err != nil {
+				return processingFailure(http.StatusInternalServerError, errCodeStorageFailed, "Error uploading to S3", err)
+			}
+			stagedKey = key
+			return nil
+		}
+
+		tmpLocalFile, err := os.CreateTemp("", "tubely-upload.mp4")
+		if err != nil {
+			return processingFailure(http.StatusInternalServerError, errCodeInternal, "Error creating temporary local file", err)
+		}
+		defer tmpLocalFile.Close()
+		tmpPath = tmpLocalFile.Name()
+		if _, err := io.Copy(tmpLocalFile, src); err != nil {
+			return processingFailure(http.StatusInternalServerError, errCodeInternal, "Error copying file contents to temporary local file", err)
+		}
+		return nil
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error reading file header", err)
+		var maxBytesErr *http.MaxBytesError
+		var perr *processingError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Video is larger than the 1 GB limit", err)
+		case errors.As(err, &perr):
+			perr.respond(w)
+		default:
+			if problem, ok := multipartParseProblem(err); ok {
+				respondWithFormErrors(w, []formFieldError{problem})
+				return
+			}
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Error parsing form data", err)
+		}
 		return
 	}
-
-	// Reset the read position to the start of the video file
-	_, err = videoFile.Seek(0, io.SeekStart)
+	if problems := validateUploadForm(r.MultipartForm, "video", "normalize_audio", "watermark", "auto_captions", "storage_class", "sha256", "md5"); len(problems) > 0 {
+		respondWithFormErrors(w, problems)
+		return
+	}
+	checksum, problems := parseUploadChecksum(r)
+	if len(problems) > 0 {
+		respondWithFormErrors(w, problems)
+		return
+	}
+	storageClass, err := cfg.uploadStorageClass(r.FormValue("storage_class"))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error resetting video file read position", err)
+		respondWithFormErrors(w, []formFieldError{{Field: "storage_class", Problem: err.Error()}})
 		return
 	}
 
-	// Validate the uploaded file to ensure it's an MP4 video
-	mediaType := http.DetectContentType(fileHeader)
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Invalid video type", nil)
+	if dryRun {
+		if analysisErr != nil {
+			respondWithMediaToolError(w, "Error analyzing video", analysisErr)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, analysis)
+		return
+	}
+	if invalidType {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidVideo, "Invalid video type", nil)
 		return
 	}
+	sourceSHA256 := hex.EncodeToString(digest.sha256.Sum(nil))
 
-	// Create a temporary local file
-	tmpLocalFile, err := os.CreateTemp("", "tubely-upload.mp4")
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating temporary local file", err)
+	// A file that doesn't match the checksum it came with was corrupted on
+	// the way, so it's turned away rather than stored
+	if err := checksum.verify(digest.sha256.Sum(nil), digest.md5.Sum(nil)); err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeIntegrityFailed, "Video doesn't match its checksum", err)
+		return
+	}
+	// Likewise a staged file the store didn't receive intact
+	if stagedKey != "" && cfg.verifyUploads && stagedInfo.ETag != "" && !etagsMatch(stagedInfo.ETag, digest.etag.etag()) {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeIntegrityFailed, "Uploaded video failed integrity check",
+			fmt.Errorf("expected ETag %s, S3 returned %s", digest.etag.etag(), stagedInfo.ETag))
+		return
 	}
-	defer os.Remove(tmpLocalFile.Name()) // clean up
-	defer tmpLocalFile.Close()
 
-	// Copy the contents from the wire to the temp file
-	_, err = io.Copy(tmpLocalFile, videoFile)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error copying file contents to temporary local file", err)
+	// Re-uploading the same file would produce the same result, so skip
+	// the processing and keep what's stored
+	if video.SourceSHA256 != nil && *video.SourceSHA256 == sourceSHA256 {
+		cfg.progress.set(videoID, uploadProgress{Stage: stageDone})
+		respondWithJSON(w, http.StatusOK, unchangedVideoResponse{videoResponse: cfg.videoResponse(r.Context(), video), Unchanged: true})
 		return
 	}
 
-	// Get the aspect ratio of the video file
-	aspectRatio, err := getVideoAspectRatio(tmpLocalFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error getting aspect ratio of video file", err)
+	upload := videoUpload{
+		mediaType:      mediaType,
+		fileName:       r.MultipartForm.File["video"][0].Filename,
+		sourceSHA256:   sourceSHA256,
+		normalizeAudio: r.FormValue("normalize_audio"),
+		watermark:      r.FormValue("watermark"),
+		autoCaptions:   r.FormValue("auto_captions"),
+		storageClass:   storageClass,
+		size:           digest.size,
+	}
+
+	// A streamed file the form's options or its contents say needs work
+	// is fetched back to be processed like any other
+	if stagedKey != "" {
+		local, err := cfg.needsLocalCopy(userID, upload, confirmType, digest)
+		if err != nil {
+			respondWithDBError(w, "Couldn't load watermark", err)
+			return
+		}
+		if local {
+			tmpPath, err = downloadToTemp(r.Context(), store, stagedKey)
+			if err != nil {
+				respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Error fetching uploaded video", err)
+				return
+			}
+		} else {
+			upload.stagedKey = stagedKey
+		}
+	}
+	upload.path = tmpPath
+
+	if confirmType {
+		upload.mediaType, err = cfg.confirmVideoType(r.Context(), upload.path, mediaType)
+		if err != nil {
+			respondWithMediaToolError(w, "Error checking video type", err)
+			return
+		}
+		if !cfg.videoTypeAllowed(upload.mediaType) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidVideo, "Invalid video type", nil)
+			return
+		}
+	}
+
+	cfg.processAndStoreVideo(w, r, video, userID, upload)
+}
+
+// videoUpload is a received source file waiting to be processed and stored,
+// along with the options the client sent with it.
+type videoUpload struct {
+	path         string
+	mediaType    string
+	fileName     string
+	sourceSHA256 string
+
+	// normalizeAudio, watermark and autoCaptions are the raw option
+	// values, which fall back to the server defaults when empty.
+	normalizeAudio string
+	watermark      string
+	autoCaptions   string
+
+	// storageClass is the validated S3 storage class for the stored video.
+	storageClass string
+
+	// stagedKey is where an upload streamed into the store as it arrived
+	// was put, when nothing has to be done to it locally. It's copied to
+	// its final key instead of being stored from path. size is its length.
+	stagedKey string
+	size      int64
+
+	// sourceWatermarked is set when the file already has a watermark, so
+	// it isn't drawn again.
+	sourceWatermarked bool
+
+	// sourceURL is where an import is downloaded from. Until its job's
+	// worker has fetched it there's no file at path, and mediaType and
+	// sourceSHA256 are empty.
+	sourceURL string
+	// importer is the tool an import is downloaded with, empty for a
+	// plain HTTP fetch. Platform imports bring the video's credits,
+	// description and thumbnail along, which are saved with the video.
+	importer      string
+	attribution   database.Attribution
+	description   string
+	thumbnailPath string
+}
+
+// processingError is a failed step of processVideo. respond reports it to
+// a client waiting on the request; background jobs record Error instead.
+type processingError struct {
+	msg     string
+	err     error
+	respond func(w http.ResponseWriter)
+}
+
+func (e *processingError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *processingError) Unwrap() error { return e.err }
+
+func processingFailure(status int, code, msg string, err error) *processingError {
+	return &processingError{msg: msg, err: err, respond: func(w http.ResponseWriter) {
+		respondWithErrorCode(w, status, code, msg, err)
+	}}
+}
+
+func mediaToolFailure(msg string, err error) *processingError {
+	return &processingError{msg: msg, err: err, respond: func(w http.ResponseWriter) {
+		respondWithMediaToolError(w, msg, err)
+	}}
+}
+
+func dbFailure(msg string, err error) *processingError {
+	return &processingError{msg: msg, err: err, respond: func(w http.ResponseWriter) {
+		respondWithDBError(w, msg, err)
+	}}
+}
+
+// processAndStoreVideo processes and stores an upload and writes the
+// response. With job workers running it only queues the upload and
+// responds 202 with the job. Either way an upload outside the size and
+// length limits is rejected first. It reports whether the video was stored
+// or queued.
+func (cfg *apiConfig) processAndStoreVideo(w http.ResponseWriter, r *http.Request, video database.Video, userID uuid.UUID, upload videoUpload) bool {
+	if err := cfg.precheckVideo(r.Context(), upload); err != nil {
+		err.respond(w)
+		return false
+	}
+	// Watermarking re-encodes the whole video, so it's left to a worker
+	// even when other uploads are processed during the request
+	queue := cfg.jobWorkers > 0
+	if !queue && !upload.sourceWatermarked {
+		_, applyWatermark, err := cfg.uploadWatermark(userID, upload.watermark)
+		if err != nil {
+			respondWithDBError(w, "Couldn't load watermark", err)
+			return false
+		}
+		queue = applyWatermark
 	}
-	var videoOrientation string
-	switch aspectRatio {
-	case "16:9":
-		videoOrientation = "landscape"
-	case "9:16":
-		videoOrientation = "portrait"
-	default:
-		videoOrientation = "other"
+	if queue {
+		if !cfg.queueVideoJob(w, r, video, userID, upload) {
+			return false
+		}
+		cfg.progress.set(video.ID, uploadProgress{Stage: stageQueued})
+		cfg.emitVideoEvent(eventVideoUploaded, video, webhookEventData{})
+		return true
 	}
 
-	// Reset the read position to the start of the temp file
-	_, err = tmpLocalFile.Seek(0, io.SeekStart)
+	cfg.setVideoStatus(video.ID, videoProcessing)
+	cfg.emitVideoEvent(eventVideoUploaded, video, webhookEventData{})
+	video, metadataStripped, err := cfg.processVideo(r.Context(), video, userID, upload)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error resetting temporary local file read position", err)
-		return
+		cfg.setVideoStatus(video.ID, videoFailed)
+		cfg.progress.fail(video.ID, err.msg)
+		cfg.emitVideoEvent(eventVideoFailed, video, webhookEventData{Error: err.msg})
+		err.respond(w)
+		return false
+	}
+	cfg.progress.set(video.ID, uploadProgress{Stage: stageDone})
+	cfg.emitVideoEvent(eventVideoProcessed, video, webhookEventData{})
+	fmt.Println("Done!")
+	respondWithJSON(w, http.StatusOK, processedVideoResponse{videoResponse: cfg.videoResponse(r.Context(), video), MetadataStripped: metadataStripped})
+	return true
+}
+
+// processVideo runs an uploaded file through conversion, probing and the
+// optional audio and watermark steps, stores the result and records it on
+// the video. A staged upload is only probed and copied into place. It
+// returns the updated video and whether the file's metadata was stripped.
+func (cfg *apiConfig) processVideo(ctx context.Context, video database.Video, userID uuid.UUID, upload videoUpload) (database.Video, bool, *processingError) {
+	if upload.stagedKey != "" {
+		return cfg.storeStagedVideo(ctx, video, userID, upload)
+	}
+	var err error
+	cfg.progress.set(video.ID, uploadProgress{Stage: stageProcessing})
+
+	// Convert other containers to MP4 before any further processing
+	videoPath := upload.path
+	if upload.mediaType != "video/mp4" {
+		videoPath, err = convertToMP4(ctx, upload.path)
+		if err != nil {
+			return video, false, mediaToolFailure("Error converting video to MP4", err)
+		}
+		defer os.Remove(videoPath) // clean up
 	}
 
-	// Create a processed version of the video for fast start
-	fastStartVideoLocation, err := processVideoForFastStart(tmpLocalFile.Name())
+	// Probe the video for its dimensions, duration and codec, and classify
+	// its orientation. Without ffprobe there's nothing to go on, so
+	// everything is filed under "other".
+	videoOrientation := "other"
+	var probe videoProbe
+	if cfg.mediaToolsAvailable {
+		probe, err = probeVideo(ctx, videoPath)
+		if err != nil {
+			return video, false, mediaToolFailure("Error probing video file", err)
+		}
+		if perr := cfg.checkVideoLimits(probe); perr != nil {
+			return video, false, perr
+		}
+		videoOrientation = probe.orientation()
+	}
+	probedPath := videoPath
+
+	// Level the audio if this upload asked for it
+	if cfg.shouldNormalizeAudio(upload.normalizeAudio) {
+		normalizedPath, err := normalizeAudio(ctx, videoPath, cfg.loudnormTarget, cfg.loudnormMode)
+		if err != nil {
+			return video, false, mediaToolFailure("Error normalizing audio", err)
+		}
+		if normalizedPath != videoPath {
+			defer os.Remove(normalizedPath) // clean up
+			videoPath = normalizedPath
+		}
+	}
+
+	// Overlay the watermark if this upload asked for one and doesn't
+	// already carry it
+	watermark, applyWatermark, err := cfg.uploadWatermark(userID, upload.watermark)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating a processed version of the video", err)
-		return
+		return video, false, dbFailure("Error loading watermark", err)
+	}
+	watermarked := upload.sourceWatermarked
+	if applyWatermark && !watermarked {
+		watermarkedPath, err := cfg.applyWatermark(ctx, videoPath, watermark)
+		if err != nil {
+			return video, false, mediaToolFailure("Error watermarking video", err)
+		}
+		if watermarkedPath != videoPath {
+			defer os.Remove(watermarkedPath) // clean up
+			videoPath = watermarkedPath
+			watermarked = true
+		}
+	}
+
+	// Convert the video to the output format. For the default format that's
+	// just moving the moov atom to the front for fast start, so the raw MP4
+	// is stored when ffmpeg isn't available or the atom is already there,
+	// unless its metadata has to be stripped. If the atom order can't be
+	// read, process it to be safe.
+	format := defaultOutputFormat
+	if cfg.mediaToolsAvailable {
+		format = cfg.outputFormat
+	}
+	var extraArgs []string
+	if cfg.stripMetadata {
+		extraArgs = format.stripMetadataArgs(probe.Rotation)
+	}
+	fastStartVideoLocation := videoPath
+	metadataStripped := false
+	alreadyFastStart, err := isFastStart(videoPath)
+	if cfg.mediaToolsAvailable && (format.reencodes() || cfg.stripMetadata || err != nil || !alreadyFastStart) {
+		fastStartVideoLocation, err = transcodeVideo(ctx, videoPath, format, extraArgs...)
+		if err != nil {
+			return video, false, mediaToolFailure("Error creating a processed version of the video", err)
+		}
+		defer os.Remove(fastStartVideoLocation) // clean up
+		metadataStripped = cfg.stripMetadata
+	}
+
+	// Anything done to the upload since it was probed may have changed its
+	// codecs, frame rate and bitrate, so describe the file that's stored.
+	// The dimensions stay as displayed.
+	if cfg.mediaToolsAvailable && fastStartVideoLocation != probedPath {
+		stored, err := probeVideo(ctx, fastStartVideoLocation)
+		if err != nil {
+			return video, false, mediaToolFailure("Error probing processed video file", err)
+		}
+		probe.Duration = stored.Duration
+		probe.Codec, probe.AudioCodec = stored.Codec, stored.AudioCodec
+		probe.FrameRate, probe.Bitrate = stored.FrameRate, stored.Bitrate
 	}
 
 	// Open the processed video
 	fastStartVideoFile, err := os.Open(fastStartVideoLocation)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error opening processed video file", err)
-		return
+		return video, false, processingFailure(http.StatusInternalServerError, errCodeInternal, "Error opening processed video file", err)
 	}
-	defer os.Remove(fastStartVideoLocation) // clean up
 	defer fastStartVideoFile.Close()
 
-	// Fill a 32-byte slice with random bytes
-	randomBytes := make([]byte, 32)
-	_, err = rand.Read(randomBytes)
+	fastStartVideoStat, err := fastStartVideoFile.Stat()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error generating random bytes", err)
-		return
+		return video, false, processingFailure(http.StatusInternalServerError, errCodeInternal, "Error reading processed video file size", err)
 	}
-	// Convert random bytes to a hex string
-	randomHex := hex.EncodeToString(randomBytes)
 
-	// Put the object into S3 using PutObject
+	// Compute the ETag S3 should report so the stored object can be verified.
+	// Large files are uploaded in parts, which changes how S3 computes it.
+	// The SHA-256 goes along with the upload for S3 to check the bytes it
+	// receives against; for a file stored as it was uploaded, that's the
+	// checksum the client sent.
+	storedHasher := sha256.New()
+	expectedETag, err := computeETag(io.TeeReader(fastStartVideoFile, storedHasher), cfg.s3PartSize)
+	if err != nil {
+		return video, false, processingFailure(http.StatusInternalServerError, errCodeInternal, "Error computing processed video checksum", err)
+	}
+	_, err = fastStartVideoFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return video, false, processingFailure(http.StatusInternalServerError, errCodeInternal, "Error resetting processed video file read position", err)
+	}
+
+	videoKey, err := randomObjectKey(videoOrientation+"/", format.extension)
+	if err != nil {
+		return video, false, processingFailure(http.StatusInternalServerError, errCodeInternal, "Error generating random bytes", err)
+	}
+
+	// Put the object into the object store
 	fmt.Println("Uploading video to S3")
-	_, err = cfg.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(fmt.Sprintf("%s/%s.mp4", videoOrientation, randomHex)),
-		Body:        fastStartVideoFile,
-		ContentType: aws.String("video/mp4"),
+	bucket := cfg.resolveBucket(userID)
+	store := cfg.storeForBucket(bucket)
+	cfg.progress.set(video.ID, uploadProgress{Stage: stageStoring, Total: fastStartVideoStat.Size()})
+	body := &sha256Body{
+		ReadSeeker: newProgressReadSeeker(fastStartVideoFile, func(n int64) { cfg.progress.setBytes(video.ID, n) }),
+		sum:        storedHasher.Sum(nil),
+	}
+	objectInfo, err := store.Put(ctx, videoKey, body, format.contentType, upload.storageClass)
+	if err != nil {
+		return video, false, processingFailure(http.StatusInternalServerError, errCodeStorageFailed, "Error uploading to S3", err)
+	}
+	if objectInfo.ETag == "" {
+		objectInfo.ETag = expectedETag
+	}
+	if cfg.verifyUploads && !etagsMatch(objectInfo.ETag, expectedETag) {
+		store.Delete(context.WithoutCancel(ctx), videoKey)
+		return video, false, processingFailure(http.StatusInternalServerError, errCodeIntegrityFailed, "Uploaded video failed integrity check",
+			fmt.Errorf("expected ETag %s, S3 returned %s", expectedETag, objectInfo.ETag))
+	}
+
+	video, perr := cfg.recordStoredVideo(ctx, video, upload, storedVideo{
+		store:       store,
+		bucket:      bucket,
+		key:         videoKey,
+		etag:        objectInfo.ETag,
+		size:        fastStartVideoStat.Size(),
+		orientation: videoOrientation,
+		probe:       probe,
+		watermarked: watermarked,
+		source:      fastStartVideoLocation,
 	})
+	return video, metadataStripped, perr
+}
+
+// storedVideo is an upload's object in its final place in the store.
+type storedVideo struct {
+	store       ObjectStore
+	bucket, key string
+	etag        string
+	size        int64
+	orientation string
+	probe       videoProbe
+	watermarked bool
+	// source is a path or URL ffmpeg can read the stored video from
+	source string
+}
+
+// recordStoredVideo points the video at its newly stored object and saves
+// it, then starts the background generators. The object is deleted again
+// if the video can't be saved.
+func (cfg *apiConfig) recordStoredVideo(ctx context.Context, video database.Video, upload videoUpload, stored storedVideo) (database.Video, *processingError) {
+	store, videoKey, bucket, probe := stored.store, stored.key, stored.bucket, stored.probe
+	// Everything stored for the old upload is deleted once the video no
+	// longer points at it. It may be in a different bucket if the user's
+	// routing changed since.
+	replaced, err := cfg.replacedObjects(video)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error uploading to S3", err)
-		return
+		store.Delete(context.WithoutCancel(ctx), videoKey)
+		return video, processingFailure(http.StatusInternalServerError, errCodeInternal, "Invalid video URL format", err)
 	}
+	video.PreviewURL = nil
+	video.SpriteURL = nil
+	video.SpriteVTTURL = nil
+	video.HLSURL = nil
+	video.Renditions = nil
 
-	// If the video already had a video URL, delete the old video in S3
-	if video.VideoURL != nil {
-		fmt.Println("Deleting old video from S3")
-		oldVideoURL := *video.VideoURL
+	// Update the VideoURL
+	videoURL := fmt.Sprintf("%s/%s", cfg.s3CfDistribution, videoKey)
+	video.VideoURL = &videoURL
+	video.VideoKey = &videoKey
+	video.VideoBucket = &bucket
+	video.VideoFilename = sanitizeFilename(upload.fileName)
+	video.Orientation = &stored.orientation
+	video.SourceSHA256 = &upload.sourceSHA256
+	video.Watermarked = stored.watermarked
+	if cfg.mediaToolsAvailable {
+		probe.applyTo(&video)
+	}
+	videoETag := strings.Trim(stored.etag, `"`)
+	video.VideoETag = &videoETag
+	video.VideoSize = &stored.size
+	ready := videoReady
+	video.ProcessingStatus = &ready
 
-		// The url is in this format "bucket,key"
-		// Extract everything after the "bucket"
-		splitURL := strings.SplitN(oldVideoURL, ",", 2)
-		if len(splitURL) < 2 {
-			respondWithError(w, http.StatusInternalServerError, "Invalid video URL format", nil)
-			return
+	// Caption status is about the current file, so a new one starts over.
+	// Without an audio track there's nothing to transcribe.
+	video.CaptionStatus, video.CaptionError = nil, nil
+	autoCaption := cfg.shouldAutoCaption(upload.autoCaptions)
+	if autoCaption {
+		status := videoPending
+		if probe.AudioCodec == "" {
+			status = videoFailed
+			noAudio := "The video has no audio"
+			video.CaptionError = &noAudio
+			autoCaption = false
 		}
-		oldVideoKey := splitURL[1]
+		video.CaptionStatus = &status
+	}
+
+	// Imports from a platform bring their credits and thumbnail along
+	cfg.applyImportMetadata(ctx, &video, upload)
 
-		// Delete the old video
-		_, err = cfg.s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-			Bucket: aws.String(cfg.s3Bucket),
-			Key:    aws.String(oldVideoKey),
-		})
+	// Videos nobody gave a thumbnail get a frame of their own. It's only a
+	// nicety, so the upload still succeeds without one.
+	if cfg.autoThumbnails && cfg.mediaToolsAvailable && video.ThumbnailURL == nil {
+		err := cfg.setAutoThumbnail(ctx, &video, stored.source, probe.Duration)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Error deleting old video in S3", err)
-			return
+			slog.Warn("couldn't generate thumbnail", "video_id", video.ID, "err", err)
 		}
 	}
 
-	// Update the VideoURL
-	videoURL := fmt.Sprintf("%s/%s/%s.mp4", cfg.s3CfDistribution, videoOrientation, randomHex)
-	video.VideoURL = &videoURL
-
-	// Update the database with the new video URL
-	err = cfg.db.UpdateVideo(video)
+	// Update the database with the new video URL. Until that's saved the
+	// old objects are still the video's, so the new one is what goes if
+	// it fails.
+	err = cfg.db.UpdateVideoReplacingObjects(video, replaced)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error updating video in database", err)
-		return
+		store.Delete(context.WithoutCancel(ctx), videoKey)
+		return video, dbFailure("Error updating video in database", err)
 	}
 
-	// Respond with updated JSON of the video's metadata
-	fmt.Println("Done!")
-	respondWithJSON(w, http.StatusOK, video)
+	// Preview clips, sprite sheets, HLS, MP4 renditions and captions are
+	// slow to make, so they're made in the background
+	if cfg.previewClips && cfg.mediaToolsAvailable {
+		go cfg.generatePreview(store, video.ID, videoURL, videoKey, probe.Duration)
+	}
+	if cfg.spriteSheets && cfg.mediaToolsAvailable {
+		go cfg.generateSprites(store, video.ID, videoURL, videoKey, probe)
+	}
+	if cfg.hlsPackaging && cfg.mediaToolsAvailable {
+		go cfg.generateHLS(store, video.ID, videoURL, videoKey, probe)
+	}
+	if cfg.mp4Renditions && cfg.mediaToolsAvailable {
+		go cfg.generateRenditions(store, video.ID, videoURL, videoKey, probe)
+	}
+	if autoCaption {
+		go cfg.generateCaptions(store, video.ID, videoURL, videoKey)
+	}
+	return video, nil
+}
+
+// randomObjectKey returns a new key of 32 random hex-encoded bytes between
+// prefix and ext, so stored objects can't be guessed or collide.
+func randomObjectKey(prefix, ext string) (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(randomBytes) + ext, nil
+}
+
+// processedVideoResponse is the video after a successful upload, with
+// whether the uploaded file's metadata (location, device, creation time)
+// was removed before it was stored. It's kept when STRIP_METADATA is off or
+// ffmpeg isn't available.
+type processedVideoResponse struct {
+	videoResponse
+	MetadataStripped bool `json:"metadata_stripped"`
+}
+
+// unchangedVideoResponse is returned instead of the plain video when an
+// upload was skipped because the file matched what's already stored.
+type unchangedVideoResponse struct {
+	videoResponse
+	Unchanged bool `json:"unchanged"`
+}
+
+// videoTypeAllowed reports whether an upload of the given media type can be
+// accepted. MP4 only needs to be on the allowlist; other containers also
+// require transcoding to be enabled and ffmpeg to be installed.
+func (cfg *apiConfig) videoTypeAllowed(mediaType string) bool {
+	if !slices.Contains(cfg.allowedVideoTypes, mediaType) {
+		return false
+	}
+	return mediaType == "video/mp4" || (cfg.transcodeVideos && cfg.mediaToolsAvailable)
+}
+
+// videoKeyFromURL recovers the object key from a stored video URL. URLs are
+// normally "<distribution>/<key>", but older rows may still use the
+// "bucket,key" format.
+func (cfg *apiConfig) videoKeyFromURL(videoURL string) (string, bool) {
+	if key, ok := strings.CutPrefix(videoURL, cfg.s3CfDistribution+"/"); ok {
+		return key, key != ""
+	}
+	_, key, ok := strings.Cut(videoURL, ",")
+	return key, ok && key != ""
 }
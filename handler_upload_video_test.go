@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+var videoKeyPattern = regexp.MustCompile(`^(landscape|portrait|other)/[0-9a-f]{64}\.mp4$`)
+
+func TestUploadVideo(t *testing.T) {
+	tests := []struct {
+		name        string
+		width       int
+		height      int
+		orientation string
+	}{
+		{"landscape", 1280, 720, "landscape"},
+		{"portrait", 720, 1280, "portrait"},
+		{"square", 480, 480, "other"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fixture := makeTestMP4(t, tc.width, tc.height)
+			h := newTestHarness(t)
+			token, video := h.createUserAndVideo("owner@example.com")
+
+			resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", fixture)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", resp.StatusCode)
+			}
+
+			keys := h.s3.keys()
+			if len(keys) != 1 {
+				t.Fatalf("expected 1 object in S3, got %d", len(keys))
+			}
+			key := keys[0]
+			if !videoKeyPattern.MatchString(key) {
+				t.Fatalf("unexpected S3 key format: %s", key)
+			}
+			if !strings.HasPrefix(key, tc.orientation+"/") {
+				t.Fatalf("expected %s orientation, got key %s", tc.orientation, key)
+			}
+
+			stored := h.getVideo(video.ID)
+			if stored.VideoURL == nil {
+				t.Fatal("expected video URL to be stored")
+			}
+			want := fmt.Sprintf("%s/%s", h.cfg.s3CfDistribution, key)
+			if *stored.VideoURL != want {
+				t.Fatalf("expected video URL %s, got %s", want, *stored.VideoURL)
+			}
+			if stored.Orientation == nil || *stored.Orientation != tc.orientation {
+				t.Fatalf("expected stored orientation %s, got %v", tc.orientation, stored.Orientation)
+			}
+			if stored.Width == nil || stored.Height == nil || *stored.Width != tc.width || *stored.Height != tc.height {
+				t.Fatalf("expected stored dimensions %dx%d, got %v x %v", tc.width, tc.height, stored.Width, stored.Height)
+			}
+		})
+	}
+}
+
+func TestUploadVideoReplacesOldObject(t *testing.T) {
+	fixture := makeTestMP4(t, 1280, 720)
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+	for i := 0; i < 2; i++ {
+		resp := h.upload(path, token, "video", "clip.mp4", fixture)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("upload %d: expected 200, got %d", i, resp.StatusCode)
+		}
+	}
+
+	// The old object stays until the cleaner gets to it
+	if keys := h.s3.keys(); len(keys) != 2 {
+		t.Fatalf("expected the old object to be kept until it's cleaned up, got %d objects", len(keys))
+	}
+	h.cfg.cleanObjects(context.Background())
+	if keys := h.s3.keys(); len(keys) != 1 {
+		t.Fatalf("expected the old object to be deleted, got %d objects", len(keys))
+	}
+}
+
+func TestUploadVideoRejectsNonMP4(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "notes.txt", []byte("definitely not a video"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+	if code := errorCode(t, resp); code != errCodeInvalidVideo {
+		t.Fatalf("expected code %s, got %q", errCodeInvalidVideo, code)
+	}
+	if keys := h.s3.keys(); len(keys) != 0 {
+		t.Fatalf("expected nothing in S3, got %v", keys)
+	}
+}
+
+func TestUploadVideoRequiresOwner(t *testing.T) {
+	h := newTestHarness(t)
+	_, video := h.createUserAndVideo("owner@example.com")
+	otherToken, _ := h.createUserAndVideo("other@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), otherToken, "video", "clip.mp4", []byte("data"))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+	if code := errorCode(t, resp); code != errCodeNotVideoOwner {
+		t.Fatalf("expected code %s, got %q", errCodeNotVideoOwner, code)
+	}
+}
+
+// minimalMP4 is just enough of an ftyp box for content sniffing to call it
+// video/mp4. It isn't playable, so it's only useful when ffmpeg is skipped.
+var minimalMP4 = append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), make([]byte, 64)...)
+
+func TestUploadVideoWithoutMediaTools(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	keys := h.s3.keys()
+	if len(keys) != 1 || !strings.HasPrefix(keys[0], "other/") {
+		t.Fatalf("expected one object under other/, got %v", keys)
+	}
+	if !bytes.Equal(h.s3.objects[keys[0]], minimalMP4) {
+		t.Fatal("expected the upload to be stored unprocessed")
+	}
+}
+
+func TestUploadVideoConcurrentConflict(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("owner@example.com")
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+
+	// Hold the first upload inside PutObject until the second has been
+	// turned away
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	h.s3.beforePut = func(context.Context, string) {
+		once.Do(func() {
+			close(entered)
+			<-release
+		})
+	}
+
+	first := make(chan *http.Response, 1)
+	firstReq := h.uploadRequest(path, token, "video", "first.mp4", minimalMP4)
+	go func() {
+		resp, err := http.DefaultClient.Do(firstReq)
+		if err != nil {
+			close(first)
+			return
+		}
+		first <- resp
+	}()
+	<-entered
+
+	second := h.upload(path, token, "video", "second.mp4", minimalMP4)
+	if second.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for the concurrent upload, got %d", second.StatusCode)
+	}
+
+	close(release)
+	resp, ok := <-first
+	if !ok {
+		t.Fatal("first upload failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for the first upload, got %d", resp.StatusCode)
+	}
+
+	keys := h.s3.keys()
+	if len(keys) != 1 {
+		t.Fatalf("expected exactly one stored object, got %v", keys)
+	}
+	stored := h.getVideo(video.ID)
+	if stored.VideoURL == nil || !strings.HasSuffix(*stored.VideoURL, keys[0]) {
+		t.Fatalf("expected the db to point at %s, got %v", keys[0], stored.VideoURL)
+	}
+
+	// The lock is released once the first upload finishes
+	again := h.upload(path, token, "video", "third.mp4", minimalMP4)
+	if again.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after the first upload finished, got %d", again.StatusCode)
+	}
+}
+
+func TestUploadVideoUnchangedSkipsProcessing(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("owner@example.com")
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+
+	resp := h.upload(path, token, "video", "clip.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	first := h.getVideo(video.ID)
+
+	resp = h.upload(path, token, "video", "clip.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for the re-upload, got %d", resp.StatusCode)
+	}
+	var body struct {
+		Unchanged bool `json:"unchanged"`
+	}
+	decodeJSON(t, resp, &body)
+	if !body.Unchanged {
+		t.Fatal("expected the re-upload to be reported as unchanged")
+	}
+	if len(h.s3.puts) != 1 {
+		t.Fatalf("expected a single S3 upload, got %d", len(h.s3.puts))
+	}
+	if second := h.getVideo(video.ID); *second.VideoURL != *first.VideoURL {
+		t.Fatal("expected the stored video to be kept")
+	}
+}
+
+func TestUploadVideoClientDisconnectAbortsPut(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	// Block inside PutObject until the request's context is cancelled, as a
+	// real upload to S3 would be interrupted
+	entered := make(chan struct{})
+	aborted := make(chan bool, 1)
+	h.s3.beforePut = func(ctx context.Context, key string) {
+		close(entered)
+		select {
+		case <-ctx.Done():
+			aborted <- true
+		case <-time.After(5 * time.Second):
+			aborted <- false
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := h.uploadRequest(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-entered
+	cancel()
+	<-done
+
+	if !<-aborted {
+		t.Fatal("PutObject's context wasn't cancelled when the client disconnected")
+	}
+	if keys := h.s3.keys(); len(keys) != 0 {
+		t.Fatalf("expected nothing stored, got %v", keys)
+	}
+	if got := h.getVideo(video.ID); got.VideoURL != nil {
+		t.Fatalf("expected no video URL, got %s", *got.VideoURL)
+	}
+}
+
+func TestUploadVideoRejectsOutOfBoundsDimensions(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+	}{
+		{"too small", 128, 96},
+		{"too wide", 1280, 160},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fixture := makeTestMP4(t, tc.width, tc.height)
+			h := newTestHarness(t)
+			token, video := h.createUserAndVideo("owner@example.com")
+
+			resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", fixture)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d", resp.StatusCode)
+			}
+			if code := errorCode(t, resp); code != errCodeInvalidDimension {
+				t.Fatalf("expected %s, got %s", errCodeInvalidDimension, code)
+			}
+			if keys := h.s3.keys(); len(keys) != 0 {
+				t.Fatalf("expected nothing stored, got %v", keys)
+			}
+		})
+	}
+}
+
+func TestUploadVideoRejectsTooLongBeforeQueueing(t *testing.T) {
+	fixture := makeTestMP4(t, 320, 240)
+	h := newTestHarness(t)
+	h.cfg.maxVideoDuration = 500 * time.Millisecond
+	h.cfg.jobWorkers = 1
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", fixture)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+	if code := errorCode(t, resp); code != errCodeVideoTooLong {
+		t.Fatalf("expected %s, got %s", errCodeVideoTooLong, code)
+	}
+	if keys := h.s3.keys(); len(keys) != 0 {
+		t.Fatalf("expected nothing stored, got %v", keys)
+	}
+	if job, err := h.cfg.db.GetLatestVideoJob(video.ID); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected no job queued, got %+v, %v", job, err)
+	}
+}
+
+func TestUploadVideoDryRun(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s?dryRun=true", video.ID), token, "video", "raw.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var analysis uploadAnalysis
+	decodeJSON(t, resp, &analysis)
+	if !analysis.Accepted || analysis.MediaType != "video/mp4" || analysis.Size != int64(len(minimalMP4)) {
+		t.Fatalf("unexpected analysis %+v", analysis)
+	}
+
+	if keys := h.s3.keys(); len(keys) != 0 {
+		t.Fatalf("expected nothing stored, got %v", keys)
+	}
+	if stored := h.getVideo(video.ID); stored.VideoURL != nil || stored.SourceSHA256 != nil {
+		t.Fatal("expected the video row to be untouched")
+	}
+}
+
+func TestUploadVideoDryRunReportsRejection(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s?dryRun=true", video.ID), token, "video", "notes.txt", []byte("just some text, not a video"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var analysis uploadAnalysis
+	decodeJSON(t, resp, &analysis)
+	if analysis.Accepted || analysis.Reason == "" {
+		t.Fatalf("expected a rejection with a reason, got %+v", analysis)
+	}
+}
+
+func TestUploadVideoRejectsLargeContentLength(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	// Declare 5 GB but send almost nothing; the handler must answer from
+	// the header alone
+	body := &countingReader{r: strings.NewReader("x")}
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/video_upload/%s", video.ID), body)
+	req.SetPathValue("videoID", video.ID.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.ContentLength = 5 << 30
+	rec := httptest.NewRecorder()
+
+	h.cfg.handlerUploadVideo(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rec.Code)
+	}
+	if body.n != 0 {
+		t.Fatalf("expected the body to be left unread, %d bytes were read", body.n)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
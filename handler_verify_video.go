@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerVerifyVideo re-heads the stored object and compares its ETag and
+// size with what was recorded at upload time, so altered or truncated
+// objects can be detected.
+func (cfg *apiConfig) handlerVerifyVideo(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		OK           bool   `json:"ok"`
+		ExpectedETag string `json:"expected_etag"`
+		ActualETag   string `json:"actual_etag"`
+		ExpectedSize int64  `json:"expected_size"`
+		ActualSize   int64  `json:"actual_size"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, jwtErrorMessage(err), err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't verify this video", nil)
+		return
+	}
+	if video.VideoURL == nil || video.VideoETag == nil || video.VideoSize == nil {
+		respondWithError(w, http.StatusNotFound, "No integrity data recorded for this video", nil)
+		return
+	}
+
+	key, ok := cfg.videoKey(video)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Invalid video URL format", nil)
+		return
+	}
+
+	info, err := cfg.videoStore(video).Head(r.Context(), key)
+	if errors.Is(err, ErrObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video file is missing", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video file info", err)
+		return
+	}
+
+	resp := response{
+		ExpectedETag: *video.VideoETag,
+		ActualETag:   info.ETag,
+		ExpectedSize: *video.VideoSize,
+		ActualSize:   info.Size,
+	}
+	resp.OK = etagsMatch(resp.ExpectedETag, resp.ActualETag) && resp.ExpectedSize == resp.ActualSize
+	if !resp.OK {
+		respondWithJSON(w, http.StatusConflict, resp)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
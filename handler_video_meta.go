@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -14,35 +16,45 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		database.CreateVideoParams
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	userID, ok := cfg.authenticateUploader(w, r)
+	if !ok {
 		return
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
 		return
 	}
 	params.UserID = userID
 
+	params.Title, params.Description, err = validateVideoMetadata(params.Title, params.Description, cfg.maxTitleLength, cfg.maxDescriptionLength)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if params.Visibility != "" {
+		params.Visibility, err = parseVisibility(params.Visibility)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, err.Error(), err)
+			return
+		}
+	}
+
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
+		respondWithDBError(w, "Couldn't create video", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, video)
+	respondWithJSON(w, http.StatusCreated, cfg.videoResponse(r.Context(), video))
 }
 
+// handlerVideoMetaDelete moves a video to the trash. It can be restored
+// until the trash sweeper purges it, or with ?permanent=true it's purged
+// right away along with every file stored for it.
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -56,7 +68,7 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -64,7 +76,7 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithVideoLookupError(w, err)
 		return
 	}
 	if video.UserID != userID {
@@ -72,15 +84,120 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	if r.URL.Query().Get("permanent") == "true" {
+		// Don't pull files out from under an upload in progress
+		if !cfg.uploadLocks.tryLock(videoID) {
+			respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An upload for this video is in progress", nil)
+			return
+		}
+		defer cfg.uploadLocks.unlock(videoID)
+
+		err = cfg.purgeVideo(r.Context(), video)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't delete video", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = cfg.db.SoftDeleteVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+		respondWithDBError(w, "Couldn't delete video", err)
 		return
 	}
+	permanent := false
+	cfg.emitVideoEvent(eventVideoDeleted, video, webhookEventData{Permanent: &permanent})
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handlerVideoMetaUpdate lets a video's owner change its title, description,
+// download file name and visibility. Fields left out of the body keep their
+// values.
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title         *string `json:"title"`
+		Description   *string `json:"description"`
+		VideoFilename *string `json:"video_filename"`
+		Visibility    *string `json:"visibility"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	var params parameters
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Couldn't decode parameters, only title, description, video_filename and visibility can be changed", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeNotVideoOwner, "You can't change this video", nil)
+		return
+	}
+	if video.DeletedAt != nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeVideoInTrash, "Restore the video from the trash first", nil)
+		return
+	}
+
+	title, description := video.Title, video.Description
+	if params.Title != nil {
+		title = *params.Title
+	}
+	if params.Description != nil {
+		description = *params.Description
+	}
+	title, description, err = validateVideoMetadata(title, description, cfg.maxTitleLength, cfg.maxDescriptionLength)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, err.Error(), err)
+		return
+	}
+	videoFilename := video.VideoFilename
+	if params.VideoFilename != nil {
+		videoFilename = sanitizeFilename(*params.VideoFilename)
+		if videoFilename == nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid video_filename", nil)
+			return
+		}
+	}
+	visibility := video.Visibility
+	if params.Visibility != nil {
+		visibility, err = parseVisibility(*params.Visibility)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, err.Error(), err)
+			return
+		}
+	}
+
+	err = cfg.db.UpdateVideoMetadata(videoID, title, description, videoFilename, visibility)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, cfg.videoResponse(r.Context(), video))
+}
+
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -91,30 +208,231 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.DeletedAt != nil || !cfg.canViewVideo(r, video) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	respondWithCachedJSON(w, r, cfg.videoResponse(r.Context(), video), video.UpdatedAt)
 }
 
+// maxVideoPageSize caps the limit clients can ask for when listing videos.
+const maxVideoPageSize = 100
+
+// handlerVideosRetrieve lists the caller's videos, or their trash with
+// ?trash=true. They can be filtered by orientation, status and visibility,
+// and sorted by created_at or title (or deleted_at in the trash) in either
+// order.
+// Without a limit every match is returned. With one, the response is a
+// page, and while more remain the X-Next-Cursor header and a Link header
+// give the cursor and URL of the next one.
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	query := r.URL.Query()
+	params := database.ListVideosParams{
+		UserID:      userID,
+		Trashed:     query.Get("trash") == "true",
+		Orientation: query.Get("orientation"),
+		Status:      query.Get("status"),
+		Visibility:  query.Get("visibility"),
+		SortBy:      query.Get("sort"),
+	}
+	switch params.Orientation {
+	case "", "landscape", "portrait", "other":
+	default:
+		respondWithError(w, http.StatusBadRequest, "Orientation must be landscape, portrait or other", nil)
+		return
+	}
+	switch params.Status {
+	case "", videoPending, videoProcessing, videoReady, videoFailed:
+	default:
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Status must be pending, processing, ready or failed", nil)
+		return
+	}
+	if params.Visibility != "" {
+		if _, err := parseVisibility(params.Visibility); err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, err.Error(), err)
+			return
+		}
+	}
+
+	// Newest first, or most recently trashed first in the trash; titles
+	// sort alphabetically
+	switch params.SortBy {
+	case "":
+		params.SortBy = "created_at"
+		if params.Trashed {
+			params.SortBy = "deleted_at"
+		}
+		params.Descending = true
+	case "created_at":
+		params.Descending = true
+	case "title":
+	case "deleted_at":
+		if !params.Trashed {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Only the trash can be sorted by deleted_at", nil)
+			return
+		}
+		params.Descending = true
+	default:
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Sort must be created_at or title", nil)
+		return
+	}
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		params.Descending = false
+	case "desc":
+		params.Descending = true
+	default:
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Order must be asc or desc", nil)
+		return
+	}
+
+	if value := query.Get("limit"); value != "" {
+		params.Limit, err = strconv.Atoi(value)
+		if err != nil || params.Limit < 1 || params.Limit > maxVideoPageSize {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, fmt.Sprintf("limit must be between 1 and %d", maxVideoPageSize), err)
+			return
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if params.Limit == 0 {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "cursor needs a limit", nil)
+			return
+		}
+		params.After, err = uuid.Parse(cursor)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Invalid cursor", err)
+			return
+		}
+		// The page would silently come back empty if the video the cursor
+		// points at was deleted since
+		after, err := cfg.db.GetVideo(params.After)
+		if err != nil || after.UserID != userID {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Cursor is no longer valid, start from the first page", err)
+			return
+		}
+	}
+
+	// One extra video says whether there's another page
+	if params.Limit > 0 {
+		params.Limit++
+	}
+	videos, err := cfg.db.ListVideos(params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		respondWithDBError(w, "Couldn't retrieve videos", err)
 		return
 	}
+	if params.Limit > 0 && len(videos) == params.Limit {
+		videos = videos[:len(videos)-1]
+		next := videos[len(videos)-1].ID.String()
+		nextQuery := r.URL.Query()
+		nextQuery.Set("cursor", next)
+		w.Header().Set("X-Next-Cursor", next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, cfg.publicURL(r.Context(), "/api/videos?"+nextQuery.Encode())))
+	}
 
-	respondWithJSON(w, http.StatusOK, videos)
+	// Trashing or restoring a video changes the list without touching any
+	// listed video, so look at the whole library
+	lastModified, err := cfg.db.GetVideosLastModified(userID)
+	if err != nil {
+		respondWithDBError(w, "Couldn't retrieve videos", err)
+		return
+	}
+
+	respondWithCachedJSON(w, r, cfg.videoResponses(r.Context(), videos), lastModified)
+}
+
+// handlerRestoreVideo takes one of the caller's videos back out of the trash.
+func (cfg *apiConfig) handlerRestoreVideo(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, jwtErrorMessage(err), err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't restore this video", nil)
+		return
+	}
+	if video.DeletedAt == nil {
+		respondWithError(w, http.StatusConflict, "Video isn't in the trash", nil)
+		return
+	}
+
+	err = cfg.db.RestoreVideo(videoID)
+	if err != nil {
+		respondWithDBError(w, "Couldn't restore video", err)
+		return
+	}
+	video.DeletedAt = nil
+
+	respondWithJSON(w, http.StatusOK, cfg.videoResponse(r.Context(), video))
+}
+
+// handlerEmptyTrash permanently deletes everything in the caller's trash
+// without waiting for the sweeper. Videos that can't be purged right now,
+// because an upload holds them or their files couldn't be removed, stay in
+// the trash and are reported in errors.
+func (cfg *apiConfig) handlerEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Purged int      `json:"purged"`
+		Errors []string `json:"errors,omitempty"`
+	}
+
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	videos, err := cfg.db.ListVideos(database.ListVideosParams{UserID: userID, Trashed: true, SortBy: "deleted_at"})
+	if err != nil {
+		respondWithDBError(w, "Couldn't retrieve trash", err)
+		return
+	}
+
+	resp := response{}
+	for _, video := range videos {
+		if !cfg.uploadLocks.tryLock(video.ID) {
+			resp.Errors = append(resp.Errors, video.ID.String()+": an upload for this video is in progress")
+			continue
+		}
+		err := cfg.purgeVideo(r.Context(), video)
+		cfg.uploadLocks.unlock(video.ID)
+		if err != nil {
+			resp.Errors = append(resp.Errors, video.ID.String()+": "+err.Error())
+			continue
+		}
+		resp.Purged++
+	}
+	respondWithJSON(w, http.StatusOK, resp)
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerVideoObjectInfo reports what's actually stored for a video, as
+// S3 sees it, so clients and support can check an upload landed intact.
+func (cfg *apiConfig) handlerVideoObjectInfo(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Key          string    `json:"key"`
+		Size         int64     `json:"size"`
+		ContentType  string    `json:"content_type"`
+		ETag         string    `json:"etag"`
+		StorageClass string    `json:"storage_class"`
+		LastModified time.Time `json:"last_modified"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, jwtErrorCode(err), jwtErrorMessage(err), err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeNotVideoOwner, "You can't view this video's storage info", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotReady, "No video has been uploaded yet", nil)
+		return
+	}
+
+	key, ok := cfg.videoKey(video)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Invalid video URL format", nil)
+		return
+	}
+
+	info, err := cfg.videoStore(video).Head(r.Context(), key)
+	if errors.Is(err, ErrObjectNotFound) {
+		// The row says there's a video but storage disagrees
+		slog.Warn("video object missing from storage", "video_id", video.ID, "key", key)
+		respondWithErrorCode(w, http.StatusNotFound, errCodeObjectMissing, "Video file is missing from storage", err)
+		return
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Couldn't get video file info", err)
+		return
+	}
+
+	// S3 leaves the storage class out for STANDARD objects
+	storageClass := info.StorageClass
+	if storageClass == "" {
+		storageClass = string(types.StorageClassStandard)
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         info.ETag,
+		StorageClass: storageClass,
+		LastModified: info.LastModified,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestVideoObjectInfo(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.storageClass = "STANDARD_IA"
+	token, video := h.createUserAndVideo("objectinfo@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	path := fmt.Sprintf("/api/videos/%s/object", video.ID)
+	resp = h.do(http.MethodGet, path, token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var info struct {
+		Key          string `json:"key"`
+		Size         int64  `json:"size"`
+		ContentType  string `json:"content_type"`
+		ETag         string `json:"etag"`
+		StorageClass string `json:"storage_class"`
+	}
+	decodeJSON(t, resp, &info)
+	stored := h.getVideo(video.ID)
+	if info.Size != int64(len(minimalMP4)) || info.ContentType != "video/mp4" || info.StorageClass != "STANDARD_IA" {
+		t.Errorf("unexpected object info %+v", info)
+	}
+	if stored.VideoETag == nil || !etagsMatch(info.ETag, *stored.VideoETag) {
+		t.Errorf("expected the recorded ETag, got %q", info.ETag)
+	}
+
+	// The row still points at the object after it's gone from the bucket
+	delete(h.s3.objects, info.Key)
+	resp = h.do(http.MethodGet, path, token, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+	if code := errorCode(t, resp); code != errCodeObjectMissing {
+		t.Errorf("expected %s, got %s", errCodeObjectMissing, code)
+	}
+
+	other, _ := h.createUserAndVideo("someone-else@example.com")
+	resp = h.do(http.MethodGet, path, other, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for another user, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// progressBytesInterval throttles bytes events, which would otherwise go
+// out for every chunk read.
+const progressBytesInterval = 250 * time.Millisecond
+
+// progressKeepAlive is how often an idle progress stream sends a comment,
+// so proxies don't close it.
+const progressKeepAlive = 15 * time.Second
+
+// handlerVideoProgress streams an upload's progress to the video's owner
+// as Server-Sent Events: a stage event whenever the upload moves on, and
+// bytes events while it's received or stored. The stream starts with the
+// current state and ends after the done or failed stage. It needs the
+// Authorization header, so browsers read it with fetch rather than
+// EventSource.
+func (cfg *apiConfig) handlerVideoProgress(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeNotVideoOwner, "You must be the video owner", nil)
+		return
+	}
+
+	unsubscribe := cfg.progress.subscribe(videoID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	keepAlive := time.NewTicker(progressKeepAlive)
+	defer keepAlive.Stop()
+	var sent *uploadProgress
+	var lastBytes time.Time
+	for {
+		progress, changed := cfg.progress.snapshot(videoID)
+		switch {
+		case sent == nil || progress.Stage != sent.Stage || progress.Error != sent.Error:
+			err = writeProgressEvent(w, "stage", progress)
+			if err == nil && progress.Bytes > 0 {
+				err = writeProgressEvent(w, "bytes", progress)
+			}
+		case progress.Bytes != sent.Bytes || progress.Total != sent.Total:
+			if wait := progressBytesInterval - time.Since(lastBytes); wait > 0 {
+				// Send whatever the count is once the interval is up
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(wait):
+				}
+				continue
+			}
+			err = writeProgressEvent(w, "bytes", progress)
+			lastBytes = time.Now()
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+		sent = &progress
+		if progress.finished() {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeProgressEvent(w io.Writer, event string, progress uploadProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestVideoProgressStream(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("progress@example.com")
+
+	path := "/api/videos/" + video.ID.String() + "/progress"
+	otherToken, _ := h.createUserAndVideo("other-progress@example.com")
+	if resp := h.do(http.MethodGet, path, otherToken, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("another user: expected 403, got %d", resp.StatusCode)
+	}
+
+	resp := h.do(http.MethodGet, path, token, nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	events := bufio.NewScanner(resp.Body)
+	next := func() (string, uploadProgress) {
+		t.Helper()
+		var event string
+		var progress uploadProgress
+		for events.Scan() {
+			line := events.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &progress); err != nil {
+					t.Fatal(err)
+				}
+			case line == "" && event != "":
+				return event, progress
+			}
+		}
+		return "", progress
+	}
+
+	if event, progress := next(); event != "stage" || progress.Stage != stageWaiting {
+		t.Fatalf("first event = %s %+v", event, progress)
+	}
+
+	upload := h.upload("/api/video_upload/"+video.ID.String(), token, "video", "raw.mp4", minimalMP4)
+	if upload.StatusCode != http.StatusOK {
+		t.Fatalf("upload: expected 200, got %d", upload.StatusCode)
+	}
+
+	// Stages come in order, though a fast upload can skip some of them
+	order := []string{stageWaiting, stageReceiving, stageProcessing, stageStoring, stageDone}
+	last := 0
+	for {
+		event, progress := next()
+		if event == "" {
+			t.Fatal("stream ended before the upload was done")
+		}
+		if event == "bytes" {
+			if progress.Total > 0 && progress.Bytes > progress.Total {
+				t.Errorf("%d of %d bytes", progress.Bytes, progress.Total)
+			}
+			continue
+		}
+		i := 0
+		for i < len(order) && order[i] != progress.Stage {
+			i++
+		}
+		if i <= last || i == len(order) {
+			t.Fatalf("stage %q after %q", progress.Stage, order[last])
+		}
+		last = i
+		if progress.Stage == stageDone {
+			break
+		}
+	}
+	if event, _ := next(); event != "" {
+		t.Errorf("stream kept going after done with %s", event)
+	}
+}
+
+func TestProgressTrackerFinish(t *testing.T) {
+	tracker := newProgressTracker()
+	id := uuid.New()
+
+	tracker.set(id, uploadProgress{Stage: stageReceiving, Total: 100})
+	tracker.setBytes(id, 40)
+	progress, changed := tracker.snapshot(id)
+	if progress.Bytes != 40 || progress.Total != 100 {
+		t.Fatalf("progress = %+v", progress)
+	}
+
+	// A request that gives up part way leaves the upload failed
+	tracker.finish(id)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("finishing didn't notify watchers")
+	}
+	if progress, _ := tracker.snapshot(id); progress.Stage != stageFailed || progress.Error == "" {
+		t.Fatalf("after an unfinished request: %+v", progress)
+	}
+
+	// Queued and finished uploads are left alone
+	for _, stage := range []string{stageQueued, stageDone} {
+		tracker.set(id, uploadProgress{Stage: stage})
+		tracker.finish(id)
+		if progress, _ := tracker.snapshot(id); progress.Stage != stage {
+			t.Errorf("finish changed %s to %s", stage, progress.Stage)
+		}
+	}
+}
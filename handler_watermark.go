@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// maxWatermarkBytes caps the size of a user's watermark image.
+const maxWatermarkBytes = 2 << 20 // 2 MB
+
+// watermarkKeyPrefix is where users' watermark images are kept in the
+// default bucket.
+const watermarkKeyPrefix = "watermarks/"
+
+// watermarkImageTypes are the image types a watermark can be. PNG keeps
+// its transparency when it's drawn.
+var watermarkImageTypes = []string{"image/png", "image/jpeg"}
+
+// handlerGetWatermark returns the caller's own watermark settings.
+func (cfg *apiConfig) handlerGetWatermark(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	watermark, err := cfg.db.GetWatermark(userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "You haven't set a watermark", nil)
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, "Couldn't get watermark", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, watermark)
+}
+
+// handlerSetWatermark sets the image drawn on the caller's uploads in
+// place of the server's watermark, replacing any they had. The form holds
+// the image along with optional position, opacity and by_default fields.
+func (cfg *apiConfig) handlerSetWatermark(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.mediaToolsAvailable {
+		respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeFFmpegMissing, "ffmpeg isn't installed", nil)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxWatermarkBytes+(64<<10))
+	err := r.ParseMultipartForm(maxWatermarkBytes)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Watermark is larger than the 2 MB limit", err)
+			return
+		}
+		if problem, ok := multipartParseProblem(err); ok {
+			respondWithFormErrors(w, []formFieldError{problem})
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Error parsing form data", err)
+		return
+	}
+	problems := validateUploadForm(r.MultipartForm, "image", "position", "opacity", "by_default")
+	watermark := database.Watermark{UserID: userID, Position: r.FormValue("position"), Opacity: 1}
+	if watermark.Position == "" {
+		watermark.Position = "bottom-right"
+	}
+	if _, ok := watermarkOverlayPositions[watermark.Position]; !ok {
+		problems = append(problems, formFieldError{Field: "position", Problem: "must be top-left, top-right, bottom-left, bottom-right or center"})
+	}
+	if value := r.FormValue("opacity"); value != "" {
+		watermark.Opacity, err = strconv.ParseFloat(value, 64)
+		if err != nil || watermark.Opacity < 0 || watermark.Opacity > 1 {
+			problems = append(problems, formFieldError{Field: "opacity", Problem: "must be a number between 0 and 1"})
+		}
+	}
+	if value := r.FormValue("by_default"); value != "" {
+		watermark.ByDefault, err = strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, formFieldError{Field: "by_default", Problem: "must be true or false"})
+		}
+	}
+	if len(problems) > 0 {
+		respondWithFormErrors(w, problems)
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "Error getting file from form data", err)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error reading watermark image", err)
+		return
+	}
+	mediaType, ext, err := verifyThumbnail(r.Context(), data, watermarkImageTypes)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Watermark must be a PNG or JPEG image", err)
+		return
+	}
+
+	previous, err := cfg.db.GetWatermark(userID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithDBError(w, "Couldn't get watermark", err)
+		return
+	}
+
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating random bytes", err)
+		return
+	}
+	watermark.ImageKey = watermarkKeyPrefix + hex.EncodeToString(randomBytes) + ext
+	_, err = cfg.store.Put(r.Context(), watermark.ImageKey, bytes.NewReader(data), mediaType, cfg.storageClass)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageFailed, "Error saving watermark image", err)
+		return
+	}
+
+	watermark, err = cfg.db.SetWatermark(watermark)
+	if err != nil {
+		cfg.removeWatermarkImage(context.WithoutCancel(r.Context()), watermark.ImageKey)
+		respondWithDBError(w, "Couldn't save watermark", err)
+		return
+	}
+	if previous.ImageKey != "" {
+		cfg.removeWatermarkImage(r.Context(), previous.ImageKey)
+	}
+
+	respondWithJSON(w, http.StatusOK, watermark)
+}
+
+// handlerDeleteWatermark removes the caller's watermark, so their uploads
+// get the server's again, if there is one.
+func (cfg *apiConfig) handlerDeleteWatermark(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err == nil {
+		err = cfg.db.DeleteWatermark(userID)
+	}
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "You haven't set a watermark", nil)
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, "Couldn't delete watermark", err)
+		return
+	}
+	cfg.removeWatermarkImage(r.Context(), watermark.ImageKey)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeWatermarkImage deletes a watermark image no longer in use. Failing
+// only leaves a stray object, so it's logged rather than reported.
+func (cfg *apiConfig) removeWatermarkImage(ctx context.Context, key string) {
+	err := cfg.store.Delete(ctx, key)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		slog.Warn("couldn't delete watermark image", "key", key, "err", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// setWatermarkRequest builds a PUT /api/watermark form with an image and
+// the given fields.
+func setWatermarkRequest(t *testing.T, h *testHarness, token string, image []byte, fields map[string]string) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	part, err := mw.CreateFormFile("image", "logo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(image)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPut, h.srv.URL+"/api/watermark", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSetWatermark(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = true
+	token, _ := h.createUserAndVideo("watermark@example.com")
+
+	resp, err := http.DefaultClient.Do(setWatermarkRequest(t, h, token, testPNG(t), map[string]string{
+		"position":   "top-left",
+		"opacity":    "0.5",
+		"by_default": "true",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var first database.Watermark
+	decodeJSON(t, resp, &first)
+	if first.Position != "top-left" || first.Opacity != 0.5 || !first.ByDefault {
+		t.Fatalf("unexpected watermark %+v", first)
+	}
+	stored, err := h.cfg.db.GetWatermark(first.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.ImageKey, watermarkKeyPrefix) || h.s3.objects[stored.ImageKey] == nil {
+		t.Fatalf("expected the image in the bucket, got key %q", stored.ImageKey)
+	}
+
+	// Setting it again replaces the image
+	resp, err = http.DefaultClient.Do(setWatermarkRequest(t, h, token, testPNG(t), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	replaced, err := h.cfg.db.GetWatermark(first.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.Position != "bottom-right" || replaced.Opacity != 1 || replaced.ByDefault {
+		t.Errorf("expected the defaults, got %+v", replaced)
+	}
+	if _, ok := h.s3.objects[stored.ImageKey]; ok {
+		t.Error("expected the old image to be deleted")
+	}
+
+	resp = h.do(http.MethodDelete, "/api/watermark", token, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if _, ok := h.s3.objects[replaced.ImageKey]; ok {
+		t.Error("expected the image to be deleted")
+	}
+	resp = h.do(http.MethodGet, "/api/watermark", token, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 after deleting, got %d", resp.StatusCode)
+	}
+}
+
+func TestSetWatermarkValidatesForm(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = true
+	token, _ := h.createUserAndVideo("watermark@example.com")
+
+	resp, err := http.DefaultClient.Do(setWatermarkRequest(t, h, token, testPNG(t), map[string]string{
+		"position": "middle",
+		"opacity":  "2",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.DefaultClient.Do(setWatermarkRequest(t, h, token, []byte("not an image"), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if code := errorCode(t, resp); resp.StatusCode != http.StatusBadRequest || code != errCodeInvalidImage {
+		t.Errorf("expected 400 %s, got %d %s", errCodeInvalidImage, resp.StatusCode, code)
+	}
+}
+
+func TestUploadWatermark(t *testing.T) {
+	h := newTestHarness(t)
+	user, err := h.cfg.db.CreateUser(database.CreateUserParams{Email: "wm@example.com", Password: "hashed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a server or user watermark there's nothing to apply
+	if _, apply, err := h.cfg.uploadWatermark(user.ID, "true"); err != nil || apply {
+		t.Fatalf("expected no watermark, got %v, %v", apply, err)
+	}
+
+	h.cfg.watermarkImage = "/etc/tubely/watermark.png"
+	h.cfg.watermarkPosition = "center"
+	h.cfg.watermarkOpacity = 0.8
+	settings, apply, err := h.cfg.uploadWatermark(user.ID, "")
+	if err != nil || apply {
+		t.Fatalf("expected the server watermark off by default, got %v, %v", apply, err)
+	}
+	if settings.image != h.cfg.watermarkImage || settings.position != "center" {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+
+	_, err = h.cfg.db.SetWatermark(database.Watermark{
+		UserID: user.ID, ImageKey: "watermarks/mine.png", Position: "top-right", Opacity: 0.3, ByDefault: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, apply, err = h.cfg.uploadWatermark(user.ID, "")
+	if err != nil || !apply {
+		t.Fatalf("expected the user's watermark on by default, got %v, %v", apply, err)
+	}
+	if settings.imageKey != "watermarks/mine.png" || settings.image != "" || settings.position != "top-right" {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+	if _, apply, _ := h.cfg.uploadWatermark(user.ID, "false"); apply {
+		t.Error("expected the form field to turn it off")
+	}
+}
+
+func TestWatermarkRequiresLogin(t *testing.T) {
+	h := newTestHarness(t)
+	resp := h.do(http.MethodGet, "/api/watermark", "", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxWebhooksPerUser caps how many webhooks a user can register.
+	maxWebhooksPerUser  = 10
+	maxWebhookURLLength = 2048
+	// webhookDeliveryLogSize is how many deliveries the delivery log shows.
+	webhookDeliveryLogSize = 100
+)
+
+// webhookResponse is a webhook as its owner sees it. The secret is only
+// included when the webhook is created.
+type webhookResponse struct {
+	database.Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+// webhookDeliveryResponse adds the payload that was sent to a delivery
+// log entry.
+type webhookDeliveryResponse struct {
+	database.WebhookDelivery
+	Payload json.RawMessage `json:"payload"`
+}
+
+// handlerWebhookCreate registers a URL to be POSTed the caller's video
+// events, signed with a secret returned only in this response.
+func (cfg *apiConfig) handlerWebhookCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var params parameters
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	u, err := url.Parse(params.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(params.URL) > maxWebhookURLLength {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "URL must be an absolute http or https URL", err)
+		return
+	}
+	for _, event := range params.Events {
+		if !slices.Contains(webhookEvents, event) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Unknown event "+event, nil)
+			return
+		}
+	}
+	slices.Sort(params.Events)
+	params.Events = slices.Compact(params.Events)
+
+	existing, err := cfg.db.GetWebhooks(userID)
+	if err != nil {
+		respondWithDBError(w, "Couldn't get webhooks", err)
+		return
+	}
+	if len(existing) >= maxWebhooksPerUser {
+		respondWithErrorCode(w, http.StatusConflict, errCodeConflict, "Too many webhooks, delete one first", nil)
+		return
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create webhook secret", err)
+		return
+	}
+	webhook := database.Webhook{
+		ID:        uuid.New(),
+		CreatedAt: time.Now().UTC(),
+		UserID:    userID,
+		URL:       u.String(),
+		Events:    params.Events,
+		Secret:    "whsec_" + hex.EncodeToString(secret),
+	}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	err = cfg.db.CreateWebhook(webhook)
+	if err != nil {
+		respondWithDBError(w, "Couldn't save webhook", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusCreated, webhookResponse{Webhook: webhook, Secret: webhook.Secret})
+}
+
+func (cfg *apiConfig) handlerWebhooksList(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	webhooks, err := cfg.db.GetWebhooks(userID)
+	if err != nil {
+		respondWithDBError(w, "Couldn't get webhooks", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, webhooks)
+}
+
+func (cfg *apiConfig) handlerWebhookDelete(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := uuid.Parse(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid webhook ID", err)
+		return
+	}
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	err = cfg.db.DeleteWebhook(webhookID, userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Webhook not found", err)
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, "Couldn't delete webhook", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerWebhookDeliveries lists a webhook's latest deliveries, with their
+// payloads and the outcome of the last attempt, for debugging receivers.
+func (cfg *apiConfig) handlerWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := uuid.Parse(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid webhook ID", err)
+		return
+	}
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	webhook, err := cfg.db.GetWebhook(webhookID)
+	if errors.Is(err, database.ErrNotFound) || (err == nil && webhook.UserID != userID) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Webhook not found", err)
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, "Couldn't get webhook", err)
+		return
+	}
+
+	deliveries, err := cfg.db.GetWebhookDeliveries(webhookID, webhookDeliveryLogSize)
+	if err != nil {
+		respondWithDBError(w, "Couldn't get webhook deliveries", err)
+		return
+	}
+	resp := make([]webhookDeliveryResponse, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		resp = append(resp, webhookDeliveryResponse{WebhookDelivery: delivery, Payload: delivery.Payload})
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "test-secret"
+
+// fakeS3 is an in-memory stand-in for the S3 client.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	buckets map[string]string // bucket each object was last put in
+	classes map[string]string // storage class each object was put with
+	ctypes  map[string]string // content type each object was put with
+	// modified is when each object was put. Objects tests add to objects
+	// directly have none and list as last modified long ago.
+	modified map[string]time.Time
+	puts     []string
+	copies   []string
+	// checksummed lists the puts and parts sent with a SHA-256, which is
+	// checked like S3 does.
+	checksummed []string
+
+	// multipart holds the parts of multipart uploads in progress, by
+	// upload ID. aborted lists uploads that were abandoned.
+	multipart map[string]map[int32][]byte
+	aborted   []string
+	// failPart, when set, makes UploadPart fail for that part number.
+	failPart int32
+	deletes  []string
+	// deleteErr, when set, is returned by every DeleteObject call.
+	deleteErr error
+	// headBucketErr, when set, is returned by every HeadBucket call.
+	headBucketErr error
+
+	// beforePut, when set, runs at the start of every PutObject call so
+	// tests can hold an upload open. Like the real client, PutObject fails
+	// if ctx is done by the time it returns.
+	beforePut func(ctx context.Context, key string)
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, buckets: map[string]string{}, classes: map[string]string{}, ctypes: map[string]string{}, modified: map[string]time.Time{}, multipart: map[string]map[int32][]byte{}}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if f.beforePut != nil {
+		f.beforePut(ctx, aws.ToString(params.Key))
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := aws.ToString(params.Key)
+	if err := f.checkSHA256(key, body, params.ChecksumSHA256); err != nil {
+		return nil, err
+	}
+	f.objects[key] = body
+	f.buckets[key] = aws.ToString(params.Bucket)
+	f.classes[key] = string(params.StorageClass)
+	f.ctypes[key] = aws.ToString(params.ContentType)
+	f.modified[key] = time.Now()
+	f.puts = append(f.puts, key)
+	sum := md5.Sum(body)
+	return &s3.PutObjectOutput{ETag: aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)}, nil
+}
+
+// checkSHA256 fails like S3's BadDigest when a checksum was sent and body
+// doesn't match it. f.mu must be held.
+func (f *fakeS3) checkSHA256(key string, body []byte, checksum *string) error {
+	if checksum == nil {
+		return nil
+	}
+	sum := sha256.Sum256(body)
+	if *checksum != base64.StdEncoding.EncodeToString(sum[:]) {
+		return errors.New("BadDigest: the SHA256 you specified did not match the calculated checksum")
+	}
+	f.checksummed = append(f.checksummed, key)
+	return nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	if params.Range != nil {
+		var start, end int
+		fmt.Sscanf(*params.Range, "bytes=%d-%d", &start, &end)
+		body = body[start:min(end+1, len(body))]
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: aws.Int64(int64(len(body))),
+	}, nil
+}
+
+func (f *fakeS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.headBucketErr != nil {
+		return nil, f.headBucketErr
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.deleteErr != nil {
+		return nil, f.deleteErr
+	}
+	key := aws.ToString(params.Key)
+	delete(f.objects, key)
+	f.deletes = append(f.deletes, key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	_, srcKey, _ := strings.Cut(source, "/")
+	body, ok := f.objects[srcKey]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	key := aws.ToString(params.Key)
+	f.objects[key] = bytes.Clone(body)
+	f.buckets[key] = aws.ToString(params.Bucket)
+	f.classes[key] = string(params.StorageClass)
+	f.ctypes[key] = f.ctypes[srcKey]
+	f.modified[key] = time.Now()
+	f.copies = append(f.copies, key)
+	sum := md5.Sum(body)
+	return &s3.CopyObjectOutput{CopyObjectResult: &types.CopyObjectResult{ETag: aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)}}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	uploadID := fmt.Sprintf("upload-%d", len(f.multipart)+len(f.aborted)+1)
+	f.multipart[uploadID] = map[int32][]byte{}
+	key := aws.ToString(params.Key)
+	f.classes[key] = string(params.StorageClass)
+	f.ctypes[key] = aws.ToString(params.ContentType)
+	f.modified[key] = time.Now()
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	partNumber := aws.ToInt32(params.PartNumber)
+	if partNumber == f.failPart {
+		return nil, errors.New("part upload failed")
+	}
+	parts, ok := f.multipart[aws.ToString(params.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{}
+	}
+	if err := f.checkSHA256(aws.ToString(params.Key), body, params.ChecksumSHA256); err != nil {
+		return nil, err
+	}
+	parts[partNumber] = body
+	sum := md5.Sum(body)
+	return &s3.UploadPartOutput{ETag: aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	uploadID := aws.ToString(params.UploadId)
+	parts, ok := f.multipart[uploadID]
+	if !ok {
+		return nil, &types.NoSuchUpload{}
+	}
+	var body, partSums []byte
+	for _, part := range params.MultipartUpload.Parts {
+		data := parts[aws.ToInt32(part.PartNumber)]
+		body = append(body, data...)
+		sum := md5.Sum(data)
+		partSums = append(partSums, sum[:]...)
+	}
+	delete(f.multipart, uploadID)
+	key := aws.ToString(params.Key)
+	f.objects[key] = body
+	f.buckets[key] = aws.ToString(params.Bucket)
+	f.puts = append(f.puts, key)
+	sum := md5.Sum(partSums)
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(params.MultipartUpload.Parts))
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(etag)}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	uploadID := aws.ToString(params.UploadId)
+	delete(f.multipart, uploadID)
+	f.aborted = append(f.aborted, uploadID)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	key := aws.ToString(params.Key)
+	sum := md5.Sum(body)
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(body))),
+		ContentType:   aws.String(f.ctypes[key]),
+		ETag:          aws.String(`"` + hex.EncodeToString(sum[:]) + `"`),
+		StorageClass:  types.StorageClass(f.classes[key]),
+	}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.ListObjectsV2Output{}
+	for key, body := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			out.Contents = append(out.Contents, types.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(body))),
+				LastModified: aws.Time(f.modified[key]),
+			})
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// testHarness wires an apiConfig to a temp SQLite database and a fake S3
+// client and serves it through httptest.
+type testHarness struct {
+	t   *testing.T
+	cfg *apiConfig
+	s3  *fakeS3
+	srv *httptest.Server
+}
+
+func newTestHarness(t *testing.T) *testHarness {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db"), database.DefaultOptions())
+	if err != nil {
+		t.Fatalf("couldn't create database: %v", err)
+	}
+
+	fake := newFakeS3()
+	cfg := &apiConfig{
+		db:               db,
+		jwtSecret:        testJWTSecret,
+		platform:         "dev",
+		filepathRoot:     filepath.Join(dir, "app"),
+		assetsRoot:       filepath.Join(dir, "assets"),
+		s3Bucket:         "tubely-test",
+		s3Region:         "us-east-2",
+		s3CfDistribution: "https://cdn.example.com",
+		port:             "8091",
+		store:            newS3ObjectStore(fake, nil, "tubely-test", 1, 0),
+		uploadLocks:      newVideoLocks(),
+		progress:         newProgressTracker(),
+		trashRetention:   30 * 24 * time.Hour,
+		orphanMinAge:     24 * time.Hour,
+		s3Client:         fake,
+		s3MaxAttempts:    1,
+
+		videoDelivery:  videoDeliveryPublic,
+		streamMode:     streamModeProxy,
+		videoURLExpiry: time.Hour,
+
+		maxTitleLength:       200,
+		maxDescriptionLength: 5000,
+		dimensionLimits:      defaultDimensionLimits,
+
+		allowedVideoTypes: []string{"video/mp4"},
+		outputFormat:      defaultOutputFormat,
+		stripMetadata:     true,
+
+		allowedThumbnailTypes: []string{"image/jpeg", "image/png"},
+
+		mediaToolsAvailable: checkMediaTools() == nil,
+
+		idempotencyTTL: 24 * time.Hour,
+		remoteClient:   newRemoteFetchClient(5 * time.Second),
+		importClient:   newRemoteFetchClient(5 * time.Second),
+
+		tusDir:          filepath.Join(dir, "tus"),
+		tusUploadExpiry: 24 * time.Hour,
+
+		jobDir:  filepath.Join(dir, "jobs"),
+		jobWake: make(chan struct{}, 1),
+
+		// Test receivers listen on loopback, which the real client refuses
+		webhookClient: &http.Client{Timeout: 5 * time.Second},
+		webhookWake:   make(chan struct{}, 1),
+	}
+	if err := cfg.ensureAssetsDir(); err != nil {
+		t.Fatalf("couldn't create assets dir: %v", err)
+	}
+
+	h := &testHarness{t: t, cfg: cfg, s3: fake}
+	h.srv = httptest.NewServer(requestLogMiddleware(cfg.routes()))
+	t.Cleanup(h.srv.Close)
+	return h
+}
+
+// createUserAndVideo inserts a user and an empty video owned by them and
+// returns an access token for that user.
+func (h *testHarness) createUserAndVideo(email string) (string, database.Video) {
+	h.t.Helper()
+
+	user, err := h.cfg.db.CreateUser(database.CreateUserParams{
+		Email:    email,
+		Password: "hashed",
+	})
+	if err != nil {
+		h.t.Fatalf("couldn't create user: %v", err)
+	}
+	video, err := h.cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       "test video",
+		Description: "a test video",
+		UserID:      user.ID,
+	})
+	if err != nil {
+		h.t.Fatalf("couldn't create video: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, testJWTSecret, time.Hour, h.cfg.jwtScope)
+	if err != nil {
+		h.t.Fatalf("couldn't make JWT: %v", err)
+	}
+	return token, video
+}
+
+// upload sends data as a multipart form with a single file field.
+func (h *testHarness) upload(path, token, field, fileName string, data []byte) *http.Response {
+	h.t.Helper()
+
+	resp, err := http.DefaultClient.Do(h.uploadRequest(path, token, field, fileName, data))
+	if err != nil {
+		h.t.Fatalf("request failed: %v", err)
+	}
+	h.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// uploadRequest builds the request upload sends, for tests that need to
+// send it from another goroutine.
+func (h *testHarness) uploadRequest(path, token, field, fileName string, data []byte) *http.Request {
+	h.t.Helper()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	part, err := mw.CreateFormFile(field, fileName)
+	if err != nil {
+		h.t.Fatalf("couldn't create form file: %v", err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, h.srv.URL+path, body)
+	if err != nil {
+		h.t.Fatalf("couldn't create request: %v", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// do sends a request with an optional bearer token and body.
+func (h *testHarness) do(method, path, token string, body io.Reader) *http.Response {
+	h.t.Helper()
+
+	req, err := http.NewRequest(method, h.srv.URL+path, body)
+	if err != nil {
+		h.t.Fatalf("couldn't create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatalf("request failed: %v", err)
+	}
+	h.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func (h *testHarness) getVideo(id uuid.UUID) database.Video {
+	h.t.Helper()
+	video, err := h.cfg.db.GetVideo(id)
+	if err != nil {
+		h.t.Fatalf("couldn't get video: %v", err)
+	}
+	return video
+}
+
+func decodeJSON(t *testing.T, resp *http.Response, v any) {
+	t.Helper()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("couldn't decode response: %v", err)
+	}
+}
+
+// errorCode decodes an error response and returns its code.
+func errorCode(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	decodeJSON(t, resp, &body)
+	if body.Error == "" {
+		t.Error("expected an error message alongside the code")
+	}
+	return body.Code
+}
+
+// requireFFmpeg skips the test when ffmpeg or ffprobe aren't on the PATH.
+func requireFFmpeg(t *testing.T) {
+	t.Helper()
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not installed", bin)
+		}
+	}
+}
+
+// makeTestMP4 renders a one second test pattern at the given size.
+func makeTestMP4(t *testing.T, width, height int) []byte {
+	t.Helper()
+	requireFFmpeg(t)
+
+	out := filepath.Join(t.TempDir(), "fixture.mp4")
+	size := fmt.Sprintf("size=%dx%d:duration=1:rate=10", width, height)
+	cmd := exec.Command("ffmpeg", "-v", "error", "-f", "lavfi", "-i", "testsrc="+size,
+		"-c:v", "mpeg4", "-pix_fmt", "yuv420p", "-f", "mp4", out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("couldn't render fixture: %v: %s", err, output)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("couldn't read fixture: %v", err)
+	}
+	return data
+}
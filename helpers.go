@@ -1,74 +1,332 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/http"
 	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
-// getVideoAspectRatio takes a file path and returns the aspect ratio as a string.
-// It uses the ffprobe command line tool to retrieve the video's aspect ratio.
-// The returned string is in the format "width:height".
-func getVideoAspectRatio(filePath string) (string, error) {
-	// Create a new command with the right arguments.
-	// The -v flag specifies the log level.
-	// The -print_format json flag specifies the output format.
-	// The -show_streams flag prints information about the file.
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
+// errMediaToolsMissing is returned when ffmpeg or ffprobe can't be found.
+var errMediaToolsMissing = errors.New("ffmpeg/ffprobe not installed")
+
+// checkMediaTools reports whether both ffmpeg and ffprobe are in the PATH.
+func checkMediaTools() error {
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			return fmt.Errorf("%w: %s isn't in the PATH", errMediaToolsMissing, bin)
+		}
+	}
+	return nil
+}
+
+// errMediaToolTimedOut is returned when ffmpeg or ffprobe runs longer than
+// mediaToolTimeout, which usually means the input is malformed.
+var errMediaToolTimedOut = errors.New("ffmpeg/ffprobe timed out")
+
+// mediaToolTimeout bounds how long a single ffmpeg or ffprobe process may
+// run. main sets it from the config before serving.
+var mediaToolTimeout = 30 * time.Minute
+
+// mediaToolKillGrace is how long runMediaTool waits for a killed process's
+// output to close, in case something it spawned is still holding it open.
+const mediaToolKillGrace = 5 * time.Second
+
+// runMediaTool runs ffmpeg or ffprobe with the given arguments and returns
+// the combined output. The process, and anything it started, is killed if
+// ctx is cancelled, e.g. when the client that's waiting on it disconnects,
+// or if it runs longer than mediaToolTimeout. It waits for a free slot in
+// mediaTools first and fails with errMediaToolsBusy if none frees up.
+func runMediaTool(ctx context.Context, name string, args ...string) ([]byte, error) {
+	release, err := mediaTools.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer release()
+
+	runCtx, cancel := context.WithTimeout(ctx, mediaToolTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(runCtx, name, args...)
+	startInProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	cmd.WaitDelay = mediaToolKillGrace
 
-	// Run the command and capture the output.
 	output, err := cmd.CombinedOutput()
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("%s aborted: %w", name, ctxErr)
+		}
+		if runCtx.Err() != nil {
+			return nil, fmt.Errorf("%w: %s ran for over %s", errMediaToolTimedOut, name, mediaToolTimeout)
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %v", errMediaToolsMissing, err)
+		}
 		if _, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("ffprobe failed: %s", string(output))
+			return nil, fmt.Errorf("%s failed: %s", name, string(output))
 		}
-		return "", fmt.Errorf("unexpected error running ffprobe: %v", err)
+		return nil, fmt.Errorf("unexpected error running %s: %v", name, err)
+	}
+	return output, nil
+}
+
+// videoProbe is what ffprobe tells us about a video's first video stream and
+// its container.
+type videoProbe struct {
+	Width              int
+	Height             int
+	DisplayAspectRatio string  // "width:height"
+	Duration           float64 // seconds
+	Codec              string
+	// AudioCodec is the first audio stream's codec, empty when there's
+	// no audio.
+	AudioCodec string
+	FrameRate  float64 // frames per second, 0 when ffprobe can't tell
+	Bitrate    int64   // bits per second, of the whole file
+
+	// Rotation is how many degrees clockwise players turn the video, from
+	// 0 to 270. Width, Height and DisplayAspectRatio are as displayed,
+	// after rotating.
+	Rotation int
+}
+
+// probeVideo takes a file path and uses the ffprobe command line tool to
+// retrieve the dimensions, aspect ratio, duration, codecs, frame rate and
+// bitrate of the video.
+func probeVideo(ctx context.Context, filePath string) (videoProbe, error) {
+	// Run the command with the right arguments.
+	// The -v flag specifies the log level.
+	// The -print_format json flag specifies the output format.
+	// The -show_streams flag prints information about each stream.
+	// The -show_format flag prints information about the container.
+	output, err := runMediaTool(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath)
+	if err != nil {
+		return videoProbe{}, err
 	}
 
 	// Define a struct to unmarshal the JSON output into.
 	type Stream struct {
+		CodecType          string `json:"codec_type"`
+		CodecName          string `json:"codec_name"`
 		Width              int    `json:"width"`
 		Height             int    `json:"height"`
 		DisplayAspectRatio string `json:"display_aspect_ratio"`
+		Duration           string `json:"duration"`
+		AvgFrameRate       string `json:"avg_frame_rate"`
+		RFrameRate         string `json:"r_frame_rate"`
+		BitRate            string `json:"bit_rate"`
+		Tags               struct {
+			Rotate string `json:"rotate"`
+		} `json:"tags"`
+		SideDataList []struct {
+			Rotation *float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	}
+	type Format struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
 	}
 	type FFProbeOutput struct {
 		Streams []Stream `json:"streams"`
+		Format  Format   `json:"format"`
 	}
 
 	// Unmarshal the output into the struct.
 	var ffprobeOutput FFProbeOutput
 	err = json.Unmarshal(output, &ffprobeOutput)
 	if err != nil {
-		return "", fmt.Errorf("error unmarshaling ffprobe output: %v", err)
+		return videoProbe{}, fmt.Errorf("error unmarshaling ffprobe output: %v", err)
 	}
 
-	// Find the first video stream and get the aspect ratio.
+	audioCodec := ""
 	for _, stream := range ffprobeOutput.Streams {
-		return stream.DisplayAspectRatio, nil
+		if stream.CodecType == "audio" {
+			audioCodec = stream.CodecName
+			break
+		}
 	}
 
-	return "", fmt.Errorf("couldn't find video stream in ffprobe output")
-}
+	// Find the first video stream.
+	for _, stream := range ffprobeOutput.Streams {
+		if stream.CodecType != "video" {
+			continue
+		}
 
-func processVideoForFastStart(filePath string) (string, error) {
-	outputFilePath := filePath + ".processing"
+		// The container's duration covers every stream, so prefer it
+		duration, err := strconv.ParseFloat(ffprobeOutput.Format.Duration, 64)
+		if err != nil {
+			duration, _ = strconv.ParseFloat(stream.Duration, 64)
+		}
+		// Likewise its bitrate includes the audio
+		bitrate, err := strconv.ParseInt(ffprobeOutput.Format.BitRate, 10, 64)
+		if err != nil {
+			bitrate, _ = strconv.ParseInt(stream.BitRate, 10, 64)
+		}
+		// The average rate is the one a variable frame rate video plays
+		// at; the base rate is all some containers record
+		frameRate := parseFrameRate(stream.AvgFrameRate)
+		if frameRate == 0 {
+			frameRate = parseFrameRate(stream.RFrameRate)
+		}
+		probe := videoProbe{
+			Width:              stream.Width,
+			Height:             stream.Height,
+			DisplayAspectRatio: stream.DisplayAspectRatio,
+			Duration:           duration,
+			Codec:              stream.CodecName,
+			AudioCodec:         audioCodec,
+			FrameRate:          frameRate,
+			Bitrate:            bitrate,
+		}
 
-	// Create a new command with the right arguments.
-	// The -i filePath flag specifies the input file path.
-	// The -c copy tells ffmpeg to copy the audio and video streams without re-encoding them.
-	// The -movflags +faststart flag specifies to optimize for fast start.
-	// The -f flag specifies the output format.
-	// The output file path is specified as an argument.
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilePath)
+		// Phones record portrait video as landscape frames plus a rotation,
+		// kept in a display matrix or, by older ffmpeg versions, a tag.
+		// The matrix's rotation is counter-clockwise.
+		rotation := 0
+		if degrees, err := strconv.Atoi(stream.Tags.Rotate); err == nil {
+			rotation = degrees
+		}
+		for _, sideData := range stream.SideDataList {
+			if sideData.Rotation != nil {
+				rotation = -int(math.Round(*sideData.Rotation))
+			}
+		}
+		probe.setRotation(rotation)
+		return probe, nil
+	}
 
-	// Run the command and capture the output.
-	output, err := cmd.CombinedOutput()
+	return videoProbe{}, fmt.Errorf("couldn't find video stream in ffprobe output")
+}
+
+// parseFrameRate reads a frame rate as ffprobe writes it, a fraction like
+// "30000/1001", rounded to hundredths. "0/0" means unknown and gives 0.
+func parseFrameRate(value string) float64 {
+	num, den, ok := strings.Cut(value, "/")
+	if !ok {
+		den = "1"
+	}
+	n, err := strconv.ParseFloat(num, 64)
 	if err != nil {
-		if _, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("ffmpeg failed: %s", string(output))
+		return 0
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return math.Round(n/d*100) / 100
+}
+
+// setRotation records a clockwise rotation in degrees and swaps the
+// dimensions when the video is turned on its side.
+func (p *videoProbe) setRotation(degrees int) {
+	p.Rotation = ((degrees % 360) + 360) % 360
+	if p.Rotation == 90 || p.Rotation == 270 {
+		p.Width, p.Height = p.Height, p.Width
+		if w, h, ok := strings.Cut(p.DisplayAspectRatio, ":"); ok {
+			p.DisplayAspectRatio = h + ":" + w
 		}
-		return "", fmt.Errorf("unexpected error running ffmpeg: %v", err)
 	}
+}
+
+// orientation classifies the probed video as "landscape", "portrait" or
+// "other" based on its display aspect ratio.
+func (p videoProbe) orientation() string {
+	switch p.DisplayAspectRatio {
+	case "16:9":
+		return "landscape"
+	case "9:16":
+		return "portrait"
+	default:
+		return "other"
+	}
+}
+
+// applyTo records the probed stream details on a video.
+func (p videoProbe) applyTo(video *database.Video) {
+	video.Width = &p.Width
+	video.Height = &p.Height
+	video.Duration = &p.Duration
+	video.Codec = &p.Codec
+	video.AudioCodec = nil
+	if p.AudioCodec != "" {
+		video.AudioCodec = &p.AudioCodec
+	}
+	video.FrameRate = &p.FrameRate
+	video.Bitrate = &p.Bitrate
+}
+
+// detectVideoType sniffs the container type from the first bytes of a file.
+// http.DetectContentType doesn't know about QuickTime, so check for its ftyp
+// brand ourselves when the standard library comes up empty. It also calls
+// every Matroska file WebM, since they share a header; only the DocType in
+// it tells them apart.
+func detectVideoType(header []byte) string {
+	mediaType := http.DetectContentType(header)
+	if mediaType == "video/webm" && bytes.Contains(header, []byte("matroska")) {
+		return "video/x-matroska"
+	}
+	if mediaType != "application/octet-stream" {
+		return mediaType
+	}
+	if len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")) && bytes.Equal(header[8:12], []byte("qt  ")) {
+		return "video/quicktime"
+	}
+	return mediaType
+}
+
+// mp4VideoCodecs and mp4AudioCodecs are the codecs, as ffprobe names them,
+// that browsers play from an MP4, so they can be copied into one as-is.
+var (
+	mp4VideoCodecs = []string{"h264", "hevc"}
+	mp4AudioCodecs = []string{"aac", "mp3"}
+)
 
+// convertToMP4 turns a video in any container ffmpeg understands, like MOV,
+// WebM or MKV, into a fast-start MP4 and returns the path of the new file.
+// Streams already in an MP4-friendly codec are remuxed, which is quick and
+// lossless; only the others are re-encoded.
+func convertToMP4(ctx context.Context, filePath string) (string, error) {
+	probe, err := probeVideo(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	outputFilePath := filePath + ".mp4"
+	_, err = runMediaTool(ctx, "ffmpeg", mp4ConversionArgs(filePath, outputFilePath, probe)...)
+	if err != nil {
+		return "", err
+	}
 	return outputFilePath, nil
 }
+
+// mp4ConversionArgs builds the ffmpeg command line for convertToMP4. Only
+// the first video and audio streams are kept: containers like MOV carry
+// timecode and data tracks MP4 can't hold.
+func mp4ConversionArgs(input, output string, probe videoProbe) []string {
+	args := []string{"-v", "error", "-i", input, "-map", "0:v:0", "-map", "0:a:0?"}
+	switch {
+	case probe.Codec == "hevc":
+		// Safari only plays HEVC in MP4 tagged as hvc1
+		args = append(args, "-c:v", "copy", "-tag:v", "hvc1")
+	case slices.Contains(mp4VideoCodecs, probe.Codec):
+		args = append(args, "-c:v", "copy")
+	default:
+		// The -pix_fmt flag keeps 10-bit and 4:4:4 sources playable
+		args = append(args, "-c:v", "libx264", "-pix_fmt", "yuv420p")
+	}
+	if probe.AudioCodec == "" || slices.Contains(mp4AudioCodecs, probe.AudioCodec) {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac")
+	}
+	return append(args, "-movflags", "+faststart", "-f", "mp4", "-y", output)
+}
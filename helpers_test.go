@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunMediaToolCancelled(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not installed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := runMediaTool(ctx, "sleep", "10")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("process wasn't killed promptly, took %s", elapsed)
+	}
+}
+
+func TestDetectVideoTypeContainers(t *testing.T) {
+	// EBML headers differ only in their DocType
+	ebml := func(docType string) []byte {
+		header := []byte{0x1a, 0x45, 0xdf, 0xa3, 0x9f, 0x42, 0x86, 0x81, 0x01, 0x42, 0x82, 0x80 | byte(len(docType))}
+		return append(append(header, docType...), make([]byte, 64)...)
+	}
+	tests := map[string]struct {
+		header []byte
+		want   string
+	}{
+		"mp4":       {ftypHeader("isom", "isom", "mp41"), "video/mp4"},
+		"quicktime": {ftypHeader("qt  ", "qt  "), "video/quicktime"},
+		"webm":      {ebml("webm"), "video/webm"},
+		"matroska":  {ebml("matroska"), "video/x-matroska"},
+	}
+	for name, tc := range tests {
+		if got := detectVideoType(tc.header); got != tc.want {
+			t.Errorf("%s: detectVideoType = %q, want %q", name, got, tc.want)
+		}
+	}
+}
+
+func TestParseFrameRate(t *testing.T) {
+	tests := map[string]float64{
+		"30/1":       30,
+		"30000/1001": 29.97,
+		"25":         25,
+		"0/0":        0,
+		"":           0,
+	}
+	for value, want := range tests {
+		if got := parseFrameRate(value); got != want {
+			t.Errorf("parseFrameRate(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestMP4ConversionArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe videoProbe
+		want  string
+	}{
+		{"iPhone HEVC", videoProbe{Codec: "hevc", AudioCodec: "aac"}, "-c:v copy -tag:v hvc1 -c:a copy"},
+		{"H.264 screen recording", videoProbe{Codec: "h264", AudioCodec: "mp3"}, "-c:v copy -c:a copy"},
+		{"silent H.264", videoProbe{Codec: "h264"}, "-c:v copy -c:a copy"},
+		{"VP9 and Opus", videoProbe{Codec: "vp9", AudioCodec: "opus"}, "-c:v libx264 -pix_fmt yuv420p -c:a aac"},
+		{"H.264 with PCM audio", videoProbe{Codec: "h264", AudioCodec: "pcm_s16le"}, "-c:v copy -c:a aac"},
+	}
+	for _, tc := range tests {
+		args := strings.Join(mp4ConversionArgs("in", "out", tc.probe), " ")
+		want := "-v error -i in -map 0:v:0 -map 0:a:0? " + tc.want + " -movflags +faststart -f mp4 -y out"
+		if args != want {
+			t.Errorf("%s: got %q, want %q", tc.name, args, want)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// hlsSegmentSeconds is the target length of each HLS segment.
+const hlsSegmentSeconds = 6
+
+// hlsAudioBitrate is the AAC bitrate of every rendition, in kbit/s.
+const hlsAudioBitrate = 128
+
+// hlsMasterPlaylist is the name of the playlist players load first.
+const hlsMasterPlaylist = "master.m3u8"
+
+// hlsRendition is one quality level of an HLS stream. Size is the length
+// of the frame's shorter side, so portrait videos get the same ladder.
+type hlsRendition struct {
+	Name         string
+	Size         int
+	VideoBitrate int // kbit/s
+	Width        int
+	Height       int
+}
+
+// hlsLadder lists the renditions offered, best first.
+var hlsLadder = []hlsRendition{
+	{Name: "1080p", Size: 1080, VideoBitrate: 5000},
+	{Name: "720p", Size: 720, VideoBitrate: 2800},
+	{Name: "480p", Size: 480, VideoBitrate: 1400},
+}
+
+// planHLSRenditions picks the renditions of the ladder a width x height
+// video can fill without upscaling and sets their frame sizes. A video
+// smaller than every rung gets a single rendition at its own size.
+func planHLSRenditions(width, height int) []hlsRendition {
+	short := min(width, height)
+	var renditions []hlsRendition
+	for _, r := range hlsLadder {
+		if r.Size <= short {
+			renditions = append(renditions, r)
+		}
+	}
+	if len(renditions) == 0 {
+		size := max(short/2*2, 2)
+		renditions = []hlsRendition{{Name: strconv.Itoa(size) + "p", Size: size, VideoBitrate: 800}}
+	}
+	for i := range renditions {
+		renditions[i].Width, renditions[i].Height = hlsFrameSize(width, height, renditions[i].Size)
+	}
+	return renditions
+}
+
+// hlsFrameSize scales a width x height frame so its shorter side is size,
+// rounding the longer side to an even number of pixels as libx264 needs.
+func hlsFrameSize(width, height, size int) (int, int) {
+	if width <= 0 || height <= 0 {
+		return size * 16 / 9 / 2 * 2, size
+	}
+	if width >= height {
+		return max(size*width/height/2*2, 2), size
+	}
+	return size, max(size*height/width/2*2, 2)
+}
+
+// maxrate is the peak video bitrate a rendition is encoded with, in
+// kbit/s.
+func (r hlsRendition) maxrate() int {
+	return r.VideoBitrate * 107 / 100
+}
+
+// hlsArgs encodes one rendition of input as segments and a media playlist
+// in dir. Keyframes are forced on segment boundaries so every rendition
+// splits at the same times and players can switch between them.
+func hlsArgs(input, dir string, r hlsRendition) []string {
+	return []string{"-v", "error", "-i", input,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", fmt.Sprintf("scale=%d:%d", r.Width, r.Height),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+		"-b:v", strconv.Itoa(r.VideoBitrate) + "k",
+		"-maxrate", strconv.Itoa(r.maxrate()) + "k",
+		"-bufsize", strconv.Itoa(r.VideoBitrate*3/2) + "k",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+		"-c:a", "aac", "-b:a", strconv.Itoa(hlsAudioBitrate) + "k", "-ac", "2",
+		"-f", "hls", "-hls_time", strconv.Itoa(hlsSegmentSeconds), "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, r.Name+"_%03d.ts"),
+		"-y", filepath.Join(dir, r.Name+".m3u8")}
+}
+
+// hlsMaster lists the renditions' media playlists, which sit next to it.
+func hlsMaster(renditions []hlsRendition) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range renditions {
+		bandwidth := (r.maxrate() + hlsAudioBitrate) * 1000
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s.m3u8\n", bandwidth, r.Width, r.Height, r.Name)
+	}
+	return b.String()
+}
+
+// hlsSubtitleGroup is the group the master playlist puts subtitle tracks in.
+const hlsSubtitleGroup = "subs"
+
+// hlsSubtitleName is the base name, in the HLS directory, of the copy of a
+// caption track and its media playlist.
+func hlsSubtitleName(language string) string {
+	return "subtitles_" + language
+}
+
+// withHLSSubtitles returns master with its subtitle tracks replaced by one
+// for each caption track, so it can be rewritten as captions change.
+// Tracks from before captions were stored in the bucket are left out.
+func withHLSSubtitles(master string, tracks database.CaptionTracks) string {
+	var media []string
+	for _, track := range tracks {
+		if track.Key == "" {
+			continue
+		}
+		name := track.Label
+		if name == "" {
+			name = track.Language
+		}
+		media = append(media, fmt.Sprintf(`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="%s",NAME="%s",LANGUAGE="%s",AUTOSELECT=YES,URI="%s.m3u8"`,
+			hlsSubtitleGroup, strings.ReplaceAll(name, `"`, "'"), track.Language, hlsSubtitleName(track.Language)))
+	}
+
+	attribute := `,SUBTITLES="` + hlsSubtitleGroup + `"`
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(master, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:TYPE=SUBTITLES,"):
+			continue
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			line = strings.ReplaceAll(line, attribute, "")
+			if len(media) > 0 {
+				line += attribute
+			}
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+			lines = append(lines, media...)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// hlsSubtitlePlaylist is the media playlist of a caption track, which is a
+// single WebVTT file covering the whole video.
+func hlsSubtitlePlaylist(duration float64, vttName string) string {
+	return fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:%.3f,\n%s\n#EXT-X-ENDLIST\n",
+		int(math.Ceil(duration)), duration, vttName)
+}
+
+// syncHLSCaptions brings a packaged video's HLS subtitles in line with its
+// caption tracks: each track is copied next to the renditions with a media
+// playlist of its own, the master playlist is rewritten to list them, and
+// copies of removed tracks are deleted. It does nothing unless hlsCaptions
+// is set.
+func (cfg *apiConfig) syncHLSCaptions(ctx context.Context, video database.Video) error {
+	if !cfg.hlsCaptions || video.HLSURL == nil {
+		return nil
+	}
+	masterKey, ok := cfg.videoKeyFromURL(*video.HLSURL)
+	if !ok {
+		return fmt.Errorf("invalid HLS URL %s", *video.HLSURL)
+	}
+	store := cfg.videoStore(video)
+	prefix := path.Dir(masterKey) + "/"
+	var duration float64
+	if video.Duration != nil {
+		duration = *video.Duration
+	}
+
+	body, _, err := store.Get(ctx, masterKey)
+	if err != nil {
+		return fmt.Errorf("couldn't get master playlist: %w", err)
+	}
+	master, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	for _, track := range video.Captions {
+		if track.Key == "" {
+			continue
+		}
+		vtt, err := cfg.readCaptionFile(ctx, track)
+		if err != nil {
+			return fmt.Errorf("couldn't read %s captions: %w", track.Language, err)
+		}
+		name := hlsSubtitleName(track.Language)
+		_, err = store.Put(ctx, prefix+name+".vtt", bytes.NewReader(vtt), "text/vtt", cfg.storageClass)
+		if err != nil {
+			return err
+		}
+		playlist := hlsSubtitlePlaylist(duration, name+".vtt")
+		_, err = store.Put(ctx, prefix+name+".m3u8", strings.NewReader(playlist), "application/vnd.apple.mpegurl", cfg.storageClass)
+		if err != nil {
+			return err
+		}
+		current[prefix+name+".vtt"] = true
+		current[prefix+name+".m3u8"] = true
+	}
+
+	updated := withHLSSubtitles(string(master), video.Captions)
+	_, err = store.Put(ctx, masterKey, strings.NewReader(updated), "application/vnd.apple.mpegurl", cfg.storageClass)
+	if err != nil {
+		return fmt.Errorf("couldn't update master playlist: %w", err)
+	}
+
+	stale, err := store.List(ctx, prefix+hlsSubtitleName(""))
+	if err != nil {
+		return err
+	}
+	for _, obj := range stale {
+		if current[obj.Key] {
+			continue
+		}
+		err := store.Delete(ctx, obj.Key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// hlsPrefix is where a video's HLS output is stored: next to the video
+// object, in a directory named after it.
+func hlsPrefix(videoKey string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "/hls/"
+}
+
+// generateHLS packages a freshly uploaded video for adaptive streaming and
+// records the master playlist on the video. Like previews it runs after
+// the upload was answered, so failures are only logged.
+func (cfg *apiConfig) generateHLS(store ObjectStore, videoID uuid.UUID, videoURL, videoKey string, probe videoProbe) {
+	err := cfg.storeHLS(context.Background(), store, videoID, videoURL, videoKey, probe)
+	if err != nil {
+		slog.Error("couldn't package video for HLS", "video_id", videoID, "err", err)
+	}
+}
+
+func (cfg *apiConfig) storeHLS(ctx context.Context, store ObjectStore, videoID uuid.UUID, videoURL, videoKey string, probe videoProbe) error {
+	sourcePath, err := downloadToTemp(ctx, store, videoKey)
+	if err != nil {
+		return fmt.Errorf("couldn't download video: %w", err)
+	}
+	defer os.Remove(sourcePath)
+
+	dir, err := os.MkdirTemp("", "tubely-hls")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	renditions := planHLSRenditions(probe.Width, probe.Height)
+	for _, r := range renditions {
+		_, err := runMediaTool(ctx, "ffmpeg", hlsArgs(sourcePath, dir, r)...)
+		if err != nil {
+			return fmt.Errorf("couldn't encode %s rendition: %w", r.Name, err)
+		}
+	}
+	err = os.WriteFile(filepath.Join(dir, hlsMasterPlaylist), []byte(hlsMaster(renditions)), 0644)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	prefix := hlsPrefix(videoKey)
+	// The master playlist goes up last, so it never points at a missing
+	// rendition
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != hlsMasterPlaylist {
+			names = append(names, entry.Name())
+		}
+	}
+	names = append(names, hlsMasterPlaylist)
+	for _, name := range names {
+		err := putHLSFile(ctx, store, filepath.Join(dir, name), prefix+name, cfg.storageClass)
+		if err != nil {
+			cfg.deleteHLSPrefix(context.WithoutCancel(ctx), store, prefix)
+			return fmt.Errorf("couldn't upload %s: %w", name, err)
+		}
+	}
+
+	hlsURL := cfg.s3CfDistribution + "/" + prefix + hlsMasterPlaylist
+	updated, err := cfg.db.SetHLSURL(videoID, videoURL, hlsURL)
+	if err != nil || !updated {
+		// The video was replaced or removed while it was packaged
+		cfg.deleteHLSPrefix(ctx, store, prefix)
+		return err
+	}
+
+	// Captions are read once the playlist is recorded, so ones uploaded
+	// while the video was being packaged are included
+	if cfg.hlsCaptions {
+		video, err := cfg.db.GetVideo(videoID)
+		if err != nil {
+			return err
+		}
+		return cfg.syncHLSCaptions(ctx, video)
+	}
+	return nil
+}
+
+func putHLSFile(ctx context.Context, store ObjectStore, filePath, key, storageClass string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	contentType := "video/mp2t"
+	if path.Ext(key) == ".m3u8" {
+		contentType = "application/vnd.apple.mpegurl"
+	}
+	_, err = store.Put(ctx, key, f, contentType, storageClass)
+	return err
+}
+
+// deleteHLS deletes every object of the HLS output whose master playlist
+// is at hlsURL. Nothing is deleted for a URL that isn't in the store.
+func (cfg *apiConfig) deleteHLS(ctx context.Context, store ObjectStore, hlsURL string) error {
+	key, ok := cfg.videoKeyFromURL(hlsURL)
+	if !ok {
+		return nil
+	}
+	return cfg.deleteHLSPrefix(ctx, store, path.Dir(key)+"/")
+}
+
+func (cfg *apiConfig) deleteHLSPrefix(ctx context.Context, store ObjectStore, prefix string) error {
+	objects, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, obj := range objects {
+		err := store.Delete(ctx, obj.Key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
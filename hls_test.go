@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestPlanHLSRenditions(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		want          []string
+	}{
+		{"1080p landscape gets the full ladder", 1920, 1080, []string{"1080p:1920x1080", "720p:1280x720", "480p:852x480"}},
+		{"720p skips 1080p", 1280, 720, []string{"720p:1280x720", "480p:852x480"}},
+		{"portrait uses the shorter side", 1080, 1920, []string{"1080p:1080x1920", "720p:720x1280", "480p:480x852"}},
+		{"tiny video keeps its own size", 320, 241, []string{"240p:318x240"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, r := range planHLSRenditions(tc.width, tc.height) {
+				got = append(got, fmt.Sprintf("%s:%dx%d", r.Name, r.Width, r.Height))
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHLSMaster(t *testing.T) {
+	got := hlsMaster(planHLSRenditions(1280, 720))
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=3124000,RESOLUTION=1280x720\n720p.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1626000,RESOLUTION=852x480\n480p.m3u8\n"
+	if got != want {
+		t.Fatalf("unexpected master playlist:\n%s", got)
+	}
+}
+
+func TestDeleteHLS(t *testing.T) {
+	h := newTestHarness(t)
+	videoKey := "landscape/abc.mp4"
+	prefix := hlsPrefix(videoKey)
+	if prefix != "landscape/abc/hls/" {
+		t.Fatalf("hlsPrefix(%q) = %q", videoKey, prefix)
+	}
+	for _, key := range []string{videoKey, prefix + "master.m3u8", prefix + "720p.m3u8", prefix + "720p_000.ts", "landscape/abcd/hls/master.m3u8"} {
+		h.s3.objects[key] = []byte("x")
+	}
+
+	err := h.cfg.deleteHLS(context.Background(), h.cfg.store, h.cfg.s3CfDistribution+"/"+prefix+hlsMasterPlaylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{videoKey, "landscape/abcd/hls/master.m3u8"}
+	got := h.s3.keys()
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("expected only the renditions to be deleted, left %v", got)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// idempotent lets clients retry next safely by sending an Idempotency-Key
+// header. The first request with a key runs normally and, if it succeeds,
+// its response is stored; repeats of it from the same user within
+// cfg.idempotencyTTL get that response back without running next again.
+// Failed requests don't keep the key, so they can be retried with it.
+func (cfg *apiConfig) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength || !isPrintableASCII(key) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParams, "Idempotency-Key must be at most 255 printable ASCII characters", nil)
+			return
+		}
+
+		// Unauthenticated requests are rejected by next; there's no user
+		// to scope the key to
+		userID, ok := cfg.requestUserID(r)
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		request := r.Method + " " + r.URL.RequestURI()
+		notBefore := time.Now().Add(-cfg.idempotencyTTL)
+		claim, claimed, err := cfg.db.ClaimIdempotencyKey(userID, key, request, notBefore)
+		if err != nil {
+			respondWithDBError(w, "Couldn't check idempotency key", err)
+			return
+		}
+		if !claimed {
+			switch {
+			case claim.Request != request:
+				respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeIdempotencyMismatch, "Idempotency-Key was already used for a different request", nil)
+			case !claim.Completed:
+				respondWithErrorCode(w, http.StatusConflict, errCodeIdempotencyInUse, "A request with this Idempotency-Key is still in progress", nil)
+			default:
+				w.Header().Set("Content-Type", claim.ContentType)
+				if claim.Location != "" {
+					w.Header().Set("Location", claim.Location)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(claim.StatusCode)
+				w.Write(claim.Body)
+			}
+			return
+		}
+
+		rec := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		var out http.ResponseWriter = rec
+		if lw, ok := w.(*loggedResponseWriter); ok {
+			out = &loggedResponseWriter{ResponseWriter: rec, method: lw.method, path: lw.path}
+		}
+		next(out, r)
+
+		if rec.status < 200 || rec.status > 299 {
+			err := cfg.db.ReleaseIdempotencyKey(userID, key)
+			if err != nil {
+				slog.Warn("couldn't release idempotency key", "user_id", userID, "err", err)
+			}
+			return
+		}
+		claim.Completed = true
+		claim.VideoID = resultVideoID(r, rec.body.Bytes())
+		claim.StatusCode = rec.status
+		claim.ContentType = rec.Header().Get("Content-Type")
+		claim.Location = rec.Header().Get("Location")
+		claim.Body = rec.body.Bytes()
+		err = cfg.db.CompleteIdempotencyKey(claim)
+		if err != nil {
+			slog.Warn("couldn't store idempotent response", "user_id", userID, "err", err)
+		}
+	}
+}
+
+// requestUserID returns the user a request's bearer token or API key
+// belongs to.
+func (cfg *apiConfig) requestUserID(r *http.Request) (uuid.UUID, bool) {
+	if hasAPIKey(r) {
+		key, err := cfg.requestAPIKey(r)
+		return key.UserID, err == nil
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtLeeway, cfg.jwtScope)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// resultVideoID is the video a request acted on: the one in its path, or
+// for requests that create one, the ID in the response.
+func resultVideoID(r *http.Request, body []byte) *uuid.UUID {
+	if id, err := uuid.Parse(r.PathValue("videoID")); err == nil {
+		return &id
+	}
+	var video database.Video
+	if json.Unmarshal(body, &video) == nil && video.ID != uuid.Nil {
+		return &video.ID
+	}
+	return nil
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// recordingResponseWriter passes a response through while keeping a copy
+// of its status and body.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
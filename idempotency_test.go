@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withKey sets the Idempotency-Key header on req.
+func withKey(req *http.Request, key string) *http.Request {
+	req.Header.Set("Idempotency-Key", key)
+	return req
+}
+
+func (h *testHarness) send(req *http.Request) *http.Response {
+	h.t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatalf("request failed: %v", err)
+	}
+	h.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func (h *testHarness) createVideoRequest(token, key string) *http.Request {
+	h.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, h.srv.URL+"/api/videos", strings.NewReader(`{"title":"retried"}`))
+	if err != nil {
+		h.t.Fatalf("couldn't create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return withKey(req, key)
+}
+
+func TestIdempotentCreateVideo(t *testing.T) {
+	h := newTestHarness(t)
+	token, _ := h.createUserAndVideo("retry@example.com")
+
+	first := h.send(h.createVideoRequest(token, "create-1"))
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", first.StatusCode)
+	}
+	firstBody, _ := io.ReadAll(first.Body)
+
+	second := h.send(h.createVideoRequest(token, "create-1"))
+	if second.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the replayed 201, got %d", second.StatusCode)
+	}
+	if second.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("expected the response to be marked as replayed")
+	}
+	secondBody, _ := io.ReadAll(second.Body)
+	if !bytes.Equal(firstBody, secondBody) {
+		t.Errorf("expected the original response, got %s", secondBody)
+	}
+
+	// Another user's key is their own
+	otherToken, _ := h.createUserAndVideo("other@example.com")
+	if resp := h.send(h.createVideoRequest(otherToken, "create-1")); resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Error("expected keys to be scoped to the user")
+	}
+
+	// Reusing the key for another endpoint is a client bug
+	_, video := h.createUserAndVideo("third@example.com")
+	req := h.uploadRequest(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4)
+	resp := h.send(withKey(req, "create-1"))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a reused key, got %d", resp.StatusCode)
+	}
+	if code := errorCode(t, resp); code != errCodeIdempotencyMismatch {
+		t.Errorf("expected %s, got %s", errCodeIdempotencyMismatch, code)
+	}
+}
+
+func TestIdempotentUploadConcurrentRetries(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("owner@example.com")
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	h.s3.beforePut = func(context.Context, string) {
+		once.Do(func() {
+			close(entered)
+			<-release
+		})
+	}
+
+	first := make(chan *http.Response, 1)
+	firstReq := withKey(h.uploadRequest(path, token, "video", "clip.mp4", minimalMP4), "upload-1")
+	go func() {
+		resp, err := http.DefaultClient.Do(firstReq)
+		if err != nil {
+			close(first)
+			return
+		}
+		first <- resp
+	}()
+	<-entered
+
+	// Retries while the first is running don't start another upload
+	const retries = 4
+	var wg sync.WaitGroup
+	statuses := make(chan int, retries)
+	for range retries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := withKey(h.uploadRequest(path, token, "video", "clip.mp4", minimalMP4), "upload-1")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusConflict {
+			t.Errorf("expected 409 for a retry in flight, got %d", status)
+		}
+	}
+
+	close(release)
+	resp, ok := <-first
+	if !ok {
+		t.Fatal("first upload failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for the first upload, got %d", resp.StatusCode)
+	}
+	firstBody, _ := io.ReadAll(resp.Body)
+
+	again := h.send(withKey(h.uploadRequest(path, token, "video", "clip.mp4", minimalMP4), "upload-1"))
+	if again.StatusCode != http.StatusOK || again.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected a replayed 200, got %d", again.StatusCode)
+	}
+	againBody, _ := io.ReadAll(again.Body)
+	if !bytes.Equal(firstBody, againBody) {
+		t.Error("expected the replay to match the original response")
+	}
+	if puts := len(h.s3.puts); puts != 1 {
+		t.Errorf("expected a single stored upload, got %d", puts)
+	}
+}
+
+func TestIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("owner@example.com")
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+
+	resp := h.send(withKey(h.uploadRequest(path, token, "video", "notes.txt", []byte("not a video")), "upload-2"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+
+	resp = h.send(withKey(h.uploadRequest(path, token, "video", "clip.mp4", minimalMP4), "upload-2"))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("expected the retry to be processed, got %d", resp.StatusCode)
+	}
+}
+
+func TestIdempotentQueuedUploadKeepsLocation(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 1
+	token, video := h.createUserAndVideo("owner@example.com")
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+
+	first := h.send(withKey(h.uploadRequest(path, token, "video", "clip.mp4", minimalMP4), "queued-1"))
+	if first.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", first.StatusCode)
+	}
+	second := h.send(withKey(h.uploadRequest(path, token, "video", "clip.mp4", minimalMP4), "queued-1"))
+	if second.StatusCode != http.StatusAccepted || second.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected the replayed 202, got %d", second.StatusCode)
+	}
+	if location := first.Header.Get("Location"); location == "" || second.Header.Get("Location") != location {
+		t.Errorf("expected the job's Location %q to be replayed, got %q", location, second.Header.Get("Location"))
+	}
+}
+
+func TestIdempotentReplayIgnoresRateLimit(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.rateLimiter = newMemoryRateLimiter()
+	h.cfg.rateLimits = map[string]rateLimit{"upload": {Requests: 1, Period: time.Hour}}
+	token, video := h.createUserAndVideo("owner@example.com")
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+
+	if resp := h.send(withKey(h.uploadRequest(path, token, "video", "clip.mp4", minimalMP4), "limited-1")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	// The one upload allowed is used up, but a retry of it only replays
+	resp := h.send(withKey(h.uploadRequest(path, token, "video", "clip.mp4", minimalMP4), "limited-1"))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected the replayed 200, got %d", resp.StatusCode)
+	}
+	if resp := h.send(withKey(h.uploadRequest(path, token, "video", "clip.mp4", minimalMP4), "limited-2")); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a new upload to be limited, got %d", resp.StatusCode)
+	}
+	if len(h.s3.puts) != 1 {
+		t.Errorf("expected one stored object, got %v", h.s3.puts)
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.idempotencyTTL = time.Millisecond
+	token, _ := h.createUserAndVideo("expiry@example.com")
+
+	h.send(h.createVideoRequest(token, "create-2"))
+	time.Sleep(5 * time.Millisecond)
+	resp := h.send(h.createVideoRequest(token, "create-2"))
+	if resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Error("expected an expired key to be processed again")
+	}
+}
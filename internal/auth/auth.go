@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -20,8 +21,34 @@ const (
 	TokenTypeAccess TokenType = "tubely-access"
 )
 
+// TokenScope is the issuer and audience access tokens are minted with and
+// must carry to validate, so tokens from one environment aren't accepted by
+// another. An empty Issuer means TokenTypeAccess; an empty Audience is
+// neither set nor checked.
+type TokenScope struct {
+	Issuer   string
+	Audience string
+}
+
+func (s TokenScope) issuer() string {
+	if s.Issuer == "" {
+		return string(TokenTypeAccess)
+	}
+	return s.Issuer
+}
+
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
+// Errors returned by ValidateJWT so callers can tell a client whether to
+// refresh its token or log in again.
+var (
+	ErrTokenExpired          = errors.New("token expired")
+	ErrTokenInvalidSignature = errors.New("invalid token signature")
+	ErrTokenMalformed        = errors.New("malformed token")
+	ErrTokenIssuerMismatch   = errors.New("token issuer mismatch")
+	ErrTokenAudienceMismatch = errors.New("token audience mismatch")
+)
+
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -38,25 +65,56 @@ func MakeJWT(
 	userID uuid.UUID,
 	tokenSecret string,
 	expiresIn time.Duration,
+	scope TokenScope,
 ) (string, error) {
 	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
+	claims := jwt.RegisteredClaims{
+		Issuer:    scope.issuer(),
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   userID.String(),
-	})
+	}
+	if scope.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{scope.Audience}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+// ValidateJWT checks the token's signature and claims, including that it was
+// minted for scope, and returns the user ID it was issued for. leeway is the
+// clock skew tolerated when checking expiry.
+func ValidateJWT(tokenString, tokenSecret string, leeway time.Duration, scope TokenScope) (uuid.UUID, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithLeeway(leeway),
+		jwt.WithIssuer(scope.issuer()),
+	}
+	if scope.Audience != "" {
+		opts = append(opts, jwt.WithAudience(scope.Audience))
+	}
+
 	claimsStruct := jwt.RegisteredClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		opts...,
 	)
 	if err != nil {
+		switch {
+		case errors.Is(err, jwt.ErrTokenExpired):
+			return uuid.Nil, fmt.Errorf("%w: %v", ErrTokenExpired, err)
+		case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+			return uuid.Nil, fmt.Errorf("%w: %v", ErrTokenInvalidSignature, err)
+		case errors.Is(err, jwt.ErrTokenMalformed):
+			return uuid.Nil, fmt.Errorf("%w: %v", ErrTokenMalformed, err)
+		case errors.Is(err, jwt.ErrTokenInvalidIssuer),
+			errors.Is(err, jwt.ErrTokenRequiredClaimMissing) && claimsStruct.Issuer == "":
+			return uuid.Nil, fmt.Errorf("%w: %v", ErrTokenIssuerMismatch, err)
+		case errors.Is(err, jwt.ErrTokenInvalidAudience),
+			errors.Is(err, jwt.ErrTokenRequiredClaimMissing) && len(claimsStruct.Audience) == 0:
+			return uuid.Nil, fmt.Errorf("%w: %v", ErrTokenAudienceMismatch, err)
+		}
 		return uuid.Nil, err
 	}
 
@@ -65,14 +123,6 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 		return uuid.Nil, err
 	}
 
-	issuer, err := token.Claims.GetIssuer()
-	if err != nil {
-		return uuid.Nil, err
-	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
-	}
-
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
 		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
@@ -102,6 +152,27 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+// APIKeyPrefix starts every user API key, so leaked keys are easy to spot
+// and tell apart from the admin key.
+const APIKeyPrefix = "tubely_"
+
+// MakeAPIKey returns a new random user API key.
+func MakeAPIKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + hex.EncodeToString(key), nil
+}
+
+// HashAPIKey is how API keys are stored and looked up. They're random
+// enough that a fast unsalted hash is safe, unlike passwords.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
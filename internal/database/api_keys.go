@@ -0,0 +1,128 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIKey lets a user's scripts authenticate without logging in. Only a
+// hash of the key is stored; Prefix is its first few characters, kept so
+// users can tell their keys apart.
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+}
+
+const apiKeyColumns = `id, created_at, last_used_at, user_id, name, prefix, key_hash`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (APIKey, error) {
+	var key APIKey
+	var id, userID string
+	err := row.Scan(&id, &key.CreatedAt, &key.LastUsedAt, &userID, &key.Name, &key.Prefix, &key.KeyHash)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.ID, err = uuid.Parse(id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+type CreateAPIKeyParams struct {
+	UserID  uuid.UUID
+	Name    string
+	Prefix  string
+	KeyHash string
+}
+
+func (c Client) CreateAPIKey(params CreateAPIKeyParams) (APIKey, error) {
+	key := APIKey{
+		ID:        uuid.New(),
+		CreatedAt: time.Now().UTC(),
+		UserID:    params.UserID,
+		Name:      params.Name,
+		Prefix:    params.Prefix,
+		KeyHash:   params.KeyHash,
+	}
+	_, err := c.exec(`
+	INSERT INTO api_keys (id, created_at, user_id, name, prefix, key_hash)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`, key.ID.String(), key.CreatedAt, key.UserID.String(), key.Name, key.Prefix, key.KeyHash)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// GetAPIKeys returns a user's keys, newest first.
+func (c Client) GetAPIKeys(userID uuid.UUID) ([]APIKey, error) {
+	rows, err := c.query(`
+	SELECT `+apiKeyColumns+`
+	FROM api_keys
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// GetAPIKeyByHash returns ErrNotFound when no key has that hash.
+func (c Client) GetAPIKeyByHash(hash string) (APIKey, error) {
+	key, err := scanAPIKey(c.queryRow(`
+	SELECT `+apiKeyColumns+`
+	FROM api_keys
+	WHERE key_hash = ?
+	`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrNotFound
+	}
+	return key, err
+}
+
+// TouchAPIKey records that a key was just used.
+func (c Client) TouchAPIKey(id uuid.UUID) error {
+	_, err := c.exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", time.Now().UTC(), id.String())
+	return err
+}
+
+// DeleteAPIKey revokes one of a user's keys. It returns ErrNotFound if the
+// user has no key with that ID.
+func (c Client) DeleteAPIKey(id, userID uuid.UUID) error {
+	result, err := c.exec("DELETE FROM api_keys WHERE id = ? AND user_id = ?", id.String(), userID.String())
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Attribution credits the platform page a video was imported from and
+// whoever published it there. Fields the platform didn't report are empty.
+type Attribution struct {
+	SourceURL   string `json:"source_url"`
+	Platform    string `json:"platform,omitempty"`
+	SourceID    string `json:"source_id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Uploader    string `json:"uploader,omitempty"`
+	UploaderURL string `json:"uploader_url,omitempty"`
+	License     string `json:"license,omitempty"`
+	// UploadDate is when it was published on the platform, as YYYY-MM-DD.
+	UploadDate string `json:"upload_date,omitempty"`
+}
+
+// Attribution is stored on the video row as a JSON object, or NULL for
+// videos that weren't imported from a platform.
+func (a *Attribution) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*a = Attribution{}
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("can't scan %T into Attribution", src)
+	}
+	return json.Unmarshal(data, a)
+}
+
+func (a Attribution) Value() (driver.Value, error) {
+	if a == (Attribution{}) {
+		return nil, nil
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// CaptionTrack is a subtitle or caption file attached to a video.
+type CaptionTrack struct {
+	Language string `json:"language"`
+	Label    string `json:"label,omitempty"`
+	URL      string `json:"url"`
+	// Key is the track's object in the default bucket. Tracks uploaded
+	// before captions were kept there have none; their file is in the
+	// assets directory.
+	Key string `json:"key,omitempty"`
+	// Generated is set on tracks transcribed from the audio rather than
+	// uploaded.
+	Generated bool `json:"generated,omitempty"`
+}
+
+// CaptionTracks are stored on the video row as a JSON array.
+type CaptionTracks []CaptionTrack
+
+func (t *CaptionTracks) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("can't scan %T into CaptionTracks", src)
+	}
+	return json.Unmarshal(data, t)
+}
+
+func (t CaptionTracks) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
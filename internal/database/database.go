@@ -1,89 +1,148 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Client runs the app's queries against SQLite or Postgres. A single
+// SQLite file suits one server; several instances share a Postgres
+// database instead.
 type Client struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect dialect
 }
 
-func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+// Options are the connection settings applied to every pooled connection.
+// Only MaxOpenConns applies to Postgres.
+type Options struct {
+	// BusyTimeout is how long a statement waits for another connection's
+	// lock before failing with "database is locked".
+	BusyTimeout time.Duration
+	// JournalMode is the journal_mode pragma. WAL lets reads carry on
+	// while a write is in progress.
+	JournalMode string
+	ForeignKeys bool
+	// MaxOpenConns caps the pool. SQLite only allows one writer at a time,
+	// so a large pool just means more connections waiting on the lock.
+	MaxOpenConns int
+}
+
+// DefaultOptions suit a single server handling a few concurrent uploads.
+func DefaultOptions() Options {
+	return Options{
+		BusyTimeout:  5 * time.Second,
+		JournalMode:  "WAL",
+		ForeignKeys:  true,
+		MaxOpenConns: 4,
+	}
+}
+
+// dsn adds the connection pragmas to pathToDB as go-sqlite3 parameters.
+func (o Options) dsn(pathToDB string) string {
+	params := url.Values{}
+	params.Set("_busy_timeout", fmt.Sprint(o.BusyTimeout.Milliseconds()))
+	if o.JournalMode != "" {
+		params.Set("_journal_mode", strings.ToUpper(o.JournalMode))
+	}
+	if o.ForeignKeys {
+		params.Set("_foreign_keys", "1")
+	} else {
+		params.Set("_foreign_keys", "0")
+	}
+	sep := "?"
+	if strings.Contains(pathToDB, "?") {
+		sep = "&"
+	}
+	return pathToDB + sep + params.Encode()
+}
+
+// NewClient connects to the database at dsn, a postgres:// URL or the path
+// of a SQLite file, and brings its schema up to date.
+func NewClient(dsn string, opts Options) (Client, error) {
+	d := dialectFor(dsn)
+	if _, ok := d.(sqliteDialect); ok {
+		dsn = opts.dsn(dsn)
+	}
+	db, err := sql.Open(d.driverName(), dsn)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
-	err = c.autoMigrate()
+	if opts.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+		db.SetMaxIdleConns(opts.MaxOpenConns)
+	}
+	c := Client{db: db, dialect: d}
+	err = c.migrate()
 	if err != nil {
+		db.Close()
 		return Client{}, err
 	}
 	return c, nil
+}
 
+// Ping checks that the database can still be reached.
+func (c Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
 }
 
-func (c *Client) autoMigrate() error {
-	userTable := `
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		password TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL
-	);
-	`
-	_, err := c.db.Exec(userTable)
-	if err != nil {
-		return err
-	}
-	refreshTokenTable := `
-	CREATE TABLE IF NOT EXISTS refresh_tokens (
-		token TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		revoked_at TIMESTAMP,
-		user_id TEXT NOT NULL,
-		expires_at TIMESTAMP NOT NULL,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);
-	`
-	_, err = c.db.Exec(refreshTokenTable)
-	if err != nil {
-		return err
-	}
+func (c Client) exec(query string, args ...any) (sql.Result, error) {
+	return c.db.Exec(c.dialect.rebind(query), args...)
+}
 
-	videoTable := `
-	CREATE TABLE IF NOT EXISTS videos (
-		id TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		title TEXT NOT NULL,
-		description TEXT,
-		thumbnail_url TEXT,
-		video_url TEXT TEXT,
-		user_id INTEGER,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);
-	`
-	_, err = c.db.Exec(videoTable)
-	if err != nil {
-		return err
-	}
-	return nil
+func (c Client) query(query string, args ...any) (*sql.Rows, error) {
+	return c.db.Query(c.dialect.rebind(query), args...)
+}
+
+func (c Client) queryRow(query string, args ...any) *sql.Row {
+	return c.db.QueryRow(c.dialect.rebind(query), args...)
+}
+
+// execer runs a statement on the database or inside a transaction.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
 }
 
 func (c Client) Reset() error {
-	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
-		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
+	if _, err := c.exec("DELETE FROM object_deletions"); err != nil {
+		return fmt.Errorf("failed to reset table object_deletions: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
-		return fmt.Errorf("failed to reset table users: %w", err)
+	if _, err := c.exec("DELETE FROM webhook_deliveries"); err != nil {
+		return fmt.Errorf("failed to reset table webhook_deliveries: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM webhooks"); err != nil {
+		return fmt.Errorf("failed to reset table webhooks: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
+	if _, err := c.exec("DELETE FROM user_watermarks"); err != nil {
+		return fmt.Errorf("failed to reset table user_watermarks: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM api_keys"); err != nil {
+		return fmt.Errorf("failed to reset table api_keys: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM video_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table video_jobs: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM tus_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table tus_uploads: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM idempotency_keys"); err != nil {
+		return fmt.Errorf("failed to reset table idempotency_keys: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM refresh_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.exec("DELETE FROM users"); err != nil {
+		return fmt.Errorf("failed to reset table users: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// dialect is what differs between the databases the client runs on.
+// Queries and schema statements are written for SQLite, with ? parameters,
+// and adapted by the dialect before they're sent.
+type dialect interface {
+	// driverName is the database/sql driver the dialect talks to.
+	driverName() string
+	// rebind rewrites the ? parameters of a query into the driver's form.
+	rebind(query string) string
+	// ddl adapts a CREATE or ALTER statement's column types.
+	ddl(stmt string) string
+	// addColumnIfMissing adds a column to a table created by an older
+	// version of the schema. CREATE TABLE IF NOT EXISTS won't touch an
+	// existing table.
+	addColumnIfMissing(ctx context.Context, conn *sql.Conn, table, column, definition string) error
+	// tableExists reports whether the database has a table.
+	tableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error)
+	// lockMigrations keeps other processes from migrating the database
+	// until the returned func is called.
+	lockMigrations(ctx context.Context, conn *sql.Conn) (func(), error)
+	// timeFromUnix is an expression turning a parameter holding Unix
+	// seconds into a timestamp that compares with TIMESTAMP columns.
+	timeFromUnix() string
+	// skipLocked ends a subquery picking a row to claim, so concurrent
+	// claims pass over rows another transaction is claiming. SQLite only
+	// has one writer at a time, so it has nothing to skip.
+	skipLocked() string
+}
+
+// dialectFor picks the dialect for a DSN. Postgres connection URLs select
+// Postgres; anything else is a path to a SQLite file.
+func dialectFor(dsn string) dialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect{}
+	}
+	return sqliteDialect{}
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) driverName() string { return "sqlite3" }
+
+func (sqliteDialect) rebind(query string) string { return query }
+
+func (sqliteDialect) ddl(stmt string) string { return stmt }
+
+func (sqliteDialect) timeFromUnix() string { return "datetime(?, 'unixepoch')" }
+
+func (sqliteDialect) skipLocked() string { return "" }
+
+func (d sqliteDialect) addColumnIfMissing(ctx context.Context, conn *sql.Conn, table, column, definition string) error {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func (sqliteDialect) tableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	var n int
+	err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+	return n > 0, err
+}
+
+// lockMigrations has nothing to do for SQLite: each migration's
+// transaction takes the database's write lock.
+func (sqliteDialect) lockMigrations(context.Context, *sql.Conn) (func(), error) {
+	return func() {}, nil
+}
+
+// postgresDialect runs the schema on Postgres, through lib/pq. Timestamps
+// are stored with their time zone so CURRENT_TIMESTAMP and the UTC times
+// the client writes agree whatever the server's zone is.
+type postgresDialect struct{}
+
+func (postgresDialect) driverName() string { return "postgres" }
+
+// rebind numbers the ? parameters as $1, $2, ..., leaving any inside
+// string literals alone.
+func (postgresDialect) rebind(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case ch == '\'':
+			quoted = !quoted
+		case ch == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
+
+var postgresTypes = strings.NewReplacer(
+	" TIMESTAMP", " TIMESTAMPTZ",
+	" BLOB", " BYTEA",
+	" REAL", " DOUBLE PRECISION",
+)
+
+func (postgresDialect) ddl(stmt string) string { return postgresTypes.Replace(stmt) }
+
+func (postgresDialect) timeFromUnix() string { return "to_timestamp(?)" }
+
+func (postgresDialect) skipLocked() string { return "FOR UPDATE SKIP LOCKED" }
+
+func (d postgresDialect) addColumnIfMissing(ctx context.Context, conn *sql.Conn, table, column, definition string) error {
+	_, err := conn.ExecContext(ctx, d.ddl(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, definition)))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func (postgresDialect) tableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	var exists bool
+	err := conn.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists)
+	return exists, err
+}
+
+// migrationLockID is the advisory lock instances take while migrating.
+const migrationLockID = 7_117_001
+
+// lockMigrations takes a session advisory lock, held by conn until it's
+// released, so instances starting together don't apply the same migration.
+func (postgresDialect) lockMigrations(ctx context.Context, conn *sql.Conn) (func(), error) {
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}, nil
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrNotFound is returned when the requested row doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// IsUnavailable reports whether err is a transient failure to use the
+// database, such as a locked SQLite file, a Postgres server that's
+// restarting or a dropped connection, rather than a problem with the query.
+// The same call may succeed if retried.
+func IsUnavailable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrCantOpen, sqlite3.ErrIoErr:
+			return true
+		}
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		// Connection exceptions, serialization failures and deadlocks,
+		// too many connections, and the server shutting down
+		case "08", "40", "53", "57":
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone)
+}
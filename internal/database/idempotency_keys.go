@@ -0,0 +1,117 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyKey records a client-supplied key and the response to the
+// request that first used it, so a retried request can be answered with
+// the original result.
+type IdempotencyKey struct {
+	UserID      uuid.UUID
+	Key         string
+	Request     string
+	CreatedAt   time.Time
+	Completed   bool
+	VideoID     *uuid.UUID
+	StatusCode  int
+	ContentType string
+	// Location is the response's Location header, if it had one.
+	Location string
+	Body     []byte
+}
+
+// ClaimIdempotencyKey marks key as in use by a request from userID. When
+// the key was already claimed since notBefore, it returns that claim and
+// false instead. Older claims have expired and are dropped.
+func (c Client) ClaimIdempotencyKey(userID uuid.UUID, key, request string, notBefore time.Time) (IdempotencyKey, bool, error) {
+	_, err := c.exec(`
+	DELETE FROM idempotency_keys
+	WHERE user_id = ? AND created_at < ?
+	`, userID.String(), notBefore.UTC())
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+
+	now := time.Now().UTC()
+	result, err := c.exec(`
+	INSERT INTO idempotency_keys (user_id, key, request, created_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT DO NOTHING
+	`, userID.String(), key, request, now)
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+	if inserted == 1 {
+		return IdempotencyKey{UserID: userID, Key: key, Request: request, CreatedAt: now}, true, nil
+	}
+
+	existing, err := c.getIdempotencyKey(userID, key)
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+	return existing, false, nil
+}
+
+func (c Client) getIdempotencyKey(userID uuid.UUID, key string) (IdempotencyKey, error) {
+	query := `
+	SELECT request, created_at, completed, video_id, status_code, content_type, location, body
+	FROM idempotency_keys
+	WHERE user_id = ? AND key = ?
+	`
+	k := IdempotencyKey{UserID: userID, Key: key}
+	var (
+		videoID     sql.NullString
+		statusCode  sql.NullInt64
+		contentType sql.NullString
+		location    sql.NullString
+	)
+	err := c.queryRow(query, userID.String(), key).
+		Scan(&k.Request, &k.CreatedAt, &k.Completed, &videoID, &statusCode, &contentType, &location, &k.Body)
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	if videoID.Valid {
+		id, err := uuid.Parse(videoID.String)
+		if err != nil {
+			return IdempotencyKey{}, err
+		}
+		k.VideoID = &id
+	}
+	k.StatusCode = int(statusCode.Int64)
+	k.ContentType = contentType.String
+	k.Location = location.String
+	return k, nil
+}
+
+// CompleteIdempotencyKey stores the response to the request holding key.
+func (c Client) CompleteIdempotencyKey(k IdempotencyKey) error {
+	var videoID *string
+	if k.VideoID != nil {
+		id := k.VideoID.String()
+		videoID = &id
+	}
+	_, err := c.exec(`
+	UPDATE idempotency_keys
+	SET completed = TRUE, video_id = ?, status_code = ?, content_type = ?, location = ?, body = ?
+	WHERE user_id = ? AND key = ?
+	`, videoID, k.StatusCode, k.ContentType, k.Location, k.Body, k.UserID.String(), k.Key)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a claim whose request failed, so the client
+// can retry with the same key.
+func (c Client) ReleaseIdempotencyKey(userID uuid.UUID, key string) error {
+	_, err := c.exec(`
+	DELETE FROM idempotency_keys
+	WHERE user_id = ? AND key = ?
+	`, userID.String(), key)
+	return err
+}
@@ -0,0 +1,183 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles are the schema changes, applied in version order. Each is
+// named NNNN_description.sql and written for SQLite, like the queries;
+// dialect.ddl adapts the column types. Add a new file to change the schema
+// rather than editing one that has already shipped.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations reads the embedded migrations, sorted by version.
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	seen := map[int]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		prefix, _, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s isn't named NNNN_description.sql", name)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, name)
+		}
+		seen[version] = name
+		body, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// migrate applies the migrations the database hasn't seen yet, each in its
+// own transaction, and records them in schema_migrations. Instances starting
+// together against one Postgres database take turns.
+func (c Client) migrate() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	unlock, err := c.dialect.lockMigrations(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("couldn't lock the schema for migration: %w", err)
+	}
+	defer unlock()
+
+	_, err = conn.ExecContext(ctx, c.dialect.ddl(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`))
+	if err != nil {
+		return err
+	}
+	var current int
+	err = conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		err = c.upgradeLegacySchema(ctx, conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err = c.applyMigration(ctx, conn, m)
+		if err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+func (c Client) applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, c.dialect.ddl(m.sql)); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, c.dialect.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"), m.version, m.name, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// upgradeLegacySchema brings a database created before migrations existed,
+// when columns were added at startup as the code needed them, up to the
+// schema of the first migration. A new database has no videos table yet
+// and is left to the migrations.
+func (c Client) upgradeLegacySchema(ctx context.Context, conn *sql.Conn) error {
+	exists, err := c.dialect.tableExists(ctx, conn, "videos")
+	if err != nil || !exists {
+		return err
+	}
+
+	legacyVideoColumns := []struct{ name, definition string }{
+		{"thumbnail_filename", "TEXT"},
+		{"video_filename", "TEXT"},
+		{"video_etag", "TEXT"},
+		{"video_size", "INTEGER"},
+		{"orientation", "TEXT"},
+		{"width", "INTEGER"},
+		{"height", "INTEGER"},
+		{"duration", "REAL"},
+		{"codec", "TEXT"},
+		{"source_sha256", "TEXT"},
+		{"deleted_at", "TIMESTAMP"},
+		{"preview_url", "TEXT"},
+		{"video_bucket", "TEXT"},
+		{"pending_upload_key", "TEXT"},
+		{"thumbnail_color", "TEXT"},
+		{"sprite_url", "TEXT"},
+		{"sprite_vtt_url", "TEXT"},
+		{"captions", "TEXT"},
+		{"processing_status", "TEXT"},
+		{"hls_url", "TEXT"},
+		{"video_key", "TEXT"},
+		{"renditions", "TEXT"},
+		{"visibility", "TEXT NOT NULL DEFAULT '" + VisibilityUnlisted + "'"},
+	}
+	for _, col := range legacyVideoColumns {
+		err = c.dialect.addColumnIfMissing(ctx, conn, "videos", col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Videos uploaded before orientation was stored still have it in
+	// their key prefix
+	_, err = conn.ExecContext(ctx, `
+	UPDATE videos
+	SET orientation = CASE
+		WHEN video_url LIKE '%landscape/%' THEN 'landscape'
+		WHEN video_url LIKE '%portrait/%' THEN 'portrait'
+		ELSE 'other'
+	END
+	WHERE orientation IS NULL AND video_url IS NOT NULL
+	`)
+	return err
+}
@@ -0,0 +1,146 @@
+-- The schema as it stood when migrations were introduced. Databases
+-- created before then already have these tables, so everything here is
+-- IF NOT EXISTS.
+
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	password TEXT NOT NULL,
+	email TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	revoked_at TIMESTAMP,
+	user_id TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS videos (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT,
+	user_id TEXT,
+	thumbnail_filename TEXT,
+	video_filename TEXT,
+	video_etag TEXT,
+	video_size INTEGER,
+	orientation TEXT,
+	width INTEGER,
+	height INTEGER,
+	duration REAL,
+	codec TEXT,
+	source_sha256 TEXT,
+	deleted_at TIMESTAMP,
+	preview_url TEXT,
+	video_bucket TEXT,
+	pending_upload_key TEXT,
+	thumbnail_color TEXT,
+	sprite_url TEXT,
+	sprite_vtt_url TEXT,
+	captions TEXT,
+	processing_status TEXT,
+	hls_url TEXT,
+	video_key TEXT,
+	renditions TEXT,
+	visibility TEXT NOT NULL DEFAULT 'unlisted',
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_videos_user_orientation ON videos(user_id, orientation);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	user_id TEXT NOT NULL,
+	key TEXT NOT NULL,
+	request TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	completed BOOLEAN NOT NULL DEFAULT FALSE,
+	video_id TEXT,
+	status_code INTEGER,
+	content_type TEXT,
+	body BLOB,
+	PRIMARY KEY(user_id, key),
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS tus_uploads (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	user_id TEXT NOT NULL,
+	video_id TEXT NOT NULL,
+	length INTEGER NOT NULL,
+	upload_offset INTEGER NOT NULL DEFAULT 0,
+	file_name TEXT NOT NULL DEFAULT '',
+	normalize_audio TEXT NOT NULL DEFAULT '',
+	watermark TEXT NOT NULL DEFAULT '',
+	storage_class TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS video_jobs (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	video_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	status TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	source_path TEXT NOT NULL,
+	media_type TEXT NOT NULL,
+	file_name TEXT NOT NULL DEFAULT '',
+	source_sha256 TEXT NOT NULL,
+	normalize_audio TEXT NOT NULL DEFAULT '',
+	watermark TEXT NOT NULL DEFAULT '',
+	storage_class TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_video_jobs_status ON video_jobs(status, created_at);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	user_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL,
+	key_hash TEXT NOT NULL UNIQUE,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	user_id TEXT NOT NULL,
+	url TEXT NOT NULL,
+	events TEXT NOT NULL DEFAULT '',
+	secret TEXT NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	webhook_id TEXT NOT NULL,
+	event TEXT NOT NULL,
+	payload BLOB NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP,
+	response_status INTEGER,
+	error TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
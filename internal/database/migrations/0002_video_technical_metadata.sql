@@ -0,0 +1,6 @@
+-- Stream details ffprobe reports besides dimensions, duration and the
+-- video codec. Bitrate is in bits per second.
+
+ALTER TABLE videos ADD COLUMN audio_codec TEXT;
+ALTER TABLE videos ADD COLUMN frame_rate REAL;
+ALTER TABLE videos ADD COLUMN bitrate INTEGER;
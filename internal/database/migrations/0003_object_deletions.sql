@@ -0,0 +1,15 @@
+-- Stored objects no video refers to any more, waiting for the cleaner to
+-- delete them. A prefix row stands for every object under key.
+
+CREATE TABLE object_deletions (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	bucket TEXT NOT NULL DEFAULT '',
+	key TEXT NOT NULL,
+	prefix BOOLEAN NOT NULL DEFAULT FALSE,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP NOT NULL,
+	error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX idx_object_deletions_due ON object_deletions(next_attempt_at);
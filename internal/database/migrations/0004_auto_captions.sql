@@ -0,0 +1,9 @@
+-- Captions transcribed automatically after an upload. caption_status is
+-- how generating them for the video's current file went, with the reason
+-- in caption_error when it failed. Uploads remember whether they asked
+-- for captions until they're processed.
+
+ALTER TABLE videos ADD COLUMN caption_status TEXT;
+ALTER TABLE videos ADD COLUMN caption_error TEXT;
+ALTER TABLE tus_uploads ADD COLUMN auto_captions TEXT NOT NULL DEFAULT '';
+ALTER TABLE video_jobs ADD COLUMN auto_captions TEXT NOT NULL DEFAULT '';
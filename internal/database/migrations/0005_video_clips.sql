@@ -0,0 +1,6 @@
+-- Clips cut from another video remember which one, and where in it they
+-- start and end, in seconds.
+
+ALTER TABLE videos ADD COLUMN clip_of TEXT;
+ALTER TABLE videos ADD COLUMN clip_start REAL;
+ALTER TABLE videos ADD COLUMN clip_end REAL;
@@ -0,0 +1,17 @@
+-- Users can overlay their own watermark on uploads in place of the
+-- server's. Videos remember whether their stored file carries one, and
+-- queued jobs whether their source already did, as clips of watermarked
+-- videos do.
+
+CREATE TABLE user_watermarks (
+	user_id TEXT PRIMARY KEY,
+	updated_at TIMESTAMP NOT NULL,
+	image_key TEXT NOT NULL,
+	position TEXT NOT NULL,
+	opacity REAL NOT NULL,
+	by_default BOOLEAN NOT NULL DEFAULT FALSE,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE videos ADD COLUMN watermarked BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE video_jobs ADD COLUMN source_watermarked BOOLEAN NOT NULL DEFAULT FALSE;
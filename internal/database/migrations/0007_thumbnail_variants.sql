@@ -0,0 +1,4 @@
+-- Smaller copies of each thumbnail, as a JSON array, so grids of videos
+-- don't have to load full-size images.
+
+ALTER TABLE videos ADD COLUMN thumbnail_variants TEXT;
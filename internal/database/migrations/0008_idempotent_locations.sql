@@ -0,0 +1,4 @@
+-- The Location header of a stored idempotent response, so a replayed 201
+-- or 202 still says where the created resource or queued job is.
+
+ALTER TABLE idempotency_keys ADD COLUMN location TEXT;
@@ -0,0 +1,4 @@
+-- Where an imported video is downloaded from. The job's file doesn't
+-- exist until its worker has fetched it.
+
+ALTER TABLE video_jobs ADD COLUMN source_url TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- Credits for videos imported from another platform, as a JSON object, and
+-- the tool a queued import is downloaded with ('' for a plain HTTP fetch).
+
+ALTER TABLE videos ADD COLUMN attribution TEXT;
+ALTER TABLE video_jobs ADD COLUMN importer TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ObjectDeletion is a stored object that's no longer referenced, or with
+// Prefix set every object under Key, queued to be deleted. Bucket is empty
+// for the default bucket.
+type ObjectDeletion struct {
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	Bucket        string    `json:"bucket"`
+	Key           string    `json:"key"`
+	Prefix        bool      `json:"prefix"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	Error         string    `json:"error"`
+}
+
+// UpdateVideoReplacingObjects saves a video and queues the objects it no
+// longer refers to for deletion in one transaction, so they're only
+// deleted once nothing points at them, and are never forgotten if the
+// update is saved.
+func (c Client) UpdateVideoReplacingObjects(video Video, deletions []ObjectDeletion) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = c.updateVideo(tx, video)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, d := range deletions {
+		_, err = tx.Exec(c.dialect.rebind(`
+		INSERT INTO object_deletions (id, created_at, bucket, key, prefix, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		`), uuid.New().String(), now, d.Bucket, d.Key, d.Prefix, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetDueObjectDeletions returns up to limit queued deletions whose next
+// attempt is due by now, oldest first.
+func (c Client) GetDueObjectDeletions(now time.Time, limit int) ([]ObjectDeletion, error) {
+	rows, err := c.query(`
+	SELECT id, created_at, bucket, key, prefix, attempts, next_attempt_at, error
+	FROM object_deletions
+	WHERE next_attempt_at <= ?
+	ORDER BY next_attempt_at, id
+	LIMIT ?
+	`, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []ObjectDeletion{}
+	for rows.Next() {
+		var d ObjectDeletion
+		var id string
+		err := rows.Scan(&id, &d.CreatedAt, &d.Bucket, &d.Key, &d.Prefix, &d.Attempts, &d.NextAttemptAt, &d.Error)
+		if err != nil {
+			return nil, err
+		}
+		d.ID, err = uuid.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+	return deletions, rows.Err()
+}
+
+// DeleteObjectDeletion takes a deletion that's been carried out off the
+// queue.
+func (c Client) DeleteObjectDeletion(id uuid.UUID) error {
+	_, err := c.exec("DELETE FROM object_deletions WHERE id = ?", id.String())
+	return err
+}
+
+// RecordObjectDeletionFailure counts a failed attempt and puts the next one
+// off until next.
+func (c Client) RecordObjectDeletionFailure(id uuid.UUID, next time.Time, failure string) error {
+	_, err := c.exec(`
+	UPDATE object_deletions
+	SET attempts = attempts + 1, next_attempt_at = ?, error = ?
+	WHERE id = ?
+	`, next.UTC(), failure, id.String())
+	return err
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Rendition is an extra MP4 encoding of a video at a lower quality, stored
+// next to the video under Key.
+type Rendition struct {
+	Name    string `json:"name"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bitrate int    `json:"bitrate"`
+	Size    int64  `json:"size"`
+	Key     string `json:"key"`
+}
+
+// Renditions are stored on the video row as a JSON array, best first.
+type Renditions []Rendition
+
+func (r *Renditions) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("can't scan %T into Renditions", src)
+	}
+	return json.Unmarshal(data, r)
+}
+
+func (r Renditions) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// ThumbnailVariant is a smaller copy of a video's thumbnail, stored next to
+// it, for clients that don't need the full-size image.
+type ThumbnailVariant struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// ThumbnailVariants are stored on the video row as a JSON array, smallest
+// first.
+type ThumbnailVariants []ThumbnailVariant
+
+func (v *ThumbnailVariants) Scan(src any) error {
+	var data []byte
+	switch s := src.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case string:
+		data = []byte(s)
+	case []byte:
+		data = s
+	default:
+		return fmt.Errorf("can't scan %T into ThumbnailVariants", src)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (v ThumbnailVariants) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
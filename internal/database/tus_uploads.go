@@ -0,0 +1,85 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TusUpload is a resumable upload in progress. The bytes received so far
+// live in a local file; this records how many there are, how many to
+// expect and the processing options to use once they've all arrived.
+type TusUpload struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UserID         uuid.UUID
+	VideoID        uuid.UUID
+	Length         int64
+	Offset         int64
+	FileName       string
+	NormalizeAudio string
+	Watermark      string
+	StorageClass   string
+	AutoCaptions   string
+}
+
+func (c Client) CreateTusUpload(u TusUpload) error {
+	_, err := c.exec(`
+	INSERT INTO tus_uploads (id, created_at, user_id, video_id, length, upload_offset, file_name, normalize_audio, watermark, storage_class, auto_captions)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, u.ID.String(), u.CreatedAt.UTC(), u.UserID.String(), u.VideoID.String(), u.Length, u.Offset,
+		u.FileName, u.NormalizeAudio, u.Watermark, u.StorageClass, u.AutoCaptions)
+	return err
+}
+
+// GetTusUpload returns ErrNotFound when there's no upload with that ID.
+func (c Client) GetTusUpload(id uuid.UUID) (TusUpload, error) {
+	query := `
+	SELECT id, created_at, user_id, video_id, length, upload_offset, file_name, normalize_audio, watermark, storage_class, auto_captions
+	FROM tus_uploads
+	WHERE id = ?
+	`
+	var u TusUpload
+	err := c.queryRow(query, id.String()).Scan(&u.ID, &u.CreatedAt, &u.UserID, &u.VideoID, &u.Length, &u.Offset,
+		&u.FileName, &u.NormalizeAudio, &u.Watermark, &u.StorageClass, &u.AutoCaptions)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TusUpload{}, ErrNotFound
+	}
+	return u, err
+}
+
+func (c Client) SetTusUploadOffset(id uuid.UUID, offset int64) error {
+	_, err := c.exec(`
+	UPDATE tus_uploads
+	SET upload_offset = ?
+	WHERE id = ?
+	`, offset, id.String())
+	return err
+}
+
+func (c Client) DeleteTusUpload(id uuid.UUID) error {
+	_, err := c.exec(`DELETE FROM tus_uploads WHERE id = ?`, id.String())
+	return err
+}
+
+// GetTusUploadsCreatedBefore returns the IDs of uploads started before t,
+// which have expired.
+func (c Client) GetTusUploadsCreatedBefore(t time.Time) ([]uuid.UUID, error) {
+	rows, err := c.query(`SELECT id FROM tus_uploads WHERE created_at < ?`, t.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Video job statuses. A job is queued until a worker claims it, running
+// while the worker processes it, and then done or failed.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// VideoJob is an uploaded video waiting for, or done with, background
+// processing. The received file stays at SourcePath until the job
+// finishes; the rest are the options it was uploaded with. An import's
+// file is downloaded from SourceURL to SourcePath by its worker.
+type VideoJob struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	VideoID        uuid.UUID
+	UserID         uuid.UUID
+	Status         string
+	Error          string
+	SourcePath     string
+	MediaType      string
+	FileName       string
+	SourceSHA256   string
+	NormalizeAudio string
+	Watermark      string
+	StorageClass   string
+	AutoCaptions   string
+	// SourceWatermarked is set when the source file already has a
+	// watermark, so processing mustn't draw another.
+	SourceWatermarked bool
+	SourceURL         string
+	// Importer is the tool SourceURL is downloaded with, empty to fetch
+	// it over plain HTTP.
+	Importer string
+}
+
+const videoJobColumns = `id, created_at, updated_at, video_id, user_id, status, error, source_path, media_type,
+	file_name, source_sha256, normalize_audio, watermark, storage_class, auto_captions, source_watermarked, source_url, importer`
+
+func scanVideoJob(row rowScanner) (VideoJob, error) {
+	var j VideoJob
+	err := row.Scan(&j.ID, &j.CreatedAt, &j.UpdatedAt, &j.VideoID, &j.UserID, &j.Status, &j.Error, &j.SourcePath, &j.MediaType,
+		&j.FileName, &j.SourceSHA256, &j.NormalizeAudio, &j.Watermark, &j.StorageClass, &j.AutoCaptions, &j.SourceWatermarked, &j.SourceURL, &j.Importer)
+	return j, err
+}
+
+// CreateVideoJob queues a job. Its status is always set to JobQueued.
+func (c Client) CreateVideoJob(j VideoJob) (VideoJob, error) {
+	j.Status = JobQueued
+	j.CreatedAt = time.Now().UTC()
+	j.UpdatedAt = j.CreatedAt
+	_, err := c.exec(`
+	INSERT INTO video_jobs (`+videoJobColumns+`)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, j.ID.String(), j.CreatedAt, j.UpdatedAt, j.VideoID.String(), j.UserID.String(), j.Status, j.Error, j.SourcePath, j.MediaType,
+		j.FileName, j.SourceSHA256, j.NormalizeAudio, j.Watermark, j.StorageClass, j.AutoCaptions, j.SourceWatermarked, j.SourceURL, j.Importer)
+	return j, err
+}
+
+// GetVideoJob returns ErrNotFound when there's no job with that ID.
+func (c Client) GetVideoJob(id uuid.UUID) (VideoJob, error) {
+	row := c.queryRow(`SELECT `+videoJobColumns+` FROM video_jobs WHERE id = ?`, id.String())
+	j, err := scanVideoJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoJob{}, ErrNotFound
+	}
+	return j, err
+}
+
+// GetLatestVideoJob returns the most recently queued job for a video, or
+// ErrNotFound when it has none.
+func (c Client) GetLatestVideoJob(videoID uuid.UUID) (VideoJob, error) {
+	row := c.queryRow(`
+	SELECT `+videoJobColumns+`
+	FROM video_jobs
+	WHERE video_id = ?
+	ORDER BY created_at DESC, id DESC
+	LIMIT 1
+	`, videoID.String())
+	j, err := scanVideoJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoJob{}, ErrNotFound
+	}
+	return j, err
+}
+
+// ClaimVideoJob marks the oldest queued job as running and returns it, so
+// no other worker picks it up. Jobs for the videos in skipVideos, which
+// the caller can't work on right now, are left queued. It returns
+// ErrNotFound when nothing else is queued.
+func (c Client) ClaimVideoJob(skipVideos ...uuid.UUID) (VideoJob, error) {
+	args := []any{JobRunning, time.Now().UTC(), JobQueued}
+	skip := ""
+	if len(skipVideos) > 0 {
+		skip = "AND video_id NOT IN (?" + strings.Repeat(", ?", len(skipVideos)-1) + ")"
+		for _, id := range skipVideos {
+			args = append(args, id.String())
+		}
+	}
+	row := c.queryRow(`
+	UPDATE video_jobs
+	SET status = ?, updated_at = ?
+	WHERE id = (
+		SELECT id FROM video_jobs
+		WHERE status = ? `+skip+`
+		ORDER BY created_at, id
+		LIMIT 1
+		`+c.dialect.skipLocked()+`
+	)
+	RETURNING `+videoJobColumns, args...)
+	j, err := scanVideoJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoJob{}, ErrNotFound
+	}
+	return j, err
+}
+
+// SetVideoJobStatus moves a job to status, recording errMsg when it
+// failed.
+func (c Client) SetVideoJobStatus(id uuid.UUID, status, errMsg string) error {
+	_, err := c.exec(`
+	UPDATE video_jobs
+	SET status = ?, error = ?, updated_at = ?
+	WHERE id = ?
+	`, status, errMsg, time.Now().UTC(), id.String())
+	return err
+}
+
+// RequeueRunningVideoJobs puts jobs that were running when the server
+// stopped back in the queue, and returns how many there were.
+func (c Client) RequeueRunningVideoJobs() (int64, error) {
+	result, err := c.exec(`
+	UPDATE video_jobs
+	SET status = ?, updated_at = ?
+	WHERE status = ?
+	`, JobQueued, time.Now().UTC(), JobRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteVideoJobsFinishedBefore forgets done and failed jobs last updated
+// before t.
+func (c Client) DeleteVideoJobsFinishedBefore(t time.Time) error {
+	_, err := c.exec(`
+	DELETE FROM video_jobs
+	WHERE status IN (?, ?) AND updated_at < ?
+	`, JobDone, JobFailed, t.UTC())
+	return err
+}
@@ -3,29 +3,63 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID                uuid.UUID     `json:"id"`
+	CreatedAt         time.Time     `json:"created_at"`
+	UpdatedAt         time.Time     `json:"updated_at"`
+	ThumbnailURL      *string       `json:"thumbnail_url"`
+	VideoURL          *string       `json:"video_url"`
+	ThumbnailFilename *string       `json:"thumbnail_filename"`
+	VideoFilename     *string       `json:"video_filename"`
+	VideoETag         *string       `json:"video_etag"`
+	VideoSize         *int64        `json:"video_size"`
+	Orientation       *string       `json:"orientation"`
+	Width             *int          `json:"width"`
+	Height            *int          `json:"height"`
+	Duration          *float64      `json:"duration"`
+	Codec             *string       `json:"codec"`
+	AudioCodec        *string       `json:"audio_codec"`
+	FrameRate         *float64      `json:"frame_rate"`
+	Bitrate           *int64        `json:"bitrate"`
+	SourceSHA256      *string       `json:"source_sha256"`
+	DeletedAt         *time.Time    `json:"deleted_at"`
+	PreviewURL        *string       `json:"preview_url"`
+	VideoBucket       *string       `json:"video_bucket"`
+	PendingUploadKey  *string       `json:"-"`
+	ThumbnailColor    *string       `json:"thumbnail_color"`
+	SpriteURL         *string       `json:"sprite_url"`
+	SpriteVTTURL      *string       `json:"sprite_vtt_url"`
+	Captions          CaptionTracks `json:"captions"`
+	ProcessingStatus  *string       `json:"processing_status"`
+	HLSURL            *string       `json:"hls_url"`
+	VideoKey          *string       `json:"video_key"`
+	Renditions        Renditions    `json:"renditions"`
+	CaptionStatus     *string       `json:"caption_status"`
+	CaptionError      *string       `json:"caption_error"`
+	// ClipOf is the video a clip was cut from, between ClipStart and
+	// ClipEnd seconds into it.
+	ClipOf    *uuid.UUID `json:"clip_of"`
+	ClipStart *float64   `json:"clip_start"`
+	ClipEnd   *float64   `json:"clip_end"`
+	// Watermarked is set when the stored file has a watermark drawn on it.
+	Watermarked bool `json:"watermarked"`
+	// ThumbnailVariants are the resized copies of the thumbnail.
+	ThumbnailVariants ThumbnailVariants `json:"thumbnail_variants"`
+	// Attribution is set on videos imported from another platform.
+	Attribution Attribution `json:"attribution"`
 	CreateVideoParams
 }
 
-type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
-}
-
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// videoColumns is the column list every video query selects, in the order
+// scanVideo expects them.
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,13 +67,123 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		thumbnail_filename,
+		video_filename,
+		video_etag,
+		video_size,
+		orientation,
+		width,
+		height,
+		duration,
+		codec,
+		audio_codec,
+		frame_rate,
+		bitrate,
+		source_sha256,
+		deleted_at,
+		preview_url,
+		video_bucket,
+		pending_upload_key,
+		thumbnail_color,
+		sprite_url,
+		sprite_vtt_url,
+		captions,
+		processing_status,
+		hls_url,
+		video_key,
+		renditions,
+		caption_status,
+		caption_error,
+		clip_of,
+		clip_start,
+		clip_end,
+		watermarked,
+		thumbnail_variants,
+		attribution,
+		visibility,
+		user_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.ThumbnailFilename,
+		&video.VideoFilename,
+		&video.VideoETag,
+		&video.VideoSize,
+		&video.Orientation,
+		&video.Width,
+		&video.Height,
+		&video.Duration,
+		&video.Codec,
+		&video.AudioCodec,
+		&video.FrameRate,
+		&video.Bitrate,
+		&video.SourceSHA256,
+		&video.DeletedAt,
+		&video.PreviewURL,
+		&video.VideoBucket,
+		&video.PendingUploadKey,
+		&video.ThumbnailColor,
+		&video.SpriteURL,
+		&video.SpriteVTTURL,
+		&video.Captions,
+		&video.ProcessingStatus,
+		&video.HLSURL,
+		&video.VideoKey,
+		&video.Renditions,
+		&video.CaptionStatus,
+		&video.CaptionError,
+		&video.ClipOf,
+		&video.ClipStart,
+		&video.ClipEnd,
+		&video.Watermarked,
+		&video.ThumbnailVariants,
+		&video.Attribution,
+		&video.Visibility,
+		&video.UserID,
+	)
+	return video, err
+}
+
+type CreateVideoParams struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// Visibility is one of the Visibility constants, unlisted when empty.
+	Visibility string    `json:"visibility"`
+	UserID     uuid.UUID `json:"user_id"`
+}
+
+// Who can see a video. Public videos are listed for everyone, unlisted
+// ones can be read by anyone with their ID, and private ones only by
+// their owner.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+// GetVideos returns a user's videos, newest first, leaving out any in the
+// trash.
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
-	WHERE user_id = ?
+	WHERE user_id = ? AND deleted_at IS NULL
 	ORDER BY created_at DESC
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.query(query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +191,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -75,10 +210,15 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
+		visibility,
 		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	visibility := params.Visibility
+	if visibility == "" {
+		visibility = VisibilityUnlisted
+	}
+	_, err := c.exec(query, id, params.Title, params.Description, visibility, params.UserID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,32 +228,15 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.queryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return Video{}, nil
+			return Video{}, ErrNotFound
 		}
 		return Video{}, err
 	}
@@ -122,34 +245,552 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 }
 
 func (c Client) UpdateVideo(video Video) error {
+	return c.updateVideo(c.db, video)
+}
+
+func (c Client) updateVideo(db execer, video Video) error {
 	query := `
 	UPDATE videos
 	SET
+		updated_at = CURRENT_TIMESTAMP,
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
+		thumbnail_filename = ?,
+		video_filename = ?,
+		video_etag = ?,
+		video_size = ?,
+		orientation = ?,
+		width = ?,
+		height = ?,
+		duration = ?,
+		codec = ?,
+		audio_codec = ?,
+		frame_rate = ?,
+		bitrate = ?,
+		source_sha256 = ?,
+		preview_url = ?,
+		video_bucket = ?,
+		pending_upload_key = ?,
+		thumbnail_color = ?,
+		sprite_url = ?,
+		sprite_vtt_url = ?,
+		captions = ?,
+		processing_status = ?,
+		hls_url = ?,
+		video_key = ?,
+		renditions = ?,
+		caption_status = ?,
+		caption_error = ?,
+		clip_of = ?,
+		clip_start = ?,
+		clip_end = ?,
+		watermarked = ?,
+		thumbnail_variants = ?,
+		attribution = ?,
+		visibility = ?,
 		user_id = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
-		query,
+	_, err := db.Exec(
+		c.dialect.rebind(query),
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
+		video.ThumbnailFilename,
+		video.VideoFilename,
+		video.VideoETag,
+		video.VideoSize,
+		video.Orientation,
+		video.Width,
+		video.Height,
+		video.Duration,
+		video.Codec,
+		video.AudioCodec,
+		video.FrameRate,
+		video.Bitrate,
+		video.SourceSHA256,
+		video.PreviewURL,
+		video.VideoBucket,
+		video.PendingUploadKey,
+		video.ThumbnailColor,
+		video.SpriteURL,
+		video.SpriteVTTURL,
+		video.Captions,
+		video.ProcessingStatus,
+		video.HLSURL,
+		video.VideoKey,
+		video.Renditions,
+		video.CaptionStatus,
+		video.CaptionError,
+		video.ClipOf,
+		video.ClipStart,
+		video.ClipEnd,
+		video.Watermarked,
+		video.ThumbnailVariants,
+		video.Attribution,
+		video.Visibility,
 		video.UserID,
 		video.ID,
 	)
 	return err
 }
 
+// GetVideosMissingProbeInfo returns up to limit uploaded videos, across all
+// users, that were stored before stream details, or the bitrate and frame
+// rate, were recorded. A page continues after the position of the last
+// video of the one before, its creation time and afterID, or starts from
+// the oldest when afterID is uuid.Nil. The video itself needn't still
+// exist.
+func (c Client) GetVideosMissingProbeInfo(afterCreated time.Time, afterID uuid.UUID, limit int) ([]Video, error) {
+	where := "video_url IS NOT NULL AND (width IS NULL OR bitrate IS NULL)"
+	args := []any{}
+	if afterID != uuid.Nil {
+		// created_at holds CURRENT_TIMESTAMP's text, which is compared as is
+		where += " AND (created_at, id) > (?, ?)"
+		args = append(args, afterCreated.UTC().Format(time.DateTime), afterID)
+	}
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE ` + where + `
+	ORDER BY created_at, id
+	LIMIT ?
+	`
+	args = append(args, limit)
+
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// GetVideosWithStoredObjects returns every video, across all users and
+// including those in the trash, that has a stored video, a direct upload
+// waiting to be finalized, a thumbnail or captions.
+func (c Client) GetVideosWithStoredObjects() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url IS NOT NULL OR pending_upload_key IS NOT NULL OR thumbnail_url IS NOT NULL OR captions IS NOT NULL
+	`
+
+	rows, err := c.query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// GetVideosLastModified returns when any of a user's videos, including those
+// in the trash, last changed, or the zero time if they have none.
+func (c Client) GetVideosLastModified(userID uuid.UUID) (time.Time, error) {
+	query := `
+	SELECT MAX(updated_at)
+	FROM videos
+	WHERE user_id = ?
+	`
+
+	// On SQLite aggregates lose the column's TIMESTAMP type, so the driver
+	// hands back the raw text; Postgres keeps it
+	var lastModified any
+	err := c.queryRow(query, userID).Scan(&lastModified)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch v := lastModified.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(time.DateTime, v)
+	case []byte:
+		return time.Parse(time.DateTime, string(v))
+	default:
+		return time.Time{}, nil
+	}
+}
+
+// SetPreviewURL records a generated preview clip, but only while the video
+// still points at videoURL so a preview rendered from a since-replaced
+// upload isn't attached. It reports whether the row was updated.
+func (c Client) SetPreviewURL(id uuid.UUID, videoURL, previewURL string) (bool, error) {
+	query := `
+	UPDATE videos
+	SET preview_url = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND video_url = ?
+	`
+	result, err := c.exec(query, previewURL, id, videoURL)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetSpriteURLs records a generated sprite sheet and its WebVTT index, but
+// only while the video still has videoURL, so a sheet rendered from a
+// replaced upload isn't attached to the new one. It reports whether the
+// video was updated.
+func (c Client) SetSpriteURLs(id uuid.UUID, videoURL, spriteURL, vttURL string) (bool, error) {
+	query := `
+	UPDATE videos
+	SET sprite_url = ?, sprite_vtt_url = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND video_url = ?
+	`
+	result, err := c.exec(query, spriteURL, vttURL, id, videoURL)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetVideoProcessingStatus records how processing of a video's latest
+// upload is going, leaving the rest of the row alone.
+func (c Client) SetVideoProcessingStatus(id uuid.UUID, status string) error {
+	query := `
+	UPDATE videos
+	SET processing_status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.exec(query, status, id)
+	return err
+}
+
+// SetCaptionStatus records how generating captions for a video is going,
+// with errMsg when it failed, as long as videoURL is still the video's
+// file. It reports whether the video was updated.
+func (c Client) SetCaptionStatus(id uuid.UUID, videoURL, status, errMsg string) (bool, error) {
+	var captionError *string
+	if errMsg != "" {
+		captionError = &errMsg
+	}
+	query := `
+	UPDATE videos
+	SET caption_status = ?, caption_error = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND video_url = ?
+	`
+	result, err := c.exec(query, status, captionError, id, videoURL)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetHLSURL records a video's HLS master playlist, as long as videoURL is
+// still the video's current file. It reports whether the video was updated.
+func (c Client) SetHLSURL(id uuid.UUID, videoURL, hlsURL string) (bool, error) {
+	query := `
+	UPDATE videos
+	SET hls_url = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND video_url = ?
+	`
+	result, err := c.exec(query, hlsURL, id, videoURL)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateVideoMetadata sets only a video's user-editable metadata, so it
+// can't undo changes processing makes to the rest of the row.
+func (c Client) UpdateVideoMetadata(id uuid.UUID, title, description string, videoFilename *string, visibility string) error {
+	query := `
+	UPDATE videos
+	SET title = ?, description = ?, video_filename = ?, visibility = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	result, err := c.exec(query, title, description, videoFilename, visibility, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetRenditions records a video's MP4 renditions, as long as videoURL is
+// still the video's current file. It reports whether the video was updated.
+func (c Client) SetRenditions(id uuid.UUID, videoURL string, renditions Renditions) (bool, error) {
+	query := `
+	UPDATE videos
+	SET renditions = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND video_url = ?
+	`
+	result, err := c.exec(query, renditions, id, videoURL)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetVideosPage returns up to limit videos across all users, trashed ones
+// included, oldest first, skipping the first offset.
+func (c Client) GetVideosPage(offset, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	ORDER BY created_at, id
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.query(query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// GetVideosDeletedBefore returns videos, across all users, that were moved
+// to the trash before cutoff.
+func (c Client) GetVideosDeletedBefore(cutoff time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at IS NOT NULL AND deleted_at < ` + c.dialect.timeFromUnix() + `
+	ORDER BY deleted_at
+	`
+
+	rows, err := c.query(query, cutoff.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// SoftDeleteVideo moves a video to the trash. Its row and stored files are
+// kept until the trash is purged.
+func (c Client) SoftDeleteVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND deleted_at IS NULL
+	`
+	_, err := c.exec(query, id)
+	return err
+}
+
+// RestoreVideo takes a video back out of the trash.
+func (c Client) RestoreVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.exec(query, id)
+	return err
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err := c.exec(query, id)
 	return err
 }
+
+// LibrarySummary aggregates a user's videos.
+type LibrarySummary struct {
+	TotalVideos       int            `json:"total_videos"`
+	TotalBytes        int64          `json:"total_bytes"`
+	TotalDuration     float64        `json:"total_duration"`
+	MissingThumbnails int            `json:"missing_thumbnails"`
+	ByOrientation     map[string]int `json:"by_orientation"`
+}
+
+// GetLibrarySummary totals a user's videos in a single query, ignoring the
+// trash. Videos that
+// haven't been uploaded yet count towards TotalVideos and
+// MissingThumbnails but have no orientation.
+func (c Client) GetLibrarySummary(userID uuid.UUID) (LibrarySummary, error) {
+	query := `
+	SELECT
+		COUNT(*),
+		COALESCE(SUM(video_size), 0),
+		COALESCE(SUM(duration), 0),
+		COUNT(*) - COUNT(thumbnail_url),
+		COUNT(CASE WHEN orientation = 'landscape' THEN 1 END),
+		COUNT(CASE WHEN orientation = 'portrait' THEN 1 END),
+		COUNT(CASE WHEN orientation = 'other' THEN 1 END)
+	FROM videos
+	WHERE user_id = ? AND deleted_at IS NULL
+	`
+
+	var summary LibrarySummary
+	var landscape, portrait, other int
+	err := c.queryRow(query, userID).Scan(
+		&summary.TotalVideos,
+		&summary.TotalBytes,
+		&summary.TotalDuration,
+		&summary.MissingThumbnails,
+		&landscape,
+		&portrait,
+		&other,
+	)
+	if err != nil {
+		return LibrarySummary{}, err
+	}
+	summary.ByOrientation = map[string]int{
+		"landscape": landscape,
+		"portrait":  portrait,
+		"other":     other,
+	}
+	return summary, nil
+}
+
+// videoSortColumns are the columns ListVideos can order by.
+var videoSortColumns = map[string]bool{
+	"created_at": true,
+	"title":      true,
+	"deleted_at": true,
+}
+
+// videoStatusExpr is a video's processing status, falling back for rows
+// from before it was recorded the same way the API does: ready once a
+// file is stored, pending until then.
+const videoStatusExpr = `COALESCE(processing_status, CASE WHEN video_url IS NOT NULL THEN 'ready' ELSE 'pending' END)`
+
+// ListVideosParams selects and orders a page of a user's videos.
+type ListVideosParams struct {
+	// UserID limits the listing to one user's videos; uuid.Nil lists
+	// everyone's.
+	UserID uuid.UUID
+	// Trashed lists the videos in the trash instead of the rest.
+	Trashed     bool
+	Orientation string
+	Status      string
+	Visibility  string
+	// SortBy is created_at, title or deleted_at. Ties are broken by ID so
+	// every video has a fixed place in the order.
+	SortBy     string
+	Descending bool
+	// After continues the listing from the video with this ID, the last
+	// one of the previous page.
+	After uuid.UUID
+	// Limit caps the page size; zero returns every match.
+	Limit int
+}
+
+// ListVideos returns a user's videos matching params. Pages are keyed on
+// the last video seen rather than an offset, so videos added or removed
+// meanwhile don't shift later pages.
+func (c Client) ListVideos(params ListVideosParams) ([]Video, error) {
+	if !videoSortColumns[params.SortBy] {
+		return nil, fmt.Errorf("can't sort videos by %q", params.SortBy)
+	}
+
+	var where []string
+	var args []any
+	if params.UserID != uuid.Nil {
+		where = append(where, "user_id = ?")
+		args = append(args, params.UserID)
+	}
+	if params.Trashed {
+		where = append(where, "deleted_at IS NOT NULL")
+	} else {
+		where = append(where, "deleted_at IS NULL")
+	}
+	if params.Orientation != "" {
+		where = append(where, "orientation = ?")
+		args = append(args, params.Orientation)
+	}
+	if params.Status != "" {
+		where = append(where, videoStatusExpr+" = ?")
+		args = append(args, params.Status)
+	}
+	if params.Visibility != "" {
+		where = append(where, "visibility = ?")
+		args = append(args, params.Visibility)
+	}
+	direction, comparison := "ASC", ">"
+	if params.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if params.After != uuid.Nil {
+		where = append(where, fmt.Sprintf("(%[1]s, id) %[2]s (SELECT %[1]s, id FROM videos WHERE id = ?)", params.SortBy, comparison))
+		args = append(args, params.After)
+	}
+
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE ` + strings.Join(where, " AND ") + `
+	ORDER BY ` + params.SortBy + " " + direction + ", id " + direction
+	if params.Limit > 0 {
+		query += "\n\tLIMIT ?"
+		args = append(args, params.Limit)
+	}
+
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
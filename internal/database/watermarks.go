@@ -0,0 +1,75 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Watermark is the image a user overlays on their uploads in place of the
+// server's, with where and how opaquely it's drawn. ByDefault applies it
+// to uploads that don't say whether they want it.
+type Watermark struct {
+	UserID    uuid.UUID `json:"user_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ImageKey  string    `json:"-"`
+	Position  string    `json:"position"`
+	Opacity   float64   `json:"opacity"`
+	ByDefault bool      `json:"by_default"`
+}
+
+// GetWatermark returns a user's watermark, or ErrNotFound if they haven't
+// set one.
+func (c Client) GetWatermark(userID uuid.UUID) (Watermark, error) {
+	wm := Watermark{UserID: userID}
+	err := c.queryRow(`
+	SELECT updated_at, image_key, position, opacity, by_default
+	FROM user_watermarks
+	WHERE user_id = ?
+	`, userID.String()).Scan(&wm.UpdatedAt, &wm.ImageKey, &wm.Position, &wm.Opacity, &wm.ByDefault)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Watermark{}, ErrNotFound
+	}
+	if err != nil {
+		return Watermark{}, err
+	}
+	return wm, nil
+}
+
+// SetWatermark stores a user's watermark, replacing any they had.
+func (c Client) SetWatermark(wm Watermark) (Watermark, error) {
+	wm.UpdatedAt = time.Now().UTC()
+	_, err := c.exec(`
+	INSERT INTO user_watermarks (user_id, updated_at, image_key, position, opacity, by_default)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (user_id) DO UPDATE SET
+		updated_at = excluded.updated_at,
+		image_key = excluded.image_key,
+		position = excluded.position,
+		opacity = excluded.opacity,
+		by_default = excluded.by_default
+	`, wm.UserID.String(), wm.UpdatedAt, wm.ImageKey, wm.Position, wm.Opacity, wm.ByDefault)
+	if err != nil {
+		return Watermark{}, err
+	}
+	return wm, nil
+}
+
+// DeleteWatermark removes a user's watermark. It returns ErrNotFound if
+// they didn't have one.
+func (c Client) DeleteWatermark(userID uuid.UUID) error {
+	result, err := c.exec(`DELETE FROM user_watermarks WHERE user_id = ?`, userID.String())
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
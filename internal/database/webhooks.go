@@ -0,0 +1,262 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook is a URL a user has registered to be sent events about their
+// videos. An empty Events receives every event.
+type Webhook struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    uuid.UUID `json:"user_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+}
+
+// Wants reports whether the webhook is subscribed to event.
+func (w Webhook) Wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery statuses of a webhook event.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event sent, or still to be sent, to a webhook.
+// Pending deliveries are retried at NextAttemptAt until they succeed or
+// run out of attempts.
+type WebhookDelivery struct {
+	ID             uuid.UUID  `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	WebhookID      uuid.UUID  `json:"webhook_id"`
+	Event          string     `json:"event"`
+	Payload        []byte     `json:"-"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	ResponseStatus *int       `json:"response_status"`
+	Error          string     `json:"error,omitempty"`
+}
+
+const webhookColumns = `id, created_at, user_id, url, events, secret`
+
+func scanWebhook(row interface{ Scan(...any) error }) (Webhook, error) {
+	var w Webhook
+	var id, userID, events string
+	err := row.Scan(&id, &w.CreatedAt, &userID, &w.URL, &events, &w.Secret)
+	if err != nil {
+		return Webhook{}, err
+	}
+	w.ID, err = uuid.Parse(id)
+	if err != nil {
+		return Webhook{}, err
+	}
+	w.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return Webhook{}, err
+	}
+	w.Events = []string{}
+	if events != "" {
+		w.Events = strings.Split(events, ",")
+	}
+	return w, nil
+}
+
+func (c Client) CreateWebhook(w Webhook) error {
+	_, err := c.exec(`
+	INSERT INTO webhooks (id, created_at, user_id, url, events, secret)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`, w.ID.String(), w.CreatedAt.UTC(), w.UserID.String(), w.URL, strings.Join(w.Events, ","), w.Secret)
+	return err
+}
+
+// GetWebhooks returns a user's webhooks, oldest first.
+func (c Client) GetWebhooks(userID uuid.UUID) ([]Webhook, error) {
+	rows, err := c.query(`
+	SELECT `+webhookColumns+`
+	FROM webhooks
+	WHERE user_id = ?
+	ORDER BY created_at, id
+	`, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+// GetWebhook returns ErrNotFound when there's no webhook with that ID.
+func (c Client) GetWebhook(id uuid.UUID) (Webhook, error) {
+	w, err := scanWebhook(c.queryRow(`
+	SELECT `+webhookColumns+`
+	FROM webhooks
+	WHERE id = ?
+	`, id.String()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Webhook{}, ErrNotFound
+	}
+	return w, err
+}
+
+// DeleteWebhook removes one of a user's webhooks along with its delivery
+// log. It returns ErrNotFound if the user has no webhook with that ID.
+func (c Client) DeleteWebhook(id, userID uuid.UUID) error {
+	result, err := c.exec("DELETE FROM webhooks WHERE id = ? AND user_id = ?", id.String(), userID.String())
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `id, created_at, updated_at, webhook_id, event, payload, status, attempts, next_attempt_at, response_status, error`
+
+func scanWebhookDelivery(row interface{ Scan(...any) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var id, webhookID string
+	var responseStatus sql.NullInt64
+	err := row.Scan(&id, &d.CreatedAt, &d.UpdatedAt, &webhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &responseStatus, &d.Error)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	d.ID, err = uuid.Parse(id)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	d.WebhookID, err = uuid.Parse(webhookID)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	if responseStatus.Valid {
+		status := int(responseStatus.Int64)
+		d.ResponseStatus = &status
+	}
+	return d, nil
+}
+
+// CreateWebhookDelivery queues an event for a webhook, to be sent as soon
+// as possible.
+func (c Client) CreateWebhookDelivery(webhookID uuid.UUID, event string, payload []byte) (WebhookDelivery, error) {
+	now := time.Now().UTC()
+	d := WebhookDelivery{
+		ID:            uuid.New(),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		WebhookID:     webhookID,
+		Event:         event,
+		Payload:       payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: &now,
+	}
+	_, err := c.exec(`
+	INSERT INTO webhook_deliveries (id, created_at, updated_at, webhook_id, event, payload, status, attempts, next_attempt_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)
+	`, d.ID.String(), now, now, webhookID.String(), event, payload, DeliveryPending, now)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	return d, nil
+}
+
+// GetDueWebhookDeliveries returns up to limit pending deliveries whose
+// next attempt is due by now, oldest first.
+func (c Client) GetDueWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	return c.queryWebhookDeliveries(`
+	SELECT `+webhookDeliveryColumns+`
+	FROM webhook_deliveries
+	WHERE status = ? AND next_attempt_at <= ?
+	ORDER BY next_attempt_at, id
+	LIMIT ?
+	`, DeliveryPending, now.UTC(), limit)
+}
+
+// GetWebhookDeliveries returns a webhook's latest deliveries, newest
+// first.
+func (c Client) GetWebhookDeliveries(webhookID uuid.UUID, limit int) ([]WebhookDelivery, error) {
+	return c.queryWebhookDeliveries(`
+	SELECT `+webhookDeliveryColumns+`
+	FROM webhook_deliveries
+	WHERE webhook_id = ?
+	ORDER BY created_at DESC, id DESC
+	LIMIT ?
+	`, webhookID.String(), limit)
+}
+
+func (c Client) queryWebhookDeliveries(query string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RecordWebhookAttempt saves the outcome of sending a delivery: its new
+// status and attempt count, when to try again if it's still pending, and
+// what the endpoint answered.
+func (c Client) RecordWebhookAttempt(d WebhookDelivery) error {
+	var nextAttemptAt any
+	if d.NextAttemptAt != nil {
+		nextAttemptAt = d.NextAttemptAt.UTC()
+	}
+	_, err := c.exec(`
+	UPDATE webhook_deliveries
+	SET status = ?, attempts = ?, next_attempt_at = ?, response_status = ?, error = ?, updated_at = ?
+	WHERE id = ?
+	`, d.Status, d.Attempts, nextAttemptAt, d.ResponseStatus, d.Error, time.Now().UTC(), d.ID.String())
+	return err
+}
+
+// DeleteWebhookDeliveriesFinishedBefore forgets delivered and failed
+// deliveries last updated before t.
+func (c Client) DeleteWebhookDeliveriesFinishedBefore(t time.Time) error {
+	_, err := c.exec(`
+	DELETE FROM webhook_deliveries
+	WHERE status != ? AND updated_at < ?
+	`, DeliveryPending, t.UTC())
+	return err
+}
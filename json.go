@@ -2,22 +2,38 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
+// respondWithError logs the underlying error server-side and returns only
+// the safe msg to the client, with a generic error code for the status.
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+	respondWithErrorCode(w, code, defaultErrorCode(code), msg, err)
+}
+
+// respondWithErrorCode is respondWithError with a specific machine-readable
+// errCode. 5XX responses are logged at error level, everything else at warn.
+func respondWithErrorCode(w http.ResponseWriter, code int, errCode, msg string, err error) {
+	attrs := []any{"status", code, "code", errCode, "msg", msg}
+	if lw, ok := w.(*loggedResponseWriter); ok {
+		attrs = append(attrs, "method", lw.method, "path", lw.path)
+	}
 	if err != nil {
-		log.Println(err)
+		attrs = append(attrs, "err", err)
 	}
 	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+		slog.Error("responding with error", attrs...)
+	} else {
+		slog.Warn("responding with error", attrs...)
 	}
 	type errorResponse struct {
 		Error string `json:"error"`
+		Code  string `json:"code"`
 	}
 	respondWithJSON(w, code, errorResponse{
 		Error: msg,
+		Code:  errCode,
 	})
 }
 
@@ -25,7 +41,7 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.Error("error marshalling JSON", "err", err)
 		w.WriteHeader(500)
 		return
 	}
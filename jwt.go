@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// jwtErrorMessage turns a token validation error into a message that tells
+// the client whether to refresh its token or log in again.
+func jwtErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrTokenExpired):
+		return "Token expired"
+	case errors.Is(err, auth.ErrTokenInvalidSignature):
+		return "Invalid token signature"
+	case errors.Is(err, auth.ErrTokenMalformed):
+		return "Malformed token"
+	case errors.Is(err, auth.ErrTokenIssuerMismatch):
+		return "Token was issued by a different server"
+	case errors.Is(err, auth.ErrTokenAudienceMismatch):
+		return "Token is for a different audience"
+	}
+	return "Couldn't validate JWT"
+}
+
+// jwtErrorCode is the error code matching jwtErrorMessage.
+func jwtErrorCode(err error) string {
+	if errors.Is(err, auth.ErrTokenExpired) {
+		return errCodeTokenExpired
+	}
+	return errCodeInvalidToken
+}
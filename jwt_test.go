@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+func TestTokenScopeMismatchRejected(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.jwtScope = auth.TokenScope{Issuer: "tubely-prod", Audience: "tubely-api"}
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	resp := h.do(http.MethodGet, "/api/videos", token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a token with the configured scope to work, got %d", resp.StatusCode)
+	}
+
+	tests := []struct {
+		name  string
+		scope auth.TokenScope
+		err   error
+	}{
+		{"other issuer", auth.TokenScope{Issuer: "tubely-staging", Audience: "tubely-api"}, auth.ErrTokenIssuerMismatch},
+		{"default issuer", auth.TokenScope{Audience: "tubely-api"}, auth.ErrTokenIssuerMismatch},
+		{"other audience", auth.TokenScope{Issuer: "tubely-prod", Audience: "tubely-admin"}, auth.ErrTokenAudienceMismatch},
+		{"no audience", auth.TokenScope{Issuer: "tubely-prod"}, auth.ErrTokenAudienceMismatch},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			other, err := auth.MakeJWT(video.UserID, testJWTSecret, time.Hour, tc.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := h.do(http.MethodGet, "/api/videos", other, nil)
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d", resp.StatusCode)
+			}
+			_, err = auth.ValidateJWT(other, testJWTSecret, 0, h.cfg.jwtScope)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
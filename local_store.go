@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localMediaPath is where the local object store's files are served from.
+const localMediaPath = "/media"
+
+// localContentTypes covers the extensions stored objects use that the
+// system's MIME tables often don't know.
+var localContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".vtt":  "text/vtt",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+}
+
+// localObjectStore is an ObjectStore on the local filesystem, for running
+// without a cloud provider. Objects are files under root named after their
+// key, served by ServeHTTP at baseURL. Storage classes are ignored and
+// content types come from the key's extension.
+type localObjectStore struct {
+	root       string
+	baseURL    string
+	signingKey []byte
+}
+
+func newLocalObjectStore(root, baseURL string, signingKey []byte) *localObjectStore {
+	return &localObjectStore{root: root, baseURL: strings.TrimSuffix(baseURL, "/"), signingKey: signingKey}
+}
+
+// path maps key to its file, refusing keys that would escape root.
+func (s *localObjectStore) path(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if key == "" || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, name), nil
+}
+
+// Put writes body to a temporary file next to the object and renames it
+// into place, so readers never see a partial object. The ETag is the MD5
+// of the content, like a single-part S3 upload's.
+func (s *localObjectStore) Put(ctx context.Context, key string, body io.Reader, contentType, storageClass string) (ObjectInfo, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	size, err := io.Copy(tmp, io.TeeReader(body, hash))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("couldn't write %s: %w", key, err)
+	}
+	err = os.Rename(tmp.Name(), filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         size,
+		ContentType:  localContentType(key),
+		ETag:         `"` + hex.EncodeToString(hash.Sum(nil)) + `"`,
+		LastModified: time.Now(),
+	}, nil
+}
+
+func (s *localObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return f, s.info(key, stat), nil
+}
+
+func (s *localObjectStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	body, _, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f := body.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (s *localObjectStore) Copy(ctx context.Context, srcKey, dstKey, storageClass string) (ObjectInfo, error) {
+	body, _, err := s.Get(ctx, srcKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer body.Close()
+	return s.Put(ctx, dstKey, body, "", storageClass)
+}
+
+// Delete removes key. Like S3, deleting a missing object isn't an error.
+func (s *localObjectStore) Delete(ctx context.Context, key string) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Head hashes the file for its ETag, since nothing else records it.
+func (s *localObjectStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	body, info, err := s.Get(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer body.Close()
+	hash := md5.New()
+	_, err = io.Copy(hash, body)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.ETag = `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+	return info, nil
+}
+
+// List walks the directory prefix falls in and returns every object whose
+// key starts with it. ETags are left out rather than hashing every file.
+func (s *localObjectStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		sub, err := s.path(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+		dir = sub
+	}
+
+	objects := []ObjectInfo{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, s.info(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *localObjectStore) info(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  localContentType(key),
+		LastModified: stat.ModTime(),
+	}
+}
+
+// Check makes sure the root directory is still there.
+func (s *localObjectStore) Check(ctx context.Context) error {
+	info, err := os.Stat(s.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", s.root)
+	}
+	return nil
+}
+
+// SignedURL links to key on this server with an expiry and an HMAC of
+// both, which ServeHTTP checks.
+func (s *localObjectStore) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	query := url.Values{"expires": {expires}, "signature": {s.sign(key, expires)}}
+	return s.baseURL + "/" + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+func (s *localObjectStore) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	fmt.Fprintf(mac, "%s\n%s", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP serves objects by key, with range requests, the way a public
+// bucket would. A request carrying a signature is refused once it has
+// expired or if the signature doesn't match.
+func (s *localObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	filePath, err := s.path(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	if signature := query.Get("signature"); signature != "" {
+		expires := query.Get("expires")
+		unix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || time.Now().Unix() > unix || !hmac.Equal([]byte(signature), []byte(s.sign(key, expires))) {
+			http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+			return
+		}
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", localContentType(key))
+	http.ServeContent(w, r, path.Base(key), stat.ModTime(), f)
+}
+
+func localContentType(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	if contentType, ok := localContentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
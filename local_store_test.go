@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalObjectStore(t *testing.T) {
+	ctx := context.Background()
+	store := newLocalObjectStore(t.TempDir(), "http://localhost/media", []byte("secret"))
+
+	info, err := store.Put(ctx, "landscape/a.mp4", strings.NewReader("video"), "video/mp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// MD5 of "video"
+	if !etagsMatch(info.ETag, "421b47ffd946ca083b65cd668c6b17e6") || info.Size != 5 {
+		t.Errorf("unexpected info %+v", info)
+	}
+	head, err := store.Head(ctx, "landscape/a.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.ETag != info.ETag || head.Size != 5 || head.ContentType != "video/mp4" {
+		t.Errorf("head %+v doesn't match put %+v", head, info)
+	}
+
+	if _, err := store.Copy(ctx, "landscape/a.mp4", "landscape/b.mp4", ""); err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := store.Get(ctx, "landscape/b.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "video" {
+		t.Errorf("copy holds %q", data)
+	}
+	body, err = store.GetRange(ctx, "landscape/b.mp4", 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(body)
+	body.Close()
+	if string(data) != "ide" {
+		t.Errorf("range holds %q", data)
+	}
+
+	objects, err := store.List(ctx, "landscape/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "landscape/a.mp4" {
+		t.Errorf("list: got %+v", objects)
+	}
+	if objects, err := store.List(ctx, "missing/"); err != nil || len(objects) != 0 {
+		t.Errorf("listing a missing prefix: got %v, %v", objects, err)
+	}
+
+	if err := store.Delete(ctx, "landscape/a.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "landscape/a.mp4"); err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+	if _, err := store.Head(ctx, "landscape/a.mp4"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound, got %v", err)
+	}
+
+	if _, err := store.Put(ctx, "../escape.mp4", strings.NewReader("x"), "video/mp4", ""); err == nil {
+		t.Error("expected keys outside the root to be refused")
+	}
+}
+
+func TestLocalObjectStoreServe(t *testing.T) {
+	ctx := context.Background()
+	store := newLocalObjectStore(t.TempDir(), "http://localhost/media", []byte("secret"))
+	if _, err := store.Put(ctx, "portrait/v.mp4", strings.NewReader("0123456789"), "video/mp4", ""); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.StripPrefix(localMediaPath, store)
+
+	get := func(target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/media/portrait/v.mp4", http.Header{"Range": {"bytes=2-4"}})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Errorf("range: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "video/mp4" {
+		t.Errorf("content type %q", rec.Header().Get("Content-Type"))
+	}
+
+	signed, err := store.SignedURL(ctx, "portrait/v.mp4", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := strings.TrimPrefix(signed, "http://localhost")
+	if rec := get(target, nil); rec.Code != http.StatusOK {
+		t.Errorf("signed: expected 200, got %d", rec.Code)
+	}
+	if rec := get(strings.Replace(target, "signature=", "signature=0", 1), nil); rec.Code != http.StatusForbidden {
+		t.Errorf("tampered: expected 403, got %d", rec.Code)
+	}
+	expired, _ := store.SignedURL(ctx, "portrait/v.mp4", -time.Minute)
+	if rec := get(strings.TrimPrefix(expired, "http://localhost"), nil); rec.Code != http.StatusForbidden {
+		t.Errorf("expired: expected 403, got %d", rec.Code)
+	}
+	if rec := get("/media/portrait/missing.mp4", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("missing: expected 404, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import "net/http"
+
+// loggedResponseWriter carries the request method and path alongside the
+// ResponseWriter so respondWithError can log them without every handler
+// having to pass the request through.
+type loggedResponseWriter struct {
+	http.ResponseWriter
+	method string
+	path   string
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (lw *loggedResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+func (lw *loggedResponseWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&loggedResponseWriter{
+			ResponseWriter: w,
+			method:         r.Method,
+			path:           r.URL.Path,
+		}, r)
+	})
+}
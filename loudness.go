@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Loudness normalization modes. Single-pass is quicker; two-pass measures
+// the audio first and then applies an exact linear correction.
+const (
+	loudnormSinglePass = "single-pass"
+	loudnormTwoPass    = "two-pass"
+)
+
+// loudnormStats are the measurements the first loudnorm pass prints.
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// parseLoudnormStats pulls the JSON block loudnorm prints at the end of
+// ffmpeg's log output.
+func parseLoudnormStats(output []byte) (loudnormStats, error) {
+	start := bytes.LastIndexByte(output, '{')
+	end := bytes.LastIndexByte(output, '}')
+	if start < 0 || end < start {
+		return loudnormStats{}, errors.New("no loudnorm measurements in ffmpeg output")
+	}
+
+	var stats loudnormStats
+	err := json.Unmarshal(output[start:end+1], &stats)
+	if err != nil {
+		return loudnormStats{}, fmt.Errorf("couldn't parse loudnorm measurements: %w", err)
+	}
+	return stats, nil
+}
+
+// silent reports whether the measured audio was digital silence, which
+// loudnorm reports as -inf and can't be normalized.
+func (s loudnormStats) silent() bool {
+	i, err := strconv.ParseFloat(s.InputI, 64)
+	return err != nil || math.IsInf(i, -1)
+}
+
+// normalizeAudio levels a video's audio to targetLUFS with ffmpeg's loudnorm
+// filter and returns the path of the new file. The video stream is copied.
+// Files without an audio stream, or with silent audio, are returned as-is.
+func normalizeAudio(ctx context.Context, inputPath string, targetLUFS float64, mode string) (string, error) {
+	hasAudio, err := hasAudioStream(ctx, inputPath)
+	if err != nil {
+		return "", err
+	}
+	if !hasAudio {
+		return inputPath, nil
+	}
+
+	target := fmt.Sprintf("I=%s:TP=-1.5:LRA=11", strconv.FormatFloat(targetLUFS, 'f', 1, 64))
+	filter := "loudnorm=" + target
+
+	if mode == loudnormTwoPass {
+		output, err := runMediaTool(ctx, "ffmpeg", "-hide_banner",
+			"-i", inputPath,
+			"-af", filter+":print_format=json",
+			"-vn", "-f", "null", "-")
+		if err != nil {
+			return "", err
+		}
+		stats, err := parseLoudnormStats(output)
+		if err != nil {
+			return "", err
+		}
+		if stats.silent() {
+			return inputPath, nil
+		}
+		filter = fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+			filter, stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset)
+	}
+
+	outputFilePath := inputPath + ".loudnorm"
+	_, err = runMediaTool(ctx, "ffmpeg",
+		"-i", inputPath,
+		"-af", filter,
+		"-c:v", "copy",
+		"-c:a", "aac",
+		"-f", "mp4",
+		outputFilePath,
+	)
+	if err != nil {
+		return "", err
+	}
+	return outputFilePath, nil
+}
+
+// hasAudioStream reports whether ffprobe finds at least one audio stream.
+func hasAudioStream(ctx context.Context, filePath string) (bool, error) {
+	output, err := runMediaTool(ctx, "ffprobe", "-v", "error", "-select_streams", "a", "-show_entries", "stream=index", "-of", "csv=p=0", filePath)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(output)) != "", nil
+}
+
+// shouldNormalizeAudio decides whether an upload's audio gets leveled. The
+// form field "normalize_audio" overrides the configured default when
+// present.
+func (cfg *apiConfig) shouldNormalizeAudio(formValue string) bool {
+	if !cfg.mediaToolsAvailable {
+		return false
+	}
+	if apply, err := strconv.ParseBool(formValue); err == nil {
+		return apply
+	}
+	return cfg.loudnormByDefault
+}
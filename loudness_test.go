@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestParseLoudnormStats(t *testing.T) {
+	output := []byte(`[Parsed_loudnorm_0 @ 0x5581] 
+{
+	"input_i" : "-27.61",
+	"input_tp" : "-4.47",
+	"input_lra" : "18.06",
+	"input_thresh" : "-39.20",
+	"output_i" : "-16.58",
+	"output_tp" : "-1.50",
+	"output_lra" : "14.78",
+	"output_thresh" : "-27.71",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.58"
+}
+`)
+	stats, err := parseLoudnormStats(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := loudnormStats{InputI: "-27.61", InputTP: "-4.47", InputLRA: "18.06", InputThresh: "-39.20", TargetOffset: "0.58"}
+	if stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	if stats.silent() {
+		t.Error("expected audio not to be silent")
+	}
+
+	if _, err := parseLoudnormStats([]byte("no stats here")); err == nil {
+		t.Error("expected error for output without measurements")
+	}
+
+	silent := loudnormStats{InputI: "-inf"}
+	if !silent.silent() {
+		t.Error("expected -inf to be silent")
+	}
+}
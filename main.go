@@ -3,39 +3,260 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"golang.org/x/text/language"
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
+	db           database.Client
+	jwtSecret    string
+	jwtLeeway    time.Duration
+	jwtScope     auth.TokenScope
+	platform     string
+	filepathRoot string
+	assetsRoot   string
+	// thumbnailStorage is where new thumbnails are kept, local or s3.
+	thumbnailStorage string
 	s3Bucket         string
 	s3Region         string
 	s3CfDistribution string
 	port             string
-	s3Client         *s3.Client
+	store            ObjectStore
+	uploadLocks      *videoLocks
+	// progress tracks uploads in flight for GET /api/videos/{videoID}/progress.
+	progress *progressTracker
+
+	// bucketResolver routes a user's uploads to a bucket other than
+	// s3Bucket. Stores for those buckets are built from s3Client.
+	bucketResolver BucketResolver
+	s3Client       S3API
+	s3MaxAttempts  int
+	// s3PartSize is the part size for multipart uploads of large objects.
+	s3PartSize int64
+
+	// presigner signs the URLs clients upload large videos to directly.
+	presigner S3Presigner
+
+	// videoDelivery is how responses link to stored videos: through the
+	// distribution, or with URLs signed for videoURLExpiry.
+	videoDelivery  string
+	videoURLExpiry time.Duration
+	// trashRetention is how long videos stay in the trash before the
+	// sweeper purges them.
+	trashRetention time.Duration
+	// orphanMinAge is how old a stored object no video refers to must be
+	// before the orphan collector counts it, so uploads in progress are
+	// left alone.
+	orphanMinAge time.Duration
+
+	// streamMode is whether the stream endpoint proxies video bytes or
+	// redirects to a signed URL.
+	streamMode string
+
+	// cloudFront signs distribution URLs and playback cookies when videos
+	// are delivered through CloudFront. Cookies are scoped to
+	// cloudFrontCookieDomain, which has to cover the distribution's domain.
+	cloudFront             *cloudFrontSigner
+	cloudFrontCookieDomain string
+
+	// publicBaseURL is the scheme, host and optional base path clients
+	// reach the server at, e.g. https://example.com/tubely. Empty means
+	// http://localhost:port.
+	publicBaseURL string
+	// assetsBaseURL is where the assets directory is served from when it
+	// isn't this server's /assets/, e.g. a CDN in front of it.
+	assetsBaseURL string
+
+	// maxTitleLength and maxDescriptionLength cap video metadata, in
+	// characters.
+	maxTitleLength       int
+	maxDescriptionLength int
+
+	// outputFormat is the container and codecs videos are stored in.
+	outputFormat outputFormat
+
+	// stripMetadata removes container metadata such as GPS position and
+	// device model from uploads, at the cost of always remuxing them.
+	stripMetadata bool
+
+	// allowedVideoTypes lists the container types accepted for upload.
+	// Anything other than video/mp4 is only accepted when transcodeVideos
+	// is on, since it has to be converted to MP4 before storing.
+	allowedVideoTypes []string
+	transcodeVideos   bool
+
+	// allowedThumbnailTypes lists the image types accepted as thumbnails.
+	allowedThumbnailTypes []string
+
+	// adminAPIKey guards the /admin endpoints that operate on every user's
+	// data. Those endpoints are disabled when it's empty.
+	adminAPIKey string
+
+	// verifyUploads rejects an upload when the ETag S3 reports doesn't
+	// match the one computed locally. Leave it off for buckets using
+	// SSE-KMS, where ETags aren't MD5 digests.
+	verifyUploads bool
+
+	// mediaToolsAvailable is false when running in degraded mode without
+	// ffmpeg/ffprobe. Orientation detection, faststart processing and
+	// transcoding are skipped and MP4s are stored as uploaded.
+	mediaToolsAvailable bool
+
+	// watermarkImage is overlaid on uploads when set. Uploads opt in or out
+	// with the "watermark" form field; watermarkByDefault applies otherwise.
+	watermarkImage     string
+	watermarkPosition  string
+	watermarkOpacity   float64
+	watermarkByDefault bool
+
+	// loudnormByDefault levels the audio of uploads to loudnormTarget LUFS
+	// unless the upload's "normalize_audio" field says otherwise.
+	// loudnormMode is single-pass or two-pass.
+	loudnormByDefault bool
+	loudnormMode      string
+	loudnormTarget    float64
+
+	// transcriber is Whisper, run locally or through an API, for captioning
+	// uploads that ask for it with the "auto_captions" field, or every
+	// upload with autoCaptionsByDefault. It's nil when WHISPER_MODE is off.
+	// whisperLanguage skips language detection when set.
+	transcriber           transcriber
+	whisperLanguage       string
+	autoCaptionsByDefault bool
+
+	// storageClass is the S3 storage class objects are stored with. Uploads
+	// can override it for the video itself with the "storage_class" field.
+	// Empty uses the bucket's default.
+	storageClass string
+
+	// thumbnailFormat, when set, re-encodes every uploaded thumbnail to
+	// that format. Empty keeps thumbnails exactly as uploaded.
+	thumbnailFormat  string
+	thumbnailQuality int
+
+	// trustedProxies are the peers whose X-Forwarded-For and X-Real-IP
+	// headers clientIP believes.
+	trustedProxies []*net.IPNet
+
+	// previewClips turns on rendering a short hover preview of every
+	// upload, previewClipLength seconds long, in the background, as one of
+	// previewFormats.
+	previewClips      bool
+	previewClipLength float64
+	previewFormat     string
+
+	// spriteSheets turns on rendering a scrubbing sprite sheet of every
+	// upload in the background: a frame every spriteInterval seconds,
+	// tiled spriteColumns wide and at most spriteRows tall.
+	spriteSheets   bool
+	spriteInterval float64
+	spriteColumns  int
+	spriteRows     int
+
+	// autoThumbnails gives uploads without a thumbnail a frame of the
+	// video as one.
+	autoThumbnails bool
+
+	// hlsPackaging turns on encoding every upload into HLS renditions for
+	// adaptive playback, in the background. hlsCaptions adds the video's
+	// caption tracks to the master playlist as subtitles.
+	hlsPackaging bool
+	hlsCaptions  bool
+
+	// mp4Renditions turns on encoding every upload at lower qualities too,
+	// as separate MP4s clients can choose between, in the background.
+	mp4Renditions bool
+
+	// dimensionLimits rejects uploads with tiny or extreme frame sizes.
+	dimensionLimits dimensionLimits
+	// maxVideoDuration rejects uploads longer than it, when non-zero.
+	maxVideoDuration time.Duration
+
+	// tusDir holds the bytes of resumable uploads in progress, which are
+	// discarded once they're tusUploadExpiry old.
+	tusDir          string
+	tusUploadExpiry time.Duration
+
+	// jobWorkers is how many uploads are processed at once in the
+	// background. Zero processes each upload during its request instead,
+	// except watermarked ones, which a single worker still takes. Queued
+	// uploads wait in jobDir; jobWake nudges an idle worker.
+	jobWorkers int
+	jobDir     string
+	jobWake    chan struct{}
+
+	// idempotencyTTL is how long a stored response is replayed to requests
+	// repeating its Idempotency-Key.
+	idempotencyTTL time.Duration
+
+	// rateLimiter counts requests to the rate limited endpoints against
+	// the limit for their scope, "auth" or "upload". Scopes without a limit
+	// aren't counted.
+	rateLimiter rateLimiter
+	rateLimits  map[string]rateLimit
+
+	// remoteClient fetches user-supplied URLs and refuses to connect to
+	// private or loopback addresses.
+	remoteClient *http.Client
+	// importClient downloads videos imported from a URL, under the same
+	// restrictions as remoteClient but with a timeout sized for video.
+	// platformDownloader is yt-dlp, for imports from video platforms that
+	// ask for it with the "importer" field. It's nil unless YTDLP_BINARY
+	// is set.
+	importClient       *http.Client
+	platformDownloader platformDownloader
+
+	// webhookClient sends webhook deliveries, under the same restrictions
+	// as remoteClient. webhookWake nudges the delivery worker.
+	webhookClient *http.Client
+	webhookWake   chan struct{}
 }
 
+// sqliteJournalModes are the values SQLite accepts for journal_mode.
+var sqliteJournalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+
 func main() {
 	godotenv.Load(".env")
 
+	var err error
 	pathToDB := os.Getenv("DB_PATH")
 	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+		log.Fatal("DB_PATH must be set")
+	}
+
+	dbOptions := database.DefaultOptions()
+	dbOptions.BusyTimeout, err = envDuration("DB_BUSY_TIMEOUT", dbOptions.BusyTimeout)
+	if err != nil || dbOptions.BusyTimeout < 0 {
+		log.Fatal("DB_BUSY_TIMEOUT must be a non-negative duration")
+	}
+	if mode := os.Getenv("DB_JOURNAL_MODE"); mode != "" {
+		if !slices.Contains(sqliteJournalModes, strings.ToUpper(mode)) {
+			log.Fatalf("Invalid DB_JOURNAL_MODE %q", mode)
+		}
+		dbOptions.JournalMode = mode
+	}
+	dbOptions.ForeignKeys = !strings.EqualFold(os.Getenv("DB_FOREIGN_KEYS"), "false")
+	dbOptions.MaxOpenConns, err = envInt("DB_MAX_OPEN_CONNS", dbOptions.MaxOpenConns)
+	if err != nil || dbOptions.MaxOpenConns < 1 {
+		log.Fatal("DB_MAX_OPEN_CONNS must be a positive number")
 	}
 
-	db, err := database.NewClient(pathToDB)
+	db, err := database.NewClient(pathToDB, dbOptions)
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
@@ -45,6 +266,15 @@ func main() {
 		log.Fatal("JWT_SECRET environment variable is not set")
 	}
 
+	jwtScope := auth.TokenScope{
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Audience: os.Getenv("JWT_AUDIENCE"),
+	}
+	jwtLeeway, err := envDuration("JWT_LEEWAY", 30*time.Second)
+	if err != nil {
+		log.Fatalf("Invalid JWT_LEEWAY: %v", err)
+	}
+
 	platform := os.Getenv("PLATFORM")
 	if platform == "" {
 		log.Fatal("PLATFORM environment variable is not set")
@@ -60,46 +290,591 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
+	storageBackend, err := parseStorageBackend(os.Getenv("STORAGE_BACKEND"))
+	if err != nil {
+		log.Fatalf("Invalid STORAGE_BACKEND: %v", err)
+	}
+
+	// The local backend needs no bucket, and serves objects itself unless
+	// S3_CF_DISTRO points somewhere else
 	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
+	if s3Bucket == "" && storageBackend != storageLocal {
 		log.Fatal("S3_BUCKET environment variable is not set")
 	}
 
 	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
+	if s3Region == "" && storageBackend == storageGCS {
+		s3Region = "auto"
+	}
+	if s3Region == "" && storageBackend != storageLocal {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
 	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
+	if s3CfDistribution == "" && storageBackend != storageLocal {
 		log.Fatal("S3_CF_DISTRO environment variable is not set")
 	}
 
+	thumbnailStorage := os.Getenv("THUMBNAIL_STORAGE")
+	if thumbnailStorage == "" {
+		thumbnailStorage = thumbnailStorageLocal
+	}
+	if thumbnailStorage != thumbnailStorageLocal && thumbnailStorage != thumbnailStorageS3 {
+		log.Fatalf("Invalid THUMBNAIL_STORAGE %q, must be local or s3", thumbnailStorage)
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("PORT environment variable is not set")
 	}
 
-	// Load the default AWS SDK config
-	sdkConfig, err := config.LoadDefaultConfig(context.TODO())
+	publicBaseURL := os.Getenv("PUBLIC_BASE_URL")
+	if publicBaseURL != "" {
+		publicBaseURL, err = parsePublicBaseURL(publicBaseURL)
+		if err != nil {
+			log.Fatalf("Invalid PUBLIC_BASE_URL: %v", err)
+		}
+	}
+	assetsBaseURL := os.Getenv("ASSETS_URL")
+	if assetsBaseURL != "" {
+		assetsBaseURL, err = parsePublicBaseURL(assetsBaseURL)
+		if err != nil {
+			log.Fatalf("Invalid ASSETS_URL: %v", err)
+		}
+	}
+
+	maxTitleLength, err := envInt("VIDEO_TITLE_MAX_LENGTH", 200)
+	if err != nil || maxTitleLength < 1 {
+		log.Fatal("VIDEO_TITLE_MAX_LENGTH must be a positive number")
+	}
+	maxDescriptionLength, err := envInt("VIDEO_DESCRIPTION_MAX_LENGTH", 5000)
+	if err != nil || maxDescriptionLength < 0 {
+		log.Fatal("VIDEO_DESCRIPTION_MAX_LENGTH must be a non-negative number")
+	}
+
+	allowedVideoTypes := envList("ALLOWED_VIDEO_TYPES", []string{"video/mp4", "video/quicktime", "video/webm", "video/x-matroska"})
+	allowedThumbnailTypes := envList("ALLOWED_THUMBNAIL_TYPES", []string{"image/jpeg", "image/png", "image/webp", "image/avif"})
+	for _, mediaType := range allowedThumbnailTypes {
+		if _, ok := thumbnailExtension(mediaType); !ok {
+			log.Fatalf("Unsupported ALLOWED_THUMBNAIL_TYPES entry %q, must be image/jpeg, image/png, image/webp or image/avif", mediaType)
+		}
+	}
+	transcodeVideos := !strings.EqualFold(os.Getenv("TRANSCODE_VIDEOS"), "false")
+	adminAPIKey := os.Getenv("ADMIN_API_KEY")
+	verifyUploads := envBool("VERIFY_UPLOADS")
+
+	previewClips := envBool("PREVIEW_CLIPS")
+	previewClipLength, err := envFloat("PREVIEW_CLIP_SECONDS", 3)
+	if err != nil || previewClipLength <= 0 {
+		log.Fatal("PREVIEW_CLIP_SECONDS must be a positive number")
+	}
+	previewFormat := os.Getenv("PREVIEW_FORMAT")
+	if previewFormat == "" {
+		previewFormat = "webp"
+	}
+	if _, ok := previewFormats[previewFormat]; !ok {
+		log.Fatalf("Invalid PREVIEW_FORMAT %q, must be webp, gif or mp4", previewFormat)
+	}
+
+	hlsPackaging := envBool("HLS_PACKAGING")
+	hlsCaptions := envBool("HLS_CAPTIONS")
+	mp4Renditions := envBool("MP4_RENDITIONS")
+	autoThumbnails := envBool("AUTO_THUMBNAILS")
+
+	spriteSheets := envBool("SPRITE_SHEETS")
+	spriteInterval, err := envFloat("SPRITE_INTERVAL_SECONDS", 10)
+	if err != nil || spriteInterval <= 0 {
+		log.Fatal("SPRITE_INTERVAL_SECONDS must be a positive number")
+	}
+	spriteColumns, err := envInt("SPRITE_COLUMNS", 10)
+	if err != nil || spriteColumns < 1 {
+		log.Fatal("SPRITE_COLUMNS must be a positive number")
+	}
+	spriteRows, err := envInt("SPRITE_ROWS", 10)
+	if err != nil || spriteRows < 1 {
+		log.Fatal("SPRITE_ROWS must be a positive number")
+	}
+
+	minDimension, err := envInt("VIDEO_MIN_DIMENSION", defaultDimensionLimits.minDimension)
+	if err != nil || minDimension < 1 {
+		log.Fatal("VIDEO_MIN_DIMENSION must be a positive number")
+	}
+	maxDimension, err := envInt("VIDEO_MAX_DIMENSION", 0)
+	if err != nil || maxDimension < 0 || (maxDimension > 0 && maxDimension < minDimension) {
+		log.Fatal("VIDEO_MAX_DIMENSION must be 0 or a number no smaller than VIDEO_MIN_DIMENSION")
+	}
+	minAspect, err := envFloat("VIDEO_MIN_ASPECT_RATIO", defaultDimensionLimits.minAspect)
+	if err != nil || minAspect <= 0 {
+		log.Fatal("VIDEO_MIN_ASPECT_RATIO must be a positive number")
+	}
+	maxAspect, err := envFloat("VIDEO_MAX_ASPECT_RATIO", defaultDimensionLimits.maxAspect)
+	if err != nil || maxAspect < minAspect {
+		log.Fatal("VIDEO_MAX_ASPECT_RATIO must be a number no smaller than VIDEO_MIN_ASPECT_RATIO")
+	}
+	maxVideoDuration, err := envDuration("VIDEO_MAX_DURATION", 0)
+	if err != nil || maxVideoDuration < 0 {
+		log.Fatal("VIDEO_MAX_DURATION must be a non-negative duration")
+	}
+	importTimeout, err := envDuration("VIDEO_IMPORT_TIMEOUT", 30*time.Minute)
+	if err != nil || importTimeout <= 0 {
+		log.Fatal("VIDEO_IMPORT_TIMEOUT must be a positive duration")
+	}
+	var platformDownloader platformDownloader
+	if ytDLPBinary := os.Getenv("YTDLP_BINARY"); ytDLPBinary != "" {
+		if _, err := exec.LookPath(ytDLPBinary); err != nil {
+			log.Fatalf("Couldn't find YTDLP_BINARY: %v", err)
+		}
+		platformDownloader = ytDLPCommand{binary: ytDLPBinary, timeout: importTimeout}
+	}
+
+	trashRetention, err := envDuration("TRASH_RETENTION", 30*24*time.Hour)
+	if err != nil || trashRetention < 0 {
+		log.Fatal("TRASH_RETENTION must be a non-negative duration")
+	}
+	trashSweepInterval, err := envDuration("TRASH_SWEEP_INTERVAL", time.Hour)
+	if err != nil || trashSweepInterval <= 0 {
+		log.Fatal("TRASH_SWEEP_INTERVAL must be a positive duration")
+	}
+
+	missingThumbnailAction := os.Getenv("MISSING_THUMBNAIL_ACTION")
+	switch missingThumbnailAction {
+	case "":
+		missingThumbnailAction = missingThumbnailClear
+	case missingThumbnailClear, missingThumbnailRegenerate:
+	default:
+		log.Fatalf("Invalid MISSING_THUMBNAIL_ACTION %q, must be clear or regenerate", missingThumbnailAction)
+	}
+	thumbnailCheckInterval, err := envDuration("THUMBNAIL_CHECK_INTERVAL", time.Hour)
+	if err != nil || thumbnailCheckInterval < 0 {
+		log.Fatal("THUMBNAIL_CHECK_INTERVAL must be a non-negative duration")
+	}
+
+	orphanGCInterval, err := envDuration("ORPHAN_GC_INTERVAL", 24*time.Hour)
+	if err != nil || orphanGCInterval < 0 {
+		log.Fatal("ORPHAN_GC_INTERVAL must be a non-negative duration")
+	}
+	orphanMinAge, err := envDuration("ORPHAN_GC_MIN_AGE", 24*time.Hour)
+	if err != nil || orphanMinAge < 0 {
+		log.Fatal("ORPHAN_GC_MIN_AGE must be a non-negative duration")
+	}
+
+	trustedProxies, err := parseCIDRs(envList("TRUSTED_PROXIES", nil))
 	if err != nil {
-		log.Fatal("Failed to load default AWS SDK config")
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	mediaToolsAvailable := true
+	if err := checkMediaTools(); err != nil {
+		if !envBool("ALLOW_MISSING_FFMPEG") {
+			log.Fatalf("%v. Install ffmpeg (which includes ffprobe), or set ALLOW_MISSING_FFMPEG=true to run without video processing", err)
+		}
+		log.Printf("Warning: %v. Running in degraded mode: videos are stored unprocessed and classified as \"other\"", err)
+		mediaToolsAvailable = false
+	}
+
+	ffmpegConcurrency, err := envInt("FFMPEG_CONCURRENCY", runtime.NumCPU())
+	if err != nil || ffmpegConcurrency < 1 {
+		log.Fatal("FFMPEG_CONCURRENCY must be a positive number")
+	}
+	ffmpegQueueTimeout, err := envDuration("FFMPEG_QUEUE_TIMEOUT", 30*time.Second)
+	if err != nil || ffmpegQueueTimeout <= 0 {
+		log.Fatal("FFMPEG_QUEUE_TIMEOUT must be a positive duration")
+	}
+	mediaTools = newMediaToolLimiter(ffmpegConcurrency, ffmpegQueueTimeout)
+	mediaToolTimeout, err = envDuration("FFMPEG_TIMEOUT", mediaToolTimeout)
+	if err != nil || mediaToolTimeout <= 0 {
+		log.Fatal("FFMPEG_TIMEOUT must be a positive duration")
+	}
+
+	watermarkImage := os.Getenv("WATERMARK_IMAGE")
+	watermarkPosition := os.Getenv("WATERMARK_POSITION")
+	if watermarkPosition == "" {
+		watermarkPosition = "bottom-right"
+	}
+	if _, ok := watermarkOverlayPositions[watermarkPosition]; !ok {
+		log.Fatalf("Invalid WATERMARK_POSITION %q", watermarkPosition)
 	}
+	watermarkOpacity, err := envFloat("WATERMARK_OPACITY", 1)
+	if err != nil || watermarkOpacity < 0 || watermarkOpacity > 1 {
+		log.Fatal("WATERMARK_OPACITY must be a number between 0 and 1")
+	}
+	if watermarkImage != "" {
+		if _, err := os.Stat(watermarkImage); err != nil {
+			log.Fatalf("Couldn't read WATERMARK_IMAGE: %v", err)
+		}
+		if !mediaToolsAvailable {
+			log.Fatal("WATERMARK_IMAGE requires ffmpeg")
+		}
+	}
+	watermarkByDefault := envBool("WATERMARK_BY_DEFAULT")
 
-	// Create a client with the new config
-	s3Client := s3.NewFromConfig(sdkConfig)
+	loudnormByDefault := envBool("NORMALIZE_AUDIO")
+	loudnormMode := os.Getenv("LOUDNORM_MODE")
+	if loudnormMode == "" {
+		loudnormMode = loudnormSinglePass
+	}
+	if loudnormMode != loudnormSinglePass && loudnormMode != loudnormTwoPass {
+		log.Fatalf("LOUDNORM_MODE must be %s or %s", loudnormSinglePass, loudnormTwoPass)
+	}
+	loudnormTarget, err := envFloat("LOUDNORM_TARGET_LUFS", -16)
+	if err != nil || loudnormTarget < -70 || loudnormTarget > -5 {
+		log.Fatal("LOUDNORM_TARGET_LUFS must be a number between -70 and -5")
+	}
+
+	var transcriber transcriber
+	whisperModel := os.Getenv("WHISPER_MODEL")
+	switch whisperMode := os.Getenv("WHISPER_MODE"); whisperMode {
+	case "", whisperOff:
+	case whisperLocal:
+		if whisperModel == "" {
+			whisperModel = "base"
+		}
+		whisperBinary := os.Getenv("WHISPER_BINARY")
+		if whisperBinary == "" {
+			whisperBinary = "whisper"
+		}
+		if _, err := exec.LookPath(whisperBinary); err != nil {
+			log.Fatalf("Couldn't find WHISPER_BINARY: %v", err)
+		}
+		transcriber = whisperCommand{binary: whisperBinary, model: whisperModel}
+	case whisperAPI:
+		if whisperModel == "" {
+			whisperModel = "whisper-1"
+		}
+		whisperAPIURL := os.Getenv("WHISPER_API_URL")
+		if whisperAPIURL == "" {
+			whisperAPIURL = defaultWhisperAPIURL
+		}
+		whisperAPIKey := os.Getenv("WHISPER_API_KEY")
+		if whisperAPIKey == "" {
+			whisperAPIKey = os.Getenv("OPENAI_API_KEY")
+		}
+		if whisperAPIKey == "" && whisperAPIURL == defaultWhisperAPIURL {
+			log.Fatal("WHISPER_MODE=api requires WHISPER_API_KEY or OPENAI_API_KEY")
+		}
+		transcriber = whisperAPIClient{
+			client: &http.Client{Timeout: whisperAPITimeout},
+			url:    whisperAPIURL,
+			apiKey: whisperAPIKey,
+			model:  whisperModel,
+		}
+	default:
+		log.Fatalf("Invalid WHISPER_MODE %q, must be off, local or api", whisperMode)
+	}
+	if transcriber != nil && !mediaToolsAvailable {
+		log.Fatal("WHISPER_MODE requires ffmpeg")
+	}
+	var whisperLanguage string
+	if raw := os.Getenv("WHISPER_LANGUAGE"); raw != "" {
+		tag, err := language.Parse(raw)
+		if err != nil {
+			log.Fatalf("Invalid WHISPER_LANGUAGE %q: %v", raw, err)
+		}
+		whisperLanguage = tag.String()
+	}
+	autoCaptionsByDefault := envBool("AUTO_CAPTIONS_BY_DEFAULT")
+	outputFormatName := os.Getenv("OUTPUT_FORMAT")
+	if outputFormatName == "" {
+		outputFormatName = "mp4"
+	}
+	outputFormat, ok := outputFormats[outputFormatName]
+	if !ok {
+		log.Fatalf("Invalid OUTPUT_FORMAT %q, must be one of %s", outputFormatName, outputFormatNames())
+	}
+	if outputFormat.reencodes() && !mediaToolsAvailable {
+		log.Fatal("OUTPUT_FORMAT " + outputFormatName + " requires ffmpeg")
+	}
+
+	if loudnormByDefault && !mediaToolsAvailable {
+		log.Fatal("NORMALIZE_AUDIO requires ffmpeg")
+	}
+
+	// WebP and AVIF thumbnails are read with ffmpeg. Without it they're
+	// only refused if they were asked for.
+	if !mediaToolsAvailable {
+		if os.Getenv("ALLOWED_THUMBNAIL_TYPES") == "" {
+			allowedThumbnailTypes = slices.DeleteFunc(allowedThumbnailTypes, func(mediaType string) bool {
+				return slices.Contains(ffmpegImageTypes, mediaType)
+			})
+		}
+		for _, mediaType := range allowedThumbnailTypes {
+			if slices.Contains(ffmpegImageTypes, mediaType) {
+				log.Fatalf("ALLOWED_THUMBNAIL_TYPES entry %q requires ffmpeg", mediaType)
+			}
+		}
+	}
+
+	thumbnailFormat := os.Getenv("THUMBNAIL_FORMAT")
+	if _, ok := thumbnailFormatExtensions[thumbnailFormat]; thumbnailFormat != "" && !ok {
+		log.Fatalf("Invalid THUMBNAIL_FORMAT %q, must be jpeg, png or webp", thumbnailFormat)
+	}
+	if thumbnailFormat == "webp" && !mediaToolsAvailable {
+		log.Fatal("THUMBNAIL_FORMAT=webp requires ffmpeg")
+	}
+	thumbnailQuality, err := envInt("THUMBNAIL_QUALITY", 85)
+	if err != nil || thumbnailQuality < 1 || thumbnailQuality > 100 {
+		log.Fatal("THUMBNAIL_QUALITY must be a number between 1 and 100")
+	}
+
+	s3MaxAttempts, err := envInt("S3_MAX_ATTEMPTS", 3)
+	if err != nil || s3MaxAttempts < 1 {
+		log.Fatal("S3_MAX_ATTEMPTS must be a positive number")
+	}
+	s3PartSizeMB, err := envInt("S3_PART_SIZE_MB", 16)
+	if err != nil || (s3PartSizeMB != 0 && int64(s3PartSizeMB)<<20 < minS3PartSize) {
+		log.Fatal("S3_PART_SIZE_MB must be at least 5, or 0 to upload every object in one request")
+	}
+	s3PartSize := int64(s3PartSizeMB) << 20
+
+	var store ObjectStore
+	var s3Client S3API
+	var presigner S3Presigner
+	if storageBackend == storageLocal {
+		// Local objects have plain MD5 ETags, never multipart ones
+		s3PartSize = 0
+	} else {
+		endpointOptions, err := s3EndpointOptions(storageBackend, os.Getenv("S3_ENDPOINT"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Load the default AWS SDK config
+		sdkConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatal("Failed to load default AWS SDK config")
+		}
+
+		// Create a client with the new config. Retries are handled by the
+		// object store, so the SDK only makes a single attempt per call.
+		client := s3.NewFromConfig(sdkConfig, endpointOptions, func(o *s3.Options) {
+			o.RetryMaxAttempts = 1
+		})
+		s3Client = client
+		presigner = s3.NewPresignClient(client)
+		store = newS3ObjectStore(client, presigner, s3Bucket, s3MaxAttempts, s3PartSize)
+	}
+
+	tusDir := os.Getenv("TUS_UPLOAD_DIR")
+	if tusDir == "" {
+		tusDir = filepath.Join(os.TempDir(), "tubely-tus")
+	}
+	tusUploadExpiry, err := envDuration("TUS_UPLOAD_EXPIRY", 24*time.Hour)
+	if err != nil || tusUploadExpiry <= 0 {
+		log.Fatal("TUS_UPLOAD_EXPIRY must be a positive duration")
+	}
+
+	jobWorkers, err := envInt("VIDEO_JOB_WORKERS", 2)
+	if err != nil || jobWorkers < 0 {
+		log.Fatal("VIDEO_JOB_WORKERS must be a non-negative number")
+	}
+	jobDir := os.Getenv("VIDEO_JOB_DIR")
+	if jobDir == "" {
+		jobDir = filepath.Join(os.TempDir(), "tubely-jobs")
+	}
+
+	idempotencyTTL, err := envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+	if err != nil || idempotencyTTL <= 0 {
+		log.Fatal("IDEMPOTENCY_KEY_TTL must be a positive duration")
+	}
+
+	rawAuthRateLimit := os.Getenv("RATE_LIMIT_AUTH")
+	if rawAuthRateLimit == "" {
+		rawAuthRateLimit = "10/1m"
+	}
+	authRateLimit, err := parseRateLimit(rawAuthRateLimit)
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_AUTH: %v", err)
+	}
+	rawUploadRateLimit := os.Getenv("RATE_LIMIT_UPLOAD")
+	if rawUploadRateLimit == "" {
+		rawUploadRateLimit = "60/1h"
+	}
+	uploadRateLimit, err := parseRateLimit(rawUploadRateLimit)
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_UPLOAD: %v", err)
+	}
+	var limiter rateLimiter = newMemoryRateLimiter()
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		client, err := newRedisClient(redisURL)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
+		}
+		limiter = &redisRateLimiter{client: client, prefix: "tubely:ratelimit:"}
+	}
+
+	storageClass, err := parseStorageClass(os.Getenv("S3_STORAGE_CLASS"))
+	if err != nil {
+		log.Fatalf("Invalid S3_STORAGE_CLASS: %v", err)
+	}
+
+	videoDelivery, err := parseVideoDelivery(os.Getenv("VIDEO_DELIVERY"))
+	if err != nil {
+		log.Fatalf("Invalid VIDEO_DELIVERY: %v", err)
+	}
+	// S3 won't sign for longer than a week
+	streamMode := os.Getenv("VIDEO_STREAM_MODE")
+	if streamMode == "" {
+		streamMode = streamModeProxy
+	}
+	if streamMode != streamModeProxy && streamMode != streamModeRedirect {
+		log.Fatalf("Invalid VIDEO_STREAM_MODE %q, must be proxy or redirect", streamMode)
+	}
+
+	videoURLExpiry, err := envDuration("VIDEO_URL_EXPIRY", time.Hour)
+	if err != nil || videoURLExpiry <= 0 || videoURLExpiry > 7*24*time.Hour {
+		log.Fatal("VIDEO_URL_EXPIRY must be a positive duration of at most 168h")
+	}
+	var cloudFront *cloudFrontSigner
+	if videoDelivery == videoDeliveryCloudFront {
+		keyPairID := os.Getenv("CLOUDFRONT_KEY_PAIR_ID")
+		keyPath := os.Getenv("CLOUDFRONT_PRIVATE_KEY_PATH")
+		if keyPairID == "" || keyPath == "" {
+			log.Fatal("CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_PATH must be set for cloudfront delivery")
+		}
+		keyData, err := os.ReadFile(keyPath)
+		if err != nil {
+			log.Fatalf("Couldn't read CLOUDFRONT_PRIVATE_KEY_PATH: %v", err)
+		}
+		key, err := parseCloudFrontKey(keyData)
+		if err != nil {
+			log.Fatalf("Invalid CloudFront private key: %v", err)
+		}
+		cloudFront = &cloudFrontSigner{keyPairID: keyPairID, key: key}
+	}
+
+	userBuckets, err := parseUserBuckets(envList("S3_USER_BUCKETS", nil))
+	if err != nil {
+		log.Fatalf("Invalid S3_USER_BUCKETS: %v", err)
+	}
+	if len(userBuckets) > 0 && storageBackend == storageLocal {
+		log.Fatal("S3_USER_BUCKETS can't be used with the local storage backend")
+	}
+	var bucketResolver BucketResolver
+	if len(userBuckets) > 0 {
+		bucketResolver = userBucketResolver(userBuckets)
+	}
 
 	cfg := apiConfig{
 		db:               db,
 		jwtSecret:        jwtSecret,
+		jwtLeeway:        jwtLeeway,
+		jwtScope:         jwtScope,
 		platform:         platform,
 		filepathRoot:     filepathRoot,
 		assetsRoot:       assetsRoot,
+		thumbnailStorage: thumbnailStorage,
 		s3Bucket:         s3Bucket,
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
-		s3Client:         s3Client,
+		publicBaseURL:    publicBaseURL,
+		assetsBaseURL:    assetsBaseURL,
+		store:            store,
+		uploadLocks:      newVideoLocks(),
+		progress:         newProgressTracker(),
+		trashRetention:   trashRetention,
+		orphanMinAge:     orphanMinAge,
+
+		bucketResolver: bucketResolver,
+		s3Client:       s3Client,
+		s3MaxAttempts:  s3MaxAttempts,
+		s3PartSize:     s3PartSize,
+		presigner:      presigner,
+		storageClass:   storageClass,
+
+		videoDelivery:  videoDelivery,
+		streamMode:     streamMode,
+		videoURLExpiry: videoURLExpiry,
+
+		cloudFront:             cloudFront,
+		cloudFrontCookieDomain: os.Getenv("CLOUDFRONT_COOKIE_DOMAIN"),
+
+		maxTitleLength:       maxTitleLength,
+		maxDescriptionLength: maxDescriptionLength,
+
+		allowedVideoTypes: allowedVideoTypes,
+		transcodeVideos:   transcodeVideos,
+		outputFormat:      outputFormat,
+		stripMetadata:     !strings.EqualFold(os.Getenv("STRIP_METADATA"), "false"),
+		adminAPIKey:       adminAPIKey,
+		verifyUploads:     verifyUploads,
+
+		allowedThumbnailTypes: allowedThumbnailTypes,
+
+		mediaToolsAvailable: mediaToolsAvailable,
+
+		watermarkImage:     watermarkImage,
+		watermarkPosition:  watermarkPosition,
+		watermarkOpacity:   watermarkOpacity,
+		watermarkByDefault: watermarkByDefault,
+
+		loudnormByDefault: loudnormByDefault,
+		loudnormMode:      loudnormMode,
+		loudnormTarget:    loudnormTarget,
+
+		transcriber:           transcriber,
+		whisperLanguage:       whisperLanguage,
+		autoCaptionsByDefault: autoCaptionsByDefault,
+
+		thumbnailFormat:  thumbnailFormat,
+		thumbnailQuality: thumbnailQuality,
+
+		previewClips:      previewClips,
+		previewClipLength: previewClipLength,
+		previewFormat:     previewFormat,
+
+		spriteSheets:   spriteSheets,
+		spriteInterval: spriteInterval,
+		spriteColumns:  spriteColumns,
+		spriteRows:     spriteRows,
+
+		hlsPackaging:  hlsPackaging,
+		hlsCaptions:   hlsCaptions,
+		mp4Renditions: mp4Renditions,
+
+		autoThumbnails: autoThumbnails,
+
+		dimensionLimits: dimensionLimits{
+			minDimension: minDimension,
+			maxDimension: maxDimension,
+			minAspect:    minAspect,
+			maxAspect:    maxAspect,
+		},
+		maxVideoDuration: maxVideoDuration,
+
+		trustedProxies: trustedProxies,
+		idempotencyTTL: idempotencyTTL,
+		remoteClient:   newRemoteFetchClient(30 * time.Second),
+		importClient:   newRemoteFetchClient(importTimeout),
+
+		platformDownloader: platformDownloader,
+
+		rateLimiter: limiter,
+		rateLimits: map[string]rateLimit{
+			"auth":   authRateLimit,
+			"upload": uploadRateLimit,
+		},
+
+		tusDir:          tusDir,
+		tusUploadExpiry: tusUploadExpiry,
+
+		jobWorkers: jobWorkers,
+		jobDir:     jobDir,
+		jobWake:    make(chan struct{}, 1),
+
+		webhookClient: newWebhookClient(),
+		webhookWake:   make(chan struct{}, 1),
+	}
+
+	if storageBackend == storageLocal {
+		localStorageDir := os.Getenv("LOCAL_STORAGE_DIR")
+		if localStorageDir == "" {
+			localStorageDir = "./storage"
+		}
+		if cfg.s3CfDistribution == "" {
+			cfg.s3CfDistribution = cfg.publicURL(context.Background(), localMediaPath)
+		}
+		cfg.store = newLocalObjectStore(localStorageDir, cfg.s3CfDistribution, []byte(jwtSecret))
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -107,33 +882,104 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: requestLogMiddleware(cfg.routes()),
+	}
+
+	go cfg.runTrashSweeper(context.Background(), cfg.trashRetention, trashSweepInterval)
+	if thumbnailCheckInterval > 0 {
+		go cfg.runThumbnailChecker(context.Background(), missingThumbnailAction, thumbnailCheckInterval)
+	}
+	if orphanGCInterval > 0 {
+		go cfg.runOrphanCollector(context.Background(), orphanGCInterval, cfg.orphanMinAge, envBool("ORPHAN_GC_DELETE"))
+	}
+	// Watermarked uploads are queued whatever jobWorkers says
+	go cfg.runVideoJobWorkers(context.Background(), max(jobWorkers, 1))
+	go cfg.runWebhookWorker(context.Background())
+	go cfg.runObjectCleaner(context.Background())
+
+	log.Printf("Serving on: %s\n", cfg.publicURL(context.Background(), "/app/"))
+	log.Fatal(srv.ListenAndServe())
+}
+
+// routes registers every handler on a new mux.
+func (cfg *apiConfig) routes() http.Handler {
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(cfg.filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
+	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(cfg.assetsRoot)))
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	if local, ok := cfg.store.(*localObjectStore); ok {
+		mux.Handle("GET "+localMediaPath+"/", http.StripPrefix(localMediaPath, local))
+	}
+
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
 
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	mux.HandleFunc("POST /api/login", cfg.rateLimited("auth", cfg.handlerLogin))
+	mux.HandleFunc("POST /api/refresh", cfg.rateLimited("auth", cfg.handlerRefresh))
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("POST /api/users", cfg.rateLimited("auth", cfg.handlerUsersCreate))
+	mux.HandleFunc("POST /api/api_keys", cfg.handlerAPIKeysCreate)
+	mux.HandleFunc("GET /api/api_keys", cfg.handlerAPIKeysList)
+	mux.HandleFunc("DELETE /api/api_keys/{keyID}", cfg.handlerAPIKeyDelete)
+
+	mux.HandleFunc("GET /api/watermark", cfg.handlerGetWatermark)
+	mux.HandleFunc("PUT /api/watermark", cfg.handlerSetWatermark)
+	mux.HandleFunc("DELETE /api/watermark", cfg.handlerDeleteWatermark)
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/webhooks", cfg.handlerWebhookCreate)
+	mux.HandleFunc("GET /api/webhooks", cfg.handlerWebhooksList)
+	mux.HandleFunc("DELETE /api/webhooks/{webhookID}", cfg.handlerWebhookDelete)
+	mux.HandleFunc("GET /api/webhooks/{webhookID}/deliveries", cfg.handlerWebhookDeliveries)
+
+	mux.HandleFunc("POST /api/videos", cfg.idempotent(cfg.handlerVideoMetaCreate))
+	// Uploads are limited where they first reach ffmpeg, so each counts
+	// once however it's sent. A retry replayed from its Idempotency-Key
+	// doesn't reach the limiter, so it gets its result even when the
+	// client has run out of uploads.
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.idempotent(cfg.rateLimited("upload", cfg.handlerUploadThumbnail)))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.idempotent(cfg.rateLimited("upload", cfg.handlerUploadVideo)))
+	mux.HandleFunc("POST /api/videos/{videoID}/upload_url", cfg.handlerCreatePresignedUpload)
+	mux.HandleFunc("POST /api/videos/{videoID}/finalize_upload", cfg.idempotent(cfg.rateLimited("upload", cfg.handlerFinalizeUpload)))
+	mux.HandleFunc("POST /api/videos/{videoID}/import", cfg.idempotent(cfg.rateLimited("upload", cfg.handlerImportVideo)))
+	mux.HandleFunc("OPTIONS "+tusUploadsPath, cfg.handlerTusOptions)
+	mux.HandleFunc("POST "+tusUploadsPath, cfg.rateLimited("upload", cfg.handlerTusCreate))
+	mux.HandleFunc("HEAD "+tusUploadsPath+"/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH "+tusUploadsPath+"/{uploadID}", cfg.handlerTusPatch)
+	mux.HandleFunc("DELETE "+tusUploadsPath+"/{uploadID}", cfg.handlerTusDelete)
+	mux.HandleFunc("GET /api/jobs/{jobID}", cfg.handlerGetVideoJob)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/videos/summary", cfg.handlerLibrarySummary)
+	mux.HandleFunc("GET /api/videos/public", cfg.handlerPublicVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
+	mux.HandleFunc("GET /api/videos/{videoID}/status", cfg.handlerVideoStatus)
+	mux.HandleFunc("POST /api/videos/{videoID}/playback_cookies", cfg.handlerPlaybackCookies)
+	mux.HandleFunc("GET /api/videos/{videoID}/download", cfg.handlerDownloadVideo)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.handlerStreamVideo)
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
+	mux.HandleFunc("GET /api/videos/{videoID}/storyboard.vtt", cfg.handlerStoryboardVTT)
+	mux.HandleFunc("GET /api/videos/{videoID}/verify", cfg.handlerVerifyVideo)
+	mux.HandleFunc("GET /api/videos/{videoID}/object", cfg.handlerVideoObjectInfo)
+	mux.HandleFunc("PATCH /api/videos/{videoID}/thumbnail", cfg.idempotent(cfg.rateLimited("upload", cfg.handlerThumbnailFromURL)))
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail_frame", cfg.idempotent(cfg.rateLimited("upload", cfg.handlerThumbnailFromFrame)))
+	mux.HandleFunc("POST /api/videos/{videoID}/captions", cfg.handlerUploadCaptions)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/captions/{language}", cfg.handlerDeleteCaptions)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/restore", cfg.handlerRestoreVideo)
+	mux.HandleFunc("DELETE /api/videos/trash", cfg.handlerEmptyTrash)
+	mux.HandleFunc("POST /api/videos/{videoID}/duplicate", cfg.handlerDuplicateVideo)
+	mux.HandleFunc("POST /api/videos/{videoID}/clips", cfg.idempotent(cfg.rateLimited("upload", cfg.handlerCreateClip)))
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/reconcile_storage", cfg.handlerReconcileStorage)
+	mux.HandleFunc("POST /admin/backfill_video_info", cfg.handlerBackfillVideoInfo)
+	mux.HandleFunc("POST /admin/resign_videos", cfg.handlerResignVideos)
+	mux.HandleFunc("POST /admin/migrate_thumbnails", cfg.handlerMigrateThumbnails)
 
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
-	}
-
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	return cfg.forwardedBaseURLMiddleware(mux)
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// errMediaToolsBusy is returned when no ffmpeg slot frees up in time.
+var errMediaToolsBusy = errors.New("too many ffmpeg jobs running")
+
+// mediaToolRetryAfter is what busy responses tell clients to wait, in
+// seconds.
+const mediaToolRetryAfter = 10
+
+// mediaToolLimiter bounds how many ffmpeg/ffprobe processes run at once so
+// a burst of uploads can't starve the machine.
+type mediaToolLimiter struct {
+	slots *semaphore.Weighted
+	wait  time.Duration
+}
+
+// mediaTools is shared by every runMediaTool call. main resizes it from the
+// config before serving.
+var mediaTools = newMediaToolLimiter(runtime.NumCPU(), 30*time.Second)
+
+func newMediaToolLimiter(concurrency int, wait time.Duration) *mediaToolLimiter {
+	return &mediaToolLimiter{
+		slots: semaphore.NewWeighted(int64(concurrency)),
+		wait:  wait,
+	}
+}
+
+// acquire blocks until a slot is free, ctx is done, or the limiter's wait
+// runs out. The returned func releases the slot.
+func (l *mediaToolLimiter) acquire(ctx context.Context) (func(), error) {
+	waitCtx, cancel := context.WithTimeout(ctx, l.wait)
+	defer cancel()
+
+	err := l.slots.Acquire(waitCtx, 1)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errMediaToolsBusy
+	}
+	return func() { l.slots.Release(1) }, nil
+}
+
+// respondWithMediaToolError reports a failed ffmpeg step, telling the
+// client to retry later if it only failed because the server was busy.
+func respondWithMediaToolError(w http.ResponseWriter, msg string, err error) {
+	if errors.Is(err, errMediaToolsBusy) {
+		w.Header().Set("Retry-After", strconv.Itoa(mediaToolRetryAfter))
+		respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeFFmpegBusy, "Server is busy processing other videos, try again later", err)
+		return
+	}
+	if errors.Is(err, errMediaToolTimedOut) {
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeFFmpegTimeout, msg+": the video took too long to process", err)
+		return
+	}
+	respondWithErrorCode(w, http.StatusInternalServerError, errCodeFFmpegFailed, msg, err)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMediaToolLimiterTimesOutWhenSaturated(t *testing.T) {
+	limiter := newMediaToolLimiter(1, 20*time.Millisecond)
+
+	release, err := limiter.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	if _, err := limiter.acquire(context.Background()); !errors.Is(err, errMediaToolsBusy) {
+		t.Fatalf("expected errMediaToolsBusy, got %v", err)
+	}
+
+	release()
+	release, err = limiter.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	release()
+}
+
+func TestMediaToolLimiterCancelledContext(t *testing.T) {
+	limiter := newMediaToolLimiter(1, time.Minute)
+	release, _ := limiter.acquire(context.Background())
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRunMediaToolBusy(t *testing.T) {
+	saved := mediaTools
+	t.Cleanup(func() { mediaTools = saved })
+	mediaTools = newMediaToolLimiter(1, 20*time.Millisecond)
+
+	release, _ := mediaTools.acquire(context.Background())
+	defer release()
+
+	if _, err := runMediaTool(context.Background(), "true"); !errors.Is(err, errMediaToolsBusy) {
+		t.Fatalf("expected errMediaToolsBusy, got %v", err)
+	}
+}
+
+func TestRespondWithMediaToolErrorBusy(t *testing.T) {
+	rec := httptest.NewRecorder()
+	respondWithMediaToolError(rec, "Error probing video file", errMediaToolsBusy)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if code := errorCode(t, rec.Result()); code != errCodeFFmpegBusy {
+		t.Errorf("expected %s, got %s", errCodeFFmpegBusy, code)
+	}
+}
+
+func TestRunMediaToolTimeout(t *testing.T) {
+	saved := mediaToolTimeout
+	t.Cleanup(func() { mediaToolTimeout = saved })
+	mediaToolTimeout = 100 * time.Millisecond
+
+	// The background sleep holds the output open, so this only returns
+	// quickly if the whole process group is killed
+	start := time.Now()
+	_, err := runMediaTool(context.Background(), "sh", "-c", "sleep 10 & wait")
+	if !errors.Is(err, errMediaToolTimedOut) {
+		t.Fatalf("expected errMediaToolTimedOut, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("took %s to stop", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	mediaToolTimeout = time.Minute
+	if _, err := runMediaTool(ctx, "sh", "-c", "sleep 10 & wait"); !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errMediaToolTimedOut) {
+		t.Fatalf("expected the caller's deadline, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	respondWithMediaToolError(rec, "Error probing video file", fmt.Errorf("%w: ffprobe", errMediaToolTimedOut))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rec.Code)
+	}
+	if code := errorCode(t, rec.Result()); code != errCodeFFmpegTimeout {
+		t.Errorf("expected %s, got %s", errCodeFFmpegTimeout, code)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// startInProcessGroup is a no-op where process groups aren't available.
+func startInProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills cmd itself where process groups aren't
+// available.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// isoBMFFBoxTypes are the box types an MP4-family file can plausibly start
+// with. Fragmented and DASH files often open with styp or a bare moof.
+var isoBMFFBoxTypes = []string{"ftyp", "styp", "moov", "moof", "sidx", "free", "skip", "wide", "mdat", "pdin"}
+
+// looksLikeISOBMFF reports whether header starts with a well-formed ISO base
+// media box, the structure MP4 and its relatives share.
+func looksLikeISOBMFF(header []byte) bool {
+	if len(header) < 8 {
+		return false
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size != 0 && size != 1 && size < 8 {
+		return false
+	}
+	return slices.Contains(isoBMFFBoxTypes, string(header[4:8]))
+}
+
+// mp4Candidate reports whether a file the sniffer couldn't place might still
+// be an MP4 with an unusual brand, worth asking ffprobe about.
+func (cfg *apiConfig) mp4Candidate(sniffed string, header []byte) bool {
+	return sniffed == "application/octet-stream" && cfg.mediaToolsAvailable && looksLikeISOBMFF(header)
+}
+
+// confirmVideoType returns the type to treat an upload at path as. When
+// sniffing came up empty for what looks like an MP4, ffprobe gets the final
+// say, so fragmented files and unusual ftyp brands aren't turned away.
+func (cfg *apiConfig) confirmVideoType(ctx context.Context, path, sniffed string) (string, error) {
+	if sniffed != "application/octet-stream" || !cfg.mediaToolsAvailable {
+		return sniffed, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	header := make([]byte, 8)
+	_, err = io.ReadFull(f, header)
+	f.Close()
+	if err != nil || !cfg.mp4Candidate(sniffed, header) {
+		return sniffed, nil
+	}
+
+	playable, err := isPlayableMP4(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if playable {
+		return "video/mp4", nil
+	}
+	return sniffed, nil
+}
+
+// isPlayableMP4 asks ffprobe whether a file is an MP4-family container with
+// at least one video stream. Files ffprobe can't read at all aren't an
+// error, just not playable.
+func isPlayableMP4(ctx context.Context, path string) (bool, error) {
+	output, err := runMediaTool(ctx, "ffprobe", "-v", "error",
+		"-show_entries", "format=format_name:stream=codec_type", "-of", "json", path)
+	if err != nil {
+		if errors.Is(err, errMediaToolsBusy) || errors.Is(err, errMediaToolsMissing) || ctx.Err() != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	var probe struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return false, nil
+	}
+	if !slices.Contains(strings.Split(probe.Format.FormatName, ","), "mp4") {
+		return false, nil
+	}
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
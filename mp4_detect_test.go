@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// ftypHeader builds an ftyp box with the given major and compatible brands,
+// padded the way the sniffer sees the start of a real file.
+func ftypHeader(major string, compatible ...string) []byte {
+	size := 16 + 4*len(compatible)
+	box := []byte{0, 0, 0, byte(size)}
+	box = append(box, "ftyp"...)
+	box = append(box, major...)
+	box = append(box, 0, 0, 0, 0)
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	return append(box, make([]byte, 64)...)
+}
+
+func TestUnusualMP4BrandsAreCandidates(t *testing.T) {
+	cfg := &apiConfig{mediaToolsAvailable: true}
+
+	fixtures := map[string][]byte{
+		"dash":      ftypHeader("dash", "iso6", "avc1"),
+		"iso5":      ftypHeader("iso5", "iso6", "msdh"),
+		"msnv":      ftypHeader("msnv", "msnv"),
+		"styp":      append([]byte("\x00\x00\x00\x18stypmsdh\x00\x00\x00\x00msdhmsix"), make([]byte, 64)...),
+		"bare moof": append([]byte("\x00\x00\x00\x10moof\x00\x00\x00\x08mfhd"), make([]byte, 64)...),
+	}
+	for name, header := range fixtures {
+		t.Run(name, func(t *testing.T) {
+			sniffed := detectVideoType(header)
+			if sniffed != "application/octet-stream" {
+				t.Skipf("sniffed as %s, no fallback needed", sniffed)
+			}
+			if !cfg.mp4Candidate(sniffed, header) {
+				t.Fatal("expected the file to be checked with ffprobe")
+			}
+		})
+	}
+}
+
+func TestNonVideoIsNotACandidate(t *testing.T) {
+	cfg := &apiConfig{mediaToolsAvailable: true}
+
+	fixtures := map[string][]byte{
+		"text":       []byte("definitely not a video, just some plain text"),
+		"zeros":      make([]byte, 64),
+		"short":      []byte("ftyp"),
+		"bad size":   append([]byte("\x00\x00\x00\x04ftypisom"), make([]byte, 64)...),
+		"random box": append([]byte("\x00\x00\x00\x10abcd"), make([]byte, 64)...),
+	}
+	for name, header := range fixtures {
+		t.Run(name, func(t *testing.T) {
+			if cfg.mp4Candidate(detectVideoType(header), header) {
+				t.Fatal("expected no ffprobe fallback")
+			}
+		})
+	}
+
+	withoutTools := &apiConfig{}
+	header := ftypHeader("dash", "iso6")
+	if withoutTools.mp4Candidate(detectVideoType(header), header) {
+		t.Fatal("expected no fallback without ffprobe")
+	}
+}
+
+func TestConfirmVideoTypeFragmentedMP4(t *testing.T) {
+	fixture := makeTestMP4(t, 320, 240)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.mp4")
+	if err := os.WriteFile(src, fixture, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remux as fragmented MP4 with a DASH brand the sniffer doesn't know
+	fragmented := filepath.Join(dir, "fragmented.mp4")
+	cmd := exec.Command("ffmpeg", "-v", "error", "-i", src, "-c", "copy",
+		"-movflags", "frag_keyframe+empty_moov", "-brand", "dash", "-f", "mp4", fragmented)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("couldn't fragment fixture: %v: %s", err, output)
+	}
+
+	cfg := &apiConfig{mediaToolsAvailable: true}
+	got, err := cfg.confirmVideoType(context.Background(), fragmented, "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "video/mp4" {
+		t.Fatalf("expected video/mp4, got %s", got)
+	}
+}
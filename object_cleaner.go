@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	// objectCleanerInterval is how often the cleaner looks for queued
+	// deletions.
+	objectCleanerInterval = time.Minute
+	// maxObjectDeletionBackoff caps how long a deletion that keeps failing
+	// waits between attempts.
+	maxObjectDeletionBackoff = 6 * time.Hour
+)
+
+// replacedObjects lists what a video stores for its current upload: the
+// video itself, its preview clip, sprite sheet, HLS renditions and MP4
+// renditions. Once the video points at a new upload they're queued for
+// deletion.
+func (cfg *apiConfig) replacedObjects(video database.Video) ([]database.ObjectDeletion, error) {
+	var bucket string
+	if video.VideoBucket != nil {
+		bucket = *video.VideoBucket
+	}
+	var deletions []database.ObjectDeletion
+	add := func(key string, prefix bool) {
+		deletions = append(deletions, database.ObjectDeletion{Bucket: bucket, Key: key, Prefix: prefix})
+	}
+
+	if video.VideoURL != nil {
+		key, ok := cfg.videoKey(video)
+		if !ok {
+			return nil, errors.New("invalid video URL format")
+		}
+		add(key, false)
+	}
+	urls := spriteURLs(video)
+	if video.PreviewURL != nil {
+		urls = append(urls, *video.PreviewURL)
+	}
+	for _, u := range urls {
+		if key, ok := cfg.videoKeyFromURL(u); ok {
+			add(key, false)
+		}
+	}
+	if video.HLSURL != nil {
+		if key, ok := cfg.videoKeyFromURL(*video.HLSURL); ok {
+			add(path.Dir(key)+"/", true)
+		}
+	}
+	for _, r := range video.Renditions {
+		add(r.Key, false)
+	}
+	return deletions, nil
+}
+
+// cleanObjects carries out every queued deletion that's due. One that
+// fails is retried later, backing off each time.
+func (cfg *apiConfig) cleanObjects(ctx context.Context) {
+	const batchSize = 100
+	for ctx.Err() == nil {
+		due, err := cfg.db.GetDueObjectDeletions(time.Now(), batchSize)
+		if err != nil {
+			slog.Error("couldn't get queued object deletions", "err", err)
+			return
+		}
+
+		for _, d := range due {
+			err := cfg.deleteQueuedObject(ctx, d)
+			if err == nil {
+				err = cfg.db.DeleteObjectDeletion(d.ID)
+				if err != nil {
+					slog.Error("couldn't dequeue object deletion", "key", d.Key, "err", err)
+					return
+				}
+				continue
+			}
+			backoff := min(time.Minute<<min(d.Attempts, 16), maxObjectDeletionBackoff)
+			slog.Warn("couldn't delete replaced object", "bucket", d.Bucket, "key", d.Key, "attempts", d.Attempts+1, "err", err)
+			err = cfg.db.RecordObjectDeletionFailure(d.ID, time.Now().Add(backoff), err.Error())
+			if err != nil {
+				slog.Error("couldn't record failed object deletion", "key", d.Key, "err", err)
+				return
+			}
+		}
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+// deleteQueuedObject deletes the object, or objects, a queued deletion
+// names. Ones that are already gone are fine.
+func (cfg *apiConfig) deleteQueuedObject(ctx context.Context, d database.ObjectDeletion) error {
+	store := cfg.storeForBucket(d.Bucket)
+	if d.Prefix {
+		return cfg.deleteHLSPrefix(ctx, store, d.Key)
+	}
+	err := store.Delete(ctx, d.Key)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("couldn't delete %s: %w", d.Key, err)
+	}
+	return nil
+}
+
+// runObjectCleaner deletes queued objects every objectCleanerInterval until
+// ctx is cancelled.
+func (cfg *apiConfig) runObjectCleaner(ctx context.Context) {
+	ticker := time.NewTicker(objectCleanerInterval)
+	defer ticker.Stop()
+	for {
+		cfg.cleanObjects(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
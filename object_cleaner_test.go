@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReplacedObjectsDeletedAfterUpdate(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("cleaner@example.com")
+	path := "/api/video_upload/" + video.ID.String()
+
+	if resp := h.upload(path, token, "video", "first.mp4", minimalMP4); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first upload: expected 200, got %d", resp.StatusCode)
+	}
+	first := h.getVideo(video.ID)
+	oldKey := *first.VideoKey
+
+	// Give the first upload a preview and HLS renditions to replace
+	previewURL := h.cfg.s3CfDistribution + "/previews/old.mp4"
+	hlsURL := h.cfg.s3CfDistribution + "/hls/old/master.m3u8"
+	first.PreviewURL, first.HLSURL = &previewURL, &hlsURL
+	if err := h.cfg.db.UpdateVideo(first); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"previews/old.mp4", "hls/old/master.m3u8", "hls/old/720p.m3u8"} {
+		h.s3.objects[key] = []byte("old")
+	}
+
+	// A trailing free box makes it a different file
+	second := append(bytes.Clone(minimalMP4), 0, 0, 0, 8, 'f', 'r', 'e', 'e')
+	if resp := h.upload(path, token, "video", "second.mp4", second); resp.StatusCode != http.StatusOK {
+		t.Fatalf("second upload: expected 200, got %d", resp.StatusCode)
+	}
+	stored := h.getVideo(video.ID)
+	if *stored.VideoKey == oldKey || stored.PreviewURL != nil || stored.HLSURL != nil {
+		t.Fatalf("after replacing: key %s, preview %v, hls %v", *stored.VideoKey, stored.PreviewURL, stored.HLSURL)
+	}
+	if _, ok := h.s3.objects[oldKey]; !ok {
+		t.Fatal("old video was deleted before the cleaner ran")
+	}
+
+	h.cfg.cleanObjects(context.Background())
+	if keys := h.s3.keys(); len(keys) != 1 || keys[0] != *stored.VideoKey {
+		t.Errorf("objects after cleaning = %v, want only %s", keys, *stored.VideoKey)
+	}
+	if due, err := h.cfg.db.GetDueObjectDeletions(time.Now().Add(24*time.Hour), 10); err != nil || len(due) != 0 {
+		t.Errorf("still queued: %+v, %v", due, err)
+	}
+}
+
+func TestObjectCleanerRetries(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("cleaner-retry@example.com")
+	path := "/api/video_upload/" + video.ID.String()
+	h.upload(path, token, "video", "first.mp4", minimalMP4)
+	h.upload(path, token, "video", "second.mp4", append(bytes.Clone(minimalMP4), 0, 0, 0, 8, 'f', 'r', 'e', 'e'))
+
+	h.s3.deleteErr = errors.New("access denied")
+	h.cfg.cleanObjects(context.Background())
+	if due, _ := h.cfg.db.GetDueObjectDeletions(time.Now(), 10); len(due) != 0 {
+		t.Fatalf("a failed deletion should wait before it's retried, got %+v", due)
+	}
+	due, err := h.cfg.db.GetDueObjectDeletions(time.Now().Add(2*time.Minute), 10)
+	if err != nil || len(due) != 1 || due[0].Attempts != 1 || due[0].Error == "" {
+		t.Fatalf("after a failed attempt: %+v, %v", due, err)
+	}
+	if len(h.s3.keys()) != 2 {
+		t.Errorf("expected both uploads to still be stored, got %v", h.s3.keys())
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrObjectNotFound is returned by an ObjectStore when the key doesn't exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectStore is where uploaded videos are kept. Handlers only talk to this
+// interface so the backend can be swapped out: S3 or an S3-compatible
+// service, local disk for self-hosting and development, fakes in tests.
+type ObjectStore interface {
+	// Put stores body under key. An empty storageClass uses the backend's
+	// default.
+	Put(ctx context.Context, key string, body io.Reader, contentType, storageClass string) (ObjectInfo, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// GetRange reads length bytes of key starting at offset, which must
+	// lie within the object.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Copy duplicates srcKey under dstKey without the data leaving the
+	// backend.
+	Copy(ctx context.Context, srcKey, dstKey, storageClass string) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// SignedURL returns a URL anyone can GET key from until expiry passes.
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+	// Check reports whether the backend can be reached, for readiness
+	// probes.
+	Check(ctx context.Context) error
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	StorageClass string
+	LastModified time.Time
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoKeyPrefixes are the top-level prefixes video objects are stored under.
+var videoKeyPrefixes = []string{"landscape/", "portrait/", "other/"}
+
+// storedKeyPrefixes are all the top-level prefixes the app stores objects
+// under in a video bucket: the videos, with their HLS and MP4 renditions
+// in a directory next to them, preview clips, sprite sheets and direct
+// uploads waiting to be finalized. Thumbnails and captions are only ever
+// kept in the default bucket.
+var storedKeyPrefixes = slices.Concat(videoKeyPrefixes, []string{"previews/", "sprites/", "uploads/"})
+
+// orphanedObject is a stored object no video refers to.
+type orphanedObject struct {
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// orphanReport is what a pass of the orphan collector found and did.
+type orphanReport struct {
+	DryRun  bool             `json:"dry_run"`
+	Scanned int              `json:"scanned"`
+	Orphans []orphanedObject `json:"orphans"`
+	Bytes   int64            `json:"bytes"`
+	Deleted int              `json:"deleted"`
+	Errors  []string         `json:"errors,omitempty"`
+}
+
+// storedReferences are the objects the database points at, by bucket.
+// Everything under a referenced directory, like a video's HLS and MP4
+// renditions, belongs to it too.
+type storedReferences struct {
+	keys map[string]map[string]bool
+	dirs map[string]map[string]bool
+}
+
+func (refs storedReferences) add(bucket, key string) {
+	if refs.keys[bucket] == nil {
+		refs.keys[bucket] = map[string]bool{}
+	}
+	refs.keys[bucket][key] = true
+}
+
+func (refs storedReferences) addDir(bucket, dir string) {
+	if refs.dirs[bucket] == nil {
+		refs.dirs[bucket] = map[string]bool{}
+	}
+	refs.dirs[bucket][dir] = true
+}
+
+func (refs storedReferences) has(bucket, key string) bool {
+	if refs.keys[bucket][key] {
+		return true
+	}
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if refs.dirs[bucket][dir+"/"] {
+			return true
+		}
+	}
+	return false
+}
+
+// storedReferences collects every object key the database refers to.
+func (cfg *apiConfig) storedReferences(videos []database.Video) storedReferences {
+	refs := storedReferences{keys: map[string]map[string]bool{}, dirs: map[string]map[string]bool{}}
+	for _, video := range videos {
+		bucket := cfg.s3Bucket
+		if video.VideoBucket != nil && *video.VideoBucket != "" {
+			bucket = *video.VideoBucket
+		}
+		if key, ok := cfg.videoKey(video); ok {
+			refs.add(bucket, key)
+			refs.addDir(bucket, strings.TrimSuffix(key, path.Ext(key))+"/")
+		}
+		urls := spriteURLs(video)
+		if video.PreviewURL != nil {
+			urls = append(urls, *video.PreviewURL)
+		}
+		for _, u := range urls {
+			if key, ok := cfg.videoKeyFromURL(u); ok {
+				refs.add(bucket, key)
+			}
+		}
+		for _, r := range video.Renditions {
+			refs.add(bucket, r.Key)
+		}
+		// Direct uploads are staged in the bucket the user's uploads go to
+		if video.PendingUploadKey != nil {
+			refs.add(cfg.resolveBucket(video.UserID), *video.PendingUploadKey)
+		}
+		if video.ThumbnailURL != nil {
+			if key, ok := cfg.thumbnailKey(*video.ThumbnailURL); ok {
+				refs.add(cfg.s3Bucket, key)
+			}
+		}
+		for _, variant := range video.ThumbnailVariants {
+			if key, ok := cfg.thumbnailKey(variant.URL); ok {
+				refs.add(cfg.s3Bucket, key)
+			}
+		}
+		for _, track := range video.Captions {
+			if track.Key != "" {
+				refs.add(cfg.s3Bucket, track.Key)
+			}
+		}
+	}
+	return refs
+}
+
+// collectOrphans finds objects in every bucket videos are stored in that no
+// video refers to, and deletes them unless dryRun is set. Objects newer
+// than minAge are left alone: an upload in progress stores its object
+// before the video is saved.
+func (cfg *apiConfig) collectOrphans(ctx context.Context, dryRun bool, minAge time.Duration) (orphanReport, error) {
+	report := orphanReport{DryRun: dryRun, Orphans: []orphanedObject{}}
+
+	videos, err := cfg.db.GetVideosWithStoredObjects()
+	if err != nil {
+		return report, fmt.Errorf("couldn't retrieve videos: %w", err)
+	}
+	refs := cfg.storedReferences(videos)
+
+	buckets := map[string]bool{cfg.s3Bucket: true}
+	for _, video := range videos {
+		if video.VideoBucket != nil && *video.VideoBucket != "" {
+			buckets[*video.VideoBucket] = true
+		}
+	}
+	names := make([]string, 0, len(buckets))
+	for bucket := range buckets {
+		names = append(names, bucket)
+	}
+	sort.Strings(names)
+
+	cutoff := time.Now().Add(-minAge)
+	for _, bucket := range names {
+		store := cfg.storeForBucket(bucket)
+		prefixes := storedKeyPrefixes
+		if bucket == cfg.s3Bucket {
+			prefixes = slices.Concat(prefixes, []string{captionKeyPrefix})
+			if cfg.thumbnailStorage == thumbnailStorageS3 {
+				prefixes = append(prefixes, thumbnailKeyPrefix)
+			}
+		}
+		for _, prefix := range prefixes {
+			objects, err := store.List(ctx, prefix)
+			if err != nil {
+				return report, fmt.Errorf("couldn't list %s in %s: %w", prefix, bucket, err)
+			}
+			report.Scanned += len(objects)
+
+			for _, obj := range objects {
+				if refs.has(bucket, obj.Key) || obj.LastModified.After(cutoff) {
+					continue
+				}
+				report.Orphans = append(report.Orphans, orphanedObject{Bucket: bucket, Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified})
+				report.Bytes += obj.Size
+				if dryRun {
+					continue
+				}
+				err := store.Delete(ctx, obj.Key)
+				if err != nil && !errors.Is(err, ErrObjectNotFound) {
+					report.Errors = append(report.Errors, bucket+"/"+obj.Key+": "+err.Error())
+					continue
+				}
+				report.Deleted++
+			}
+		}
+	}
+	return report, nil
+}
+
+// runOrphanCollector looks for orphaned objects every interval until ctx is
+// cancelled, deleting them if del is set and otherwise only logging them.
+func (cfg *apiConfig) runOrphanCollector(ctx context.Context, interval, minAge time.Duration, del bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := cfg.collectOrphans(ctx, !del, minAge)
+		if err != nil {
+			slog.Error("orphaned object collection failed", "err", err)
+			continue
+		}
+		if len(report.Orphans) == 0 {
+			continue
+		}
+		if !del {
+			slog.Warn("found orphaned objects", "count", len(report.Orphans), "bytes", report.Bytes)
+			continue
+		}
+		slog.Info("deleted orphaned objects", "count", report.Deleted, "bytes", report.Bytes, "errors", len(report.Errors))
+	}
+}
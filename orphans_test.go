@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReconcileStorageCollectsOrphans(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.adminAPIKey = "admin-key"
+	token, video := h.createUserAndVideo("orphans@example.com")
+	if resp := h.upload("/api/video_upload/"+video.ID.String(), token, "video", "clip.mp4", minimalMP4); resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: expected 200, got %d", resp.StatusCode)
+	}
+	stored := h.getVideo(video.ID)
+	videoKey := *stored.VideoKey
+	previewURL := h.cfg.s3CfDistribution + "/previews/kept.mp4"
+	stored.PreviewURL = &previewURL
+	if err := h.cfg.db.UpdateVideo(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects added straight to the fake are old; ones put are new
+	hlsKey := strings.TrimSuffix(videoKey, ".mp4") + "/hls/720p.m3u8"
+	kept := []string{videoKey, "previews/kept.mp4", hlsKey}
+	orphans := []string{"landscape/lost.mp4", "previews/lost.mp4", "uploads/abandoned"}
+	for _, key := range append(kept[1:], orphans...) {
+		h.s3.objects[key] = []byte("x")
+	}
+	if _, err := h.cfg.store.Put(context.Background(), "other/recent.mp4", bytes.NewReader([]byte("x")), "video/mp4", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	reconcile := func(query string) orphanReport {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/reconcile_storage"+query, nil)
+		req.Header.Set("Authorization", "ApiKey admin-key")
+		resp := h.send(req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("reconcile%s: expected 200, got %d", query, resp.StatusCode)
+		}
+		var report orphanReport
+		decodeJSON(t, resp, &report)
+		return report
+	}
+	keys := func(report orphanReport) []string {
+		var keys []string
+		for _, orphan := range report.Orphans {
+			keys = append(keys, orphan.Key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	sort.Strings(orphans)
+
+	report := reconcile("")
+	if !report.DryRun || report.Deleted != 0 || strings.Join(keys(report), ",") != strings.Join(orphans, ",") {
+		t.Fatalf("dry run = %+v", report)
+	}
+	if len(h.s3.keys()) != len(kept)+len(orphans)+1 {
+		t.Fatalf("a dry run deleted objects: %v", h.s3.keys())
+	}
+
+	if report := reconcile("?confirm=true"); report.Deleted != len(orphans) {
+		t.Fatalf("confirmed = %+v", report)
+	}
+	// The recent object could be an upload still in progress
+	if report := reconcile("?confirm=true&min_age=0s"); report.Deleted != 1 || report.Orphans[0].Key != "other/recent.mp4" {
+		t.Fatalf("with no minimum age = %+v", report)
+	}
+	got := h.s3.keys()
+	sort.Strings(got)
+	sort.Strings(kept)
+	if strings.Join(got, ",") != strings.Join(kept, ",") {
+		t.Errorf("objects left = %v, want %v", got, kept)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outputFormat is the container and codecs uploads are stored in.
+type outputFormat struct {
+	container   string // ffmpeg's -f name
+	extension   string
+	contentType string
+
+	// videoCodec and audioCodec are ffmpeg encoder names. When videoCodec
+	// is empty the streams are copied as-is instead of re-encoded.
+	videoCodec string
+	audioCodec string
+	codecArgs  []string
+}
+
+// outputFormats are the choices for OUTPUT_FORMAT. The default, mp4, keeps
+// the uploaded streams and only moves the moov atom to the front.
+var outputFormats = map[string]outputFormat{
+	"mp4": {container: "mp4", extension: ".mp4", contentType: "video/mp4"},
+	"mp4-h264": {
+		container: "mp4", extension: ".mp4", contentType: "video/mp4",
+		videoCodec: "libx264", audioCodec: "aac",
+		codecArgs: []string{"-crf", "23", "-preset", "medium", "-pix_fmt", "yuv420p"},
+	},
+	"mp4-av1": {
+		container: "mp4", extension: ".mp4", contentType: "video/mp4",
+		videoCodec: "libsvtav1", audioCodec: "aac",
+		codecArgs: []string{"-crf", "35", "-preset", "8"},
+	},
+	"webm-vp9": {
+		container: "webm", extension: ".webm", contentType: "video/webm",
+		videoCodec: "libvpx-vp9", audioCodec: "libopus",
+		// Constant quality mode needs the bitrate cap turned off
+		codecArgs: []string{"-crf", "32", "-b:v", "0", "-row-mt", "1"},
+	},
+	"webm-av1": {
+		container: "webm", extension: ".webm", contentType: "video/webm",
+		videoCodec: "libsvtav1", audioCodec: "libopus",
+		codecArgs: []string{"-crf", "35", "-preset", "8"},
+	},
+}
+
+var defaultOutputFormat = outputFormats["mp4"]
+
+// outputFormatNames lists the OUTPUT_FORMAT values, for error messages.
+func outputFormatNames() string {
+	names := make([]string, 0, len(outputFormats))
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// reencodes reports whether storing in this format means re-encoding,
+// rather than just remuxing.
+func (f outputFormat) reencodes() bool {
+	return f.videoCodec != ""
+}
+
+// ffmpegArgs builds the ffmpeg command line converting input to output,
+// with extra output options added before the format.
+func (f outputFormat) ffmpegArgs(input, output string, extra ...string) []string {
+	args := []string{"-i", input}
+	if f.reencodes() {
+		args = append(args, "-c:v", f.videoCodec, "-c:a", f.audioCodec)
+		args = append(args, f.codecArgs...)
+	} else {
+		args = append(args, "-c", "copy")
+	}
+	// Only MP4 has a moov atom to move; WebM puts its cues up front anyway
+	if f.container == "mp4" {
+		args = append(args, "-movflags", "faststart")
+	}
+	args = append(args, extra...)
+	return append(args, "-f", f.container, output)
+}
+
+// stripMetadataArgs are the ffmpeg options that drop container and stream
+// metadata, like GPS position, device model and creation time, from the
+// output. Rotation is side data and survives, but ffmpeg before 6.0 only
+// writes it back from the rotate tag, so that's restored when the streams
+// are copied. Re-encoding applies the rotation to the frames instead.
+func (f outputFormat) stripMetadataArgs(rotation int) []string {
+	args := []string{"-map_metadata", "-1"}
+	if rotation != 0 && !f.reencodes() {
+		args = append(args, "-metadata:s:v:0", "rotate="+strconv.Itoa(rotation))
+	}
+	return args
+}
+
+// transcodeVideo writes filePath in format f and returns the new file's
+// path. For the default format this is a quick remux that makes the MP4
+// fast-start; other formats re-encode.
+func transcodeVideo(ctx context.Context, filePath string, f outputFormat, extraArgs ...string) (string, error) {
+	outputFilePath := filePath + ".processing"
+	_, err := runMediaTool(ctx, "ffmpeg", f.ffmpegArgs(filePath, outputFilePath, extraArgs...)...)
+	if err != nil {
+		return "", err
+	}
+	return outputFilePath, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOutputFormatArgs(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{
+			format: "mp4",
+			want:   []string{"-i", "in", "-c", "copy", "-movflags", "faststart", "-f", "mp4", "out"},
+		},
+		{
+			format: "webm-vp9",
+			want:   []string{"-i", "in", "-c:v", "libvpx-vp9", "-c:a", "libopus", "-crf", "32", "-b:v", "0", "-row-mt", "1", "-f", "webm", "out"},
+		},
+	}
+	for _, tt := range tests {
+		got := outputFormats[tt.format].ffmpegArgs("in", "out")
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.format, got, tt.want)
+		}
+	}
+	if outputFormats["mp4"].reencodes() {
+		t.Error("expected the default format to copy streams")
+	}
+}
+
+func TestUploadVideoWebMOutput(t *testing.T) {
+	requireFFmpeg(t)
+	h := newTestHarness(t)
+	h.cfg.outputFormat = outputFormats["webm-vp9"]
+	token, video := h.createUserAndVideo("webm@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", makeTestMP4(t, 320, 180))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	stored := h.getVideo(video.ID)
+	if stored.VideoURL == nil || !strings.HasSuffix(*stored.VideoURL, ".webm") {
+		t.Fatalf("expected a .webm video URL, got %v", stored.VideoURL)
+	}
+	key := h.s3.puts[len(h.s3.puts)-1]
+	if got := h.s3.ctypes[key]; got != "video/webm" {
+		t.Errorf("expected video/webm, got %q", got)
+	}
+}
+
+func TestStripMetadataArgs(t *testing.T) {
+	copyArgs := defaultOutputFormat.stripMetadataArgs(90)
+	want := []string{"-map_metadata", "-1", "-metadata:s:v:0", "rotate=90"}
+	if !slices.Equal(copyArgs, want) {
+		t.Errorf("copy args = %q, want %q", copyArgs, want)
+	}
+
+	// Re-encoding bakes the rotation into the frames, so tagging it again
+	// would turn the video twice
+	reencodeArgs := outputFormats["mp4-h264"].stripMetadataArgs(90)
+	if !slices.Equal(reencodeArgs, []string{"-map_metadata", "-1"}) {
+		t.Errorf("re-encode args = %q", reencodeArgs)
+	}
+
+	args := defaultOutputFormat.ffmpegArgs("in", "out", defaultOutputFormat.stripMetadataArgs(0)...)
+	want = []string{"-i", "in", "-c", "copy", "-movflags", "faststart", "-map_metadata", "-1", "-f", "mp4", "out"}
+	if !slices.Equal(args, want) {
+		t.Errorf("ffmpegArgs = %q, want %q", args, want)
+	}
+}
+
+func TestVideoProbeRotation(t *testing.T) {
+	tests := []struct {
+		degrees  int
+		rotation int
+		want     string
+	}{
+		{degrees: 0, rotation: 0, want: "landscape"},
+		{degrees: 90, rotation: 90, want: "portrait"},
+		{degrees: -90, rotation: 270, want: "portrait"},
+		{degrees: 180, rotation: 180, want: "landscape"},
+	}
+	for _, tt := range tests {
+		p := videoProbe{Width: 1920, Height: 1080, DisplayAspectRatio: "16:9"}
+		p.setRotation(tt.degrees)
+		if p.Rotation != tt.rotation || p.orientation() != tt.want {
+			t.Errorf("setRotation(%d) = %d, %s; want %d, %s", tt.degrees, p.Rotation, p.orientation(), tt.rotation, tt.want)
+		}
+	}
+}
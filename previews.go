@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// previewWindow picks where a preview clip of clipLength seconds starts and
+// how long it runs, centered on the middle of the video. Videos shorter than
+// clipLength are used whole.
+func previewWindow(duration, clipLength float64) (start, length float64) {
+	if duration <= clipLength {
+		return 0, duration
+	}
+	return (duration - clipLength) / 2, clipLength
+}
+
+// previewFormat is a kind of file hover previews can be rendered as.
+type previewFormat struct {
+	extension   string
+	contentType string
+}
+
+// previewFormats are the PREVIEW_FORMAT choices. Animated images play in an
+// <img>, so list UIs can show them without a video player; MP4 clips are
+// the smallest.
+var previewFormats = map[string]previewFormat{
+	"mp4":  {".mp4", "video/mp4"},
+	"webp": {".webp", "image/webp"},
+	"gif":  {".gif", "image/gif"},
+}
+
+// makePreviewClip renders a short, silent, low resolution preview from the
+// middle of a video for hover previews and returns its path.
+func makePreviewClip(ctx context.Context, inputPath string, duration, clipLength float64, format string) (string, error) {
+	outputPath := inputPath + ".preview" + previewFormats[format].extension
+	_, err := runMediaTool(ctx, "ffmpeg", previewArgs(inputPath, outputPath, duration, clipLength, format)...)
+	if err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// previewArgs builds the ffmpeg command line for makePreviewClip. Animated
+// images are smaller and run at 10 fps to keep them light.
+func previewArgs(input, output string, duration, clipLength float64, format string) []string {
+	start, length := previewWindow(duration, clipLength)
+	args := []string{"-v", "error",
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+		"-t", strconv.FormatFloat(length, 'f', 3, 64),
+		"-i", input, "-an"}
+
+	switch format {
+	case "webp":
+		args = append(args, "-vf", "fps=10,scale=-2:180",
+			"-c:v", "libwebp", "-quality", "60", "-loop", "0", "-f", "webp")
+	case "gif":
+		// A palette made for the clip looks far better than GIF's default
+		args = append(args, "-filter_complex",
+			"fps=10,scale=-2:180:flags=lanczos,split[a][b];[a]palettegen=max_colors=128[p];[b][p]paletteuse",
+			"-loop", "0", "-f", "gif")
+	default:
+		// scale=-2:240 keeps the aspect ratio with an even width, which
+		// libx264 requires
+		args = append(args, "-vf", "scale=-2:240",
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "30",
+			"-movflags", "faststart", "-f", "mp4")
+	}
+	return append(args, "-y", output)
+}
+
+// generatePreview renders a preview for a freshly uploaded video, stores it
+// under previews/ in the video's bucket and records it on the video. It
+// runs in the background after the upload has been answered, so failures
+// are only logged.
+func (cfg *apiConfig) generatePreview(store ObjectStore, videoID uuid.UUID, videoURL, videoKey string, duration float64) {
+	err := cfg.storePreview(context.Background(), store, videoID, videoURL, videoKey, duration)
+	if err != nil {
+		slog.Error("couldn't generate preview clip", "video_id", videoID, "err", err)
+	}
+}
+
+func (cfg *apiConfig) storePreview(ctx context.Context, store ObjectStore, videoID uuid.UUID, videoURL, videoKey string, duration float64) error {
+	sourcePath, err := downloadToTemp(ctx, store, videoKey)
+	if err != nil {
+		return fmt.Errorf("couldn't download video: %w", err)
+	}
+	defer os.Remove(sourcePath)
+
+	previewPath, err := makePreviewClip(ctx, sourcePath, duration, cfg.previewClipLength, cfg.previewFormat)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(previewPath)
+
+	previewFile, err := os.Open(previewPath)
+	if err != nil {
+		return err
+	}
+	defer previewFile.Close()
+
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return err
+	}
+	format := previewFormats[cfg.previewFormat]
+	previewKey := "previews/" + hex.EncodeToString(randomBytes) + format.extension
+	_, err = store.Put(ctx, previewKey, previewFile, format.contentType, cfg.storageClass)
+	if err != nil {
+		return fmt.Errorf("couldn't upload preview: %w", err)
+	}
+
+	previewURL := cfg.s3CfDistribution + "/" + previewKey
+	updated, err := cfg.db.SetPreviewURL(videoID, videoURL, previewURL)
+	if err != nil || !updated {
+		// The video was replaced or removed while the preview rendered
+		store.Delete(ctx, previewKey)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPreviewWindow(t *testing.T) {
+	tests := []struct {
+		duration, clipLength float64
+		wantStart, wantLen   float64
+	}{
+		{60, 3, 28.5, 3},
+		{3, 3, 0, 3},
+		{1.5, 3, 0, 1.5},
+		{10, 4, 3, 4},
+	}
+	for _, tt := range tests {
+		start, length := previewWindow(tt.duration, tt.clipLength)
+		if start != tt.wantStart || length != tt.wantLen {
+			t.Errorf("previewWindow(%v, %v) = (%v, %v), want (%v, %v)",
+				tt.duration, tt.clipLength, start, length, tt.wantStart, tt.wantLen)
+		}
+	}
+}
+
+func TestPreviewArgs(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{"webp", []string{"-c:v", "libwebp", "-loop", "0", "-f", "webp"}},
+		{"gif", []string{"paletteuse", "-f", "gif"}},
+		{"mp4", []string{"-c:v", "libx264", "-f", "mp4"}},
+	}
+	for _, tt := range tests {
+		args := strings.Join(previewArgs("in.mp4", "out", 60, 4, tt.format), " ")
+		if !strings.HasPrefix(args, "-v error -ss 28.000 -t 4.000 -i in.mp4 -an ") || !strings.HasSuffix(args, " -y out") {
+			t.Errorf("%s: unexpected clip window or output in %q", tt.format, args)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(args, want) {
+				t.Errorf("%s: args %q missing %q", tt.format, args, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Stages of an upload reported on the progress stream. Bytes count what's
+// been received from the client while receiving, what's been fetched from
+// the source URL while an import is downloading, and what's been sent to
+// the store while storing.
+const (
+	stageWaiting     = "waiting"
+	stageReceiving   = "receiving"
+	stageDownloading = "downloading"
+	stageQueued      = "queued"
+	stageProcessing  = "processing"
+	stageStoring     = "storing"
+	stageDone        = "done"
+	stageFailed      = "failed"
+)
+
+// progressRetention is how long an upload's progress is kept once nothing
+// is watching or updating it, so a client that connects just after it
+// finishes still sees the outcome.
+const progressRetention = 10 * time.Minute
+
+// uploadProgress is a snapshot of where a video's upload is.
+type uploadProgress struct {
+	Stage string `json:"stage"`
+	Bytes int64  `json:"bytes"`
+	// Total is how many bytes the stage expects, 0 when it isn't known.
+	Total int64  `json:"total"`
+	Error string `json:"error,omitempty"`
+}
+
+// finished reports whether nothing more will happen to the upload without
+// a new request.
+func (p uploadProgress) finished() bool {
+	return p.Stage == stageDone || p.Stage == stageFailed
+}
+
+// progressTracker holds the progress of uploads being handled by this
+// instance, for streaming to their owners. It's in memory only: a client
+// talking to another instance, or reconnecting after a restart, sees the
+// video waiting.
+type progressTracker struct {
+	mu     sync.Mutex
+	videos map[uuid.UUID]*progressEntry
+}
+
+type progressEntry struct {
+	progress uploadProgress
+	// changed is closed, and replaced, whenever progress changes.
+	changed     chan struct{}
+	subscribers int
+	updatedAt   time.Time
+}
+
+func newProgressTracker() *progressTracker {
+	return &progressTracker{videos: map[uuid.UUID]*progressEntry{}}
+}
+
+// entry returns the video's entry, creating it if needed. t.mu must be
+// held.
+func (t *progressTracker) entry(videoID uuid.UUID) *progressEntry {
+	e, ok := t.videos[videoID]
+	if !ok {
+		e = &progressEntry{
+			progress:  uploadProgress{Stage: stageWaiting},
+			changed:   make(chan struct{}),
+			updatedAt: time.Now(),
+		}
+		t.videos[videoID] = e
+	}
+	return e
+}
+
+func (t *progressTracker) notify(e *progressEntry) {
+	e.updatedAt = time.Now()
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// set moves a video's upload to a new stage.
+func (t *progressTracker) set(videoID uuid.UUID, p uploadProgress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep()
+	e := t.entry(videoID)
+	e.progress = p
+	t.notify(e)
+}
+
+// setBytes records how far the current stage has got.
+func (t *progressTracker) setBytes(videoID uuid.UUID, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entry(videoID)
+	e.progress.Bytes = n
+	t.notify(e)
+}
+
+// fail marks a video's upload failed with msg as the reason.
+func (t *progressTracker) fail(videoID uuid.UUID, msg string) {
+	t.set(videoID, uploadProgress{Stage: stageFailed, Error: msg})
+}
+
+// finish is deferred by requests that handle an upload. If the request
+// ends without the upload being stored or queued, it's marked failed, so
+// watchers aren't left waiting on a request that gave up.
+func (t *progressTracker) finish(videoID uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entry(videoID)
+	if e.progress.finished() || e.progress.Stage == stageQueued {
+		return
+	}
+	e.progress = uploadProgress{Stage: stageFailed, Error: "Upload didn't complete"}
+	t.notify(e)
+}
+
+// subscribe keeps a video's progress around while it's being watched.
+// Call the returned func when done watching.
+func (t *progressTracker) subscribe(videoID uuid.UUID) (unsubscribe func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entry(videoID).subscribers++
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		e := t.entry(videoID)
+		e.subscribers--
+		e.updatedAt = time.Now()
+	}
+}
+
+// snapshot returns a video's current progress and a channel that's closed
+// when it next changes.
+func (t *progressTracker) snapshot(videoID uuid.UUID) (uploadProgress, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entry(videoID)
+	return e.progress, e.changed
+}
+
+// sweep forgets uploads nobody has watched or updated for a while. t.mu
+// must be held.
+func (t *progressTracker) sweep() {
+	for id, e := range t.videos {
+		if e.subscribers == 0 && time.Since(e.updatedAt) > progressRetention {
+			delete(t.videos, id)
+		}
+	}
+}
+
+// progressReader reports the running total of bytes read through it.
+type progressReader struct {
+	r      io.Reader
+	n      int64
+	report func(n int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.n += int64(n)
+		p.report(p.n)
+	}
+	return n, err
+}
+
+// progressReadSeeker is a progressReader that keeps its source seekable,
+// so stores can still size and rewind it. Rewinding rewinds the count.
+type progressReadSeeker struct {
+	progressReader
+	s io.Seeker
+}
+
+func newProgressReadSeeker(rs io.ReadSeeker, report func(n int64)) *progressReadSeeker {
+	return &progressReadSeeker{progressReader: progressReader{r: rs, report: report}, s: rs}
+}
+
+func (p *progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := p.s.Seek(offset, whence)
+	if err == nil {
+		p.n = pos
+	}
+	return pos, err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit allows Requests per Period, in a burst or spread out. A zero
+// limit allows everything.
+type rateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// parseRateLimit reads a limit written as "requests/period", e.g. "10/1m".
+// "0" and "off" turn limiting off.
+func parseRateLimit(value string) (rateLimit, error) {
+	if value == "0" || strings.EqualFold(value, "off") {
+		return rateLimit{}, nil
+	}
+	rawRequests, rawPeriod, ok := strings.Cut(value, "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("%q isn't of the form requests/period", value)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(rawRequests))
+	if err != nil || requests < 1 {
+		return rateLimit{}, fmt.Errorf("%q must allow a positive number of requests", value)
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(rawPeriod))
+	if err != nil || period <= 0 {
+		return rateLimit{}, fmt.Errorf("%q must have a positive period", value)
+	}
+	return rateLimit{Requests: requests, Period: period}, nil
+}
+
+func (l rateLimit) enabled() bool { return l.Requests > 0 }
+
+// refillRate is how many tokens the bucket gains per second.
+func (l rateLimit) refillRate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// decision describes a request given the tokens left in its bucket after
+// it was counted.
+func (l rateLimit) decision(allowed bool, tokens float64) rateDecision {
+	rate := l.refillRate()
+	d := rateDecision{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(l.Requests) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		d.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return d
+}
+
+// rateDecision is whether a request may go ahead and what to tell the
+// client about its quota.
+type rateDecision struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long a rejected client must wait for a token.
+	RetryAfter time.Duration
+}
+
+// rateLimiter takes a token from the bucket named by key, if it has one.
+// Buckets start full, with limit.Requests tokens, and refill steadily over
+// limit.Period.
+type rateLimiter interface {
+	take(ctx context.Context, key string, limit rateLimit) (rateDecision, error)
+}
+
+// memoryRateLimiter keeps buckets in this process, so each server counts
+// on its own. Buckets that have refilled are dropped now and then.
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{buckets: map[string]*tokenBucket{}, lastSweep: time.Now(), now: time.Now}
+}
+
+func (m *memoryRateLimiter) take(ctx context.Context, key string, limit rateLimit) (rateDecision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, b := range m.buckets {
+			if now.After(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Requests), updated: now}
+		m.buckets[key] = b
+	}
+	elapsed := max(now.Sub(b.updated).Seconds(), 0)
+	b.tokens = min(float64(limit.Requests), b.tokens+elapsed*limit.refillRate())
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	d := limit.decision(allowed, b.tokens)
+	b.full = now.Add(d.Reset)
+	return d, nil
+}
+
+// rateLimited applies scope's limit to next. Requests are counted against
+// the user they're authenticated as, or the client's IP address when they
+// aren't, in a bucket of their own for each scope. If the limiter's backend
+// fails the request is let through rather than taking the endpoint down
+// with it.
+func (cfg *apiConfig) rateLimited(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := cfg.rateLimits[scope]
+		if !limit.enabled() || cfg.rateLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		key := scope + ":ip:" + clientIP(r, cfg.trustedProxies)
+		if userID, ok := cfg.requestUserID(r); ok {
+			key = scope + ":user:" + userID.String()
+		}
+
+		d, err := cfg.rateLimiter.take(r.Context(), key, limit)
+		if err != nil {
+			slog.Warn("couldn't check rate limit, allowing request", "key", key, "err", err)
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, ceilSeconds(limit.Period)))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+		if !d.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+			respondWithErrorCode(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests, try again later", nil)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
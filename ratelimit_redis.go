@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisTimeout bounds a call to Redis that has no earlier deadline.
+const redisTimeout = 2 * time.Second
+
+// takeTokenScript is the token bucket, run atomically by Redis so every
+// server shares it. Tokens are stored as a string; Lua numbers returned to
+// the client are truncated to integers.
+const takeTokenScript = `
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or capacity
+local updated = tonumber(state[2]) or now
+local rate = capacity / period
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+// redisRateLimiter keeps buckets in Redis, so servers behind a load
+// balancer share one count per client.
+type redisRateLimiter struct {
+	client *redisClient
+	prefix string
+}
+
+func (l *redisRateLimiter) take(ctx context.Context, key string, limit rateLimit) (rateDecision, error) {
+	reply, err := l.client.do(ctx, "EVAL", takeTokenScript, "1", l.prefix+key,
+		strconv.Itoa(limit.Requests), strconv.FormatInt(limit.Period.Milliseconds(), 10))
+	if err != nil {
+		return rateDecision{}, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return rateDecision{}, fmt.Errorf("unexpected reply from rate limit script: %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	rawTokens, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(rawTokens, 64)
+	if err != nil {
+		return rateDecision{}, fmt.Errorf("unexpected token count %q: %w", rawTokens, err)
+	}
+	return limit.decision(allowed == 1, tokens), nil
+}
+
+// redisClient speaks just enough of the Redis protocol to run commands,
+// keeping a few idle connections around for reuse.
+type redisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+	idle     chan *redisConn
+}
+
+// newRedisClient connects to Redis at a redis:// or rediss:// URL like
+// redis://:password@host:6379/0. Nothing is dialed until the first command.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q, must be redis or rediss", u.Scheme)
+	}
+	c := &redisClient{addr: u.Host, tls: u.Scheme == "rediss", idle: make(chan *redisConn, 8)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database number %q", db)
+		}
+	}
+	return c, nil
+}
+
+// redisConn is a connection with the reader its replies are parsed from.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and returns its reply: a string, an int64, nil, or a
+// []any of those. Error replies are returned as errors.
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	reply, err := conn.call(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var (
+		raw net.Conn
+		err error
+	)
+	if c.tls {
+		raw, err = (&tls.Dialer{NetDialer: dialer}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to Redis: %w", err)
+	}
+	conn := &redisConn{Conn: raw, r: bufio.NewReader(raw)}
+	raw.SetDeadline(time.Now().Add(redisTimeout))
+
+	var setup [][]string
+	switch {
+	case c.username != "" && c.password != "":
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, cmd := range setup {
+		if _, err := conn.call(cmd...); err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("couldn't set up Redis connection: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) call(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.r)
+}
+
+// redisError is an error reply from Redis. The connection is still usable
+// after one.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed Redis reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed Redis bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed Redis array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			values[i], err = readRedisReply(r)
+			if err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				values[i] = replyErr
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown Redis reply type %q", kind)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newMemoryRateLimiter()
+	limiter.now = func() time.Time { return now }
+	limit := rateLimit{Requests: 3, Period: time.Minute}
+
+	for i := range 3 {
+		d, _ := limiter.take(context.Background(), "a", limit)
+		if !d.Allowed || d.Remaining != 2-i {
+			t.Fatalf("request %d: got %+v, want allowed with %d remaining", i+1, d, 2-i)
+		}
+	}
+	d, _ := limiter.take(context.Background(), "a", limit)
+	if d.Allowed || d.RetryAfter != 20*time.Second {
+		t.Fatalf("request 4: got %+v, want rejected for 20s", d)
+	}
+	if d, _ := limiter.take(context.Background(), "b", limit); !d.Allowed {
+		t.Fatalf("another key should have its own bucket, got %+v", d)
+	}
+
+	now = now.Add(20 * time.Second)
+	if d, _ := limiter.take(context.Background(), "a", limit); !d.Allowed || d.Remaining != 0 {
+		t.Fatalf("after refilling a token: got %+v", d)
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    rateLimit
+		wantErr bool
+	}{
+		{"10/1m", rateLimit{10, time.Minute}, false},
+		{" 60 / 1h ", rateLimit{60, time.Hour}, false},
+		{"0", rateLimit{}, false},
+		{"off", rateLimit{}, false},
+		{"10", rateLimit{}, true},
+		{"0/1m", rateLimit{}, true},
+		{"10/0s", rateLimit{}, true},
+	}
+	for _, tc := range tests {
+		got, err := parseRateLimit(tc.value)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseRateLimit(%q) = %+v, %v", tc.value, got, err)
+		}
+	}
+}
+
+func TestRateLimitedEndpoints(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.rateLimiter = newMemoryRateLimiter()
+	h.cfg.rateLimits = map[string]rateLimit{
+		"auth":   {Requests: 2, Period: time.Minute},
+		"upload": {Requests: 1, Period: time.Hour},
+	}
+
+	login := func() *http.Response {
+		return h.do(http.MethodPost, "/api/login", "", strings.NewReader(`{"email":"nobody@example.com","password":"wrong"}`))
+	}
+	for i := range 2 {
+		resp := login()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("login %d was rate limited", i+1)
+		}
+		if got := resp.Header.Get("RateLimit-Remaining"); got != []string{"1", "0"}[i] {
+			t.Errorf("login %d: RateLimit-Remaining = %q", i+1, got)
+		}
+		if got := resp.Header.Get("RateLimit-Policy"); got != "2;w=60" {
+			t.Errorf("login %d: RateLimit-Policy = %q", i+1, got)
+		}
+	}
+	resp := login()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third login: got status %d, want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if code := errorCode(t, resp); code != errCodeRateLimited {
+		t.Errorf("error code = %q, want %q", code, errCodeRateLimited)
+	}
+
+	// Uploads are counted per user, apart from the auth endpoints
+	tokenA, videoA := h.createUserAndVideo("a@example.com")
+	tokenB, videoB := h.createUserAndVideo("b@example.com")
+	if resp := h.upload("/api/video_upload/"+videoA.ID.String(), tokenA, "video", "a.mp4", minimalMP4); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first upload: got status %d", resp.StatusCode)
+	}
+	if resp := h.upload("/api/video_upload/"+videoA.ID.String(), tokenA, "video", "a.mp4", minimalMP4); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second upload by the same user: got status %d, want 429", resp.StatusCode)
+	}
+	if resp := h.upload("/api/video_upload/"+videoB.ID.String(), tokenB, "video", "b.mp4", minimalMP4); resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload by another user: got status %d", resp.StatusCode)
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*3\r\n:1\r\n$4\r\n0.25\r\n$-1\r\n-ERR wrong\r\n"))
+	got, err := readRedisReply(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []any{int64(1), "0.25", nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if _, err := readRedisReply(r); err == nil || err.Error() != "redis: ERR wrong" {
+		t.Errorf("error reply: got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var errRemoteAddressNotAllowed = errors.New("remote address is not publicly routable")
+
+// isPublicIP reports whether ip is safe for the server to connect to on a
+// client's behalf. Loopback, private, link-local and other special ranges
+// are rejected so user-supplied URLs can't reach internal services.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() &&
+		!ip.IsPrivate() &&
+		!ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast()
+}
+
+// newPublicDialer returns a dialer that refuses addresses isPublicIP
+// rejects. The check runs after DNS resolution, on every connection, so
+// redirects and rebinding can't be used to reach a private address.
+func newPublicDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("%w: %s", errRemoteAddressNotAllowed, host)
+			}
+			return nil
+		},
+	}
+}
+
+// newRemoteFetchClient returns an HTTP client for fetching user-supplied
+// URLs, which only connects to public addresses.
+func newRemoteFetchClient(timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           newPublicDialer().DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("unsupported redirect scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// fetchRemoteFile downloads rawURL with client, refusing anything that
+// isn't http(s) or is larger than maxBytes.
+func fetchRemoteFile(ctx context.Context, client *http.Client, rawURL string, maxBytes int64) ([]byte, error) {
+	resp, err := openRemoteFile(ctx, client, rawURL, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("remote file is larger than %d bytes", maxBytes)
+	}
+	return data, nil
+}
+
+// parseRemoteURL checks that a user-supplied URL is one the server will
+// fetch: absolute, with a host, over http or https.
+func parseRemoteURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("URL has no host")
+	}
+	return u, nil
+}
+
+// openRemoteFile starts downloading rawURL with client, for callers that
+// stream the body rather than hold it in memory. A response that says
+// it's larger than maxBytes is refused, but one that doesn't say must
+// still be cut off by the caller. The caller closes the body.
+func openRemoteFile(ctx context.Context, client *http.Client, rawURL string, maxBytes int64) (*http.Response, error) {
+	u, err := parseRemoteURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("remote server returned %s", resp.Status)
+	}
+	if resp.ContentLength > maxBytes {
+		resp.Body.Close()
+		return nil, fmt.Errorf("remote file is larger than %d bytes", maxBytes)
+	}
+	return resp, nil
+}
+
+// checkPublicHost resolves host and makes sure every address it has is
+// publicly routable, to turn away URLs for tools that make their own
+// connections before starting them. It can't see the connections
+// themselves, so redirects and later lookups go unchecked; the tools are
+// also pointed at a publicProxy for that.
+func checkPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("%w: %s", errRemoteAddressNotAllowed, addr.IP)
+		}
+	}
+	return nil
+}
+
+// publicProxy is an HTTP proxy that only connects to public addresses,
+// for tools like yt-dlp that make their own connections and would
+// otherwise follow a redirect anywhere. https goes through CONNECT
+// tunnels and plain http is forwarded.
+type publicProxy struct {
+	dialer  *net.Dialer
+	forward *httputil.ReverseProxy
+}
+
+func newPublicProxy() *publicProxy {
+	dialer := newPublicDialer()
+	return &publicProxy{
+		dialer: dialer,
+		forward: &httputil.ReverseProxy{
+			// A proxy request already has the absolute URL to fetch
+			Rewrite: func(*httputil.ProxyRequest) {},
+			Transport: &http.Transport{
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 10 * time.Second,
+			},
+		},
+	}
+}
+
+func (p *publicProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "only absolute http URLs are proxied", http.StatusBadRequest)
+		return
+	}
+	p.forward.ServeHTTP(w, r)
+}
+
+// tunnel connects a CONNECT request to its host and passes bytes both
+// ways until either side closes.
+func (p *publicProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := p.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	// Closing both ends, deferred above, stops the other copy
+	<-done
+}
+
+// startPublicProxy serves a publicProxy on a loopback port and returns its
+// URL, along with a function that shuts it down.
+func startPublicProxy() (string, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: newPublicProxy(), ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	return "http://" + ln.Addr().String(), func() { srv.Close() }, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.0.0.5", false},
+		{"172.16.3.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestPublicProxyRefusesPrivateAddresses(t *testing.T) {
+	unreachable := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the proxy shouldn't reach a loopback server")
+	})
+	target := httptest.NewServer(unreachable)
+	defer target.Close()
+	tlsTarget := httptest.NewTLSServer(unreachable)
+	defer tlsTarget.Close()
+
+	proxyURL, stop, err := startPublicProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	u, _ := url.Parse(proxyURL)
+	transport := tlsTarget.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("http: expected 502, got %d", resp.StatusCode)
+	}
+	if resp, err := client.Get(tlsTarget.URL); err == nil {
+		resp.Body.Close()
+		t.Error("https: expected the CONNECT to be refused")
+	}
+}
+
+func TestPublicProxyTunnels(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through"))
+	}))
+	defer target.Close()
+
+	// Loopback is all there is to reach here, so let it through
+	p := newPublicProxy()
+	p.dialer = &net.Dialer{}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+	u, _ := url.Parse(proxy.URL)
+	transport := target.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+
+	resp, err := (&http.Client{Transport: transport}).Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "through" {
+		t.Errorf("unexpected body %q, %v", body, err)
+	}
+}
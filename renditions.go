@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// renditionKey is where a video's rendition called name is stored: next
+// to the video object, in a directory named after it like its HLS output.
+func renditionKey(videoKey, name string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "/renditions/" + name + ".mp4"
+}
+
+// mp4RenditionArgs encodes input as a progressive MP4 at r's size and
+// bitrate, with the moov atom up front so it plays while downloading.
+func mp4RenditionArgs(input, output string, r hlsRendition) []string {
+	return []string{"-v", "error", "-i", input,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", fmt.Sprintf("scale=%d:%d", r.Width, r.Height),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+		"-b:v", strconv.Itoa(r.VideoBitrate) + "k",
+		"-maxrate", strconv.Itoa(r.maxrate()) + "k",
+		"-bufsize", strconv.Itoa(r.VideoBitrate*3/2) + "k",
+		"-c:a", "aac", "-b:a", strconv.Itoa(hlsAudioBitrate) + "k", "-ac", "2",
+		"-movflags", "+faststart",
+		"-f", "mp4", "-y", output}
+}
+
+// generateRenditions encodes a freshly uploaded video at each quality of
+// the HLS ladder it can fill and records them on the video. Like HLS it
+// runs after the upload was answered, so failures are only logged.
+func (cfg *apiConfig) generateRenditions(store ObjectStore, videoID uuid.UUID, videoURL, videoKey string, probe videoProbe) {
+	err := cfg.storeRenditions(context.Background(), store, videoID, videoURL, videoKey, probe)
+	if err != nil {
+		slog.Error("couldn't encode video renditions", "video_id", videoID, "err", err)
+	}
+}
+
+func (cfg *apiConfig) storeRenditions(ctx context.Context, store ObjectStore, videoID uuid.UUID, videoURL, videoKey string, probe videoProbe) error {
+	sourcePath, err := downloadToTemp(ctx, store, videoKey)
+	if err != nil {
+		return fmt.Errorf("couldn't download video: %w", err)
+	}
+	defer os.Remove(sourcePath)
+
+	dir, err := os.MkdirTemp("", "tubely-renditions")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var renditions database.Renditions
+	for _, r := range planHLSRenditions(probe.Width, probe.Height) {
+		output := filepath.Join(dir, r.Name+".mp4")
+		_, err := runMediaTool(ctx, "ffmpeg", mp4RenditionArgs(sourcePath, output, r)...)
+		if err != nil {
+			cfg.deleteRenditions(context.WithoutCancel(ctx), store, renditions)
+			return fmt.Errorf("couldn't encode %s rendition: %w", r.Name, err)
+		}
+		rendition, err := putRendition(ctx, store, output, renditionKey(videoKey, r.Name), cfg.storageClass)
+		if err != nil {
+			cfg.deleteRenditions(context.WithoutCancel(ctx), store, renditions)
+			return fmt.Errorf("couldn't upload %s rendition: %w", r.Name, err)
+		}
+		rendition.Name = r.Name
+		rendition.Width = r.Width
+		rendition.Height = r.Height
+		rendition.Bitrate = r.VideoBitrate + hlsAudioBitrate
+		renditions = append(renditions, rendition)
+		os.Remove(output)
+	}
+
+	updated, err := cfg.db.SetRenditions(videoID, videoURL, renditions)
+	if err != nil || !updated {
+		// The video was replaced or removed while it was encoded
+		cfg.deleteRenditions(ctx, store, renditions)
+		return err
+	}
+	return nil
+}
+
+func putRendition(ctx context.Context, store ObjectStore, filePath, key, storageClass string) (database.Rendition, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return database.Rendition{}, err
+	}
+	defer f.Close()
+	info, err := store.Put(ctx, key, f, "video/mp4", storageClass)
+	if err != nil {
+		return database.Rendition{}, err
+	}
+	return database.Rendition{Key: key, Size: info.Size}, nil
+}
+
+// deleteRenditions deletes the stored files of renditions. Ones that are
+// already gone don't count as failures.
+func (cfg *apiConfig) deleteRenditions(ctx context.Context, store ObjectStore, renditions database.Renditions) error {
+	var errs []error
+	for _, r := range renditions {
+		err := store.Delete(ctx, r.Key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// renditionResponse is a rendition as clients see it, with a URL to load
+// it from in place of its key.
+type renditionResponse struct {
+	Name    string  `json:"name"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Bitrate int     `json:"bitrate"`
+	Size    int64   `json:"size"`
+	URL     *string `json:"url"`
+}
+
+// renditionResponses links to a video's renditions the same way as to the
+// video itself.
+func (cfg *apiConfig) renditionResponses(ctx context.Context, video database.Video) []renditionResponse {
+	resp := make([]renditionResponse, 0, len(video.Renditions))
+	for _, r := range video.Renditions {
+		var url *string
+		switch {
+		case cfg.signsURLs(video):
+			url = cfg.signedURL(video, r.Key)
+		case video.VideoBucket != nil && *video.VideoBucket != cfg.s3Bucket:
+			download := cfg.publicURL(ctx, "/api/videos/"+video.ID.String()+"/download?quality="+r.Name)
+			url = &download
+		default:
+			stored := cfg.s3CfDistribution + "/" + r.Key
+			url = &stored
+		}
+		resp = append(resp, renditionResponse{
+			Name:    r.Name,
+			Width:   r.Width,
+			Height:  r.Height,
+			Bitrate: r.Bitrate,
+			Size:    r.Size,
+			URL:     url,
+		})
+	}
+	return resp
+}
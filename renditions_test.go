@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestRenditions(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("quality@example.com")
+
+	videoKey := "landscape/abc.mp4"
+	videoURL := h.cfg.s3CfDistribution + "/" + videoKey
+	fileName := "holiday.mov"
+	video.VideoURL = &videoURL
+	video.VideoKey = &videoKey
+	video.VideoFilename = &fileName
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	key := renditionKey(videoKey, "480p")
+	if key != "landscape/abc/renditions/480p.mp4" {
+		t.Fatalf("renditionKey = %q", key)
+	}
+	h.s3.objects[videoKey] = []byte("original")
+	h.s3.objects[key] = []byte("smaller")
+
+	// Renditions of a replaced video aren't recorded
+	updated, err := h.cfg.db.SetRenditions(video.ID, "https://cdn.example.com/landscape/old.mp4", database.Renditions{{Name: "480p", Key: key}})
+	if err != nil || updated {
+		t.Fatalf("SetRenditions for an old URL = %v, %v", updated, err)
+	}
+	updated, err = h.cfg.db.SetRenditions(video.ID, videoURL, database.Renditions{
+		{Name: "480p", Width: 854, Height: 480, Bitrate: 1528, Size: 7, Key: key},
+	})
+	if err != nil || !updated {
+		t.Fatalf("SetRenditions = %v, %v", updated, err)
+	}
+
+	var got videoResponse
+	decodeJSON(t, h.do(http.MethodGet, "/api/videos/"+video.ID.String(), token, nil), &got)
+	if len(got.Renditions) != 1 || got.Renditions[0].URL == nil || *got.Renditions[0].URL != "https://cdn.example.com/"+key || got.Renditions[0].Width != 854 {
+		t.Fatalf("renditions = %+v", got.Renditions)
+	}
+
+	resp := h.do(http.MethodGet, "/api/videos/"+video.ID.String()+"/download?quality=480p", "", nil)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "smaller" {
+		t.Fatalf("download 480p: %d %q", resp.StatusCode, body)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); cd != `attachment; filename=holiday-480p.mp4` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	if resp := h.do(http.MethodGet, "/api/videos/"+video.ID.String()+"/download?quality=1080p", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing rendition: expected 404, got %d", resp.StatusCode)
+	}
+
+	if resp := h.do(http.MethodDelete, "/api/videos/"+video.ID.String()+"?permanent=true", token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("permanent delete: expected 204, got %d", resp.StatusCode)
+	}
+	if keys := h.s3.keys(); len(keys) != 0 {
+		t.Errorf("left behind %v", keys)
+	}
+}
+
+func TestStoreRenditions(t *testing.T) {
+	requireFFmpeg(t)
+	h := newTestHarness(t)
+	_, video := h.createUserAndVideo("encode@example.com")
+
+	videoKey := "landscape/enc.mp4"
+	videoURL := h.cfg.s3CfDistribution + "/" + videoKey
+	video.VideoURL = &videoURL
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	h.s3.objects[videoKey] = makeTestMP4(t, 1280, 720)
+
+	err := h.cfg.storeRenditions(context.Background(), h.cfg.store, video.ID, videoURL, videoKey, videoProbe{Width: 1280, Height: 720})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := h.getVideo(video.ID)
+	var names []string
+	for _, r := range stored.Renditions {
+		names = append(names, r.Name)
+		if _, ok := h.s3.objects[r.Key]; !ok || r.Size == 0 {
+			t.Errorf("rendition %+v wasn't stored", r)
+		}
+	}
+	if !slices.Equal(names, []string{"720p", "480p"}) {
+		t.Errorf("renditions = %v", names)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+const (
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// retryableS3ErrorCodes are the S3 error codes worth another attempt.
+var retryableS3ErrorCodes = map[string]bool{
+	"SlowDown":            true,
+	"Throttling":          true,
+	"ThrottlingException": true,
+	"RequestTimeout":      true,
+	"InternalError":       true,
+	"ServiceUnavailable":  true,
+}
+
+// isRetryableS3Error reports whether err looks transient: throttling or a
+// server-side failure.
+func isRetryableS3Error(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && retryableS3ErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	var statusErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &statusErr) {
+		code := statusErr.HTTPStatusCode()
+		return code == 429 || code >= 500
+	}
+	return false
+}
+
+// withRetry calls fn up to maxAttempts times, backing off exponentially with
+// full jitter between attempts. It gives up early on errors that aren't
+// retryable, when ctx is cancelled, or when the next wait would run past
+// ctx's deadline.
+func withRetry(ctx context.Context, maxAttempts int, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = fn()
+		if err == nil || !isRetryableS3Error(err) || attempt == maxAttempts-1 {
+			return err
+		}
+
+		backoff := min(retryBaseDelay<<attempt, retryMaxDelay)
+		wait := rand.N(backoff) + 1
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestWithRetry(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "SlowDown"}
+	denied := &smithy.GenericAPIError{Code: "AccessDenied"}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"retries throttling", []error{throttled, throttled, nil}, 3, nil},
+		{"gives up after max attempts", []error{throttled, throttled, throttled, nil}, 3, throttled},
+		{"no retry on client error", []error{denied, nil}, 1, denied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := withRetry(context.Background(), 3, func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopsAtDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+
+	calls := 0
+	withRetry(ctx, 10, func() error {
+		calls++
+		return &smithy.GenericAPIError{Code: "InternalError"}
+	})
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3API is the subset of the S3 client the object store depends on. It exists
+// so tests can swap in a fake instead of talking to AWS.
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+}
+
+// minS3PartSize is the smallest part S3 accepts in a multipart upload,
+// other than the last one.
+const minS3PartSize = 5 << 20 // 5 MiB
+
+// s3ObjectStore is an ObjectStore backed by a single S3 bucket. Every call
+// is retried on throttling and server errors up to maxAttempts times.
+// Objects larger than partSize are uploaded in parts of that size; zero
+// uploads everything with a single PutObject. Without a presigner it can't
+// hand out signed URLs.
+type s3ObjectStore struct {
+	client      S3API
+	presigner   S3Presigner
+	bucket      string
+	maxAttempts int
+	partSize    int64
+}
+
+func newS3ObjectStore(client S3API, presigner S3Presigner, bucket string, maxAttempts int, partSize int64) *s3ObjectStore {
+	return &s3ObjectStore{client: client, presigner: presigner, bucket: bucket, maxAttempts: max(maxAttempts, 1), partSize: partSize}
+}
+
+// sha256Body is a Put body whose SHA-256 is already known. The S3 store
+// sends it as the object's checksum, so S3 turns the upload away if the
+// bytes it receives don't match.
+type sha256Body struct {
+	io.ReadSeeker
+	sum []byte
+}
+
+// Put uploads body under key. Bodies over the part size go up as a
+// multipart upload, one part in memory at a time, so each part is retried
+// on its own and a failure late in a large file doesn't restart it. A
+// *sha256Body is checked by S3: whole, or part by part when it's uploaded
+// in parts, since S3 only keeps SHA-256s of multipart objects per part.
+func (s *s3ObjectStore) Put(ctx context.Context, key string, body io.Reader, contentType, storageClass string) (ObjectInfo, error) {
+	var sum []byte
+	if b, ok := body.(*sha256Body); ok {
+		sum = b.sum
+	}
+	if s.partSize <= 0 {
+		return s.putObject(ctx, key, body, contentType, storageClass, sum)
+	}
+
+	// A seekable body's size says which way to go without reading it
+	if seeker, ok := body.(io.Seeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = seeker.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		if size <= s.partSize {
+			return s.putObject(ctx, key, body, contentType, storageClass, sum)
+		}
+		return s.putMultipart(ctx, key, body, contentType, storageClass, sum != nil)
+	}
+
+	first := make([]byte, s.partSize)
+	n, err := io.ReadFull(body, first)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return s.putObject(ctx, key, bytes.NewReader(first[:n]), contentType, storageClass, sum)
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	// Exactly one part's worth still fits a single PutObject
+	var peek [1]byte
+	if k, _ := io.ReadFull(body, peek[:]); k == 0 {
+		return s.putObject(ctx, key, bytes.NewReader(first), contentType, storageClass, sum)
+	}
+	rest := io.MultiReader(bytes.NewReader(first), bytes.NewReader(peek[:]), body)
+	return s.putMultipart(ctx, key, rest, contentType, storageClass, sum != nil)
+}
+
+// putObject uploads body with one PutObject. The body is rewound between
+// attempts when it supports seeking; otherwise a failed upload can't be
+// retried. A non-nil sum is sent as the body's SHA-256.
+func (s *s3ObjectStore) putObject(ctx context.Context, key string, body io.Reader, contentType, storageClass string, sum []byte) (ObjectInfo, error) {
+	var checksum *string
+	if sum != nil {
+		checksum = aws.String(base64.StdEncoding.EncodeToString(sum))
+	}
+	maxAttempts := s.maxAttempts
+	seeker, canSeek := body.(io.Seeker)
+	if !canSeek {
+		maxAttempts = 1
+	}
+
+	var out *s3.PutObjectOutput
+	first := true
+	err := withRetry(ctx, maxAttempts, func() error {
+		if !first {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		var err error
+		out, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:         aws.String(s.bucket),
+			Key:            aws.String(key),
+			Body:           body,
+			ContentType:    aws.String(contentType),
+			StorageClass:   types.StorageClass(storageClass),
+			ChecksumSHA256: checksum,
+		})
+		return err
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:         key,
+		ContentType: contentType,
+		ETag:        aws.ToString(out.ETag),
+	}, nil
+}
+
+// putMultipart uploads body in parts of s.partSize. The upload is aborted
+// if any part fails, so S3 doesn't keep (and bill for) the parts sent so
+// far. With checksums set, each part is sent with its SHA-256.
+func (s *s3ObjectStore) putMultipart(ctx context.Context, key string, body io.Reader, contentType, storageClass string, checksums bool) (ObjectInfo, error) {
+	var algorithm types.ChecksumAlgorithm
+	if checksums {
+		algorithm = types.ChecksumAlgorithmSha256
+	}
+	var created *s3.CreateMultipartUploadOutput
+	err := withRetry(ctx, s.maxAttempts, func() error {
+		var err error
+		created, err = s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(key),
+			ContentType:       aws.String(contentType),
+			StorageClass:      types.StorageClass(storageClass),
+			ChecksumAlgorithm: algorithm,
+		})
+		return err
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	uploadID := created.UploadId
+
+	abort := func(cause error) (ObjectInfo, error) {
+		_, err := s.client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+		})
+		if err != nil {
+			return ObjectInfo{}, errors.Join(cause, fmt.Errorf("couldn't abort multipart upload: %w", err))
+		}
+		return ObjectInfo{}, cause
+	}
+
+	var parts []types.CompletedPart
+	buf := make([]byte, s.partSize)
+	for partNumber := int32(1); ; partNumber++ {
+		n, err := io.ReadFull(body, buf)
+		if errors.Is(err, io.EOF) && partNumber > 1 {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return abort(err)
+		}
+
+		part := bytes.NewReader(buf[:n])
+		var checksum *string
+		if checksums {
+			sum := sha256.Sum256(buf[:n])
+			checksum = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		var out *s3.UploadPartOutput
+		err = withRetry(ctx, s.maxAttempts, func() error {
+			if _, err := part.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			var err error
+			out, err = s.client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:         aws.String(s.bucket),
+				Key:            aws.String(key),
+				UploadId:       uploadID,
+				PartNumber:     aws.Int32(partNumber),
+				Body:           part,
+				ContentLength:  aws.Int64(int64(n)),
+				ChecksumSHA256: checksum,
+			})
+			return err
+		})
+		if err != nil {
+			return abort(fmt.Errorf("couldn't upload part %d: %w", partNumber, err))
+		}
+		parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(partNumber), ChecksumSHA256: checksum})
+		if int64(n) < s.partSize {
+			break
+		}
+	}
+
+	var completed *s3.CompleteMultipartUploadOutput
+	err = withRetry(ctx, s.maxAttempts, func() error {
+		var err error
+		completed, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		return err
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return ObjectInfo{
+		Key:         key,
+		ContentType: contentType,
+		ETag:        aws.ToString(completed.ETag),
+	}, nil
+}
+
+func (s *s3ObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	var out *s3.GetObjectOutput
+	err := withRetry(ctx, s.maxAttempts, func() error {
+		var err error
+		out, err = s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		return nil, ObjectInfo{}, err
+	}
+	return out.Body, ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *s3ObjectStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	var out *s3.GetObjectOutput
+	err := withRetry(ctx, s.maxAttempts, func() error {
+		var err error
+		out, err = s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		})
+		return err
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Copy copies within the bucket with CopyObject, which handles objects up
+// to 5 GB, well above the upload limit.
+func (s *s3ObjectStore) Copy(ctx context.Context, srcKey, dstKey, storageClass string) (ObjectInfo, error) {
+	copySource := (&url.URL{Path: s.bucket + "/" + srcKey}).EscapedPath()
+	var out *s3.CopyObjectOutput
+	err := withRetry(ctx, s.maxAttempts, func() error {
+		var err error
+		out, err = s.client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:       aws.String(s.bucket),
+			Key:          aws.String(dstKey),
+			CopySource:   aws.String(copySource),
+			StorageClass: types.StorageClass(storageClass),
+		})
+		return err
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, srcKey)
+		}
+		return ObjectInfo{}, err
+	}
+	info := ObjectInfo{Key: dstKey, StorageClass: storageClass}
+	if out.CopyObjectResult != nil {
+		info.ETag = aws.ToString(out.CopyObjectResult.ETag)
+		info.LastModified = aws.ToTime(out.CopyObjectResult.LastModified)
+	}
+	return info, nil
+}
+
+func (s *s3ObjectStore) Delete(ctx context.Context, key string) error {
+	return withRetry(ctx, s.maxAttempts, func() error {
+		_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+}
+
+func (s *s3ObjectStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	var out *s3.HeadObjectOutput
+	err := withRetry(ctx, s.maxAttempts, func() error {
+		var err error
+		out, err = s.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		ETag:         aws.ToString(out.ETag),
+		StorageClass: string(out.StorageClass),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+// List pages through every object under prefix.
+func (s *s3ObjectStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	objects := []ObjectInfo{}
+	for paginator.HasMorePages() {
+		var page *s3.ListObjectsV2Output
+		err := withRetry(ctx, s.maxAttempts, func() error {
+			var err error
+			page, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				ETag:         aws.ToString(obj.ETag),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// Check sends a HeadBucket, which fails if the bucket is missing or the
+// credentials can't reach it. It isn't retried: a probe should answer
+// quickly and will be repeated anyway.
+func (s *s3ObjectStore) Check(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err != nil {
+		return fmt.Errorf("couldn't reach bucket %s: %w", s.bucket, err)
+	}
+	return nil
+}
+
+// SignedURL presigns a GetObject request. Signing happens locally, so it's
+// neither retried nor checks that the object exists.
+func (s *s3ObjectStore) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if s.presigner == nil {
+		return "", errors.New("no presigner configured")
+	}
+	req, err := s.presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3PutMultipart(t *testing.T) {
+	fake := newFakeS3()
+	store := newS3ObjectStore(fake, nil, "tubely-test", 1, 16)
+	data := bytes.Repeat([]byte("0123456789"), 4)
+
+	info, err := store.Put(context.Background(), "big.mp4", bytes.NewReader(data), "video/mp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects["big.mp4"], data) {
+		t.Fatalf("stored %q", fake.objects["big.mp4"])
+	}
+	want, err := computeETag(bytes.NewReader(data), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !etagsMatch(info.ETag, want) || want[len(want)-2:] != "-3" {
+		t.Errorf("ETag %s, want %s", info.ETag, want)
+	}
+}
+
+func TestS3PutUnseekableBody(t *testing.T) {
+	for _, size := range []int{10, 16, 17} {
+		fake := newFakeS3()
+		store := newS3ObjectStore(fake, nil, "tubely-test", 1, 16)
+		data := bytes.Repeat([]byte("x"), size)
+
+		// MultiReader hides the bytes.Reader's Seek method
+		info, err := store.Put(context.Background(), "clip.mp4", io.MultiReader(bytes.NewReader(data)), "video/mp4", "")
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(fake.objects["clip.mp4"], data) {
+			t.Errorf("%d bytes: stored %d bytes", size, len(fake.objects["clip.mp4"]))
+		}
+		if multipart := strings.Contains(info.ETag, "-"); multipart != (size > 16) {
+			t.Errorf("%d bytes: ETag %s from the wrong upload path", size, info.ETag)
+		}
+	}
+}
+
+func TestS3PutMultipartAbortsOnFailure(t *testing.T) {
+	fake := newFakeS3()
+	fake.failPart = 2
+	store := newS3ObjectStore(fake, nil, "tubely-test", 1, 16)
+
+	_, err := store.Put(context.Background(), "big.mp4", bytes.NewReader(make([]byte, 40)), "video/mp4", "")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(fake.aborted) != 1 || len(fake.multipart) != 0 {
+		t.Errorf("expected the upload to be aborted, got aborted %v, pending %d", fake.aborted, len(fake.multipart))
+	}
+	if _, ok := fake.objects["big.mp4"]; ok {
+		t.Error("expected no object to be stored")
+	}
+}
+
+func TestS3PutSHA256Body(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 4)
+	sum := sha256.Sum256(data)
+
+	fake := newFakeS3()
+	store := newS3ObjectStore(fake, nil, "tubely-test", 1, 0)
+	_, err := store.Put(context.Background(), "clip.mp4", &sha256Body{ReadSeeker: bytes.NewReader(data), sum: sum[:]}, "video/mp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.checksummed) != 1 {
+		t.Errorf("expected the put to carry its checksum, got %v", fake.checksummed)
+	}
+
+	// Multipart uploads are checked part by part
+	fake = newFakeS3()
+	store = newS3ObjectStore(fake, nil, "tubely-test", 1, 16)
+	_, err = store.Put(context.Background(), "big.mp4", &sha256Body{ReadSeeker: bytes.NewReader(data), sum: sum[:]}, "video/mp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.checksummed) != 3 {
+		t.Errorf("expected 3 checksummed parts, got %v", fake.checksummed)
+	}
+
+	// S3 rejects bytes that don't match
+	fake = newFakeS3()
+	store = newS3ObjectStore(fake, nil, "tubely-test", 1, 0)
+	wrong := sha256.Sum256([]byte("something else"))
+	_, err = store.Put(context.Background(), "clip.mp4", &sha256Body{ReadSeeker: bytes.NewReader(data), sum: wrong[:]}, "video/mp4", "")
+	if err == nil {
+		t.Fatal("expected a mismatched checksum to fail")
+	}
+	if _, ok := fake.objects["clip.mp4"]; ok {
+		t.Error("expected no object to be stored")
+	}
+}
+
+func TestUploadVideoMultipartVerified(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.verifyUploads = true
+	h.cfg.s3PartSize = 32
+	h.cfg.store = newS3ObjectStore(h.s3, nil, h.cfg.s3Bucket, 1, h.cfg.s3PartSize)
+	token, video := h.createUserAndVideo("multipart@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// The file streams into a staging object in parts, is checked against
+	// the ETag worked out as it went by, and is copied into place
+	if len(h.s3.puts) != 1 || !strings.HasPrefix(h.s3.puts[0], "uploads/") {
+		t.Fatalf("expected one multipart upload to a staging key, got %v", h.s3.puts)
+	}
+	if !slices.Contains(h.s3.deletes, h.s3.puts[0]) {
+		t.Errorf("expected the staging object %s to be deleted", h.s3.puts[0])
+	}
+	keys := h.s3.keys()
+	if len(keys) != 1 || !slices.Equal(h.s3.copies, keys) || !bytes.Equal(h.s3.objects[keys[0]], minimalMP4) {
+		t.Fatalf("expected the upload copied to its final key, got %v from copies %v", keys, h.s3.copies)
+	}
+	stored := h.getVideo(video.ID)
+	if stored.VideoKey == nil || *stored.VideoKey != keys[0] {
+		t.Errorf("expected the video to point at %s, got %v", keys[0], stored.VideoKey)
+	}
+	if stored.VideoSize == nil || *stored.VideoSize != int64(len(minimalMP4)) || stored.VideoETag == nil {
+		t.Errorf("expected size %d and an ETag, got %v and %v", len(minimalMP4), stored.VideoSize, stored.VideoETag)
+	}
+}
+
+func TestUploadVideoStreamedChecksumMismatch(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.s3PartSize = 32
+	h.cfg.store = newS3ObjectStore(h.s3, nil, h.cfg.s3Bucket, 1, h.cfg.s3PartSize)
+	token, video := h.createUserAndVideo("streamed@example.com")
+
+	wrong := sha256.Sum256([]byte("something else"))
+	req := h.uploadRequest(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4)
+	req.Header.Set("X-Content-SHA256", hex.EncodeToString(wrong[:]))
+	resp := h.send(req)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+	if code := errorCode(t, resp); code != errCodeIntegrityFailed {
+		t.Fatalf("expected %s, got %s", errCodeIntegrityFailed, code)
+	}
+	// The staged copy is already in the store by the time the checksum can
+	// be checked, so it has to be cleaned up
+	if len(h.s3.puts) != 1 || !slices.Contains(h.s3.deletes, h.s3.puts[0]) {
+		t.Errorf("expected the staging object to be deleted, put %v, deleted %v", h.s3.puts, h.s3.deletes)
+	}
+	if keys := h.s3.keys(); len(keys) != 0 {
+		t.Fatalf("expected nothing stored, got %v", keys)
+	}
+}
+
+func TestS3SignedURL(t *testing.T) {
+	store := newS3ObjectStore(newFakeS3(), nil, "tubely-test", 1, 0)
+	if _, err := store.SignedURL(context.Background(), "a.mp4", time.Minute); err == nil {
+		t.Error("expected an error without a presigner")
+	}
+
+	store.presigner = &fakePresigner{}
+	signed, err := store.SignedURL(context.Background(), "landscape/a.mp4", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://tubely-test.s3.example.com/landscape/a.mp4?X-Amz-Expires=3600"; signed != want {
+		t.Errorf("got %s, want %s", signed, want)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// spriteTileWidth is the width of each frame in a sprite sheet. The height
+// follows the video's aspect ratio.
+const spriteTileWidth = 160
+
+// spriteLayout describes how many frames a sprite sheet holds, how they're
+// tiled and how many seconds apart they were taken.
+type spriteLayout struct {
+	Frames   int
+	Columns  int
+	Rows     int
+	Interval float64
+}
+
+// planSpriteSheet lays out one frame every interval seconds, in rows of up
+// to maxColumns. Long videos that would need more than maxRows rows spread
+// the frames further apart instead, and short videos get a smaller sheet.
+func planSpriteSheet(duration, interval float64, maxColumns, maxRows int) spriteLayout {
+	frames := max(int(math.Ceil(duration/interval)), 1)
+	if frames > maxColumns*maxRows {
+		frames = maxColumns * maxRows
+		interval = duration / float64(frames)
+	}
+	columns := min(frames, maxColumns)
+	return spriteLayout{
+		Frames:   frames,
+		Columns:  columns,
+		Rows:     (frames + columns - 1) / columns,
+		Interval: interval,
+	}
+}
+
+// spriteTileHeight scales height to match a tileWidth-wide tile, rounded to
+// an even number of pixels.
+func spriteTileHeight(width, height, tileWidth int) int {
+	if width <= 0 || height <= 0 {
+		return tileWidth * 9 / 16
+	}
+	h := int(math.Round(float64(tileWidth)*float64(height)/float64(width)/2)) * 2
+	return max(h, 2)
+}
+
+// makeSpriteSheet tiles frames taken across the video into a single JPEG
+// and returns its path.
+func makeSpriteSheet(ctx context.Context, inputPath string, layout spriteLayout, tileWidth, tileHeight int) (string, error) {
+	outputPath := inputPath + ".sprite.jpg"
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d",
+		strconv.FormatFloat(layout.Interval, 'f', 3, 64), tileWidth, tileHeight, layout.Columns, layout.Rows)
+	_, err := runMediaTool(ctx, "ffmpeg", "-v", "error", "-i", inputPath,
+		"-an", "-vf", filter, "-frames:v", "1", "-q:v", "5", "-y", outputPath)
+	if err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// spriteVTT maps each frame's time range to its tile in imageURL using
+// media fragments, the format scrubbing UIs expect.
+func spriteVTT(layout spriteLayout, duration float64, tileWidth, tileHeight int, imageURL string) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := range layout.Frames {
+		start := float64(i) * layout.Interval
+		end := start + layout.Interval
+		if i == layout.Frames-1 || end > duration {
+			end = max(duration, start)
+		}
+		x := (i % layout.Columns) * tileWidth
+		y := (i / layout.Columns) * tileHeight
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), imageURL, x, y, tileWidth, tileHeight)
+	}
+	return b.String()
+}
+
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// generateSprites renders a sprite sheet and its WebVTT index for a freshly
+// uploaded video and stores both under sprites/<video ID>/ in the video's
+// bucket. Like previews it runs after the upload was answered, so failures
+// are only logged.
+func (cfg *apiConfig) generateSprites(store ObjectStore, videoID uuid.UUID, videoURL, videoKey string, probe videoProbe) {
+	err := cfg.storeSprites(context.Background(), store, videoID, videoURL, videoKey, probe)
+	if err != nil {
+		slog.Error("couldn't generate sprite sheet", "video_id", videoID, "err", err)
+	}
+}
+
+func (cfg *apiConfig) storeSprites(ctx context.Context, store ObjectStore, videoID uuid.UUID, videoURL, videoKey string, probe videoProbe) error {
+	sourcePath, err := downloadToTemp(ctx, store, videoKey)
+	if err != nil {
+		return fmt.Errorf("couldn't download video: %w", err)
+	}
+	defer os.Remove(sourcePath)
+
+	layout := planSpriteSheet(probe.Duration, cfg.spriteInterval, cfg.spriteColumns, cfg.spriteRows)
+	tileHeight := spriteTileHeight(probe.Width, probe.Height, spriteTileWidth)
+	spritePath, err := makeSpriteSheet(ctx, sourcePath, layout, spriteTileWidth, tileHeight)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spritePath)
+
+	spriteFile, err := os.Open(spritePath)
+	if err != nil {
+		return err
+	}
+	defer spriteFile.Close()
+
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return err
+	}
+	prefix := "sprites/" + videoID.String() + "/" + hex.EncodeToString(randomBytes)
+	imageKey := prefix + ".jpg"
+	vttKey := prefix + ".vtt"
+
+	_, err = store.Put(ctx, imageKey, spriteFile, "image/jpeg", cfg.storageClass)
+	if err != nil {
+		return fmt.Errorf("couldn't upload sprite sheet: %w", err)
+	}
+	// The VTT sits next to the image, so a relative reference resolves
+	vtt := spriteVTT(layout, probe.Duration, spriteTileWidth, tileHeight, path.Base(imageKey))
+	_, err = store.Put(ctx, vttKey, strings.NewReader(vtt), "text/vtt", cfg.storageClass)
+	if err != nil {
+		store.Delete(ctx, imageKey)
+		return fmt.Errorf("couldn't upload sprite index: %w", err)
+	}
+
+	spriteURL := cfg.s3CfDistribution + "/" + imageKey
+	vttURL := cfg.s3CfDistribution + "/" + vttKey
+	updated, err := cfg.db.SetSpriteURLs(videoID, videoURL, spriteURL, vttURL)
+	if err != nil || !updated {
+		// The video was replaced or removed while the sheet rendered
+		store.Delete(ctx, imageKey)
+		store.Delete(ctx, vttKey)
+		return err
+	}
+	return nil
+}
+
+// rewriteSpriteVTT points the cues of a stored sprite index, which name the
+// sheet relative to the index, at imageURL instead.
+func rewriteSpriteVTT(vtt, imageName, imageURL string) string {
+	lines := strings.Split(vtt, "\n")
+	for i, line := range lines {
+		if fragment, ok := strings.CutPrefix(line, imageName+"#"); ok {
+			lines[i] = imageURL + "#" + fragment
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// storyboardURL is where clients get a video's sprite index. When URLs are
+// signed the stored index's relative reference to the sheet wouldn't load,
+// so the API serves a copy pointing at a signed URL of it instead.
+func (cfg *apiConfig) storyboardURL(ctx context.Context, video database.Video) *string {
+	if video.SpriteVTTURL == nil || !cfg.signsURLs(video) {
+		return video.SpriteVTTURL
+	}
+	url := cfg.publicURL(ctx, "/api/videos/"+video.ID.String()+"/storyboard.vtt")
+	return &url
+}
+
+// spriteURLs returns whichever of a video's sprite sheet URLs are set.
+func spriteURLs(video database.Video) []string {
+	urls := []string{}
+	for _, u := range []*string{video.SpriteURL, video.SpriteVTTURL} {
+		if u != nil {
+			urls = append(urls, *u)
+		}
+	}
+	return urls
+}
+
+// deleteStoredURLs deletes the objects behind stored URLs from store.
+// Objects that are already gone are fine.
+func (cfg *apiConfig) deleteStoredURLs(ctx context.Context, store ObjectStore, urls []string) error {
+	for _, u := range urls {
+		key, ok := cfg.videoKeyFromURL(u)
+		if !ok {
+			continue
+		}
+		err := store.Delete(ctx, key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
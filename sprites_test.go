@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPlanSpriteSheet(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration float64
+		want     spriteLayout
+	}{
+		{"short video gets a small sheet", 25, spriteLayout{Frames: 3, Columns: 3, Rows: 1, Interval: 10}},
+		{"exactly one row", 50, spriteLayout{Frames: 5, Columns: 5, Rows: 1, Interval: 10}},
+		{"wraps into rows", 72, spriteLayout{Frames: 8, Columns: 5, Rows: 2, Interval: 10}},
+		{"long video spreads frames out", 300, spriteLayout{Frames: 15, Columns: 5, Rows: 3, Interval: 20}},
+		{"tiny video still gets a frame", 0.5, spriteLayout{Frames: 1, Columns: 1, Rows: 1, Interval: 10}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := planSpriteSheet(tc.duration, 10, 5, 3)
+			if got != tc.want {
+				t.Fatalf("planSpriteSheet(%v) = %+v, want %+v", tc.duration, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSpriteTileHeight(t *testing.T) {
+	if h := spriteTileHeight(1920, 1080, 160); h != 90 {
+		t.Errorf("16:9 tile height = %d, want 90", h)
+	}
+	if h := spriteTileHeight(1080, 1920, 160); h != 284 {
+		t.Errorf("9:16 tile height = %d, want 284", h)
+	}
+	if h := spriteTileHeight(0, 0, 160); h != 90 {
+		t.Errorf("unknown size tile height = %d, want 90", h)
+	}
+}
+
+func TestSpriteVTT(t *testing.T) {
+	layout := spriteLayout{Frames: 3, Columns: 2, Rows: 2, Interval: 10}
+	got := spriteVTT(layout, 25, 160, 90, "sheet.jpg")
+	want := "WEBVTT\n" +
+		"\n00:00:00.000 --> 00:00:10.000\nsheet.jpg#xywh=0,0,160,90\n" +
+		"\n00:00:10.000 --> 00:00:20.000\nsheet.jpg#xywh=160,0,160,90\n" +
+		"\n00:00:20.000 --> 00:00:25.000\nsheet.jpg#xywh=0,90,160,90\n"
+	if got != want {
+		t.Fatalf("unexpected VTT:\n%s", got)
+	}
+}
+
+func TestVTTTimestamp(t *testing.T) {
+	if got := vttTimestamp(3725.5); got != "01:02:05.500" {
+		t.Fatalf("vttTimestamp(3725.5) = %s", got)
+	}
+	if !strings.HasPrefix(vttTimestamp(0), "00:00:00") {
+		t.Fatal("expected zero timestamp")
+	}
+}
+
+func TestStoryboardVTTSignsSpriteSheet(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.presigner = &fakePresigner{}
+	h.cfg.store = newS3ObjectStore(h.s3, h.cfg.presigner, h.cfg.s3Bucket, 1, 0)
+	h.cfg.videoDelivery = videoDeliverySigned
+	token, video := h.createUserAndVideo("storyboard@example.com")
+
+	prefix := "sprites/" + video.ID.String() + "/abc"
+	h.s3.objects[prefix+".jpg"] = []byte("jpeg")
+	h.s3.objects[prefix+".vtt"] = []byte("WEBVTT\n\n00:00:00.000 --> 00:00:10.000\nabc.jpg#xywh=0,0,160,90\n")
+	videoURL := h.cfg.s3CfDistribution + "/landscape/abc.mp4"
+	spriteURL := h.cfg.s3CfDistribution + "/" + prefix + ".jpg"
+	vttURL := h.cfg.s3CfDistribution + "/" + prefix + ".vtt"
+	video.VideoURL = &videoURL
+	video.SpriteURL = &spriteURL
+	video.SpriteVTTURL = &vttURL
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := h.do(http.MethodGet, "/api/videos/"+video.ID.String(), token, nil)
+	var body videoResponse
+	decodeJSON(t, resp, &body)
+	wantPath := "/api/videos/" + video.ID.String() + "/storyboard.vtt"
+	if body.SpriteVTTURL == nil || !strings.HasSuffix(*body.SpriteVTTURL, wantPath) {
+		t.Fatalf("sprite_vtt_url = %v, want the storyboard endpoint", body.SpriteVTTURL)
+	}
+
+	resp = h.do(http.MethodGet, wantPath, token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("storyboard: got status %d", resp.StatusCode)
+	}
+	vtt, _ := io.ReadAll(resp.Body)
+	want := "https://tubely-test.s3.example.com/" + prefix + ".jpg?X-Amz-Expires=3600#xywh=0,0,160,90"
+	if !strings.Contains(string(vtt), "\n"+want+"\n") {
+		t.Errorf("storyboard doesn't point at the signed sheet:\n%s", vtt)
+	}
+}
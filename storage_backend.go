@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Storage backends STORAGE_BACKEND selects between.
+const (
+	storageS3           = "s3"
+	storageS3Compatible = "s3-compatible"
+	storageGCS          = "gcs"
+	storageLocal        = "local"
+)
+
+// gcsEndpoint is Cloud Storage's S3-compatible XML API. It's reached with
+// HMAC keys given as ordinary AWS credentials.
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// parseStorageBackend validates STORAGE_BACKEND, defaulting to S3.
+func parseStorageBackend(value string) (string, error) {
+	switch value {
+	case "":
+		return storageS3, nil
+	case storageS3, storageS3Compatible, storageGCS, storageLocal:
+		return value, nil
+	default:
+		return "", fmt.Errorf("must be %s, %s, %s or %s", storageS3, storageS3Compatible, storageGCS, storageLocal)
+	}
+}
+
+// s3EndpointOptions points the S3 client at the backend's endpoint.
+// Self-hosted services like MinIO serve buckets under the path instead of
+// as subdomains, so they're addressed path-style. An endpoint on plain S3
+// is kept as given, e.g. for a VPC endpoint or localstack.
+func s3EndpointOptions(backend, endpoint string) (func(*s3.Options), error) {
+	if backend == storageGCS && endpoint == "" {
+		endpoint = gcsEndpoint
+	}
+	if backend == storageS3Compatible && endpoint == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT is required for the %s backend", backend)
+	}
+	return func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = &endpoint
+		}
+		o.UsePathStyle = backend == storageS3Compatible
+	}, nil
+}
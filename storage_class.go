@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// archivalStorageClasses need a restore before an object can be read, which
+// would leave videos unplayable, so they can't be chosen for uploads.
+var archivalStorageClasses = []types.StorageClass{
+	types.StorageClassGlacier,
+	types.StorageClassDeepArchive,
+}
+
+// parseStorageClass validates an S3 storage class name such as STANDARD_IA
+// or INTELLIGENT_TIERING. An empty name is valid and means the bucket's
+// default class.
+func parseStorageClass(name string) (string, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "" {
+		return "", nil
+	}
+	class := types.StorageClass(name)
+	if slices.Contains(archivalStorageClasses, class) {
+		return "", fmt.Errorf("storage class %s needs a restore before videos can be played", name)
+	}
+	if !slices.Contains(class.Values(), class) {
+		return "", fmt.Errorf("unknown storage class %q", name)
+	}
+	return name, nil
+}
+
+// uploadStorageClass is the storage class for a video whose upload asked
+// for requested, falling back to the configured default.
+func (cfg *apiConfig) uploadStorageClass(requested string) (string, error) {
+	if strings.TrimSpace(requested) == "" {
+		return cfg.storageClass, nil
+	}
+	return parseStorageClass(requested)
+}
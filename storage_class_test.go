@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+func TestParseStorageClass(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: ""},
+		{in: "STANDARD", want: "STANDARD"},
+		{in: " standard_ia ", want: "STANDARD_IA"},
+		{in: "INTELLIGENT_TIERING", want: "INTELLIGENT_TIERING"},
+		{in: "GLACIER", wantErr: true},
+		{in: "DEEP_ARCHIVE", wantErr: true},
+		{in: "CHEAP", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStorageClass(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseStorageClass(%q): unexpected error %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseStorageClass(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUploadVideoStorageClass(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.storageClass = "INTELLIGENT_TIERING"
+	token, video := h.createUserAndVideo("classes@example.com")
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+
+	resp := h.upload(path, token, "video", "raw.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	key := h.s3.puts[len(h.s3.puts)-1]
+	if got := h.s3.classes[key]; got != "INTELLIGENT_TIERING" {
+		t.Errorf("expected the configured class, got %q", got)
+	}
+
+	withClass := func(class string) func(mw *multipart.Writer) {
+		return func(mw *multipart.Writer) {
+			part, _ := mw.CreateFormFile("video", "raw.mp4")
+			part.Write(append(minimalMP4, class...))
+			mw.WriteField("storage_class", class)
+		}
+	}
+
+	resp = h.sendForm(path, token, withClass("standard_ia"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	key = h.s3.puts[len(h.s3.puts)-1]
+	if got := h.s3.classes[key]; got != "STANDARD_IA" {
+		t.Errorf("expected the requested class, got %q", got)
+	}
+
+	resp = h.sendForm(path, token, withClass("GLACIER"))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+}
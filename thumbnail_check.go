@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// What to do about a thumbnail that's gone from the assets directory or
+// bucket, set with MISSING_THUMBNAIL_ACTION.
+const (
+	missingThumbnailClear      = "clear"
+	missingThumbnailRegenerate = "regenerate"
+)
+
+// thumbnailCheckResult counts what a thumbnail check found and did.
+type thumbnailCheckResult struct {
+	Checked     int
+	Missing     int
+	Cleared     int
+	Regenerated int
+}
+
+// checkThumbnails looks for videos whose thumbnail no longer exists in the
+// assets directory or bucket, e.g. after the disk was wiped, so clients
+// don't get broken images. Missing thumbnails are cleared, or with the
+// regenerate action replaced by a frame of the video, falling back to
+// clearing when that isn't possible. Videos in the trash and videos being
+// uploaded to are skipped.
+func (cfg *apiConfig) checkThumbnails(ctx context.Context, action string) (thumbnailCheckResult, error) {
+	const pageSize = 100
+
+	var result thumbnailCheckResult
+	var errs []error
+	for offset := 0; ; offset += pageSize {
+		videos, err := cfg.db.GetVideosPage(offset, pageSize)
+		if err != nil {
+			return result, fmt.Errorf("couldn't list videos: %w", err)
+		}
+
+		for _, video := range videos {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			if video.DeletedAt != nil || video.ThumbnailURL == nil {
+				continue
+			}
+			exists, ok := cfg.thumbnailExists(ctx, *video.ThumbnailURL)
+			if !ok {
+				continue
+			}
+			result.Checked++
+			if exists {
+				continue
+			}
+			result.Missing++
+
+			if !cfg.uploadLocks.tryLock(video.ID) {
+				continue
+			}
+			regenerated, err := cfg.fixMissingThumbnail(ctx, &video, action)
+			cfg.uploadLocks.unlock(video.ID)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", video.ID, err))
+				continue
+			}
+			if regenerated {
+				result.Regenerated++
+			} else {
+				result.Cleared++
+			}
+		}
+
+		if len(videos) < pageSize {
+			return result, errors.Join(errs...)
+		}
+	}
+}
+
+// fixMissingThumbnail replaces or clears a video's missing thumbnail and
+// saves the video. It reports whether a new thumbnail was made.
+func (cfg *apiConfig) fixMissingThumbnail(ctx context.Context, video *database.Video, action string) (bool, error) {
+	regenerated := false
+	if action == missingThumbnailRegenerate {
+		err := cfg.regenerateThumbnail(ctx, video)
+		if err != nil {
+			slog.Warn("couldn't regenerate missing thumbnail, clearing it", "video_id", video.ID, "err", err)
+		} else {
+			regenerated = true
+		}
+	}
+	if !regenerated {
+		if err := cfg.deleteThumbnailVariants(ctx, video.ThumbnailVariants); err != nil {
+			slog.Warn("couldn't delete sizes of missing thumbnail", "video_id", video.ID, "err", err)
+		}
+		video.ThumbnailURL = nil
+		video.ThumbnailFilename = nil
+		video.ThumbnailColor = nil
+		video.ThumbnailVariants = nil
+	}
+
+	err := cfg.db.UpdateVideo(*video)
+	if err != nil {
+		return false, fmt.Errorf("couldn't update video: %w", err)
+	}
+	return regenerated, nil
+}
+
+// regenerateThumbnail sets a video's thumbnail to its default poster frame.
+func (cfg *apiConfig) regenerateThumbnail(ctx context.Context, video *database.Video) error {
+	if !cfg.mediaToolsAvailable {
+		return errors.New("ffmpeg isn't installed")
+	}
+	if video.VideoURL == nil {
+		return errors.New("video hasn't been uploaded")
+	}
+	key, ok := cfg.videoKey(*video)
+	if !ok {
+		return errors.New("invalid video URL format")
+	}
+
+	videoPath, err := downloadToTemp(ctx, cfg.videoStore(*video), key)
+	if err != nil {
+		return fmt.Errorf("couldn't download video: %w", err)
+	}
+	defer os.Remove(videoPath)
+
+	if video.Duration == nil {
+		probe, err := probeVideo(ctx, videoPath)
+		if err != nil {
+			return fmt.Errorf("couldn't probe video: %w", err)
+		}
+		video.Duration = &probe.Duration
+	}
+	at, err := frameTimestamp("", *video.Duration)
+	if err != nil {
+		return err
+	}
+	thumbnailData, ext, err := cfg.frameThumbnail(ctx, videoPath, at)
+	if err != nil {
+		return fmt.Errorf("couldn't extract frame: %w", err)
+	}
+
+	// The old file is already gone, so replaceThumbnail has nothing to remove
+	err = cfg.replaceThumbnail(ctx, video, thumbnailData, ext)
+	if err != nil {
+		return err
+	}
+	video.ThumbnailFilename = nil
+	return nil
+}
+
+// thumbnailExists reports whether a stored thumbnail is still there. The
+// second result is false for URLs this server doesn't store, and when the
+// bucket couldn't be asked, since a thumbnail shouldn't be cleared over a
+// network blip.
+func (cfg *apiConfig) thumbnailExists(ctx context.Context, thumbnailURL string) (bool, bool) {
+	if key, ok := cfg.thumbnailKey(thumbnailURL); ok {
+		_, err := cfg.store.Head(ctx, key)
+		if errors.Is(err, ErrObjectNotFound) {
+			return false, true
+		}
+		if err != nil {
+			slog.Warn("couldn't check thumbnail", "key", key, "err", err)
+			return false, false
+		}
+		return true, true
+	}
+	path, ok := cfg.localThumbnailPath(thumbnailURL)
+	if !ok {
+		return false, false
+	}
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err), true
+}
+
+// localThumbnailPath maps a thumbnail URL served from the assets directory
+// to its file. Other URLs return false.
+func (cfg *apiConfig) localThumbnailPath(thumbnailURL string) (string, bool) {
+	name, ok := strings.CutPrefix(thumbnailURL, cfg.assetsBaseURL+"/")
+	if cfg.assetsBaseURL == "" || !ok {
+		_, name, ok = strings.Cut(thumbnailURL, "/assets/")
+	}
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	return filepath.Join(cfg.assetsRoot, name), true
+}
+
+// runThumbnailChecker checks thumbnails every interval until ctx is
+// cancelled.
+func (cfg *apiConfig) runThumbnailChecker(ctx context.Context, action string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		result, err := cfg.checkThumbnails(ctx, action)
+		if err != nil {
+			slog.Error("thumbnail check failed", "missing", result.Missing, "err", err)
+			continue
+		}
+		if result.Missing > 0 {
+			slog.Info("fixed missing thumbnails", "checked", result.Checked, "cleared", result.Cleared, "regenerated", result.Regenerated)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestCheckThumbnailsClearsMissingFiles(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	_, missing := h.createUserAndVideo("missing@example.com")
+	_, present := h.createUserAndVideo("present@example.com")
+
+	setThumbnail := func(video *database.Video, name string) {
+		t.Helper()
+		url := h.cfg.publicURL(context.Background(), "/assets/"+name)
+		color := "#112233"
+		video.ThumbnailURL = &url
+		video.ThumbnailColor = &color
+		if err := h.cfg.db.UpdateVideo(*video); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setThumbnail(&missing, "gone.jpg")
+	setThumbnail(&present, "here.jpg")
+	if err := os.WriteFile(filepath.Join(h.cfg.assetsRoot, "here.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without ffmpeg, regenerating falls back to clearing
+	result, err := h.cfg.checkThumbnails(context.Background(), missingThumbnailRegenerate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 2 || result.Missing != 1 || result.Cleared != 1 || result.Regenerated != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if got := h.getVideo(missing.ID); got.ThumbnailURL != nil || got.ThumbnailColor != nil {
+		t.Errorf("expected missing thumbnail to be cleared, got %v, %v", got.ThumbnailURL, got.ThumbnailColor)
+	}
+	if got := h.getVideo(present.ID); got.ThumbnailURL == nil {
+		t.Error("expected existing thumbnail to be kept")
+	}
+}
+
+func TestLocalThumbnailPath(t *testing.T) {
+	cfg := &apiConfig{assetsRoot: "assets"}
+	if path, ok := cfg.localThumbnailPath("https://example.com/assets/abc.png"); !ok || path != filepath.Join("assets", "abc.png") {
+		t.Errorf("got %q, %v", path, ok)
+	}
+	for _, url := range []string{"https://images.example.com/abc.png", "https://example.com/assets/", "https://example.com/assets/a/b.png"} {
+		if _, ok := cfg.localThumbnailPath(url); ok {
+			t.Errorf("%s: expected not local", url)
+		}
+	}
+}
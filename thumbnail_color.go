@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// dominantColor returns the most common color in img as "#rrggbb", for
+// clients to paint as a placeholder while the thumbnail loads. Colors are
+// bucketed coarsely so near-identical shades count together, and the
+// winning bucket's pixels are averaged. Large images are sampled on a grid.
+// It returns "" for an image with no opaque pixels.
+func dominantColor(img image.Image) string {
+	const maxSamples = 64 // per side
+
+	bounds := img.Bounds()
+	stepX := max(bounds.Dx()/maxSamples, 1)
+	stepY := max(bounds.Dy()/maxSamples, 1)
+
+	type bucket struct {
+		count   int
+		r, g, b uint64
+	}
+	buckets := map[uint32]*bucket{}
+	var best *bucket
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			// Un-premultiply, then keep the top 4 bits of each channel
+			r, g, b = r*0xffff/a>>8, g*0xffff/a>>8, b*0xffff/a>>8
+			key := r>>4<<8 | g>>4<<4 | b>>4
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.r += uint64(r)
+			bk.g += uint64(g)
+			bk.b += uint64(b)
+			if best == nil || bk.count > best.count {
+				best = bk
+			}
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	n := uint64(best.count)
+	return fmt.Sprintf("#%02x%02x%02x", best.r/n, best.g/n, best.b/n)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestDominantColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.RGBA{R: 0x20, G: 0x40, B: 0xc0, A: 0xff}}, image.Point{}, draw.Src)
+	// A smaller red patch shouldn't win
+	draw.Draw(img, image.Rect(0, 0, 50, 50), &image.Uniform{C: color.RGBA{R: 0xff, A: 0xff}}, image.Point{}, draw.Src)
+
+	if got := dominantColor(img); got != "#2040c0" {
+		t.Fatalf("expected #2040c0, got %s", got)
+	}
+}
+
+func TestDominantColorIgnoresTransparency(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	if got := dominantColor(img); got != "" {
+		t.Fatalf("expected no color for a transparent image, got %s", got)
+	}
+
+	img.Set(3, 3, color.NRGBA{G: 0xff, A: 0xff})
+	if got := dominantColor(img); got != "#00ff00" {
+		t.Fatalf("expected #00ff00, got %s", got)
+	}
+}
+
+func TestUploadThumbnailRecordsColor(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("owner@example.com")
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 36))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.RGBA{R: 0x10, G: 0x80, B: 0x30, A: 0xff}}, image.Point{}, draw.Src)
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := h.upload(fmt.Sprintf("/api/thumbnail_upload/%s", video.ID), token, "thumbnail", "thumb.png", buf.Bytes())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var got database.Video
+	decodeJSON(t, resp, &got)
+	if got.ThumbnailColor == nil || *got.ThumbnailColor != "#108030" {
+		t.Fatalf("expected color #108030, got %v", got.ThumbnailColor)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ffmpegImageTypes are the thumbnail types Go can't decode itself, so
+// they're read with ffmpeg. Accepting them needs ffmpeg installed.
+var ffmpegImageTypes = []string{"image/webp", "image/avif"}
+
+// sniffImageType returns an image's media type from its first bytes.
+// http.DetectContentType knows WebP but not AVIF, which is stored in MP4's
+// container.
+func sniffImageType(data []byte) string {
+	if isAVIF(data) {
+		return "image/avif"
+	}
+	return http.DetectContentType(data)
+}
+
+// isAVIF reports whether data starts with an ftyp box naming an AVIF brand,
+// as its major brand or a compatible one.
+func isAVIF(data []byte) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(data[:4]))
+	if size < 16 || size > len(data) {
+		return false
+	}
+	for i := 8; i+4 <= size; i += 4 {
+		// Bytes 12 to 16 are the minor version, not a brand
+		if i == 12 {
+			continue
+		}
+		if brand := string(data[i : i+4]); brand == "avif" || brand == "avis" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebPStructure makes sure a WebP file is exactly as long as its RIFF
+// header says, with nothing appended after the image.
+func checkWebPStructure(data []byte) error {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return fmt.Errorf("missing WebP header")
+	}
+	if size := int64(binary.LittleEndian.Uint32(data[4:8])) + 8; size != int64(len(data)) {
+		return fmt.Errorf("WebP header says %d bytes, file has %d", size, len(data))
+	}
+	return nil
+}
+
+// checkAVIFStructure makes sure an AVIF file is a run of boxes that ends
+// exactly where the file does, with nothing appended after the image.
+func checkAVIFStructure(data []byte) error {
+	for offset := int64(0); offset < int64(len(data)); {
+		rest := data[offset:]
+		if len(rest) < 8 {
+			return fmt.Errorf("truncated box at byte %d", offset)
+		}
+		size := int64(binary.BigEndian.Uint32(rest[:4]))
+		switch size {
+		case 0:
+			// The last box runs to the end of the file
+			return nil
+		case 1:
+			if len(rest) < 16 {
+				return fmt.Errorf("truncated box at byte %d", offset)
+			}
+			size = int64(binary.BigEndian.Uint64(rest[8:16]))
+		}
+		if size < 8 || size > int64(len(rest)) {
+			return fmt.Errorf("box at byte %d runs past the end of the file", offset)
+		}
+		offset += size
+	}
+	return nil
+}
+
+// decodeImage decodes a thumbnail of any supported type, with ffmpeg for
+// the types Go can't read. JPEGs are turned the way their EXIF orientation
+// says, which Go's decoder ignores.
+func decodeImage(ctx context.Context, data []byte) (image.Image, error) {
+	mediaType := sniffImageType(data)
+	if slices.Contains(ffmpegImageTypes, mediaType) {
+		return ffmpegDecodeImage(ctx, data, mediaType)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode image: %w", err)
+	}
+	if mediaType == "image/jpeg" {
+		img = orientImage(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// ffmpegDecodeImage decodes an image by having ffmpeg convert it to PNG.
+// Its size is checked with ffprobe first, so an image claiming enormous
+// dimensions isn't decoded.
+func ffmpegDecodeImage(ctx context.Context, data []byte, mediaType string) (image.Image, error) {
+	ext, _ := thumbnailExtension(mediaType)
+	dir, err := os.MkdirTemp("", "tubely-image-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	inputPath := filepath.Join(dir, "input"+ext)
+	if err := os.WriteFile(inputPath, data, 0600); err != nil {
+		return nil, err
+	}
+
+	output, err := runMediaTool(ctx, "ffprobe", "-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "csv=p=0:s=x",
+		inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read image header: %w", err)
+	}
+	widthText, heightText, _ := strings.Cut(strings.TrimSpace(string(output)), "x")
+	width, _ := strconv.Atoi(widthText)
+	height, _ := strconv.Atoi(heightText)
+	if width <= 0 || height <= 0 || width*height > maxThumbnailPixels {
+		return nil, fmt.Errorf("image is %dx%d", width, height)
+	}
+
+	outputPath := filepath.Join(dir, "output.png")
+	_, err = runMediaTool(ctx, "ffmpeg", "-v", "error", "-i", inputPath, "-frames:v", "1", "-c:v", "png", "-f", "image2", outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode image: %w", err)
+	}
+	f, err := os.Open(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// encodeWebP writes img as a WebP image at the given quality, encoded by
+// ffmpeg from a PNG copy.
+func encodeWebP(ctx context.Context, w io.Writer, img image.Image, quality int) error {
+	dir, err := os.MkdirTemp("", "tubely-image-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	inputPath := filepath.Join(dir, "input.png")
+	input, err := os.Create(inputPath)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(input, img)
+	input.Close()
+	if err != nil {
+		return err
+	}
+
+	outputPath := filepath.Join(dir, "output.webp")
+	_, err = runMediaTool(ctx, "ffmpeg", "-v", "error", "-i", inputPath,
+		"-frames:v", "1", "-c:v", "libwebp", "-quality", strconv.Itoa(quality),
+		"-f", "webp", "-y", outputPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
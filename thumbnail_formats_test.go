@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// fakeWebP is a RIFF container holding a WebP chunk, enough to sniff and
+// check the structure of but not to decode.
+func fakeWebP(payload []byte) []byte {
+	chunk := append([]byte("VP8L"), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	chunk = append(chunk, payload...)
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(chunk)))...)
+	data = append(data, "WEBP"...)
+	return append(data, chunk...)
+}
+
+// fakeAVIF is an ftyp box with the given brands followed by an empty mdat.
+func fakeAVIF(major string, compatible ...string) []byte {
+	body := []byte(major + "\x00\x00\x00\x00")
+	for _, brand := range compatible {
+		body = append(body, brand...)
+	}
+	data := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	data = append(data, "ftyp"...)
+	data = append(data, body...)
+	data = binary.BigEndian.AppendUint32(data, 8)
+	return append(data, "mdat"...)
+}
+
+func TestSniffImageType(t *testing.T) {
+	tests := map[string]struct {
+		data []byte
+		want string
+	}{
+		"webp":            {fakeWebP([]byte("pixels")), "image/webp"},
+		"avif":            {fakeAVIF("avif", "mif1", "miaf"), "image/avif"},
+		"avif compatible": {fakeAVIF("mif1", "avif"), "image/avif"},
+		"mp4":             {fakeAVIF("isom", "mp41"), "video/mp4"},
+	}
+	for name, tt := range tests {
+		if got := sniffImageType(tt.data); got != tt.want {
+			t.Errorf("%s: got %s, want %s", name, got, tt.want)
+		}
+	}
+}
+
+func TestImageStructureChecks(t *testing.T) {
+	webp := fakeWebP([]byte("pixels"))
+	if err := checkWebPStructure(webp); err != nil {
+		t.Errorf("webp: %v", err)
+	}
+	if err := checkWebPStructure(append(bytes.Clone(webp), "PK\x03\x04"...)); err == nil {
+		t.Error("expected appended data after a WebP to be rejected")
+	}
+
+	avif := fakeAVIF("avif", "mif1")
+	if err := checkAVIFStructure(avif); err != nil {
+		t.Errorf("avif: %v", err)
+	}
+	if err := checkAVIFStructure(append(bytes.Clone(avif), "<script>"...)); err == nil {
+		t.Error("expected appended data after an AVIF to be rejected")
+	}
+	if err := checkAVIFStructure(avif[:len(avif)-2]); err == nil {
+		t.Error("expected a truncated AVIF to be rejected")
+	}
+}
+
+func TestVerifyThumbnailRejectsPolyglotWebP(t *testing.T) {
+	allowed := []string{"image/webp"}
+	data := append(fakeWebP([]byte("pixels")), "<html>"...)
+	_, _, err := verifyThumbnail(context.Background(), data, allowed)
+	if err == nil || errors.Is(err, errUnsupportedThumbnail) {
+		t.Errorf("expected a verification error, got %v", err)
+	}
+}
+
+func TestUploadWebPThumbnail(t *testing.T) {
+	requireFFmpeg(t)
+	h := newTestHarness(t)
+	h.cfg.allowedThumbnailTypes = append(h.cfg.allowedThumbnailTypes, "image/webp")
+	token, video := h.createUserAndVideo("webp@example.com")
+
+	webp := &bytes.Buffer{}
+	if err := encodeWebP(context.Background(), webp, image.NewRGBA(image.Rect(0, 0, 400, 200)), 80); err != nil {
+		t.Skipf("ffmpeg can't encode WebP: %v", err)
+	}
+
+	resp := h.upload("/api/thumbnail_upload/"+video.ID.String(), token, "thumbnail", "thumb.webp", webp.Bytes())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	stored := h.getVideo(video.ID)
+	if filepath.Ext(*stored.ThumbnailURL) != ".webp" {
+		t.Errorf("expected a WebP thumbnail, got %s", *stored.ThumbnailURL)
+	}
+	if len(stored.ThumbnailVariants) != 1 || filepath.Ext(stored.ThumbnailVariants[0].URL) != ".webp" {
+		t.Errorf("expected a small WebP variant, got %+v", stored.ThumbnailVariants)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+)
+
+// stripImageMetadata removes everything from a thumbnail that isn't needed
+// to show it, like EXIF GPS coordinates, camera details and text comments,
+// and returns the cleaned image with the extension it should be stored
+// with. JPEG, PNG and WebP files are rewritten without their metadata
+// segments, leaving the pixels untouched. A JPEG's EXIF orientation is
+// kept, on its own, so photos still display the right way up. AVIF
+// metadata can't be removed in place, so AVIF images are re-encoded as
+// WebP. Other types are returned unchanged.
+func stripImageMetadata(ctx context.Context, data []byte, quality int) ([]byte, string, error) {
+	mediaType := sniffImageType(data)
+	ext, _ := thumbnailExtension(mediaType)
+	var err error
+	switch mediaType {
+	case "image/jpeg":
+		data, err = stripJPEGMetadata(data)
+	case "image/png":
+		data, err = stripPNGMetadata(data)
+	case "image/webp":
+		data, err = stripWebPMetadata(data)
+	case "image/avif":
+		var img image.Image
+		img, err = decodeImage(ctx, data)
+		if err != nil {
+			return nil, "", err
+		}
+		buf := &bytes.Buffer{}
+		err = encodeWebP(ctx, buf, img, quality)
+		data, ext = buf.Bytes(), thumbnailFormatExtensions["webp"]
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't strip image metadata: %w", err)
+	}
+	return data, ext, nil
+}
+
+// keptJPEGMarkers are the JPEG segments other than image data that survive
+// stripping: the JFIF header, ICC color profiles and Adobe's color
+// transform flag, which decoders need to get colors right.
+var keptJPEGMarkers = map[byte]bool{
+	0xe0: true, // APP0, JFIF
+	0xe2: true, // APP2, ICC profile
+	0xee: true, // APP14, Adobe
+}
+
+// stripJPEGMetadata drops the application segments and comments from a
+// JPEG, which is where EXIF, XMP and IPTC data live. The segments that
+// describe the image itself, and everything from the start of the scan
+// on, are copied as they are.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("missing JPEG start of image marker")
+	}
+	orientation := 1
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	wroteOrientation := false
+
+	for i := 2; i < len(data); {
+		if data[i] != 0xff {
+			return nil, fmt.Errorf("expected a marker at byte %d", i)
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte before a marker
+			i++
+			continue
+		}
+		if marker == 0xd9 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			// Markers without a length
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+		if i+4 > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+		if end > len(data) || end < i+4 {
+			return nil, errors.New("JPEG segment runs past the end of the file")
+		}
+		segment := data[i:end]
+
+		if marker == 0xe1 && orientation == 1 {
+			if o, ok := exifOrientation(segment[4:]); ok {
+				orientation = o
+			}
+		}
+		isMetadata := (marker >= 0xe0 && marker <= 0xef && !keptJPEGMarkers[marker]) || marker == 0xfe
+		if !isMetadata {
+			// The orientation goes before the first segment that isn't
+			// APP0, where EXIF normally sits
+			if !wroteOrientation && marker != 0xe0 {
+				if orientation != 1 {
+					out.Write(orientationSegment(orientation))
+				}
+				wroteOrientation = true
+			}
+			out.Write(segment)
+		}
+		i = end
+
+		if marker == 0xda {
+			// Start of scan: the rest is image data
+			out.Write(data[i:])
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// exifOrientation reads the orientation tag from the first IFD of an APP1
+// segment's EXIF data.
+func exifOrientation(payload []byte) (int, bool) {
+	tiff, ok := bytes.CutPrefix(payload, []byte("Exif\x00\x00"))
+	if !ok || len(tiff) < 8 {
+		return 0, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			return o, o >= 1 && o <= 8
+		}
+	}
+	return 0, false
+}
+
+// orientationSegment is an APP1 segment whose EXIF data holds nothing but
+// the orientation.
+func orientationSegment(orientation int) []byte {
+	exif := []byte("Exif\x00\x00")
+	exif = append(exif, "MM\x00\x2a"...)               // big-endian TIFF header
+	exif = binary.BigEndian.AppendUint32(exif, 8)      // first IFD offset
+	exif = binary.BigEndian.AppendUint16(exif, 1)      // one entry
+	exif = binary.BigEndian.AppendUint16(exif, 0x0112) // orientation
+	exif = binary.BigEndian.AppendUint16(exif, 3)      // SHORT
+	exif = binary.BigEndian.AppendUint32(exif, 1)      // one value
+	exif = binary.BigEndian.AppendUint16(exif, uint16(orientation))
+	exif = binary.BigEndian.AppendUint16(exif, 0) // padding
+	exif = binary.BigEndian.AppendUint32(exif, 0) // no next IFD
+
+	segment := []byte{0xff, 0xe1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(exif)+2))
+	return append(segment, exif...)
+}
+
+// strippedPNGChunks are the PNG chunks that hold text, EXIF data and
+// modification times rather than anything needed to draw the image.
+var strippedPNGChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata drops the text, EXIF and time chunks from a PNG.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("missing PNG signature")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:i+4]))
+		if end > len(data) || end < i+12 {
+			return nil, errors.New("PNG chunk runs past the end of the file")
+		}
+		chunk := data[i:end]
+		typ := string(chunk[4:8])
+		if crc32.ChecksumIEEE(chunk[4:len(chunk)-4]) != binary.BigEndian.Uint32(chunk[len(chunk)-4:]) {
+			return nil, fmt.Errorf("bad checksum on PNG %s chunk", typ)
+		}
+		if !strippedPNGChunks[typ] {
+			out.Write(chunk)
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks from a WebP and clears
+// the flags announcing them in its extended header.
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if err := checkWebPStructure(data); err != nil {
+		return nil, err
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		end := i + 8 + size + size%2
+		if end > len(data) || end < i+8 {
+			return nil, errors.New("WebP chunk runs past the end of the file")
+		}
+		chunk := bytes.Clone(data[i:end])
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP flags
+			}
+			out.Write(chunk)
+		default:
+			out.Write(chunk)
+		}
+		i = end
+	}
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// orientImage turns a decoded image the way its EXIF orientation says it
+// should be shown. Orientations 5 to 8 swap its width and height.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			// Where in the stored image the shown pixel comes from
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 1 when it
+// has none.
+func jpegOrientation(data []byte) int {
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == 0xda {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+		if end > len(data) || end < i+4 {
+			break
+		}
+		if marker == 0xe1 {
+			if o, ok := exifOrientation(data[i+4 : end]); ok {
+				return o
+			}
+		}
+		i = end
+	}
+	return 1
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// jpegWithEXIF encodes a width x height JPEG carrying an EXIF segment with
+// the given orientation and a fake GPS note, plus a comment.
+func jpegWithEXIF(t *testing.T, width, height, orientation int) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	exif := orientationSegment(orientation)
+	exif = append(exif, "GPS 51.5007N 0.1246W"...)
+	binary.BigEndian.PutUint16(exif[2:4], uint16(len(exif)-2))
+	comment := []byte{0xff, 0xfe, 0x00, 0x0b}
+	comment = append(comment, "my house!"...)
+
+	var out []byte
+	out = append(out, encoded[:2]...)
+	out = append(out, exif...)
+	out = append(out, comment...)
+	return append(out, encoded[2:]...)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	data := jpegWithEXIF(t, 40, 20, 6)
+	stripped, ext, err := stripImageMetadata(context.Background(), data, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext != ".jpg" {
+		t.Errorf("expected .jpg, got %s", ext)
+	}
+	if bytes.Contains(stripped, []byte("GPS")) || bytes.Contains(stripped, []byte("my house")) {
+		t.Error("metadata survived stripping")
+	}
+	if got := jpegOrientation(stripped); got != 6 {
+		t.Errorf("expected orientation 6 to be kept, got %d", got)
+	}
+
+	// Orientation 6 is a quarter turn, so the decoded image is upright
+	img, err := decodeImage(context.Background(), stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Errorf("expected 20x40 after orienting, got %v", b)
+	}
+
+	// Without an orientation to keep, no EXIF is left at all
+	stripped, _, err = stripImageMetadata(context.Background(), jpegWithEXIF(t, 4, 4, 1), 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped, []byte("Exif")) {
+		t.Error("expected no EXIF segment")
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// Put a text chunk after IHDR, which is 25 bytes long
+	text := []byte("Location\x00Home sweet home")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)))
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	ihdrEnd := len(pngSignature) + 25
+	data := append(append(bytes.Clone(encoded[:ihdrEnd]), chunk...), encoded[ihdrEnd:]...)
+
+	stripped, _, err := stripImageMetadata(context.Background(), data, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, encoded) {
+		t.Error("expected the text chunk to be removed and nothing else")
+	}
+}
+
+func TestStripWebPMetadata(t *testing.T) {
+	chunk := func(typ string, payload []byte) []byte {
+		c := append([]byte(typ), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+		c = append(c, payload...)
+		if len(payload)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x08 | 0x04
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = append(body, chunk("VP8X", vp8x)...)
+	body = append(body, chunk("VP8L", []byte{0x2f, 1, 2, 3, 4})...)
+	body = append(body, chunk("EXIF", []byte("GPS 51.5007N"))...)
+	body = append(body, chunk("XMP ", []byte("<x:xmpmeta/>"))...)
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	data = append(data, body...)
+
+	stripped, err := stripWebPMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWebPStructure(stripped); err != nil {
+		t.Errorf("stripped file is malformed: %v", err)
+	}
+	if bytes.Contains(stripped, []byte("GPS")) || bytes.Contains(stripped, []byte("xmpmeta")) {
+		t.Error("metadata survived stripping")
+	}
+	if flags := stripped[20]; flags != 0 {
+		t.Errorf("expected the metadata flags to be cleared, got %#x", flags)
+	}
+}
+
+func TestThumbnailUploadStripsMetadata(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("exif@example.com")
+
+	resp := h.upload("/api/thumbnail_upload/"+video.ID.String(), token, "thumbnail", "photo.jpg", jpegWithEXIF(t, 64, 48, 1))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("thumbnail upload: expected 200, got %d", resp.StatusCode)
+	}
+	stored := h.getVideo(video.ID)
+	path, ok := h.cfg.localThumbnailPath(*stored.ThumbnailURL)
+	if !ok {
+		t.Fatalf("expected a local thumbnail, got %s", *stored.ThumbnailURL)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("GPS")) {
+		t.Error("stored thumbnail still has its EXIF data")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/draw"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// thumbnailSize is a width thumbnails are scaled down to for clients that
+// show them small, like a grid of videos.
+type thumbnailSize struct {
+	name  string
+	width int
+}
+
+// thumbnailSizes are the variants made of every thumbnail, smallest first.
+var thumbnailSizes = []thumbnailSize{
+	{name: "small", width: 320},
+	{name: "medium", width: 640},
+	{name: "large", width: 1280},
+}
+
+// storeThumbnailVariants stores a copy of a thumbnail at each size that's
+// narrower than the image, named after the thumbnail's file. Thumbnails
+// aren't scaled up, so a small image may get no variants at all. AVIF
+// can't be encoded here, so AVIF thumbnails get WebP variants.
+func (cfg *apiConfig) storeThumbnailVariants(ctx context.Context, baseName, ext string, img image.Image) (database.ThumbnailVariants, error) {
+	if ext == ".avif" {
+		ext = thumbnailFormatExtensions["webp"]
+	}
+	format := ""
+	for f, e := range thumbnailFormatExtensions {
+		if e == ext {
+			format = f
+		}
+	}
+	if format == "" || (format == "webp" && !cfg.mediaToolsAvailable) {
+		return nil, nil
+	}
+
+	var variants database.ThumbnailVariants
+	bounds := img.Bounds()
+	for _, size := range thumbnailSizes {
+		if size.width >= bounds.Dx() {
+			break
+		}
+		resized := resizeImage(img, size.width)
+		buf := &bytes.Buffer{}
+		err := encodeImage(ctx, buf, resized, format, cfg.thumbnailQuality)
+		if err == nil {
+			var url string
+			url, err = cfg.storeThumbnail(ctx, baseName+"-"+size.name+ext, buf)
+			variants = append(variants, database.ThumbnailVariant{
+				Name:   size.name,
+				Width:  resized.Bounds().Dx(),
+				Height: resized.Bounds().Dy(),
+				URL:    url,
+			})
+		}
+		if err != nil {
+			cfg.deleteThumbnailVariants(context.WithoutCancel(ctx), variants)
+			return nil, err
+		}
+	}
+	return variants, nil
+}
+
+// deleteThumbnailVariants removes the stored files of a thumbnail's
+// variants, carrying on past failures.
+func (cfg *apiConfig) deleteThumbnailVariants(ctx context.Context, variants database.ThumbnailVariants) error {
+	var errs []error
+	for _, variant := range variants {
+		if variant.URL != "" {
+			errs = append(errs, cfg.deleteThumbnail(ctx, variant.URL))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// thumbnailResponseURLs maps each thumbnail size to the URL clients load
+// it from. Sizes the thumbnail was too small to make get the thumbnail
+// itself.
+func (cfg *apiConfig) thumbnailResponseURLs(video database.Video) map[string]string {
+	if video.ThumbnailURL == nil {
+		return nil
+	}
+	urls := make(map[string]string, len(thumbnailSizes))
+	for _, size := range thumbnailSizes {
+		url := *video.ThumbnailURL
+		for _, variant := range video.ThumbnailVariants {
+			if variant.Name == size.name {
+				url = variant.URL
+			}
+		}
+		if delivered := cfg.thumbnailDeliveryURL(video, url); delivered != nil {
+			urls[size.name] = *delivered
+		}
+	}
+	return urls
+}
+
+// resizeImage scales img down to width, keeping its aspect ratio. Each
+// output pixel averages the block of source pixels it covers, which keeps
+// the result smooth where picking single pixels would alias.
+func resizeImage(img image.Image, width int) *image.RGBA {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	height := max(1, (srcH*width+srcW/2)/srcW)
+
+	// Work on premultiplied RGBA so transparent pixels don't darken the
+	// edges they're averaged into
+	src := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcH/height, max((y+1)*srcH/height, y*srcH/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcW/width, max((x+1)*srcW/width, x*srcW/width+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			// Alternate black and white columns
+			if x%2 == 1 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	resized := resizeImage(src, 2)
+	if got := resized.Bounds(); got.Dx() != 2 || got.Dy() != 1 {
+		t.Fatalf("expected 2x1, got %v", got)
+	}
+	// Each output pixel averages a black and a white column
+	if c := resized.RGBAAt(0, 0); c.R != 128 || c.G != 128 || c.B != 128 || c.A != 255 {
+		t.Errorf("expected mid grey, got %v", c)
+	}
+}
+
+func TestThumbnailVariants(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.thumbnailQuality = 85
+	token, video := h.createUserAndVideo("sizes@example.com")
+
+	upload := func(width, height int) videoResponse {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+			t.Fatal(err)
+		}
+		resp := h.upload("/api/thumbnail_upload/"+video.ID.String(), token, "thumbnail", "thumb.png", buf.Bytes())
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("thumbnail upload: expected 200, got %d", resp.StatusCode)
+		}
+		var body videoResponse
+		decodeJSON(t, resp, &body)
+		return body
+	}
+
+	body := upload(1000, 500)
+	stored := h.getVideo(video.ID)
+	if len(stored.ThumbnailVariants) != 2 {
+		t.Fatalf("expected small and medium variants, got %+v", stored.ThumbnailVariants)
+	}
+	small := stored.ThumbnailVariants[0]
+	if small.Name != "small" || small.Width != 320 || small.Height != 160 {
+		t.Errorf("unexpected small variant %+v", small)
+	}
+	if body.Thumbnails["small"] != small.URL || body.Thumbnails["medium"] != stored.ThumbnailVariants[1].URL {
+		t.Errorf("unexpected thumbnails %v", body.Thumbnails)
+	}
+	// The original isn't scaled up for the large size
+	if body.Thumbnails["large"] != *stored.ThumbnailURL {
+		t.Errorf("expected the original for large, got %q", body.Thumbnails["large"])
+	}
+	smallPath, ok := h.cfg.localThumbnailPath(small.URL)
+	if !ok {
+		t.Fatalf("expected a local variant, got %s", small.URL)
+	}
+	data, err := os.ReadFile(smallPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, err := png.DecodeConfig(bytes.NewReader(data)); err != nil || config.Width != 320 {
+		t.Errorf("variant file: %+v, %v", config, err)
+	}
+
+	// Replacing the thumbnail deletes the old variants
+	upload(100, 100)
+	if _, err := os.Stat(smallPath); !os.IsNotExist(err) {
+		t.Errorf("old variant wasn't removed: %v", err)
+	}
+	replaced := h.getVideo(video.ID)
+	if len(replaced.ThumbnailVariants) != 0 {
+		t.Errorf("expected no variants for a small image, got %+v", replaced.ThumbnailVariants)
+	}
+}
+
+func TestThumbnailVariantsMigrate(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.adminAPIKey = "admin-key"
+	token, video := h.createUserAndVideo("sizes@example.com")
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 400, 300))); err != nil {
+		t.Fatal(err)
+	}
+	resp := h.upload("/api/thumbnail_upload/"+video.ID.String(), token, "thumbnail", "thumb.png", buf.Bytes())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("thumbnail upload: expected 200, got %d", resp.StatusCode)
+	}
+
+	h.cfg.thumbnailStorage = thumbnailStorageS3
+	req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/migrate_thumbnails", nil)
+	req.Header.Set("Authorization", "ApiKey admin-key")
+	if resp := h.send(req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("migrate: expected 200, got %d", resp.StatusCode)
+	}
+
+	migrated := h.getVideo(video.ID)
+	if len(migrated.ThumbnailVariants) != 1 {
+		t.Fatalf("expected the small variant, got %+v", migrated.ThumbnailVariants)
+	}
+	key, ok := h.cfg.thumbnailKey(migrated.ThumbnailVariants[0].URL)
+	if !ok || !strings.HasSuffix(key, "-small.png") || h.s3.objects[key] == nil {
+		t.Errorf("expected the variant in the bucket, got %s", migrated.ThumbnailVariants[0].URL)
+	}
+}
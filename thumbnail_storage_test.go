@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestThumbnailsInBucket(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.adminAPIKey = "admin-key"
+	token, video := h.createUserAndVideo("thumbs@example.com")
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 16, 9))); err != nil {
+		t.Fatal(err)
+	}
+	uploadThumbnail := func() string {
+		t.Helper()
+		resp := h.upload("/api/thumbnail_upload/"+video.ID.String(), token, "thumbnail", "thumb.png", buf.Bytes())
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("thumbnail upload: expected 200, got %d", resp.StatusCode)
+		}
+		return *h.getVideo(video.ID).ThumbnailURL
+	}
+	migrate := func(want int) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/migrate_thumbnails", nil)
+		req.Header.Set("Authorization", "ApiKey admin-key")
+		if resp := h.send(req); resp.StatusCode != want {
+			t.Fatalf("migrate: expected %d, got %d", want, resp.StatusCode)
+		}
+	}
+
+	localURL := uploadThumbnail()
+	localPath, ok := h.cfg.localThumbnailPath(localURL)
+	if !ok {
+		t.Fatalf("expected a local thumbnail, got %s", localURL)
+	}
+	migrate(http.StatusConflict)
+
+	h.cfg.thumbnailStorage = thumbnailStorageS3
+	migrate(http.StatusOK)
+	migrated := *h.getVideo(video.ID).ThumbnailURL
+	key, ok := h.cfg.thumbnailKey(migrated)
+	if !ok || key != thumbnailKeyPrefix+strings.TrimPrefix(localURL, h.cfg.publicURL(context.Background(), "/assets/")) {
+		t.Fatalf("migrated thumbnail URL = %s", migrated)
+	}
+	if !bytes.Equal(h.s3.objects[key], buf.Bytes()) {
+		t.Error("migrated thumbnail doesn't match the file")
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Errorf("local file wasn't removed: %v", err)
+	}
+
+	// Replacing a thumbnail in the bucket deletes the old object
+	replaced := uploadThumbnail()
+	newKey, ok := h.cfg.thumbnailKey(replaced)
+	if !ok || newKey == key {
+		t.Fatalf("replaced thumbnail URL = %s", replaced)
+	}
+	if keys := h.s3.keys(); len(keys) != 1 || keys[0] != newKey {
+		t.Fatalf("stored keys = %v", keys)
+	}
+	if result, err := h.cfg.checkThumbnails(context.Background(), missingThumbnailClear); err != nil || result.Checked != 1 || result.Missing != 0 {
+		t.Fatalf("thumbnail check = %+v, %v", result, err)
+	}
+
+	if resp := h.do(http.MethodDelete, "/api/videos/"+video.ID.String()+"?permanent=true", token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("permanent delete: expected 204, got %d", resp.StatusCode)
+	}
+	if keys := h.s3.keys(); len(keys) != 0 {
+		t.Errorf("left behind %v", keys)
+	}
+}
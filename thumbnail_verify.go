@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"slices"
+)
+
+// maxThumbnailBytes caps the size of a thumbnail file.
+const maxThumbnailBytes = 10 << 20 // 10 MB
+
+// maxThumbnailPixels caps the decoded size of a thumbnail, so a small file
+// that claims enormous dimensions can't exhaust memory when it's decoded.
+const maxThumbnailPixels = 8192 * 8192
+
+// errUnsupportedThumbnail means an upload isn't one of the allowed image
+// types. Other verifyThumbnail errors mean it claims to be one but isn't.
+var errUnsupportedThumbnail = errors.New("unsupported media type")
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	pngIEND      = []byte("\x00\x00\x00\x00IEND\xaeB`\x82")
+)
+
+// verifyThumbnail makes sure data is a genuine image of one of the allowed
+// types before it's stored, and returns its type and file extension.
+// Sniffing only looks at the first bytes, so the whole file must also have
+// the structure of that type, with nothing appended after the image (where
+// polyglot files hide a second format), and decode cleanly. WebP and AVIF
+// images are decoded with ffmpeg.
+func verifyThumbnail(ctx context.Context, data []byte, allowedTypes []string) (string, string, error) {
+	mediaType := sniffImageType(data)
+	ext, ok := thumbnailExtension(mediaType)
+	if !ok || !slices.Contains(allowedTypes, mediaType) {
+		return "", "", errUnsupportedThumbnail
+	}
+
+	switch mediaType {
+	case "image/jpeg":
+		if !bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}) {
+			return "", "", errors.New("missing JPEG start of image marker")
+		}
+		if !bytes.HasSuffix(data, []byte{0xff, 0xd9}) {
+			return "", "", errors.New("data after the end of the JPEG image")
+		}
+	case "image/png":
+		if !bytes.HasPrefix(data, pngSignature) || len(data) < 16 || string(data[12:16]) != "IHDR" {
+			return "", "", errors.New("PNG doesn't start with a header chunk")
+		}
+		if !bytes.HasSuffix(data, pngIEND) {
+			return "", "", errors.New("data after the end of the PNG image")
+		}
+	case "image/webp":
+		if err := checkWebPStructure(data); err != nil {
+			return "", "", err
+		}
+	case "image/avif":
+		if err := checkAVIFStructure(data); err != nil {
+			return "", "", err
+		}
+	}
+	if slices.Contains(ffmpegImageTypes, mediaType) {
+		if _, err := ffmpegDecodeImage(ctx, data, mediaType); err != nil {
+			return "", "", err
+		}
+		return mediaType, ext, nil
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't read image header: %w", err)
+	}
+	if "image/"+format != mediaType {
+		return "", "", fmt.Errorf("decodes as %s, not %s", format, mediaType)
+	}
+	if config.Width == 0 || config.Height == 0 || config.Width*config.Height > maxThumbnailPixels {
+		return "", "", fmt.Errorf("image is %dx%d", config.Width, config.Height)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return "", "", fmt.Errorf("couldn't decode image: %w", err)
+	}
+	return mediaType, ext, nil
+}
+
+// respondWithThumbnailError reports an upload verifyThumbnail rejected.
+func respondWithThumbnailError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedThumbnail) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Unsupported media type", err)
+		return
+	}
+	respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Thumbnail isn't a valid image: "+err.Error(), err)
+}
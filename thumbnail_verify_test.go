@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func encodedTestImage(t *testing.T, format string) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 9))
+	buf := &bytes.Buffer{}
+	var err error
+	if format == "png" {
+		err = png.Encode(buf, img)
+	} else {
+		err = jpeg.Encode(buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifyThumbnail(t *testing.T) {
+	allowed := []string{"image/jpeg", "image/png"}
+	pngData := encodedTestImage(t, "png")
+	jpegData := encodedTestImage(t, "jpeg")
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		ext  string
+	}{
+		{"png", pngData, ".png"},
+		{"jpeg", jpegData, ".jpg"},
+	} {
+		_, ext, err := verifyThumbnail(context.Background(), tt.data, allowed)
+		if err != nil || ext != tt.ext {
+			t.Errorf("%s: got %q, %v", tt.name, ext, err)
+		}
+	}
+
+	if _, _, err := verifyThumbnail(context.Background(), pngData, []string{"image/jpeg"}); !errors.Is(err, errUnsupportedThumbnail) {
+		t.Errorf("disallowed type: expected errUnsupportedThumbnail, got %v", err)
+	}
+
+	invalid := map[string][]byte{
+		"appended zip":    append(bytes.Clone(jpegData), []byte("PK\x03\x04payload")...),
+		"truncated png":   pngData[:len(pngData)-20],
+		"corrupt pixels":  corruptMiddle(pngData),
+		"header only png": append(bytes.Clone(pngData[:33]), pngIEND...),
+	}
+	for name, data := range invalid {
+		_, _, err := verifyThumbnail(context.Background(), data, allowed)
+		if err == nil || errors.Is(err, errUnsupportedThumbnail) {
+			t.Errorf("%s: expected a verification error, got %v", name, err)
+		}
+	}
+}
+
+// corruptMiddle flips bytes inside the image data, leaving the start and end
+// markers intact.
+func corruptMiddle(data []byte) []byte {
+	out := bytes.Clone(data)
+	for i := 40; i < len(out)-20; i++ {
+		out[i] ^= 0xff
+	}
+	return out
+}
+
+func TestUploadThumbnailRejectsPolyglot(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("polyglot@example.com")
+
+	data := append(encodedTestImage(t, "jpeg"), []byte("<script>alert(1)</script>")...)
+	resp := h.upload(fmt.Sprintf("/api/thumbnail_upload/%s", video.ID), token, "thumbnail", "thumb.jpg", data)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	decodeJSON(t, resp, &body)
+	if body.Code != errCodeInvalidImage {
+		t.Errorf("expected %s, got %s", errCodeInvalidImage, body.Code)
+	}
+	if stored := h.getVideo(video.ID); stored.ThumbnailURL != nil {
+		t.Error("expected no thumbnail to be stored")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// thumbnailFormatExtensions maps the supported THUMBNAIL_FORMAT values to the
+// extension normalized thumbnails are stored with.
+var thumbnailFormatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"webp": ".webp",
+}
+
+// thumbnailExtension returns the file extension thumbnails of the given
+// sniffed media type are stored with, and false for unsupported types.
+func thumbnailExtension(mediaType string) (string, bool) {
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg", true
+	case "image/png":
+		return ".png", true
+	case "image/webp":
+		return ".webp", true
+	case "image/avif":
+		return ".avif", true
+	default:
+		return "", false
+	}
+}
+
+// Where thumbnails are kept, set with THUMBNAIL_STORAGE: files in the
+// assets directory served by this instance, or objects in the default
+// bucket served through the distribution, which every instance shares.
+const (
+	thumbnailStorageLocal = "local"
+	thumbnailStorageS3    = "s3"
+)
+
+// thumbnailKeyPrefix is the prefix thumbnails are stored under in the
+// bucket. Their names are random and never reused, so they can be cached
+// forever.
+const thumbnailKeyPrefix = "thumbnails/"
+
+// replaceThumbnail stores data under a new random name along with its
+// resized variants, removes the video's previous thumbnail and points
+// ThumbnailURL at the new one. Metadata like EXIF location data is
+// stripped first, which can change ext for AVIF images. It also records
+// the image's dominant color, or clears it and the variants if the image
+// can't be decoded. The caller saves the video.
+func (cfg *apiConfig) replaceThumbnail(ctx context.Context, video *database.Video, data io.Reader, ext string) error {
+	// Fill a 32-byte slice with random bytes and convert it into a random base64 string
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return fmt.Errorf("couldn't generate file name: %w", err)
+	}
+	baseName := base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	raw, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	stripped, strippedExt, err := stripImageMetadata(ctx, raw, cfg.thumbnailQuality)
+	if err != nil {
+		return err
+	}
+	if strippedExt != "" {
+		ext = strippedExt
+	}
+	thumbnailURL, err := cfg.storeThumbnail(ctx, baseName+ext, bytes.NewReader(stripped))
+	if err != nil {
+		return err
+	}
+
+	img, decodeErr := decodeImage(ctx, stripped)
+	var variants database.ThumbnailVariants
+	if decodeErr == nil {
+		variants, err = cfg.storeThumbnailVariants(ctx, baseName, ext, img)
+		if err != nil {
+			cfg.deleteThumbnail(context.WithoutCancel(ctx), thumbnailURL)
+			return err
+		}
+	}
+
+	// Delete the old thumbnail if it exists
+	if video.ThumbnailURL != nil {
+		err = cfg.deleteThumbnail(ctx, *video.ThumbnailURL)
+		if err != nil {
+			return fmt.Errorf("couldn't delete old thumbnail: %w", err)
+		}
+	}
+	err = cfg.deleteThumbnailVariants(ctx, video.ThumbnailVariants)
+	if err != nil {
+		return fmt.Errorf("couldn't delete old thumbnail sizes: %w", err)
+	}
+
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailVariants = variants
+
+	video.ThumbnailColor = nil
+	if decodeErr == nil {
+		if c := dominantColor(img); c != "" {
+			video.ThumbnailColor = &c
+		}
+	}
+	return nil
+}
+
+// storeThumbnail saves a thumbnail as fileName wherever THUMBNAIL_STORAGE
+// says and returns the URL it's served from.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, fileName string, data io.Reader) (string, error) {
+	if cfg.thumbnailStorage == thumbnailStorageS3 {
+		key := thumbnailKeyPrefix + fileName
+		_, err := cfg.store.Put(ctx, key, data, mime.TypeByExtension(filepath.Ext(fileName)), "")
+		if err != nil {
+			return "", fmt.Errorf("couldn't upload thumbnail: %w", err)
+		}
+		return cfg.s3CfDistribution + "/" + key, nil
+	}
+
+	localFile, err := os.Create(filepath.Join(cfg.assetsRoot, fileName))
+	if err != nil {
+		return "", fmt.Errorf("couldn't create thumbnail file: %w", err)
+	}
+	defer localFile.Close()
+	if _, err := io.Copy(localFile, data); err != nil {
+		return "", fmt.Errorf("couldn't write thumbnail file: %w", err)
+	}
+	return cfg.assetURL(ctx, fileName), nil
+}
+
+// thumbnailKey maps the URL of a thumbnail kept in the bucket to its key.
+// Thumbnails in the assets directory return false.
+func (cfg *apiConfig) thumbnailKey(thumbnailURL string) (string, bool) {
+	key, ok := strings.CutPrefix(thumbnailURL, cfg.s3CfDistribution+"/")
+	if !ok {
+		return "", false
+	}
+	name, ok := strings.CutPrefix(key, thumbnailKeyPrefix)
+	return key, ok && name != "" && !strings.Contains(name, "/")
+}
+
+// openThumbnail reads a stored thumbnail, wherever it's kept.
+func (cfg *apiConfig) openThumbnail(ctx context.Context, thumbnailURL string) (io.ReadCloser, error) {
+	if key, ok := cfg.thumbnailKey(thumbnailURL); ok {
+		body, _, err := cfg.store.Get(ctx, key)
+		return body, err
+	}
+	path, ok := cfg.localThumbnailPath(thumbnailURL)
+	if !ok {
+		return nil, fmt.Errorf("thumbnail URL %s isn't stored by this server", thumbnailURL)
+	}
+	return os.Open(path)
+}
+
+// deleteThumbnail removes a stored thumbnail. One that's already gone, or a
+// URL this server doesn't store, isn't an error.
+func (cfg *apiConfig) deleteThumbnail(ctx context.Context, thumbnailURL string) error {
+	if key, ok := cfg.thumbnailKey(thumbnailURL); ok {
+		err := cfg.store.Delete(ctx, key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+		return nil
+	}
+	path, ok := cfg.localThumbnailPath(thumbnailURL)
+	if !ok {
+		return nil
+	}
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// thumbnailResponseURL is the URL clients load a video's thumbnail from.
+func (cfg *apiConfig) thumbnailResponseURL(video database.Video) *string {
+	if video.ThumbnailURL == nil {
+		return nil
+	}
+	return cfg.thumbnailDeliveryURL(video, *video.ThumbnailURL)
+}
+
+// thumbnailDeliveryURL is the URL clients load a stored thumbnail file
+// from. Thumbnails in the bucket are signed like the video when delivery
+// isn't public; they're always in the default bucket, whatever the
+// video's is.
+func (cfg *apiConfig) thumbnailDeliveryURL(video database.Video, thumbnailURL string) *string {
+	if cfg.videoDelivery == videoDeliveryPublic {
+		return &thumbnailURL
+	}
+	key, ok := cfg.thumbnailKey(thumbnailURL)
+	if !ok {
+		return &thumbnailURL
+	}
+	return cfg.signedURL(database.Video{ID: video.ID}, key)
+}
+
+// normalizeThumbnail decodes an image and re-encodes it in the given
+// format, returning the encoded image and its file extension. quality
+// only applies to JPEG and WebP output.
+func normalizeThumbnail(ctx context.Context, r io.Reader, format string, quality int) (*bytes.Buffer, string, error) {
+	ext, ok := thumbnailFormatExtensions[format]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported thumbnail format %q", format)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	img, err := decodeImage(ctx, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	buf := &bytes.Buffer{}
+	err = encodeImage(ctx, buf, img, format, quality)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf, ext, nil
+}
+
+// encodeImage writes img in one of the THUMBNAIL_FORMAT formats. quality
+// only applies to JPEG and WebP output; WebP is encoded with ffmpeg.
+func encodeImage(ctx context.Context, w io.Writer, img image.Image, format string, quality int) error {
+	var err error
+	switch format {
+	case "jpeg":
+		// JPEG has no alpha channel, so flatten transparent areas onto white
+		// rather than letting them turn black
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		err = jpeg.Encode(w, flat, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(w, img)
+	case "webp":
+		err = encodeWebP(ctx, w, img, quality)
+	default:
+		return fmt.Errorf("unsupported thumbnail format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't encode image: %w", err)
+	}
+	return nil
+}
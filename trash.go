@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// purgeTrash permanently removes videos that have been in the trash longer
+// than retention and returns how many were purged. A video whose files
+// can't be removed is left for the next sweep.
+func (cfg *apiConfig) purgeTrash(ctx context.Context, retention time.Duration) (int, error) {
+	videos, err := cfg.db.GetVideosDeletedBefore(time.Now().Add(-retention))
+	if err != nil {
+		return 0, fmt.Errorf("couldn't list trashed videos: %w", err)
+	}
+
+	purged := 0
+	var errs []error
+	for _, video := range videos {
+		err := cfg.purgeVideo(ctx, video)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", video.ID, err))
+			continue
+		}
+		purged++
+	}
+	return purged, errors.Join(errs...)
+}
+
+// purgeVideo deletes a video's stored video, preview, sprite sheet, HLS and
+// rendition objects, its thumbnail and caption files, and finally its row.
+// Files that are already gone don't count as failures, so a purge that
+// stopped partway can simply be run again.
+func (cfg *apiConfig) purgeVideo(ctx context.Context, video database.Video) error {
+	store := cfg.videoStore(video)
+	if key, ok := cfg.videoKey(video); ok {
+		err := store.Delete(ctx, key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return fmt.Errorf("couldn't delete video object: %w", err)
+		}
+	}
+
+	if video.PreviewURL != nil {
+		if key, ok := cfg.videoKeyFromURL(*video.PreviewURL); ok {
+			err := store.Delete(ctx, key)
+			if err != nil && !errors.Is(err, ErrObjectNotFound) {
+				return fmt.Errorf("couldn't delete preview object: %w", err)
+			}
+		}
+	}
+
+	err := cfg.deleteStoredURLs(ctx, store, spriteURLs(video))
+	if err != nil {
+		return fmt.Errorf("couldn't delete sprite sheet: %w", err)
+	}
+
+	if video.HLSURL != nil {
+		err := cfg.deleteHLS(ctx, store, *video.HLSURL)
+		if err != nil {
+			return fmt.Errorf("couldn't delete HLS renditions: %w", err)
+		}
+	}
+
+	err = cfg.deleteRenditions(ctx, store, video.Renditions)
+	if err != nil {
+		return fmt.Errorf("couldn't delete renditions: %w", err)
+	}
+
+	if video.ThumbnailURL != nil {
+		err := cfg.deleteThumbnail(ctx, *video.ThumbnailURL)
+		if err != nil {
+			return fmt.Errorf("couldn't delete thumbnail: %w", err)
+		}
+	}
+	err = cfg.deleteThumbnailVariants(ctx, video.ThumbnailVariants)
+	if err != nil {
+		return fmt.Errorf("couldn't delete thumbnail sizes: %w", err)
+	}
+
+	var captionErrs []error
+	for _, track := range video.Captions {
+		captionErrs = append(captionErrs, cfg.removeCaptionFile(ctx, track))
+	}
+	if err := errors.Join(captionErrs...); err != nil {
+		return fmt.Errorf("couldn't delete captions: %w", err)
+	}
+
+	err = cfg.db.DeleteVideo(video.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't delete video: %w", err)
+	}
+	permanent := true
+	cfg.emitVideoEvent(eventVideoDeleted, video, webhookEventData{Permanent: &permanent})
+	return nil
+}
+
+// runTrashSweeper purges the trash every interval until ctx is cancelled.
+func (cfg *apiConfig) runTrashSweeper(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := cfg.purgeTrash(ctx, retention)
+		if err != nil {
+			slog.Error("trash sweep failed", "purged", purged, "err", err)
+			continue
+		}
+		if purged > 0 {
+			slog.Info("purged trashed videos", "count", purged)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("trash@example.com")
+
+	key := "landscape/abc.mp4"
+	h.s3.objects[key] = []byte("video")
+	videoURL := h.cfg.s3CfDistribution + "/" + key
+	video.VideoURL = &videoURL
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/videos/" + video.ID.String()
+
+	listVideos := func(query string) []database.Video {
+		t.Helper()
+		resp := h.do(http.MethodGet, "/api/videos"+query, token, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("list: expected 200, got %d", resp.StatusCode)
+		}
+		var videos []database.Video
+		decodeJSON(t, resp, &videos)
+		return videos
+	}
+
+	if resp := h.do(http.MethodDelete, path, token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+	if videos := listVideos(""); len(videos) != 0 {
+		t.Fatalf("expected trashed video to be hidden, got %d videos", len(videos))
+	}
+	if videos := listVideos("?trash=true"); len(videos) != 1 || videos[0].DeletedAt == nil {
+		t.Fatalf("expected 1 trashed video, got %+v", videos)
+	}
+	if resp := h.do(http.MethodGet, path, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get trashed video: expected 404, got %d", resp.StatusCode)
+	}
+	if _, ok := h.s3.objects[key]; !ok {
+		t.Fatal("soft delete removed the stored object")
+	}
+
+	if resp := h.do(http.MethodPost, path+"/restore", token, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore: expected 200, got %d", resp.StatusCode)
+	}
+	if videos := listVideos(""); len(videos) != 1 {
+		t.Fatalf("expected restored video to be listed, got %d videos", len(videos))
+	}
+	if resp := h.do(http.MethodPost, path+"/restore", token, nil); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("restore again: expected 409, got %d", resp.StatusCode)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("purge@example.com")
+
+	key := "portrait/abc.mp4"
+	h.s3.objects[key] = []byte("video")
+	videoURL := h.cfg.s3CfDistribution + "/" + key
+	video.VideoURL = &videoURL
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	if resp := h.do(http.MethodDelete, "/api/videos/"+video.ID.String(), token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+
+	purged, err := h.cfg.purgeTrash(context.Background(), time.Hour)
+	if err != nil || purged != 0 {
+		t.Fatalf("purge within retention: purged %d, err %v", purged, err)
+	}
+
+	// A negative retention puts the cutoff in the future
+	purged, err = h.cfg.purgeTrash(context.Background(), -time.Hour)
+	if err != nil || purged != 1 {
+		t.Fatalf("purge past retention: purged %d, err %v", purged, err)
+	}
+	if _, ok := h.s3.objects[key]; ok {
+		t.Fatal("expected stored object to be deleted")
+	}
+	if _, err := h.cfg.db.GetVideo(video.ID); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected video row to be deleted, got err %v", err)
+	}
+}
+
+func TestPermanentDelete(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("permanent@example.com")
+	otherToken, _ := h.createUserAndVideo("permanent-other@example.com")
+	path := "/api/videos/" + video.ID.String() + "?permanent=true"
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: expected 200, got %d", resp.StatusCode)
+	}
+	stored := h.getVideo(video.ID)
+	thumbnailPath := filepath.Join(h.cfg.assetsRoot, "thumb.png")
+	if err := os.WriteFile(thumbnailPath, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	thumbnailURL := h.cfg.publicURL(context.Background(), "/assets/thumb.png")
+	stored.ThumbnailURL = &thumbnailURL
+	// The preview is already gone from storage, which mustn't block the delete
+	previewURL := h.cfg.s3CfDistribution + "/previews/gone.mp4"
+	stored.PreviewURL = &previewURL
+	if err := h.cfg.db.UpdateVideo(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := h.do(http.MethodDelete, path, otherToken, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("other user: expected 403, got %d", resp.StatusCode)
+	}
+	if resp := h.do(http.MethodDelete, path, token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+	if keys := h.s3.keys(); len(keys) != 0 {
+		t.Errorf("expected every object to be deleted, found %v", keys)
+	}
+	if _, err := os.Stat(thumbnailPath); !os.IsNotExist(err) {
+		t.Errorf("expected the thumbnail to be deleted, got %v", err)
+	}
+	if _, err := h.cfg.db.GetVideo(video.ID); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected video row to be deleted, got err %v", err)
+	}
+	if resp := h.do(http.MethodDelete, path, token, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second delete: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestEmptyTrash(t *testing.T) {
+	h := newTestHarness(t)
+	token, trashed := h.createUserAndVideo("empty-trash@example.com")
+	kept, err := h.cfg.db.CreateVideo(database.CreateVideoParams{Title: "kept", UserID: trashed.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, othersTrash := h.createUserAndVideo("other-trash@example.com")
+
+	key := "landscape/trashed.mp4"
+	h.s3.objects[key] = []byte("video")
+	videoURL := h.cfg.s3CfDistribution + "/" + key
+	trashed.VideoURL = &videoURL
+	if err := h.cfg.db.UpdateVideo(trashed); err != nil {
+		t.Fatal(err)
+	}
+	for _, trash := range []struct {
+		token string
+		id    string
+	}{{token, trashed.ID.String()}, {otherToken, othersTrash.ID.String()}} {
+		if resp := h.do(http.MethodDelete, "/api/videos/"+trash.id, trash.token, nil); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+		}
+	}
+
+	var listed []videoResponse
+	decodeJSON(t, h.do(http.MethodGet, "/api/videos?trash=true", token, nil), &listed)
+	if len(listed) != 1 || listed[0].PurgeAt == nil || !listed[0].PurgeAt.Equal(listed[0].DeletedAt.Add(h.cfg.trashRetention)) {
+		t.Fatalf("trash listing = %+v", listed)
+	}
+
+	resp := h.do(http.MethodDelete, "/api/videos/trash", token, nil)
+	var result struct {
+		Purged int `json:"purged"`
+	}
+	decodeJSON(t, resp, &result)
+	if resp.StatusCode != http.StatusOK || result.Purged != 1 {
+		t.Fatalf("empty trash: %d, purged %d", resp.StatusCode, result.Purged)
+	}
+	if _, ok := h.s3.objects[key]; ok {
+		t.Error("purged video's object is still stored")
+	}
+	if _, err := h.cfg.db.GetVideo(trashed.ID); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("trashed video: %v", err)
+	}
+	// Only the caller's trash is emptied
+	for _, id := range []uuid.UUID{kept.ID, othersTrash.ID} {
+		if _, err := h.cfg.db.GetVideo(id); err != nil {
+			t.Errorf("video %s: %v", id, err)
+		}
+	}
+}
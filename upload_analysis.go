@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// uploadAnalysis is what a dry-run upload reports: what was detected and
+// whether the real upload would be accepted.
+type uploadAnalysis struct {
+	Accepted  bool   `json:"accepted"`
+	Reason    string `json:"reason,omitempty"`
+	MediaType string `json:"media_type"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+
+	// Unchanged is true when the file matches the one already stored, so
+	// uploading it would be a no-op.
+	Unchanged bool `json:"unchanged"`
+	Transcode bool `json:"transcode"`
+	FastStart bool `json:"fast_start"`
+
+	Orientation string  `json:"orientation,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+	Codec       string  `json:"codec,omitempty"`
+}
+
+// analyzeUpload runs the checks an upload goes through, without converting
+// or storing anything. Validation failures are reported in the analysis;
+// the error is only for failures to analyze at all.
+func (cfg *apiConfig) analyzeUpload(ctx context.Context, src io.Reader, mediaType string, video database.Video) (uploadAnalysis, error) {
+	analysis := uploadAnalysis{MediaType: mediaType}
+
+	tmpFile, err := os.CreateTemp("", "tubely-dryrun-*")
+	if err != nil {
+		return uploadAnalysis{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hasher := sha256.New()
+	analysis.Size, err = io.Copy(io.MultiWriter(tmpFile, hasher), src)
+	if err != nil {
+		return uploadAnalysis{}, err
+	}
+	analysis.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	analysis.Unchanged = video.SourceSHA256 != nil && *video.SourceSHA256 == analysis.SHA256
+
+	mediaType, err = cfg.confirmVideoType(ctx, tmpFile.Name(), mediaType)
+	if err != nil {
+		return uploadAnalysis{}, err
+	}
+	analysis.MediaType = mediaType
+	if !cfg.videoTypeAllowed(mediaType) {
+		analysis.Reason = "Invalid video type"
+		return analysis, nil
+	}
+	analysis.Transcode = mediaType != "video/mp4" || (cfg.mediaToolsAvailable && cfg.outputFormat.reencodes())
+	if mediaType == "video/mp4" {
+		analysis.FastStart, _ = isFastStart(tmpFile.Name())
+	}
+
+	// Without ffprobe there's nothing more to check
+	if !cfg.mediaToolsAvailable {
+		analysis.Orientation = "other"
+		analysis.Accepted = true
+		return analysis, nil
+	}
+
+	probe, err := probeVideo(ctx, tmpFile.Name())
+	if err != nil {
+		return uploadAnalysis{}, err
+	}
+	analysis.Orientation = probe.orientation()
+	analysis.Width = probe.Width
+	analysis.Height = probe.Height
+	analysis.Duration = probe.Duration
+	analysis.Codec = probe.Codec
+
+	if err := cfg.checkVideoLimits(probe); err != nil {
+		analysis.Reason = err.msg
+		return analysis, nil
+	}
+	analysis.Accepted = true
+	return analysis, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// uploadChecksum is the digest a client sent along with a file, so bytes
+// corrupted on the way in are rejected rather than stored. Either or both
+// may be set.
+type uploadChecksum struct {
+	sha256 []byte
+	md5    []byte
+}
+
+// parseUploadChecksum reads an upload's checksums from the X-Content-SHA256
+// and Content-MD5 headers, or the sha256 and md5 form fields, which win
+// when both are sent. They describe the uploaded file rather than the
+// whole request body, and can be hex or base64.
+func parseUploadChecksum(r *http.Request) (uploadChecksum, []formFieldError) {
+	var checksum uploadChecksum
+	var problems []formFieldError
+	for _, c := range []struct {
+		field, header string
+		size          int
+		dst           *[]byte
+	}{
+		{"sha256", "X-Content-SHA256", sha256.Size, &checksum.sha256},
+		{"md5", "Content-MD5", md5.Size, &checksum.md5},
+	} {
+		value := r.FormValue(c.field)
+		if value == "" {
+			value = r.Header.Get(c.header)
+		}
+		if value == "" {
+			continue
+		}
+		sum, ok := decodeDigest(value, c.size)
+		if !ok {
+			problems = append(problems, formFieldError{Field: c.field, Problem: fmt.Sprintf("must be a %d-byte digest in hex or base64", c.size)})
+			continue
+		}
+		*c.dst = sum
+	}
+	return checksum, problems
+}
+
+// decodeDigest decodes a size-byte digest written as hex or standard
+// base64.
+func decodeDigest(value string, size int) ([]byte, bool) {
+	if len(value) == hex.EncodedLen(size) {
+		if sum, err := hex.DecodeString(value); err == nil {
+			return sum, true
+		}
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	return sum, err == nil && len(sum) == size
+}
+
+// verify reports whether a file with the given digests matches the
+// checksum.
+func (c uploadChecksum) verify(sha256Sum, md5Sum []byte) error {
+	if c.sha256 != nil && !bytes.Equal(c.sha256, sha256Sum) {
+		return fmt.Errorf("expected SHA-256 %x, received %x", c.sha256, sha256Sum)
+	}
+	if c.md5 != nil && !bytes.Equal(c.md5, md5Sum) {
+		return fmt.Errorf("expected MD5 %x, received %x", c.md5, md5Sum)
+	}
+	return nil
+}
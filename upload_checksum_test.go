@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestDecodeDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("video"))
+	for _, value := range []string{hex.EncodeToString(sum[:]), base64.StdEncoding.EncodeToString(sum[:])} {
+		got, ok := decodeDigest(value, sha256.Size)
+		if !ok || string(got) != string(sum[:]) {
+			t.Errorf("couldn't decode %q", value)
+		}
+	}
+	for _, value := range []string{"abc", hex.EncodeToString(sum[:16]), "not base64!"} {
+		if _, ok := decodeDigest(value, sha256.Size); ok {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestUploadVideoChecksum(t *testing.T) {
+	sha := sha256.Sum256(minimalMP4)
+	md := md5.Sum(minimalMP4)
+	wrong := md5.Sum([]byte("something else"))
+
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		status  int
+		errCode string
+	}{
+		{"matching SHA-256", "X-Content-SHA256", hex.EncodeToString(sha[:]), http.StatusOK, ""},
+		{"matching MD5", "Content-MD5", base64.StdEncoding.EncodeToString(md[:]), http.StatusOK, ""},
+		{"mismatched MD5", "Content-MD5", base64.StdEncoding.EncodeToString(wrong[:]), http.StatusBadRequest, errCodeIntegrityFailed},
+		{"malformed SHA-256", "X-Content-SHA256", "deadbeef", http.StatusUnprocessableEntity, errCodeInvalidFields},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t)
+			h.cfg.mediaToolsAvailable = false
+			token, video := h.createUserAndVideo("owner@example.com")
+
+			req := h.uploadRequest(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4)
+			req.Header.Set(tc.header, tc.value)
+			resp := h.send(req)
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected %d, got %d", tc.status, resp.StatusCode)
+			}
+			if tc.errCode != "" {
+				if code := errorCode(t, resp); code != tc.errCode {
+					t.Fatalf("expected %s, got %s", tc.errCode, code)
+				}
+				if keys := h.s3.keys(); len(keys) != 0 {
+					t.Fatalf("expected nothing stored, got %v", keys)
+				}
+				return
+			}
+			// The file is stored as uploaded, so S3 checks it against the
+			// client's own SHA-256
+			if len(h.s3.checksummed) != 1 {
+				t.Errorf("expected the stored video to carry a checksum, got %v", h.s3.checksummed)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// stagedUploadURLExpiry is how long ffprobe and ffmpeg get to read a staged
+// upload through a signed URL.
+const stagedUploadURLExpiry = 15 * time.Minute
+
+// uploadDigest works out everything handlerUploadVideo needs to know about
+// an upload's bytes as they stream past: the hashes its checksum is checked
+// against, the ETag the store should report for it, whether its moov atom
+// comes first, and its size.
+type uploadDigest struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+	etag   *etagHasher
+	moov   moovScanner
+	size   int64
+}
+
+func newUploadDigest(partSize int64) *uploadDigest {
+	return &uploadDigest{sha256: sha256.New(), md5: md5.New(), etag: newETagHasher(partSize)}
+}
+
+func (d *uploadDigest) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	d.md5.Write(p)
+	d.etag.Write(p)
+	d.moov.Write(p)
+	d.size += int64(len(p))
+	return len(p), nil
+}
+
+// streamsUploads reports whether uploads from userID can go straight into
+// store as they arrive, rather than to a temp file first. They can unless
+// something known before the file arrives needs a local copy: ffmpeg
+// re-encoding or stripping metadata, audio leveling or a watermark on by
+// default, a job worker that processes the file from disk, or an S3 store
+// sending each object in one PutObject, which needs its length up front.
+func (cfg *apiConfig) streamsUploads(store ObjectStore, userID uuid.UUID) (bool, error) {
+	if s3Store, ok := store.(*s3ObjectStore); ok && s3Store.partSize <= 0 {
+		return false, nil
+	}
+	if cfg.jobWorkers > 0 {
+		return false, nil
+	}
+	if cfg.mediaToolsAvailable && (cfg.outputFormat.reencodes() || cfg.stripMetadata || cfg.shouldNormalizeAudio("")) {
+		return false, nil
+	}
+	_, applyWatermark, err := cfg.uploadWatermark(userID, "")
+	return !applyWatermark, err
+}
+
+// needsLocalCopy reports whether a streamed upload has to be fetched back
+// from the store after all, because of what turned up with it: a type
+// ffprobe has to confirm or ffmpeg has to convert, options asking for
+// audio leveling or a watermark, or a moov atom ffmpeg can move to the
+// front.
+func (cfg *apiConfig) needsLocalCopy(userID uuid.UUID, upload videoUpload, confirmType bool, digest *uploadDigest) (bool, error) {
+	if confirmType || upload.mediaType != "video/mp4" || cfg.shouldNormalizeAudio(upload.normalizeAudio) {
+		return true, nil
+	}
+	if cfg.mediaToolsAvailable {
+		if fastStart, err := digest.moov.result(); err != nil || !fastStart {
+			return true, nil
+		}
+	}
+	_, applyWatermark, err := cfg.uploadWatermark(userID, upload.watermark)
+	return applyWatermark, err
+}
+
+// storeStagedVideo is processVideo for an upload streamed into the store
+// that needs nothing done to it. It's probed through a signed URL, checked
+// against the limits and copied to its final key within the store.
+func (cfg *apiConfig) storeStagedVideo(ctx context.Context, video database.Video, userID uuid.UUID, upload videoUpload) (database.Video, bool, *processingError) {
+	cfg.progress.set(video.ID, uploadProgress{Stage: stageProcessing})
+	bucket := cfg.resolveBucket(userID)
+	store := cfg.storeForBucket(bucket)
+
+	videoOrientation := "other"
+	var probe videoProbe
+	var source string
+	if cfg.mediaToolsAvailable {
+		var err error
+		source, err = store.SignedURL(ctx, upload.stagedKey, stagedUploadURLExpiry)
+		if err != nil {
+			return video, false, processingFailure(http.StatusInternalServerError, errCodeStorageFailed, "Error signing uploaded video URL", err)
+		}
+		probe, err = probeVideo(ctx, source)
+		if err != nil {
+			return video, false, mediaToolFailure("Error probing video file", err)
+		}
+		if perr := cfg.checkVideoLimits(probe); perr != nil {
+			return video, false, perr
+		}
+		videoOrientation = probe.orientation()
+	}
+
+	videoKey, err := randomObjectKey(videoOrientation+"/", defaultOutputFormat.extension)
+	if err != nil {
+		return video, false, processingFailure(http.StatusInternalServerError, errCodeInternal, "Error generating random bytes", err)
+	}
+	cfg.progress.set(video.ID, uploadProgress{Stage: stageStoring, Total: upload.size})
+	objectInfo, err := store.Copy(ctx, upload.stagedKey, videoKey, upload.storageClass)
+	if err != nil {
+		return video, false, processingFailure(http.StatusInternalServerError, errCodeStorageFailed, "Error uploading to S3", err)
+	}
+
+	video, perr := cfg.recordStoredVideo(ctx, video, upload, storedVideo{
+		store:       store,
+		bucket:      bucket,
+		key:         videoKey,
+		etag:        objectInfo.ETag,
+		size:        upload.size,
+		orientation: videoOrientation,
+		probe:       probe,
+		watermarked: upload.sourceWatermarked,
+		source:      source,
+	})
+	return video, false, perr
+}
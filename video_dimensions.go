@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// errInvalidDimensions is wrapped by every dimension check failure.
+var errInvalidDimensions = errors.New("invalid video dimensions")
+
+// errTooLong is wrapped by every duration check failure.
+var errTooLong = errors.New("video too long")
+
+// dimensionLimits are the sanity bounds an upload's probed size must fall
+// within. minDimension applies to the shorter side and maxDimension to the
+// longer one. Aspect ratios are width divided by height; a zero bound is
+// not enforced.
+type dimensionLimits struct {
+	minDimension int
+	maxDimension int
+	minAspect    float64
+	maxAspect    float64
+}
+
+// defaultDimensionLimits accept anything from 144p up and from 1:4 portrait
+// to 4:1 landscape.
+var defaultDimensionLimits = dimensionLimits{
+	minDimension: 144,
+	minAspect:    0.25,
+	maxAspect:    4,
+}
+
+// check reports why a width x height video is out of bounds, or nil.
+func (l dimensionLimits) check(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("%w: couldn't read a frame size, the file may be corrupt", errInvalidDimensions)
+	}
+	if min(width, height) < l.minDimension {
+		return fmt.Errorf("%w: %dx%d is smaller than the %dpx minimum", errInvalidDimensions, width, height, l.minDimension)
+	}
+	if l.maxDimension > 0 && max(width, height) > l.maxDimension {
+		return fmt.Errorf("%w: %dx%d is larger than the %dpx maximum", errInvalidDimensions, width, height, l.maxDimension)
+	}
+	aspect := float64(width) / float64(height)
+	if (l.minAspect > 0 && aspect < l.minAspect) || (l.maxAspect > 0 && aspect > l.maxAspect) {
+		return fmt.Errorf("%w: %dx%d has an aspect ratio of %.2f, outside the allowed %.2f to %.2f",
+			errInvalidDimensions, width, height, aspect, l.minAspect, l.maxAspect)
+	}
+	return nil
+}
+
+// checkDuration reports why a video of the given length in seconds is too
+// long, or nil. A zero limit, or a duration ffprobe couldn't read, isn't
+// checked.
+func checkDuration(seconds float64, limit time.Duration) error {
+	if limit <= 0 || seconds <= 0 {
+		return nil
+	}
+	if length := time.Duration(seconds * float64(time.Second)); length > limit {
+		return fmt.Errorf("%w: %s is longer than the %s maximum", errTooLong, length.Round(time.Second), limit)
+	}
+	return nil
+}
+
+// checkVideoLimits rejects a probed video whose size or length is outside
+// what the server accepts.
+func (cfg *apiConfig) checkVideoLimits(probe videoProbe) *processingError {
+	if err := cfg.dimensionLimits.check(probe.Width, probe.Height); err != nil {
+		return processingFailure(http.StatusBadRequest, errCodeInvalidDimension, err.Error(), err)
+	}
+	if err := checkDuration(probe.Duration, cfg.maxVideoDuration); err != nil {
+		return processingFailure(http.StatusBadRequest, errCodeVideoTooLong, err.Error(), err)
+	}
+	return nil
+}
+
+// precheckVideo probes an upload and checks it against the limits before
+// it's converted, queued or stored, so a video that would be turned away
+// anyway costs no ffmpeg or S3 work. Without ffprobe there's nothing to
+// check, and a staged upload is checked before it's copied instead.
+func (cfg *apiConfig) precheckVideo(ctx context.Context, upload videoUpload) *processingError {
+	if !cfg.mediaToolsAvailable || upload.stagedKey != "" {
+		return nil
+	}
+	probe, err := probeVideo(ctx, upload.path)
+	if err != nil {
+		return mediaToolFailure("Error probing video file", err)
+	}
+	return cfg.checkVideoLimits(probe)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDimensionLimitsCheck(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		ok            bool
+	}{
+		{"1080p landscape", 1920, 1080, true},
+		{"1080p portrait", 1080, 1920, true},
+		{"square", 480, 480, true},
+		{"at minimum", 256, 144, true},
+		{"just below minimum", 256, 143, false},
+		{"one pixel", 1, 1, false},
+		{"exactly 4:1", 1600, 400, true},
+		{"just past 4:1", 1601, 400, false},
+		{"exactly 1:4", 400, 1600, true},
+		{"just past 1:4", 400, 1601, false},
+		{"extreme", 10000, 2, false},
+		{"zero width", 0, 720, false},
+		{"missing", 0, 0, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := defaultDimensionLimits.check(tc.width, tc.height)
+			if tc.ok && err != nil {
+				t.Fatalf("expected %dx%d to pass, got %v", tc.width, tc.height, err)
+			}
+			if !tc.ok && !errors.Is(err, errInvalidDimensions) {
+				t.Fatalf("expected %dx%d to be rejected, got %v", tc.width, tc.height, err)
+			}
+		})
+	}
+}
+
+func TestDimensionLimitsZeroBoundsAreOff(t *testing.T) {
+	if err := (dimensionLimits{}).check(10000, 2); err != nil {
+		t.Fatalf("expected no limits, got %v", err)
+	}
+}
+
+func TestDimensionLimitsMaximum(t *testing.T) {
+	limits := dimensionLimits{maxDimension: 3840}
+	if err := limits.check(3840, 2160); err != nil {
+		t.Fatalf("expected 4K to pass, got %v", err)
+	}
+	if err := limits.check(2160, 3841); !errors.Is(err, errInvalidDimensions) {
+		t.Fatalf("expected a portrait video past the maximum to be rejected, got %v", err)
+	}
+}
+
+func TestCheckDuration(t *testing.T) {
+	if err := checkDuration(3600, time.Hour); err != nil {
+		t.Fatalf("expected exactly the limit to pass, got %v", err)
+	}
+	if err := checkDuration(3601, time.Hour); !errors.Is(err, errTooLong) {
+		t.Fatalf("expected to be rejected, got %v", err)
+	}
+	if err := checkDuration(0, time.Hour); err != nil {
+		t.Fatalf("expected an unknown duration to pass, got %v", err)
+	}
+	if err := checkDuration(1e6, 0); err != nil {
+		t.Fatalf("expected no limit, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Tools an import can be downloaded with, chosen with its "importer"
+// field. A direct import fetches the URL itself, while yt-dlp finds the
+// video on a platform's page and brings its metadata and thumbnail along.
+const (
+	importerDirect = "direct"
+	importerYTDLP  = "yt-dlp"
+)
+
+// maxAttributionFieldLength caps the credits a platform import brings
+// along that have no limit of their own, like the uploader's name.
+const maxAttributionFieldLength = 200
+
+// importDir is where a platform import's metadata and thumbnail wait next
+// to the job's file until the job is done.
+func importDir(sourcePath string) string {
+	return sourcePath + ".import"
+}
+
+// importFileName is the name an imported video is stored with: the last
+// segment of its URL's path, or a generic name when that's empty.
+func importFileName(rawURL string) string {
+	u, err := parseRemoteURL(rawURL)
+	if err != nil {
+		return "video.mp4"
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "video.mp4"
+	}
+	return name
+}
+
+// prepareImport downloads an import's file to upload.path, unless an
+// earlier run already did, and checks it like a received upload. It
+// returns the upload filled in with the file's type and hash, and with
+// what a platform import brought along, and whether the file is the one
+// the video already has.
+func (cfg *apiConfig) prepareImport(ctx context.Context, video database.Video, upload videoUpload) (videoUpload, bool, *processingError) {
+	if _, err := os.Stat(upload.path); errors.Is(err, os.ErrNotExist) {
+		if upload.importer == importerYTDLP {
+			err = cfg.downloadPlatformImport(ctx, video, upload)
+		} else {
+			err = cfg.downloadImport(ctx, video, upload)
+		}
+		if err != nil {
+			return upload, false, processingFailure(http.StatusBadRequest, errCodeFetchFailed, "Couldn't download video", err)
+		}
+	}
+	if upload.importer == importerYTDLP {
+		info, err := readYTDLPInfo(importDir(upload.path))
+		if err != nil {
+			return upload, false, processingFailure(http.StatusInternalServerError, errCodeInternal, "Couldn't read video metadata", err)
+		}
+		upload.attribution = info.attribution(upload.sourceURL)
+		upload.description = info.Description
+		upload.thumbnailPath = findPlatformThumbnail(importDir(upload.path))
+		if upload.fileName == "" {
+			upload.fileName = info.fileName()
+		}
+	}
+
+	mediaType, sourceSHA256, err := inspectUploadedFile(upload.path)
+	if err != nil {
+		return upload, false, processingFailure(http.StatusInternalServerError, errCodeInternal, "Couldn't read downloaded video", err)
+	}
+	mediaType, err = cfg.confirmVideoType(ctx, upload.path, mediaType)
+	if err != nil {
+		return upload, false, mediaToolFailure("Error checking video type", err)
+	}
+	if !cfg.videoTypeAllowed(mediaType) {
+		return upload, false, processingFailure(http.StatusBadRequest, errCodeInvalidVideo, "Invalid video type", nil)
+	}
+	upload.mediaType = mediaType
+	upload.sourceSHA256 = sourceSHA256
+	if video.SourceSHA256 != nil && *video.SourceSHA256 == sourceSHA256 {
+		return upload, true, nil
+	}
+	if perr := cfg.precheckVideo(ctx, upload); perr != nil {
+		return upload, false, perr
+	}
+	cfg.emitVideoEvent(eventVideoUploaded, video, webhookEventData{})
+	return upload, false, nil
+}
+
+// downloadImport fetches an import's source URL to upload.path, reporting
+// how much has arrived on the video's progress. The file is written under
+// another name and renamed once it's complete, so a download cut short
+// isn't mistaken for a finished one.
+func (cfg *apiConfig) downloadImport(ctx context.Context, video database.Video, upload videoUpload) error {
+	resp, err := openRemoteFile(ctx, cfg.importClient, upload.sourceURL, maxVideoUploadBytes)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	partPath := upload.path + ".part"
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partPath) // clean up if it isn't renamed
+
+	cfg.progress.set(video.ID, uploadProgress{Stage: stageDownloading, Total: max(resp.ContentLength, 0)})
+	body := &progressReader{r: resp.Body, report: func(n int64) { cfg.progress.setBytes(video.ID, n) }}
+	n, err := io.Copy(f, io.LimitReader(body, maxVideoUploadBytes+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n > maxVideoUploadBytes {
+		return fmt.Errorf("remote file is larger than the 1 GB limit")
+	}
+	return os.Rename(partPath, upload.path)
+}
+
+// downloadPlatformImport has the platformDownloader fetch an import's page
+// into its importDir, then moves the video it found to upload.path, where
+// a requeued job will find it.
+func (cfg *apiConfig) downloadPlatformImport(ctx context.Context, video database.Video, upload videoUpload) error {
+	if cfg.platformDownloader == nil {
+		return errors.New("yt-dlp imports aren't enabled")
+	}
+	dir := importDir(upload.path)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return err
+	}
+
+	// yt-dlp doesn't say how far along it is, just that it's working
+	cfg.progress.set(video.ID, uploadProgress{Stage: stageDownloading})
+	if err := cfg.platformDownloader.download(ctx, upload.sourceURL, dir); err != nil {
+		return err
+	}
+	videoPath, err := findPlatformVideo(dir)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(videoPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxVideoUploadBytes {
+		return fmt.Errorf("remote file is larger than the 1 GB limit")
+	}
+	return os.Rename(videoPath, upload.path)
+}
+
+// applyImportMetadata fills in what a platform import brought along: its
+// credits, its description when the video has none and its thumbnail when
+// the video has none. The platform's text is cleaned up like a client's,
+// and cut to fit rather than refused. The thumbnail is only a nicety,
+// like an automatic one, so failing to store it is only logged. The
+// caller saves the video.
+func (cfg *apiConfig) applyImportMetadata(ctx context.Context, video *database.Video, upload videoUpload) {
+	if upload.attribution != (database.Attribution{}) {
+		a := upload.attribution
+		a.Title = clippedMetadataText(a.Title, false, cfg.maxTitleLength)
+		a.Platform = clippedMetadataText(a.Platform, false, maxAttributionFieldLength)
+		a.SourceID = clippedMetadataText(a.SourceID, false, maxAttributionFieldLength)
+		a.Uploader = clippedMetadataText(a.Uploader, false, maxAttributionFieldLength)
+		a.License = clippedMetadataText(a.License, false, maxAttributionFieldLength)
+		video.Attribution = a
+	}
+	if video.Description == "" {
+		video.Description = clippedMetadataText(upload.description, true, cfg.maxDescriptionLength)
+	}
+	if upload.thumbnailPath != "" && video.ThumbnailURL == nil {
+		err := cfg.setImportedThumbnail(ctx, video, upload.thumbnailPath)
+		if err != nil {
+			slog.Warn("couldn't store imported thumbnail", "video_id", video.ID, "err", err)
+		}
+	}
+}
+
+// setImportedThumbnail checks and stores a thumbnail file an import
+// downloaded, the same way as one fetched from a thumbnail URL.
+func (cfg *apiConfig) setImportedThumbnail(ctx context.Context, video *database.Video, thumbnailPath string) error {
+	f, err := os.Open(thumbnailPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxThumbnailBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxThumbnailBytes {
+		return fmt.Errorf("thumbnail is larger than %d bytes", maxThumbnailBytes)
+	}
+
+	_, fileExtension, err := verifyThumbnail(ctx, data, cfg.allowedThumbnailTypes)
+	if err != nil {
+		return err
+	}
+	var thumbnailData io.Reader = bytes.NewReader(data)
+	if cfg.thumbnailFormat != "" {
+		thumbnailData, fileExtension, err = normalizeThumbnail(ctx, thumbnailData, cfg.thumbnailFormat, cfg.thumbnailQuality)
+		if err != nil {
+			return err
+		}
+	}
+	err = cfg.replaceThumbnail(ctx, video, thumbnailData, fileExtension)
+	if err != nil {
+		return err
+	}
+	video.ThumbnailFilename = nil
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Processing statuses of a video's latest upload. A video is pending until
+// a file has been uploaded and, when uploads are queued, until a worker
+// picks it up.
+const (
+	videoPending    = "pending"
+	videoProcessing = "processing"
+	videoReady      = "ready"
+	videoFailed     = "failed"
+)
+
+// videoJobPollInterval is how often idle workers look for jobs they weren't
+// woken for, such as ones put back because the video was busy.
+const videoJobPollInterval = 5 * time.Second
+
+// videoJobRetention is how long a finished job can still be looked up.
+const videoJobRetention = 7 * 24 * time.Hour
+
+// videoJobResponse is a processing job as clients see it.
+type videoJobResponse struct {
+	ID        uuid.UUID `json:"id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Progress is how far a running job has got, such as how much of an
+	// import has been downloaded. Only the instance running the job knows.
+	Progress *uploadProgress `json:"progress,omitempty"`
+}
+
+func newVideoJobResponse(job database.VideoJob) videoJobResponse {
+	return videoJobResponse{
+		ID:        job.ID,
+		VideoID:   job.VideoID,
+		Status:    job.Status,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+}
+
+// queuedVideoResponse is the 202 response to an upload left to a worker.
+type queuedVideoResponse struct {
+	Job   videoJobResponse `json:"job"`
+	Video videoResponse    `json:"video"`
+}
+
+// queueVideoJob hands an upload to the job workers instead of processing it
+// during the request. The received file is moved into the job directory,
+// since the caller removes upload.path once it returns; an import has no
+// file yet, and its worker downloads it there. The caller holds the
+// video's upload lock, so no worker can start on the job before the video
+// is marked as queued, and wakes a worker once it lets go of the lock with
+// releaseUploadLock.
+func (cfg *apiConfig) queueVideoJob(w http.ResponseWriter, r *http.Request, video database.Video, userID uuid.UUID, upload videoUpload) bool {
+	latest, err := cfg.db.GetLatestVideoJob(video.ID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithDBError(w, "Couldn't check for queued uploads", err)
+		return false
+	}
+	if err == nil && (latest.Status == database.JobQueued || latest.Status == database.JobRunning) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadInProgress, "An earlier upload of this video is still being processed", nil)
+		return false
+	}
+
+	err = os.MkdirAll(cfg.jobDir, 0755)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create job directory", err)
+		return false
+	}
+	jobID := uuid.New()
+	sourcePath := filepath.Join(cfg.jobDir, jobID.String())
+	if upload.sourceURL == "" {
+		err = moveFile(upload.path, sourcePath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+			return false
+		}
+	}
+
+	previousStatus := video.ProcessingStatus
+	pending := videoPending
+	video.ProcessingStatus = &pending
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		os.Remove(sourcePath)
+		respondWithDBError(w, "Couldn't update video", err)
+		return false
+	}
+
+	job, err := cfg.db.CreateVideoJob(database.VideoJob{
+		ID:             jobID,
+		VideoID:        video.ID,
+		UserID:         userID,
+		SourcePath:     sourcePath,
+		MediaType:      upload.mediaType,
+		FileName:       upload.fileName,
+		SourceSHA256:   upload.sourceSHA256,
+		NormalizeAudio: upload.normalizeAudio,
+		Watermark:      upload.watermark,
+		AutoCaptions:   upload.autoCaptions,
+		StorageClass:   upload.storageClass,
+
+		SourceWatermarked: upload.sourceWatermarked,
+		SourceURL:         upload.sourceURL,
+		Importer:          upload.importer,
+	})
+	if err != nil {
+		os.Remove(sourcePath)
+		video.ProcessingStatus = previousStatus
+		if err := cfg.db.UpdateVideo(video); err != nil {
+			slog.Warn("couldn't restore video status", "video_id", video.ID, "err", err)
+		}
+		respondWithDBError(w, "Couldn't queue video for processing", err)
+		return false
+	}
+
+	w.Header().Set("Location", cfg.publicURL(r.Context(), "/api/jobs/"+job.ID.String()))
+	respondWithJSON(w, http.StatusAccepted, queuedVideoResponse{
+		Job:   newVideoJobResponse(job),
+		Video: cfg.videoResponse(r.Context(), video),
+	})
+	return true
+}
+
+// handlerGetVideoJob reports the progress of one of the caller's
+// processing jobs.
+func (cfg *apiConfig) handlerGetVideoJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := uuid.Parse(r.PathValue("jobID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid job ID", err)
+		return
+	}
+	userID, ok := cfg.authenticateUploader(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := cfg.db.GetVideoJob(jobID)
+	if errors.Is(err, database.ErrNotFound) || (err == nil && job.UserID != userID) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Job not found", err)
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, "Couldn't get job", err)
+		return
+	}
+	resp := newVideoJobResponse(job)
+	if job.Status == database.JobRunning {
+		if progress, _ := cfg.progress.snapshot(job.VideoID); progress.Stage != stageWaiting {
+			resp.Progress = &progress
+		}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// wakeVideoJobWorker tells an idle worker there's a job to claim without
+// waiting for its next poll.
+func (cfg *apiConfig) wakeVideoJobWorker() {
+	select {
+	case cfg.jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// releaseUploadLock unlocks a video after a request that may have queued
+// a job for it, then wakes a worker for the job. Waking one while the
+// video is still locked would only have it put the job back until its
+// next poll.
+func (cfg *apiConfig) releaseUploadLock(id uuid.UUID) {
+	cfg.uploadLocks.unlock(id)
+	cfg.wakeVideoJobWorker()
+}
+
+// runVideoJobWorkers starts the job workers and forgets old finished jobs
+// until ctx is cancelled. Jobs left running by a previous process are put
+// back in the queue first.
+func (cfg *apiConfig) runVideoJobWorkers(ctx context.Context, workers int) {
+	requeued, err := cfg.db.RequeueRunningVideoJobs()
+	if err != nil {
+		slog.Error("couldn't requeue interrupted video jobs", "err", err)
+	} else if requeued > 0 {
+		slog.Info("requeued interrupted video jobs", "count", requeued)
+	}
+
+	for range workers {
+		go cfg.runVideoJobWorker(ctx)
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := cfg.db.DeleteVideoJobsFinishedBefore(time.Now().Add(-videoJobRetention))
+		if err != nil {
+			slog.Error("couldn't delete old video jobs", "err", err)
+		}
+	}
+}
+
+func (cfg *apiConfig) runVideoJobWorker(ctx context.Context) {
+	ticker := time.NewTicker(videoJobPollInterval)
+	defer ticker.Stop()
+	for {
+		cfg.runQueuedVideoJobs(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-cfg.jobWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// runQueuedVideoJobs works through the queue until it's empty. A job whose
+// video is locked by another request goes back in the queue for a later
+// poll, and the rest of that video's jobs are skipped until then so the
+// jobs behind them don't wait too.
+func (cfg *apiConfig) runQueuedVideoJobs(ctx context.Context) {
+	var busy []uuid.UUID
+	for ctx.Err() == nil {
+		job, err := cfg.db.ClaimVideoJob(busy...)
+		if errors.Is(err, database.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			slog.Error("couldn't claim video job", "err", err)
+			return
+		}
+
+		if !cfg.uploadLocks.tryLock(job.VideoID) {
+			cfg.setVideoJobStatus(job.ID, database.JobQueued, "")
+			busy = append(busy, job.VideoID)
+			continue
+		}
+		// Another idle worker can look for the next job meanwhile
+		cfg.wakeVideoJobWorker()
+		cfg.runVideoJob(ctx, job)
+		cfg.uploadLocks.unlock(job.VideoID)
+	}
+}
+
+// runVideoJob processes and stores a queued upload, recording the outcome
+// on the job and the video. An import is downloaded and checked first. A
+// job that only failed because ffmpeg was busy goes back in the queue.
+func (cfg *apiConfig) runVideoJob(ctx context.Context, job database.VideoJob) {
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		removeJobFiles(job)
+		cfg.setVideoJobStatus(job.ID, database.JobFailed, "Couldn't get video")
+		slog.Error("video job failed", "job_id", job.ID, "video_id", job.VideoID, "err", err)
+		return
+	}
+	if video.DeletedAt != nil {
+		removeJobFiles(job)
+		cfg.failVideoJob(job, "Video was moved to the trash")
+		return
+	}
+
+	upload := videoUpload{
+		path:           job.SourcePath,
+		mediaType:      job.MediaType,
+		fileName:       job.FileName,
+		sourceSHA256:   job.SourceSHA256,
+		normalizeAudio: job.NormalizeAudio,
+		watermark:      job.Watermark,
+		autoCaptions:   job.AutoCaptions,
+		storageClass:   job.StorageClass,
+
+		sourceWatermarked: job.SourceWatermarked,
+		sourceURL:         job.SourceURL,
+		importer:          job.Importer,
+	}
+	var perr *processingError
+	if upload.sourceURL != "" {
+		var unchanged bool
+		upload, unchanged, perr = cfg.prepareImport(ctx, video, upload)
+		if perr == nil && unchanged {
+			cfg.applyImportMetadata(ctx, &video, upload)
+			if err := cfg.db.UpdateVideo(video); err != nil {
+				slog.Error("couldn't save imported metadata", "video_id", video.ID, "err", err)
+			}
+			removeJobFiles(job)
+			cfg.setVideoStatus(video.ID, videoReady)
+			cfg.setVideoJobStatus(job.ID, database.JobDone, "")
+			cfg.progress.set(video.ID, uploadProgress{Stage: stageDone})
+			return
+		}
+	}
+
+	if perr == nil {
+		cfg.setVideoStatus(video.ID, videoProcessing)
+		video, _, perr = cfg.processVideo(ctx, video, job.UserID, upload)
+	}
+	if perr != nil && errors.Is(perr, errMediaToolsBusy) {
+		cfg.progress.set(video.ID, uploadProgress{Stage: stageQueued})
+		cfg.setVideoStatus(video.ID, videoPending)
+		cfg.setVideoJobStatus(job.ID, database.JobQueued, "")
+		return
+	}
+	removeJobFiles(job)
+	if perr != nil {
+		slog.Error("video job failed", "job_id", job.ID, "video_id", job.VideoID, "err", perr)
+		cfg.failVideoJob(job, perr.msg)
+		return
+	}
+	cfg.setVideoJobStatus(job.ID, database.JobDone, "")
+	cfg.progress.set(video.ID, uploadProgress{Stage: stageDone})
+	cfg.emitVideoEvent(eventVideoProcessed, video, webhookEventData{})
+}
+
+// failVideoJob records a failed job, with msg as the reason clients see.
+func (cfg *apiConfig) failVideoJob(job database.VideoJob, msg string) {
+	cfg.progress.fail(job.VideoID, msg)
+	cfg.setVideoStatus(job.VideoID, videoFailed)
+	cfg.setVideoJobStatus(job.ID, database.JobFailed, msg)
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		slog.Error("couldn't get failed video", "video_id", job.VideoID, "err", err)
+		return
+	}
+	cfg.emitVideoEvent(eventVideoFailed, video, webhookEventData{Error: msg})
+}
+
+func (cfg *apiConfig) setVideoJobStatus(id uuid.UUID, status, errMsg string) {
+	err := cfg.db.SetVideoJobStatus(id, status, errMsg)
+	if err != nil {
+		slog.Error("couldn't update video job", "job_id", id, "status", status, "err", err)
+	}
+}
+
+// removeJobFiles deletes a finished job's file, along with anything its
+// import left next to it.
+func removeJobFiles(job database.VideoJob) {
+	os.Remove(job.SourcePath)
+	os.RemoveAll(importDir(job.SourcePath))
+}
+
+// moveFile renames src to dst, copying it when they're on different
+// filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("couldn't copy %s: %w", src, err)
+	}
+	os.Remove(src)
+	return nil
+}
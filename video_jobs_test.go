@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestQueuedVideoUpload(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 1
+	token, video := h.createUserAndVideo("queued@example.com")
+	otherToken, _ := h.createUserAndVideo("queued-other@example.com")
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+
+	resp := h.upload(path, token, "video", "clip.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	var queued struct {
+		Job   videoJobResponse `json:"job"`
+		Video videoResponse    `json:"video"`
+	}
+	decodeJSON(t, resp, &queued)
+	if queued.Job.Status != database.JobQueued || queued.Job.VideoID != video.ID {
+		t.Fatalf("unexpected job %+v", queued.Job)
+	}
+	if resp.Header.Get("Location") == "" {
+		t.Error("expected a Location header for the job")
+	}
+	if status := queued.Video.ProcessingStatus; status != videoPending {
+		t.Errorf("expected the video to be queued, got %v", status)
+	}
+	if len(h.s3.keys()) != 0 {
+		t.Fatalf("nothing should be stored before a worker runs, got %v", h.s3.keys())
+	}
+
+	// Only one upload of a video can wait at a time
+	if resp := h.upload(path, token, "video", "other.mp4", append(minimalMP4, 0)); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second upload: expected 409, got %d", resp.StatusCode)
+	}
+
+	jobPath := "/api/jobs/" + queued.Job.ID.String()
+	if resp := h.do(http.MethodGet, jobPath, otherToken, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("other user's job: expected 404, got %d", resp.StatusCode)
+	}
+
+	h.cfg.runQueuedVideoJobs(context.Background())
+
+	stored := h.getVideo(video.ID)
+	if stored.VideoURL == nil || stored.VideoFilename == nil || *stored.VideoFilename != "clip.mp4" {
+		t.Fatalf("expected the video to be stored, got %v, %v", stored.VideoURL, stored.VideoFilename)
+	}
+	if stored.ProcessingStatus == nil || *stored.ProcessingStatus != videoReady {
+		t.Errorf("expected the video to be ready, got %v", stored.ProcessingStatus)
+	}
+	resp = h.do(http.MethodGet, jobPath, token, nil)
+	var job videoJobResponse
+	decodeJSON(t, resp, &job)
+	if job.Status != database.JobDone {
+		t.Errorf("expected the job to be done, got %+v", job)
+	}
+	if entries, _ := os.ReadDir(h.cfg.jobDir); len(entries) != 0 {
+		t.Errorf("expected the queued file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestQueuedVideoUploadFailure(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 1
+	token, video := h.createUserAndVideo("queued-fail@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	var queued struct {
+		Job videoJobResponse `json:"job"`
+	}
+	decodeJSON(t, resp, &queued)
+
+	// The video is trashed before a worker gets to it
+	if err := h.cfg.db.SoftDeleteVideo(video.ID); err != nil {
+		t.Fatal(err)
+	}
+	h.cfg.runQueuedVideoJobs(context.Background())
+
+	job, err := h.cfg.db.GetVideoJob(queued.Job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != database.JobFailed || job.Error == "" {
+		t.Errorf("expected the job to fail with a reason, got %q %q", job.Status, job.Error)
+	}
+	stored := h.getVideo(video.ID)
+	if stored.ProcessingStatus == nil || *stored.ProcessingStatus != videoFailed || stored.VideoURL != nil {
+		t.Errorf("expected a failed video with nothing stored, got %v %v", stored.ProcessingStatus, stored.VideoURL)
+	}
+	if _, err := os.Stat(job.SourcePath); !os.IsNotExist(err) {
+		t.Errorf("expected the queued file to be removed, got %v", err)
+	}
+}
+
+func TestQueuedVideoJobsSkipLockedVideos(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 1
+	token, first := h.createUserAndVideo("queued-locked@example.com")
+	otherToken, second := h.createUserAndVideo("queued-free@example.com")
+
+	for _, u := range []struct {
+		token string
+		video database.Video
+	}{{token, first}, {otherToken, second}} {
+		resp := h.upload(fmt.Sprintf("/api/video_upload/%s", u.video.ID), u.token, "video", "clip.mp4", minimalMP4)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", resp.StatusCode)
+		}
+	}
+
+	// The older job's video is busy with another request
+	if !h.cfg.uploadLocks.tryLock(first.ID) {
+		t.Fatal("expected the video to be unlocked")
+	}
+	h.cfg.runQueuedVideoJobs(context.Background())
+	h.cfg.uploadLocks.unlock(first.ID)
+
+	if job, err := h.cfg.db.GetLatestVideoJob(first.ID); err != nil || job.Status != database.JobQueued {
+		t.Errorf("locked video: expected its job to stay queued, got %q, %v", job.Status, err)
+	}
+	if job, err := h.cfg.db.GetLatestVideoJob(second.ID); err != nil || job.Status != database.JobDone {
+		t.Errorf("free video: expected its job to run, got %q, %v", job.Status, err)
+	}
+
+	h.cfg.runQueuedVideoJobs(context.Background())
+	if job, err := h.cfg.db.GetLatestVideoJob(first.ID); err != nil || job.Status != database.JobDone {
+		t.Errorf("once unlocked: expected the job to run, got %q, %v", job.Status, err)
+	}
+}
+
+func TestQueuedVideoUploadWakesWorkerAfterUnlocking(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 1
+	token, video := h.createUserAndVideo("queued-wake@example.com")
+
+	// A worker woken by the upload should find the video free to work on
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-h.cfg.jobWake
+		h.cfg.runQueuedVideoJobs(context.Background())
+	}()
+	rec := httptest.NewRecorder()
+	h.cfg.routes().ServeHTTP(rec, h.uploadRequest(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", minimalMP4))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upload didn't wake a worker")
+	}
+
+	job, err := h.cfg.db.GetLatestVideoJob(video.ID)
+	if err != nil || job.Status != database.JobDone {
+		t.Errorf("expected the woken worker to run the job, got %q, %v", job.Status, err)
+	}
+}
+
+func TestWatermarkedUploadIsQueuedWithoutWorkers(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.jobWorkers = 0
+	token, video := h.createUserAndVideo("queued-watermark@example.com")
+	path := fmt.Sprintf("/api/video_upload/%s", video.ID)
+
+	// Without a watermark the upload is processed during the request
+	if resp := h.upload(path, token, "video", "clip.mp4", minimalMP4); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unwatermarked: expected 200, got %d", resp.StatusCode)
+	}
+
+	h.cfg.watermarkImage = "/etc/tubely/watermark.png"
+	h.cfg.watermarkByDefault = true
+	resp := h.upload(path, token, "video", "other.mp4", append(minimalMP4, 0))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("watermarked: expected 202, got %d", resp.StatusCode)
+	}
+	var queued struct {
+		Job videoJobResponse `json:"job"`
+	}
+	decodeJSON(t, resp, &queued)
+	if queued.Job.Status != database.JobQueued {
+		t.Errorf("expected a queued job, got %+v", queued.Job)
+	}
+}
+
+func TestVideoStatus(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("status@example.com")
+	statusPath := fmt.Sprintf("/api/videos/%s/status", video.ID)
+
+	type statusResponse struct {
+		Status   string  `json:"status"`
+		VideoURL *string `json:"video_url"`
+		JobID    *string `json:"job_id"`
+		Error    string  `json:"error"`
+	}
+	getStatus := func() statusResponse {
+		t.Helper()
+		resp := h.do(http.MethodGet, statusPath, "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		if resp.Header.Get("Cache-Control") != "no-store" {
+			t.Error("status responses shouldn't be cached")
+		}
+		var status statusResponse
+		decodeJSON(t, resp, &status)
+		return status
+	}
+
+	if status := getStatus(); status.Status != videoPending || status.VideoURL != nil {
+		t.Errorf("before upload: got %+v", status)
+	}
+
+	h.cfg.jobWorkers = 1
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	if status := getStatus(); status.Status != videoPending || status.JobID == nil {
+		t.Errorf("queued: got %+v", status)
+	}
+
+	h.cfg.runQueuedVideoJobs(context.Background())
+	if status := getStatus(); status.Status != videoReady || status.VideoURL == nil || status.Error != "" {
+		t.Errorf("processed: got %+v", status)
+	}
+
+	// A failed synchronous upload is reported too
+	h.cfg.jobWorkers = 0
+	h.cfg.mediaToolsAvailable = true
+	h.cfg.dimensionLimits.minDimension = 1 << 20
+	resp = h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "small.mp4", makeTestMP4(t, 64, 64))
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("expected the upload to be rejected")
+	}
+	if status := getStatus(); status.Status != videoFailed {
+		t.Errorf("failed: got %+v", status)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestVideoListPagination(t *testing.T) {
+	h := newTestHarness(t)
+	token, first := h.createUserAndVideo("pages@example.com")
+	ids := []uuid.UUID{first.ID}
+	for _, title := range []string{"delta", "bravo", "echo", "alpha"} {
+		video, err := h.cfg.db.CreateVideo(database.CreateVideoParams{Title: title, UserID: first.UserID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, video.ID)
+	}
+
+	list := func(path string) ([]videoResponse, *http.Response) {
+		t.Helper()
+		resp := h.do(http.MethodGet, path, token, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d", path, resp.StatusCode)
+		}
+		var videos []videoResponse
+		decodeJSON(t, resp, &videos)
+		return videos, resp
+	}
+
+	// Following the cursor visits every video exactly once
+	var seen []uuid.UUID
+	path := "/api/videos?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("pagination didn't end")
+		}
+		videos, resp := list(path)
+		if len(videos) > 2 {
+			t.Fatalf("page has %d videos", len(videos))
+		}
+		for _, video := range videos {
+			seen = append(seen, video.ID)
+		}
+		path = ""
+		if next := resp.Header.Get("X-Next-Cursor"); next != "" {
+			if link := resp.Header.Get("Link"); !strings.Contains(link, "cursor="+next) || !strings.HasSuffix(link, `rel="next"`) {
+				t.Errorf("Link = %q", link)
+			}
+			path = "/api/videos?limit=2&cursor=" + url.QueryEscape(next)
+		}
+	}
+	slices.SortFunc(seen, func(a, b uuid.UUID) int { return strings.Compare(a.String(), b.String()) })
+	slices.SortFunc(ids, func(a, b uuid.UUID) int { return strings.Compare(a.String(), b.String()) })
+	if !slices.Equal(seen, ids) {
+		t.Errorf("paged through %v, want %v", seen, ids)
+	}
+
+	videos, _ := list("/api/videos?sort=title&limit=3")
+	var titles []string
+	for _, video := range videos {
+		titles = append(titles, video.Title)
+	}
+	if !slices.Equal(titles, []string{"alpha", "bravo", "delta"}) {
+		t.Errorf("titles = %v", titles)
+	}
+	videos, _ = list("/api/videos?sort=title&order=desc&limit=1")
+	if len(videos) != 1 || videos[0].Title != first.Title {
+		t.Errorf("last title = %+v, want %s", videos, first.Title)
+	}
+
+	failed := videoFailed
+	first.ProcessingStatus = &failed
+	if err := h.cfg.db.UpdateVideo(first); err != nil {
+		t.Fatal(err)
+	}
+	videos, _ = list("/api/videos?status=failed")
+	if len(videos) != 1 || videos[0].ID != first.ID {
+		t.Errorf("failed videos = %+v", videos)
+	}
+	if videos, _ = list("/api/videos?status=pending"); len(videos) != 4 {
+		t.Errorf("expected 4 pending videos, got %d", len(videos))
+	}
+
+	_, other := h.createUserAndVideo("someone-else@example.com")
+	for _, path := range []string{
+		"/api/videos?limit=0",
+		"/api/videos?limit=1000",
+		"/api/videos?sort=views",
+		"/api/videos?sort=deleted_at",
+		"/api/videos?order=up",
+		"/api/videos?status=done",
+		"/api/videos?limit=2&cursor=nope",
+		"/api/videos?cursor=" + first.ID.String(),
+		"/api/videos?limit=2&cursor=" + uuid.NewString(),
+		"/api/videos?limit=2&cursor=" + other.ID.String(),
+	} {
+		resp := h.do(http.MethodGet, path, token, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s: expected 400, got %d", path, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// videoLocks tracks which videos have an upload in flight so a second upload
+// for the same video can be turned away instead of racing the first one on
+// the db update and the old-object cleanup.
+type videoLocks struct {
+	mu     sync.Mutex
+	active map[uuid.UUID]struct{}
+}
+
+func newVideoLocks() *videoLocks {
+	return &videoLocks{active: map[uuid.UUID]struct{}{}}
+}
+
+// tryLock claims the video and reports whether it was free.
+func (l *videoLocks) tryLock(id uuid.UUID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.active[id]; ok {
+		return false
+	}
+	l.active[id] = struct{}{}
+	return true
+}
+
+func (l *videoLocks) unlock(id uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.active, id)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// validateVideoMetadata cleans up a title and description the way every
+// create and update path should: Unicode is normalized to NFC, control
+// characters are dropped (descriptions keep newlines and tabs) and
+// surrounding whitespace is trimmed. It returns the cleaned values, or an
+// error whose message is safe to show the client.
+func validateVideoMetadata(title, description string, maxTitleLength, maxDescriptionLength int) (string, string, error) {
+	title = cleanMetadataText(title, false)
+	if title == "" {
+		return "", "", errors.New("Title is required")
+	}
+	if n := utf8.RuneCountInString(title); n > maxTitleLength {
+		return "", "", fmt.Errorf("Title must be at most %d characters, got %d", maxTitleLength, n)
+	}
+
+	description = cleanMetadataText(description, true)
+	if n := utf8.RuneCountInString(description); n > maxDescriptionLength {
+		return "", "", fmt.Errorf("Description must be at most %d characters, got %d", maxDescriptionLength, n)
+	}
+
+	return title, description, nil
+}
+
+func cleanMetadataText(s string, multiline bool) string {
+	s = strings.ToValidUTF8(s, "")
+	s = norm.NFC.String(s)
+	s = strings.Map(func(r rune) rune {
+		if multiline && (r == '\n' || r == '\t') {
+			return r
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// clippedMetadataText cleans up text like cleanMetadataText and cuts it to
+// maxLength characters, for metadata taken from elsewhere that's kept even
+// when it's too long.
+func clippedMetadataText(s string, multiline bool, maxLength int) string {
+	s = cleanMetadataText(s, multiline)
+	if runes := []rune(s); len(runes) > maxLength {
+		s = strings.TrimSpace(string(runes[:maxLength]))
+	}
+	return s
+}
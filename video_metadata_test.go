@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateVideoMetadata(t *testing.T) {
+	tests := []struct {
+		name            string
+		title           string
+		description     string
+		wantTitle       string
+		wantDescription string
+		wantErr         bool
+	}{
+		{"trims whitespace", "  My video \t", "\n about it \n", "My video", "about it", false},
+		{"strips control characters", "My\x00 vid\x1beo", "line one\nline\x07 two", "My video", "line one\nline two", false},
+		{"normalizes to NFC", "Cafe\u0301", "", "Caf\u00e9", "", false},
+		{"rejects empty title", "   ", "desc", "", "", true},
+		{"rejects control-only title", "\x00\x01", "desc", "", "", true},
+		{"rejects long title", "abcdefghijk", "", "", "", true},
+		{"counts characters not bytes", "ééééééééé", "", "ééééééééé", "", false},
+		{"rejects long description", "ok", "this description is far too long", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			title, description, err := validateVideoMetadata(tt.title, tt.description, 10, 20)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if title != tt.wantTitle || description != tt.wantDescription {
+				t.Errorf("got (%q, %q), want (%q, %q)", title, description, tt.wantTitle, tt.wantDescription)
+			}
+		})
+	}
+}
+
+func TestUpdateVideoMetadata(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("editor@example.com")
+	otherToken, _ := h.createUserAndVideo("stranger@example.com")
+	path := "/api/videos/" + video.ID.String()
+
+	patch := func(token, body string, want int) videoResponse {
+		t.Helper()
+		resp := h.do(http.MethodPatch, path, token, strings.NewReader(body))
+		if resp.StatusCode != want {
+			t.Fatalf("PATCH %s: expected %d, got %d", body, want, resp.StatusCode)
+		}
+		var got videoResponse
+		if want == http.StatusOK {
+			decodeJSON(t, resp, &got)
+		}
+		return got
+	}
+
+	got := patch(token, `{"title":"  New title "}`, http.StatusOK)
+	if got.Title != "New title" || got.Description != video.Description {
+		t.Fatalf("after title update: %q / %q", got.Title, got.Description)
+	}
+	got = patch(token, `{"description":"","video_filename":"../clips/final cut.mov"}`, http.StatusOK)
+	if got.Title != "New title" || got.Description != "" || got.VideoFilename == nil || *got.VideoFilename != "final cut.mov" {
+		t.Fatalf("after partial update: %+v", got)
+	}
+
+	patch(token, `{"title":"   "}`, http.StatusBadRequest)
+	patch(token, `{"video_url":"https://evil.example.com/x.mp4"}`, http.StatusBadRequest)
+	patch(token, `{"video_filename":".."}`, http.StatusBadRequest)
+	patch(otherToken, `{"title":"Mine now"}`, http.StatusForbidden)
+	patch("", `{"title":"Anyone"}`, http.StatusUnauthorized)
+
+	if stored := h.getVideo(video.ID); stored.Title != "New title" {
+		t.Errorf("rejected updates changed the title to %q", stored.Title)
+	}
+}
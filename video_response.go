@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoResponse is a video as API clients see it. database.Video is what
+// the server works with and holds storage details (the bucket, how the
+// video URL was stored, content hashes) that clients have no use for;
+// handlers convert to this before responding so none of them leak.
+type videoResponse struct {
+	ID                uuid.UUID           `json:"id"`
+	CreatedAt         time.Time           `json:"created_at"`
+	UpdatedAt         time.Time           `json:"updated_at"`
+	Title             string              `json:"title"`
+	Description       string              `json:"description"`
+	Visibility        string              `json:"visibility"`
+	UserID            uuid.UUID           `json:"user_id"`
+	VideoURL          *string             `json:"video_url"`
+	StreamURL         *string             `json:"stream_url"`
+	ThumbnailURL      *string             `json:"thumbnail_url"`
+	Thumbnails        map[string]string   `json:"thumbnails,omitempty"`
+	PreviewURL        *string             `json:"preview_url"`
+	HLSURL            *string             `json:"hls_url"`
+	Renditions        []renditionResponse `json:"renditions"`
+	SpriteURL         *string             `json:"sprite_url"`
+	SpriteVTTURL      *string             `json:"sprite_vtt_url"`
+	Captions          []captionResponse   `json:"captions"`
+	VideoFilename     *string             `json:"video_filename"`
+	ThumbnailFilename *string             `json:"thumbnail_filename"`
+	VideoSize         *int64              `json:"video_size"`
+	Orientation       *string             `json:"orientation"`
+	Width             *int                `json:"width"`
+	Height            *int                `json:"height"`
+	Duration          *float64            `json:"duration"`
+	Codec             *string             `json:"codec"`
+	AudioCodec        *string             `json:"audio_codec"`
+	FrameRate         *float64            `json:"frame_rate"`
+	Bitrate           *int64              `json:"bitrate"`
+	ThumbnailColor    *string             `json:"thumbnail_color"`
+	DeletedAt         *time.Time          `json:"deleted_at"`
+	// PurgeAt is when a video in the trash will be deleted for good.
+	PurgeAt          *time.Time `json:"purge_at,omitempty"`
+	ProcessingStatus string     `json:"processing_status"`
+	// CaptionStatus is how transcribing the video's audio went, when its
+	// upload asked for captions.
+	CaptionStatus *string `json:"caption_status,omitempty"`
+	CaptionError  *string `json:"caption_error,omitempty"`
+	// Clip is set on videos cut from another one.
+	Clip *clipResponse `json:"clip,omitempty"`
+	// Watermarked is whether the delivered video has a watermark on it.
+	Watermarked bool `json:"watermarked"`
+	// Attribution credits the platform a video was imported from.
+	Attribution *database.Attribution `json:"attribution,omitempty"`
+}
+
+func (cfg *apiConfig) videoResponse(ctx context.Context, video database.Video) videoResponse {
+	return videoResponse{
+		ID:                video.ID,
+		CreatedAt:         video.CreatedAt,
+		UpdatedAt:         video.UpdatedAt,
+		Title:             video.Title,
+		Description:       video.Description,
+		Visibility:        video.Visibility,
+		UserID:            video.UserID,
+		VideoURL:          cfg.playableVideoURL(ctx, video),
+		StreamURL:         cfg.streamURL(ctx, video),
+		ThumbnailURL:      cfg.thumbnailResponseURL(video),
+		Thumbnails:        cfg.thumbnailResponseURLs(video),
+		PreviewURL:        cfg.deliveryURL(video, video.PreviewURL),
+		HLSURL:            video.HLSURL,
+		Renditions:        cfg.renditionResponses(ctx, video),
+		SpriteURL:         cfg.deliveryURL(video, video.SpriteURL),
+		SpriteVTTURL:      cfg.storyboardURL(ctx, video),
+		Captions:          cfg.captionResponses(video),
+		VideoFilename:     video.VideoFilename,
+		ThumbnailFilename: video.ThumbnailFilename,
+		VideoSize:         video.VideoSize,
+		Orientation:       video.Orientation,
+		Width:             video.Width,
+		Height:            video.Height,
+		Duration:          video.Duration,
+		Codec:             video.Codec,
+		AudioCodec:        video.AudioCodec,
+		FrameRate:         video.FrameRate,
+		Bitrate:           video.Bitrate,
+		ThumbnailColor:    video.ThumbnailColor,
+		DeletedAt:         video.DeletedAt,
+		PurgeAt:           cfg.purgeAt(video),
+		ProcessingStatus:  videoStatus(video),
+		CaptionStatus:     video.CaptionStatus,
+		CaptionError:      video.CaptionError,
+		Clip:              clipInfo(video),
+		Watermarked:       video.Watermarked,
+		Attribution:       attributionInfo(video),
+	}
+}
+
+func attributionInfo(video database.Video) *database.Attribution {
+	if video.Attribution == (database.Attribution{}) {
+		return nil
+	}
+	return &video.Attribution
+}
+
+func (cfg *apiConfig) purgeAt(video database.Video) *time.Time {
+	if video.DeletedAt == nil {
+		return nil
+	}
+	purgeAt := video.DeletedAt.Add(cfg.trashRetention)
+	return &purgeAt
+}
+
+// streamURL is where a <video> tag can play an uploaded video through this
+// server, without knowing where it's stored. A <video> tag can't send the
+// credentials a private video needs, so those play from their signed URL.
+func (cfg *apiConfig) streamURL(ctx context.Context, video database.Video) *string {
+	if video.VideoURL == nil || video.Visibility == database.VisibilityPrivate {
+		return nil
+	}
+	url := cfg.publicURL(ctx, "/api/videos/"+video.ID.String()+"/stream")
+	return &url
+}
+
+func (cfg *apiConfig) videoResponses(ctx context.Context, videos []database.Video) []videoResponse {
+	resp := make([]videoResponse, 0, len(videos))
+	for _, video := range videos {
+		resp = append(resp, cfg.videoResponse(ctx, video))
+	}
+	return resp
+}
+
+// captionResponse is a caption track as API clients see it.
+type captionResponse struct {
+	Language string `json:"language"`
+	Label    string `json:"label,omitempty"`
+	URL      string `json:"url"`
+	// Generated tracks were transcribed from the audio.
+	Generated bool `json:"generated,omitempty"`
+}
+
+// captionResponses lists a video's caption tracks, with URLs signed when
+// the video's are. Tracks are in the default bucket, not the video's.
+func (cfg *apiConfig) captionResponses(video database.Video) []captionResponse {
+	inDefaultBucket := video
+	inDefaultBucket.VideoBucket = nil
+	var tracks []captionResponse
+	for _, track := range video.Captions {
+		url := &track.URL
+		if track.Key != "" {
+			url = cfg.deliveryURL(inDefaultBucket, url)
+		}
+		if url == nil {
+			continue
+		}
+		tracks = append(tracks, captionResponse{Language: track.Language, Label: track.Label, URL: *url, Generated: track.Generated})
+	}
+	return tracks
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestVideoResponsePlayableURL(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("dto@example.com")
+
+	legacy := "tubely-test,landscape/abc.mp4"
+	sha := "deadbeef"
+	video.VideoURL = &legacy
+	video.SourceSHA256 = &sha
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := h.do(http.MethodGet, fmt.Sprintf("/api/videos/%s", video.ID), token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var body map[string]any
+	decodeJSON(t, resp, &body)
+	if got := body["video_url"]; got != "https://cdn.example.com/landscape/abc.mp4" {
+		t.Errorf("video_url = %v", got)
+	}
+	for _, field := range []string{"video_bucket", "video_key", "source_sha256", "video_etag"} {
+		if _, ok := body[field]; ok {
+			t.Errorf("response exposes %s", field)
+		}
+	}
+
+	// The distribution doesn't serve other buckets
+	bucket := "tubely-eu"
+	video.VideoBucket = &bucket
+	got := h.cfg.playableVideoURL(context.Background(), video)
+	want := h.cfg.publicURL(context.Background(), "/api/videos/"+video.ID.String()+"/download")
+	if got == nil || *got != want {
+		t.Errorf("playableVideoURL = %v, want %s", got, want)
+	}
+}
+
+func TestVideoListUsesResponseFormat(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("list@example.com")
+	legacy := "tubely-test,portrait/xyz.mp4"
+	video.VideoURL = &legacy
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := h.do(http.MethodGet, "/api/videos", token, nil)
+	var videos []json.RawMessage
+	decodeJSON(t, resp, &videos)
+	if len(videos) != 1 {
+		t.Fatalf("expected 1 video, got %d", len(videos))
+	}
+	var listed videoResponse
+	if err := json.Unmarshal(videos[0], &listed); err != nil {
+		t.Fatal(err)
+	}
+	if listed.VideoURL == nil || *listed.VideoURL != "https://cdn.example.com/portrait/xyz.mp4" {
+		t.Errorf("video_url = %v", listed.VideoURL)
+	}
+}
+
+func TestVideoResponseTechnicalMetadata(t *testing.T) {
+	h := newTestHarness(t)
+	token, video := h.createUserAndVideo("metadata@example.com")
+	probe := videoProbe{Width: 1920, Height: 1080, Duration: 61.5, Codec: "h264", AudioCodec: "aac", FrameRate: 29.97, Bitrate: 4_200_000}
+	probe.applyTo(&video)
+	if err := h.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	decodeJSON(t, h.do(http.MethodGet, "/api/videos/"+video.ID.String(), token, nil), &got)
+	want := map[string]any{
+		"width":       1920.0,
+		"height":      1080.0,
+		"duration":    61.5,
+		"codec":       "h264",
+		"audio_codec": "aac",
+		"frame_rate":  29.97,
+		"bitrate":     4_200_000.0,
+	}
+	for field, value := range want {
+		if got[field] != value {
+			t.Errorf("%s = %v, want %v", field, got[field], value)
+		}
+	}
+}
+
+func TestVideoResponseSignedDelivery(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	h.cfg.presigner = &fakePresigner{}
+	h.cfg.store = newS3ObjectStore(h.s3, h.cfg.presigner, h.cfg.s3Bucket, 1, 0)
+	h.cfg.videoDelivery = videoDeliverySigned
+	token, video := h.createUserAndVideo("signed@example.com")
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "clip.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var body videoResponse
+	decodeJSON(t, resp, &body)
+
+	stored := h.getVideo(video.ID)
+	if stored.VideoKey == nil {
+		t.Fatal("expected the video key to be stored")
+	}
+	want := fmt.Sprintf("https://tubely-test.s3.example.com/%s?X-Amz-Expires=3600", *stored.VideoKey)
+	if body.VideoURL == nil || *body.VideoURL != want {
+		t.Errorf("video_url = %v, want %s", body.VideoURL, want)
+	}
+
+	// Videos in other buckets are signed for their own bucket
+	bucket := "tubely-eu"
+	stored.VideoBucket = &bucket
+	got := h.cfg.playableVideoURL(context.Background(), stored)
+	want = fmt.Sprintf("https://tubely-eu.s3.example.com/%s?X-Amz-Expires=3600", *stored.VideoKey)
+	if got == nil || *got != want {
+		t.Errorf("playableVideoURL = %v, want %s", got, want)
+	}
+}
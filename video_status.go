@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoStatus is where a video is in the upload pipeline. Videos stored
+// before statuses were recorded are ready if they have a file.
+func videoStatus(video database.Video) string {
+	if video.ProcessingStatus != nil {
+		return *video.ProcessingStatus
+	}
+	if video.VideoURL != nil {
+		return videoReady
+	}
+	return videoPending
+}
+
+// setVideoStatus records a video's processing status. The status is only
+// informational, so a failure is logged rather than failing the upload.
+func (cfg *apiConfig) setVideoStatus(videoID uuid.UUID, status string) {
+	err := cfg.db.SetVideoProcessingStatus(videoID, status)
+	if err != nil {
+		slog.Warn("couldn't record video status", "video_id", videoID, "status", status, "err", err)
+	}
+}
+
+// handlerVideoStatus reports whether a video is ready to play, for clients
+// polling after an upload. Unlike the video itself it's never cached.
+func (cfg *apiConfig) handlerVideoStatus(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		VideoID       uuid.UUID  `json:"video_id"`
+		Status        string     `json:"status"`
+		VideoURL      *string    `json:"video_url"`
+		HLSURL        *string    `json:"hls_url"`
+		JobID         *uuid.UUID `json:"job_id,omitempty"`
+		Error         string     `json:"error,omitempty"`
+		CaptionStatus *string    `json:"caption_status,omitempty"`
+		CaptionError  *string    `json:"caption_error,omitempty"`
+		UpdatedAt     time.Time  `json:"updated_at"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithVideoLookupError(w, err)
+		return
+	}
+	if video.DeletedAt != nil || !cfg.canViewVideo(r, video) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	resp := response{
+		VideoID:       video.ID,
+		Status:        videoStatus(video),
+		CaptionStatus: video.CaptionStatus,
+		CaptionError:  video.CaptionError,
+		UpdatedAt:     video.UpdatedAt,
+	}
+	if resp.Status == videoReady {
+		resp.VideoURL = cfg.playableVideoURL(r.Context(), video)
+		resp.HLSURL = video.HLSURL
+	}
+	job, err := cfg.db.GetLatestVideoJob(video.ID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithDBError(w, "Couldn't get processing job", err)
+		return
+	}
+	if err == nil {
+		resp.JobID = &job.ID
+		if resp.Status == videoFailed {
+			resp.Error = job.Error
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, resp)
+}
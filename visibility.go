@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// parseVisibility validates a visibility a client asked for.
+func parseVisibility(value string) (string, error) {
+	switch value {
+	case database.VisibilityPublic, database.VisibilityUnlisted, database.VisibilityPrivate:
+		return value, nil
+	default:
+		return "", fmt.Errorf("visibility must be %s, %s or %s", database.VisibilityPublic, database.VisibilityUnlisted, database.VisibilityPrivate)
+	}
+}
+
+// canViewVideo reports whether a request may read a video. Private videos
+// are only shown to their owner; to anyone else they don't exist.
+func (cfg *apiConfig) canViewVideo(r *http.Request, video database.Video) bool {
+	if video.Visibility != database.VisibilityPrivate {
+		return true
+	}
+	userID, ok := cfg.requestUserID(r)
+	return ok && userID == video.UserID
+}
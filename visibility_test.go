@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestVideoVisibility(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.presigner = &fakePresigner{}
+	h.cfg.store = newS3ObjectStore(h.s3, h.cfg.presigner, h.cfg.s3Bucket, 1, 0)
+	token, unlisted := h.createUserAndVideo("visibility@example.com")
+	otherToken, _ := h.createUserAndVideo("someone-else@example.com")
+
+	create := func(visibility string) videoResponse {
+		t.Helper()
+		resp := h.do(http.MethodPost, "/api/videos", token, strings.NewReader(`{"title":"t","description":"d","visibility":"`+visibility+`"}`))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create %s: expected 201, got %d", visibility, resp.StatusCode)
+		}
+		var video videoResponse
+		decodeJSON(t, resp, &video)
+		if video.Visibility != visibility {
+			t.Fatalf("created %s video, got %s", visibility, video.Visibility)
+		}
+		// Give it a file so it's ready
+		stored, err := h.cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := "landscape/" + video.ID.String() + ".mp4"
+		videoURL := h.cfg.s3CfDistribution + "/" + key
+		stored.VideoURL, stored.VideoKey = &videoURL, &key
+		if err := h.cfg.db.UpdateVideo(stored); err != nil {
+			t.Fatal(err)
+		}
+		h.s3.objects[key] = minimalMP4
+		return video
+	}
+	public := create(database.VisibilityPublic)
+	private := create(database.VisibilityPrivate)
+	if unlisted.Visibility != database.VisibilityUnlisted {
+		t.Errorf("default visibility = %q", unlisted.Visibility)
+	}
+	if resp := h.do(http.MethodPost, "/api/videos", token, strings.NewReader(`{"title":"t","description":"d","visibility":"secret"}`)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown visibility: expected 400, got %d", resp.StatusCode)
+	}
+
+	// Private videos only exist for their owner
+	for _, path := range []string{"", "/status", "/download", "/stream"} {
+		path = "/api/videos/" + private.ID.String() + path
+		for name, tok := range map[string]string{"anonymous": "", "another user": otherToken} {
+			if resp := h.do(http.MethodGet, path, tok, nil); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET %s as %s: expected 404, got %d", path, name, resp.StatusCode)
+			}
+		}
+		if resp := h.do(http.MethodGet, path, token, nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s as the owner: expected 200, got %d", path, resp.StatusCode)
+		}
+	}
+	if resp := h.do(http.MethodGet, "/api/videos/"+unlisted.ID.String(), "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("unlisted video by ID: expected 200, got %d", resp.StatusCode)
+	}
+
+	// Even with public delivery, the owner only gets signed URLs to a
+	// private video
+	var got videoResponse
+	decodeJSON(t, h.do(http.MethodGet, "/api/videos/"+private.ID.String(), token, nil), &got)
+	if got.VideoURL == nil || !strings.Contains(*got.VideoURL, "X-Amz-Expires=") || got.StreamURL != nil {
+		t.Errorf("private video_url = %v, stream_url = %v", got.VideoURL, got.StreamURL)
+	}
+	decodeJSON(t, h.do(http.MethodGet, "/api/videos/"+public.ID.String(), "", nil), &got)
+	if got.VideoURL == nil || strings.Contains(*got.VideoURL, "X-Amz-Expires=") {
+		t.Errorf("public video_url = %v", got.VideoURL)
+	}
+
+	listPublic := func() []uuid.UUID {
+		t.Helper()
+		resp := h.do(http.MethodGet, "/api/videos/public", "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("public list: expected 200, got %d", resp.StatusCode)
+		}
+		var videos []videoResponse
+		decodeJSON(t, resp, &videos)
+		var ids []uuid.UUID
+		for _, video := range videos {
+			ids = append(ids, video.ID)
+		}
+		return ids
+	}
+	if ids := listPublic(); len(ids) != 1 || ids[0] != public.ID {
+		t.Fatalf("public list = %v, want only %s", ids, public.ID)
+	}
+
+	// Making a video private takes it out of the listing
+	resp := h.do(http.MethodPatch, "/api/videos/"+public.ID.String(), token, strings.NewReader(`{"visibility":"private"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH visibility: expected 200, got %d", resp.StatusCode)
+	}
+	if ids := listPublic(); len(ids) != 0 {
+		t.Errorf("public list after making it private = %v", ids)
+	}
+	if resp := h.do(http.MethodGet, "/api/videos/"+public.ID.String(), "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after making it private: expected 404, got %d", resp.StatusCode)
+	}
+
+	var own []videoResponse
+	decodeJSON(t, h.do(http.MethodGet, "/api/videos?visibility=private", token, nil), &own)
+	if len(own) != 2 {
+		t.Errorf("owner's private videos = %d, want 2", len(own))
+	}
+}
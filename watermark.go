@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// watermarkOverlayPositions maps a corner name to ffmpeg overlay coordinates,
+// keeping a 10px margin from the edges.
+var watermarkOverlayPositions = map[string]string{
+	"top-left":     "10:10",
+	"top-right":    "W-w-10:10",
+	"bottom-left":  "10:H-h-10",
+	"bottom-right": "W-w-10:H-h-10",
+	"center":       "(W-w)/2:(H-h)/2",
+}
+
+// watermarkVideo overlays overlayImagePath onto the video at the given
+// position and opacity, returning the path of the watermarked copy. The video
+// stream has to be re-encoded; audio is copied untouched. Files without a
+// video stream are returned as-is since there's nothing to draw on.
+func watermarkVideo(ctx context.Context, inputPath, overlayImagePath, position string, opacity float64) (string, error) {
+	coords, ok := watermarkOverlayPositions[position]
+	if !ok {
+		return "", fmt.Errorf("unknown watermark position %q", position)
+	}
+
+	hasVideo, err := hasVideoStream(ctx, inputPath)
+	if err != nil {
+		return "", err
+	}
+	if !hasVideo {
+		return inputPath, nil
+	}
+
+	outputFilePath := inputPath + ".watermarked"
+
+	// Scale the overlay's alpha channel by the opacity, then draw it on top
+	// of the first video stream.
+	filter := fmt.Sprintf(
+		"[1:v]format=rgba,colorchannelmixer=aa=%s[wm];[0:v][wm]overlay=%s",
+		strconv.FormatFloat(opacity, 'f', 2, 64),
+		coords,
+	)
+	_, err = runMediaTool(ctx, "ffmpeg",
+		"-i", inputPath,
+		"-i", overlayImagePath,
+		"-filter_complex", filter,
+		"-c:v", "libx264",
+		"-c:a", "copy",
+		"-f", "mp4",
+		outputFilePath,
+	)
+	if err != nil {
+		return "", err
+	}
+	return outputFilePath, nil
+}
+
+// hasVideoStream reports whether ffprobe finds at least one video stream.
+func hasVideoStream(ctx context.Context, filePath string) (bool, error) {
+	output, err := runMediaTool(ctx, "ffprobe", "-v", "error", "-select_streams", "v", "-show_entries", "stream=index", "-of", "csv=p=0", filePath)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(output)) != "", nil
+}
+
+// watermarkSettings is the watermark drawn on an upload: the image, on
+// disk or as a key in the default bucket, and how to draw it.
+type watermarkSettings struct {
+	image    string
+	imageKey string
+	position string
+	opacity  float64
+}
+
+// uploadWatermark decides whether an upload gets a watermark and which.
+// A user's own watermark replaces the server's. The form field
+// "watermark" overrides the default for whichever applies.
+func (cfg *apiConfig) uploadWatermark(userID uuid.UUID, formValue string) (watermarkSettings, bool, error) {
+	settings := watermarkSettings{image: cfg.watermarkImage, position: cfg.watermarkPosition, opacity: cfg.watermarkOpacity}
+	byDefault := cfg.watermarkByDefault
+	userWatermark, err := cfg.db.GetWatermark(userID)
+	switch {
+	case err == nil:
+		settings = watermarkSettings{imageKey: userWatermark.ImageKey, position: userWatermark.Position, opacity: userWatermark.Opacity}
+		byDefault = userWatermark.ByDefault
+	case !errors.Is(err, database.ErrNotFound):
+		return watermarkSettings{}, false, err
+	case cfg.watermarkImage == "":
+		return watermarkSettings{}, false, nil
+	}
+	if apply, err := strconv.ParseBool(formValue); err == nil {
+		return settings, apply, nil
+	}
+	return settings, byDefault, nil
+}
+
+// applyWatermark draws a watermark on a video, fetching a user's image
+// from the bucket first. Like watermarkVideo it returns the input path when
+// there was nothing to draw on.
+func (cfg *apiConfig) applyWatermark(ctx context.Context, inputPath string, settings watermarkSettings) (string, error) {
+	image := settings.image
+	if settings.imageKey != "" {
+		imagePath, err := downloadToTemp(ctx, cfg.store, settings.imageKey)
+		if err != nil {
+			return "", fmt.Errorf("couldn't download watermark image: %w", err)
+		}
+		defer os.Remove(imagePath)
+		image = imagePath
+	}
+	return watermarkVideo(ctx, inputPath, image, settings.position, settings.opacity)
+}
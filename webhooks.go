@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Video lifecycle events webhooks can subscribe to.
+const (
+	eventVideoUploaded  = "video.uploaded"
+	eventVideoProcessed = "video.processed"
+	eventVideoFailed    = "video.failed"
+	eventVideoDeleted   = "video.deleted"
+)
+
+var webhookEvents = []string{eventVideoUploaded, eventVideoProcessed, eventVideoFailed, eventVideoDeleted}
+
+// webhookRetryDelays is how long to wait before each retry of a failed
+// delivery. It's given up on once they've all been used.
+var webhookRetryDelays = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	8 * time.Hour,
+}
+
+const (
+	// webhookTimeout bounds each delivery attempt.
+	webhookTimeout = 10 * time.Second
+	// webhookConcurrency is how many deliveries are sent at once.
+	webhookConcurrency = 4
+	// webhookPollInterval is how often the worker looks for retries that
+	// have come due.
+	webhookPollInterval = 15 * time.Second
+	// webhookDeliveryRetention is how long finished deliveries stay in the
+	// delivery log.
+	webhookDeliveryRetention = 7 * 24 * time.Hour
+)
+
+// webhookSignatureHeader carries the delivery's timestamp and an
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook's secret, as
+// "t=<unix seconds>,v1=<hex>". Receivers should recompute it and reject
+// stale timestamps to stop replays.
+const webhookSignatureHeader = "Tubely-Signature"
+
+// webhookEvent is the body POSTed to webhooks. ID is the same for every
+// webhook sent the event, and across retries, so receivers can ignore
+// duplicates.
+type webhookEvent struct {
+	ID        uuid.UUID        `json:"id"`
+	Type      string           `json:"type"`
+	CreatedAt time.Time        `json:"created_at"`
+	Data      webhookEventData `json:"data"`
+}
+
+type webhookEventData struct {
+	Video videoResponse `json:"video"`
+	// Error is why processing failed, for video.failed.
+	Error string `json:"error,omitempty"`
+	// Permanent is whether the video was deleted for good rather than
+	// moved to the trash, for video.deleted.
+	Permanent *bool `json:"permanent,omitempty"`
+}
+
+// emitVideoEvent queues event for every webhook of the video's owner that
+// subscribes to it. The payload has the video as currently stored, if it
+// still is, since callers' copies can lag behind status updates. Failures
+// are only logged: the change the event reports has already happened.
+func (cfg *apiConfig) emitVideoEvent(event string, video database.Video, data webhookEventData) {
+	webhooks, err := cfg.db.GetWebhooks(video.UserID)
+	if err != nil {
+		slog.Error("couldn't get webhooks", "user_id", video.UserID, "event", event, "err", err)
+		return
+	}
+	var payload []byte
+	queued := false
+	for _, webhook := range webhooks {
+		if !webhook.Wants(event) {
+			continue
+		}
+		if payload == nil {
+			if stored, err := cfg.db.GetVideo(video.ID); err == nil {
+				video = stored
+			}
+			// Webhooks outlive the request, so they get the configured URLs
+			data.Video = cfg.videoResponse(context.Background(), video)
+			payload, err = json.Marshal(webhookEvent{
+				ID:        uuid.New(),
+				Type:      event,
+				CreatedAt: time.Now().UTC(),
+				Data:      data,
+			})
+			if err != nil {
+				slog.Error("couldn't encode webhook event", "video_id", video.ID, "event", event, "err", err)
+				return
+			}
+		}
+		_, err = cfg.db.CreateWebhookDelivery(webhook.ID, event, payload)
+		if err != nil {
+			slog.Error("couldn't queue webhook delivery", "webhook_id", webhook.ID, "event", event, "err", err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		cfg.wakeWebhookWorker()
+	}
+}
+
+func (cfg *apiConfig) wakeWebhookWorker() {
+	select {
+	case cfg.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// runWebhookWorker sends queued deliveries and retries failed ones until
+// ctx is cancelled, and forgets old finished deliveries.
+func (cfg *apiConfig) runWebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+	for {
+		cfg.sendDueWebhooks(ctx)
+		if time.Since(lastCleanup) > time.Hour {
+			err := cfg.db.DeleteWebhookDeliveriesFinishedBefore(time.Now().Add(-webhookDeliveryRetention))
+			if err != nil {
+				slog.Error("couldn't delete old webhook deliveries", "err", err)
+			}
+			lastCleanup = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-cfg.webhookWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendDueWebhooks sends every delivery that's due, a few at a time.
+func (cfg *apiConfig) sendDueWebhooks(ctx context.Context) {
+	const batchSize = 50
+	for ctx.Err() == nil {
+		due, err := cfg.db.GetDueWebhookDeliveries(time.Now(), batchSize)
+		if err != nil {
+			slog.Error("couldn't get due webhook deliveries", "err", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, webhookConcurrency)
+		for _, delivery := range due {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				cfg.attemptWebhookDelivery(ctx, delivery)
+			}()
+		}
+		wg.Wait()
+		// Anything left over, or that couldn't be recorded, waits for
+		// the next poll
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+// attemptWebhookDelivery sends a delivery once and records the outcome.
+// Anything but a 2xx response counts as a failure, redirects included.
+func (cfg *apiConfig) attemptWebhookDelivery(ctx context.Context, delivery database.WebhookDelivery) {
+	delivery.Attempts++
+	delivery.ResponseStatus = nil
+	delivery.Error = ""
+
+	webhook, err := cfg.db.GetWebhook(delivery.WebhookID)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			slog.Error("couldn't get webhook", "webhook_id", delivery.WebhookID, "err", err)
+			return
+		}
+		delivery.Status = database.DeliveryFailed
+		delivery.NextAttemptAt = nil
+		delivery.Error = "Webhook was deleted"
+		cfg.recordWebhookAttempt(delivery)
+		return
+	}
+
+	status, err := cfg.postWebhook(ctx, webhook, delivery)
+	if status != 0 {
+		delivery.ResponseStatus = &status
+	}
+	switch {
+	case err == nil:
+		delivery.Status = database.DeliveryDelivered
+		delivery.NextAttemptAt = nil
+	case delivery.Attempts > len(webhookRetryDelays):
+		delivery.Status = database.DeliveryFailed
+		delivery.NextAttemptAt = nil
+		delivery.Error = err.Error()
+	default:
+		next := time.Now().Add(webhookRetryDelays[delivery.Attempts-1])
+		delivery.NextAttemptAt = &next
+		delivery.Error = err.Error()
+	}
+	if err != nil {
+		slog.Warn("webhook delivery failed", "webhook_id", webhook.ID, "delivery_id", delivery.ID,
+			"attempt", delivery.Attempts, "status", delivery.Status, "err", err)
+	}
+	cfg.recordWebhookAttempt(delivery)
+}
+
+func (cfg *apiConfig) recordWebhookAttempt(delivery database.WebhookDelivery) {
+	err := cfg.db.RecordWebhookAttempt(delivery)
+	if err != nil {
+		slog.Error("couldn't record webhook delivery", "delivery_id", delivery.ID, "err", err)
+	}
+}
+
+// postWebhook POSTs a delivery's payload to its webhook and returns the
+// response status, if there was a response.
+func (cfg *apiConfig) postWebhook(ctx context.Context, webhook database.Webhook, delivery database.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Tubely-Webhooks")
+	req.Header.Set("Tubely-Event", delivery.Event)
+	req.Header.Set("Tubely-Delivery", delivery.ID.String())
+	req.Header.Set(webhookSignatureHeader, "t="+timestamp+",v1="+signWebhook(webhook.Secret, timestamp, delivery.Payload))
+
+	resp, err := cfg.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookClient is a remote fetch client, which won't connect to
+// private addresses, that doesn't follow redirects.
+func newWebhookClient() *http.Client {
+	client := newRemoteFetchClient(webhookTimeout)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}
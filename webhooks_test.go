@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	// failures is how many requests to failPath get a 500.
+	failPath string
+	failures int
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+	if r.URL.Path == rcv.failPath && rcv.failures > 0 {
+		rcv.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	h := newTestHarness(t)
+	h.cfg.mediaToolsAvailable = false
+	token, video := h.createUserAndVideo("hooks@example.com")
+
+	receiver := &webhookReceiver{failPath: "/all", failures: 1}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+
+	register := func(body string, want int) webhookResponse {
+		t.Helper()
+		resp := h.do(http.MethodPost, "/api/webhooks", token, strings.NewReader(body))
+		if resp.StatusCode != want {
+			t.Fatalf("register %s: expected %d, got %d", body, want, resp.StatusCode)
+		}
+		var webhook webhookResponse
+		if want == http.StatusCreated {
+			decodeJSON(t, resp, &webhook)
+		}
+		return webhook
+	}
+	all := register(fmt.Sprintf(`{"url":%q}`, srv.URL+"/all"), http.StatusCreated)
+	deletes := register(fmt.Sprintf(`{"url":%q,"events":["video.deleted"]}`, srv.URL+"/deletes"), http.StatusCreated)
+	if !strings.HasPrefix(all.Secret, "whsec_") {
+		t.Fatalf("secret = %q", all.Secret)
+	}
+	register(`{"url":"ftp://example.com/hook"}`, http.StatusBadRequest)
+	register(`{"url":"https://example.com/hook","events":["video.watched"]}`, http.StatusBadRequest)
+
+	resp := h.upload(fmt.Sprintf("/api/video_upload/%s", video.ID), token, "video", "raw.mp4", minimalMP4)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: expected 200, got %d", resp.StatusCode)
+	}
+	if resp := h.do(http.MethodDelete, "/api/videos/"+video.ID.String(), token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+	h.cfg.sendDueWebhooks(context.Background())
+
+	// The first delivery to /all failed and waits for a retry
+	if len(receiver.requests) != 4 {
+		t.Fatalf("expected 4 deliveries, got %d", len(receiver.requests))
+	}
+	got := map[string][]string{}
+	for i, req := range receiver.requests {
+		var event webhookEvent
+		if err := json.Unmarshal(receiver.bodies[i], &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != req.Header.Get("Tubely-Event") || event.Data.Video.ID != video.ID {
+			t.Errorf("event %+v sent as %s", event, req.Header.Get("Tubely-Event"))
+		}
+		if event.Type == eventVideoDeleted && (event.Data.Permanent == nil || *event.Data.Permanent) {
+			t.Errorf("soft delete reported permanent = %v", event.Data.Permanent)
+		}
+		got[req.URL.Path] = append(got[req.URL.Path], event.Type)
+
+		secret := all.Secret
+		if req.URL.Path == "/deletes" {
+			secret = deletes.Secret
+		}
+		var timestamp, signature string
+		fmt.Sscanf(strings.ReplaceAll(req.Header.Get(webhookSignatureHeader), ",", " "), "t=%s v1=%s", &timestamp, &signature)
+		if signature != signWebhook(secret, timestamp, receiver.bodies[i]) {
+			t.Errorf("bad signature %q", req.Header.Get(webhookSignatureHeader))
+		}
+	}
+	// Deliveries are sent concurrently, so in no particular order
+	slices.Sort(got["/all"])
+	want := map[string][]string{
+		"/all":     {eventVideoDeleted, eventVideoProcessed, eventVideoUploaded},
+		"/deletes": {eventVideoDeleted},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	var deliveries []webhookDeliveryResponse
+	decodeJSON(t, h.do(http.MethodGet, "/api/webhooks/"+all.ID.String()+"/deliveries", token, nil), &deliveries)
+	if len(deliveries) != 3 {
+		t.Fatalf("expected 3 deliveries in the log, got %d", len(deliveries))
+	}
+	var retry database.WebhookDelivery
+	for _, d := range deliveries {
+		if d.Status == database.DeliveryPending {
+			retry = d.WebhookDelivery
+		} else if d.Status != database.DeliveryDelivered {
+			t.Errorf("delivery status = %s", d.Status)
+		}
+	}
+	if retry.Attempts != 1 || retry.ResponseStatus == nil || *retry.ResponseStatus != http.StatusInternalServerError || retry.NextAttemptAt == nil {
+		t.Fatalf("failed delivery = %+v", retry)
+	}
+
+	stored, err := h.cfg.db.GetWebhookDeliveries(all.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range stored {
+		if d.ID == retry.ID {
+			h.cfg.attemptWebhookDelivery(context.Background(), d)
+		}
+	}
+	decodeJSON(t, h.do(http.MethodGet, "/api/webhooks/"+all.ID.String()+"/deliveries", token, nil), &deliveries)
+	for _, d := range deliveries {
+		if d.ID == retry.ID && (d.Status != database.DeliveryDelivered || d.Attempts != 2) {
+			t.Errorf("retried delivery = %+v", d.WebhookDelivery)
+		}
+	}
+
+	otherToken, _ := h.createUserAndVideo("nosy@example.com")
+	if resp := h.do(http.MethodGet, "/api/webhooks/"+all.ID.String()+"/deliveries", otherToken, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("another user's delivery log: expected 404, got %d", resp.StatusCode)
+	}
+	if resp := h.do(http.MethodDelete, "/api/webhooks/"+all.ID.String(), token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete webhook: expected 204, got %d", resp.StatusCode)
+	}
+	var webhooks []database.Webhook
+	decodeJSON(t, h.do(http.MethodGet, "/api/webhooks", token, nil), &webhooks)
+	if len(webhooks) != 1 || webhooks[0].ID != deletes.ID {
+		t.Errorf("webhooks = %+v", webhooks)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// platformDownloader fetches a video from its page on a platform like
+// YouTube or Vimeo into dir, for imports with "importer": "yt-dlp". It
+// leaves the video as video.<ext>, the platform's metadata in yt-dlp's
+// video.info.json format and, when the platform has one, the thumbnail
+// as thumbnail.<ext>.
+type platformDownloader interface {
+	download(ctx context.Context, pageURL, dir string) error
+}
+
+// ytDLPCommand runs the yt-dlp command line tool. It takes one of the
+// media tool slots, since it runs ffmpeg to merge separate video and audio
+// streams.
+type ytDLPCommand struct {
+	binary string
+	// timeout bounds the whole download.
+	timeout time.Duration
+}
+
+func (c ytDLPCommand) download(ctx context.Context, pageURL, dir string) error {
+	u, err := parseRemoteURL(pageURL)
+	if err != nil {
+		return err
+	}
+	if err := checkPublicHost(ctx, u.Hostname()); err != nil {
+		return err
+	}
+	// yt-dlp makes its own connections, so they go through a proxy that
+	// checks each one like the import client does. The native downloader
+	// keeps streaming formats from being fetched by ffmpeg, which would
+	// go around it.
+	proxyURL, stopProxy, err := startPublicProxy()
+	if err != nil {
+		return err
+	}
+	defer stopProxy()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	_, err = runMediaTool(ctx, c.binary,
+		"--ignore-config",
+		"--proxy", proxyURL,
+		"--downloader", "native",
+		"--no-playlist",
+		"--no-progress",
+		"--max-filesize", strconv.FormatInt(maxVideoUploadBytes, 10),
+		"--merge-output-format", "mp4",
+		"--write-info-json",
+		"--write-thumbnail",
+		"--convert-thumbnails", "jpg",
+		"--paths", dir,
+		"--output", "video.%(ext)s",
+		"--output", "thumbnail:thumbnail.%(ext)s",
+		"--", u.String(),
+	)
+	return err
+}
+
+// ytDLPInfoFile is the name of the metadata a platformDownloader leaves.
+const ytDLPInfoFile = "video.info.json"
+
+// ytDLPInfo is the part of yt-dlp's metadata imports keep.
+type ytDLPInfo struct {
+	ID           string `json:"id"`
+	Title        string `json:"title"`
+	Description  string `json:"description"`
+	Ext          string `json:"ext"`
+	WebpageURL   string `json:"webpage_url"`
+	ExtractorKey string `json:"extractor_key"`
+	Uploader     string `json:"uploader"`
+	UploaderURL  string `json:"uploader_url"`
+	ChannelURL   string `json:"channel_url"`
+	License      string `json:"license"`
+	UploadDate   string `json:"upload_date"` // YYYYMMDD
+}
+
+// attribution credits the video's page, falling back to pageURL, the one
+// it was imported from, when yt-dlp doesn't know the canonical one.
+func (i ytDLPInfo) attribution(pageURL string) database.Attribution {
+	a := database.Attribution{
+		SourceURL:   i.WebpageURL,
+		Platform:    i.ExtractorKey,
+		SourceID:    i.ID,
+		Title:       i.Title,
+		Uploader:    i.Uploader,
+		UploaderURL: i.UploaderURL,
+		License:     i.License,
+	}
+	if a.SourceURL == "" {
+		a.SourceURL = pageURL
+	}
+	if a.UploaderURL == "" {
+		a.UploaderURL = i.ChannelURL
+	}
+	if date, err := time.Parse("20060102", i.UploadDate); err == nil {
+		a.UploadDate = date.Format(time.DateOnly)
+	}
+	return a
+}
+
+// fileName is a name for the video made from its title, like a browser
+// would save it.
+func (i ytDLPInfo) fileName() string {
+	name := strings.NewReplacer("/", "-", `\`, "-").Replace(strings.TrimSpace(i.Title))
+	if name == "" {
+		name = "video"
+	}
+	ext := i.Ext
+	if ext == "" {
+		ext = "mp4"
+	}
+	return name + "." + ext
+}
+
+// readYTDLPInfo parses the metadata a platformDownloader left in dir.
+func readYTDLPInfo(dir string) (ytDLPInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ytDLPInfoFile))
+	if err != nil {
+		return ytDLPInfo{}, err
+	}
+	var info ytDLPInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return ytDLPInfo{}, fmt.Errorf("couldn't parse yt-dlp metadata: %w", err)
+	}
+	return info, nil
+}
+
+// findPlatformVideo returns the video a platformDownloader left in dir.
+func findPlatformVideo(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	videoPath := ""
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == ytDLPInfoFile || !strings.HasPrefix(name, "video.") ||
+			strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".ytdl") {
+			continue
+		}
+		if videoPath != "" {
+			return "", errors.New("yt-dlp left more than one video file")
+		}
+		videoPath = filepath.Join(dir, name)
+	}
+	if videoPath == "" {
+		return "", errors.New("yt-dlp didn't leave a video file")
+	}
+	return videoPath, nil
+}
+
+// findPlatformThumbnail returns the thumbnail a platformDownloader left in
+// dir, or an empty string if there isn't one.
+func findPlatformThumbnail(dir string) string {
+	matches, _ := filepath.Glob(filepath.Join(dir, "thumbnail.*"))
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestYTDLPInfoAttribution(t *testing.T) {
+	info := ytDLPInfo{ID: "42", Uploader: "someone", UploadDate: "not a date"}
+	a := info.attribution("https://example.com/v/42")
+	if a.SourceURL != "https://example.com/v/42" {
+		t.Errorf("expected the imported page as the source, got %q", a.SourceURL)
+	}
+	if a.UploadDate != "" {
+		t.Errorf("expected an unparseable date to be dropped, got %q", a.UploadDate)
+	}
+	if name := info.fileName(); name != "video.mp4" {
+		t.Errorf("expected a generic name without a title, got %q", name)
+	}
+}
+
+func TestFindPlatformVideo(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{ytDLPInfoFile, "thumbnail.jpg", "video.f137.mp4.part", "video.webm"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	videoPath, err := findPlatformVideo(dir)
+	if err != nil || filepath.Base(videoPath) != "video.webm" {
+		t.Errorf("expected video.webm, got %q, %v", videoPath, err)
+	}
+	if thumbnail := findPlatformThumbnail(dir); filepath.Base(thumbnail) != "thumbnail.jpg" {
+		t.Errorf("expected thumbnail.jpg, got %q", thumbnail)
+	}
+
+	os.Remove(filepath.Join(dir, "video.webm"))
+	if _, err := findPlatformVideo(dir); err == nil {
+		t.Error("expected an error without a video file")
+	}
+}